@@ -0,0 +1,350 @@
+package bucketsync
+
+import (
+	"context"
+	"encoding/binary"
+	"sort"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// POSIX ACLs are stored in Meta of the node, and these xattrs pass them in
+// the binary format of Linux.
+const (
+	ACLAccessXAttr  = "system.posix_acl_access"
+	ACLDefaultXAttr = "system.posix_acl_default" // directory only
+)
+
+// Linux binary format of ACL xattr is aclVersion in 4 bytes, followed by
+// entries of tag (2), perm (2) and id (4), little endian.
+const (
+	aclVersion   = 2
+	aclEntrySize = 8
+)
+
+// Tags of ACLEntry
+const (
+	ACLUserObj  = 0x01
+	ACLUser     = 0x02
+	ACLGroupObj = 0x04
+	ACLGroup    = 0x08
+	ACLMask     = 0x10
+	ACLOther    = 0x20
+)
+
+// ACLEntry grants Perm (rwx bits) to Tag, and ID of the bucket for ACLUser
+// and ACLGroup.
+type ACLEntry struct {
+	Tag  uint16 `json:"tag"`
+	Perm uint16 `json:"perm"`
+	ID   uint32 `json:"id,omitempty"`
+}
+
+// ACL is sorted by tag and id, as Linux does.
+type ACL []ACLEntry
+
+// parseACL returns ACL of xattr value, with ids mapped to stored ones.
+func (s *Session) parseACL(data []byte) (ACL, error) {
+	if len(data) < 4 || (len(data)-4)%aclEntrySize != 0 {
+		return nil, errors.Errorf("invalid ACL size %d", len(data))
+	}
+	if v := binary.LittleEndian.Uint32(data); v != aclVersion {
+		return nil, errors.Errorf("unsupported ACL version %d", v)
+	}
+	acl := make(ACL, 0, (len(data)-4)/aclEntrySize)
+	for p := data[4:]; len(p) != 0; p = p[aclEntrySize:] {
+		e := ACLEntry{
+			Tag:  binary.LittleEndian.Uint16(p),
+			Perm: binary.LittleEndian.Uint16(p[2:]),
+		}
+		switch e.Tag {
+		case ACLUser:
+			e.ID = idMap(s.config.UIDMap).toStored(binary.LittleEndian.Uint32(p[4:]))
+		case ACLGroup:
+			e.ID = idMap(s.config.GIDMap).toStored(binary.LittleEndian.Uint32(p[4:]))
+		}
+		acl = append(acl, e)
+	}
+	sort.Slice(acl, func(i, j int) bool {
+		if acl[i].Tag != acl[j].Tag {
+			return acl[i].Tag < acl[j].Tag
+		}
+		return acl[i].ID < acl[j].ID
+	})
+	if !acl.valid() {
+		return nil, errors.New("invalid ACL entries")
+	}
+	return acl, nil
+}
+
+// valid returns true if acl has one of each base entries, no duplicates, and
+// a mask if it has named entries.
+func (acl ACL) valid() bool {
+	count := map[uint16]int{}
+	for i, e := range acl {
+		if e.Perm&^7 != 0 {
+			return false
+		}
+		switch e.Tag {
+		case ACLUserObj, ACLGroupObj, ACLMask, ACLOther:
+			if count[e.Tag] != 0 {
+				return false
+			}
+		case ACLUser, ACLGroup:
+			if i > 0 && acl[i-1].Tag == e.Tag && acl[i-1].ID == e.ID {
+				return false
+			}
+		default:
+			return false
+		}
+		count[e.Tag]++
+	}
+	named := count[ACLUser] + count[ACLGroup]
+	return count[ACLUserObj] == 1 && count[ACLGroupObj] == 1 && count[ACLOther] == 1 &&
+		(named == 0 || count[ACLMask] == 1)
+}
+
+func (acl ACL) equal(other ACL) bool {
+	if len(acl) != len(other) {
+		return false
+	}
+	for i := range acl {
+		if acl[i] != other[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// marshalACL returns xattr value of acl, with ids mapped to host ones.
+func (s *Session) marshalACL(acl ACL) []byte {
+	data := make([]byte, 4+len(acl)*aclEntrySize)
+	binary.LittleEndian.PutUint32(data, aclVersion)
+	p := data[4:]
+	for _, e := range acl {
+		id := uint32(0xffffffff) // ACL_UNDEFINED_ID
+		switch e.Tag {
+		case ACLUser:
+			id = idMap(s.config.UIDMap).toHost(e.ID)
+		case ACLGroup:
+			id = idMap(s.config.GIDMap).toHost(e.ID)
+		}
+		binary.LittleEndian.PutUint16(p, e.Tag)
+		binary.LittleEndian.PutUint16(p[2:], e.Perm)
+		binary.LittleEndian.PutUint32(p[4:], id)
+		p = p[aclEntrySize:]
+	}
+	return data
+}
+
+// aclOfMode returns ACL equivalent to permission bits of mode.
+func aclOfMode(mode uint32) ACL {
+	return ACL{
+		{Tag: ACLUserObj, Perm: uint16(mode >> 6 & 7)},
+		{Tag: ACLGroupObj, Perm: uint16(mode >> 3 & 7)},
+		{Tag: ACLOther, Perm: uint16(mode & 7)},
+	}
+}
+
+// groupClass returns index of entry which group bits of mode reflect, the
+// mask if any.
+func (acl ACL) groupClass() int {
+	class := -1
+	for i, e := range acl {
+		if e.Tag == ACLMask || (e.Tag == ACLGroupObj && class < 0) {
+			class = i
+		}
+	}
+	return class
+}
+
+// setAccessACL sets acl to meta, and permission bits of mode to reflect it.
+// ACL equivalent to mode is not stored.
+func setAccessACL(meta *Meta, acl ACL) {
+	mode := meta.Mode &^ 0777
+	for i, e := range acl {
+		switch {
+		case e.Tag == ACLUserObj:
+			mode |= uint32(e.Perm) << 6
+		case i == acl.groupClass():
+			mode |= uint32(e.Perm) << 3
+		case e.Tag == ACLOther:
+			mode |= uint32(e.Perm)
+		}
+	}
+	meta.Mode = mode
+	meta.ACL = acl
+	if len(acl) == 3 {
+		meta.ACL = nil
+	}
+}
+
+// chmodACL updates entries of access ACL which permission bits of mode
+// reflect, after chmod.
+func chmodACL(meta *Meta) {
+	if meta.ACL == nil {
+		return
+	}
+	acl := append(ACL{}, meta.ACL...)
+	class := acl.groupClass()
+	for i := range acl {
+		switch {
+		case acl[i].Tag == ACLUserObj:
+			acl[i].Perm = uint16(meta.Mode >> 6 & 7)
+		case i == class:
+			acl[i].Perm = uint16(meta.Mode >> 3 & 7)
+		case acl[i].Tag == ACLOther:
+			acl[i].Perm = uint16(meta.Mode & 7)
+		}
+	}
+	meta.ACL = acl
+}
+
+// inheritACL applies default ACL of the directory to meta of a new entry.
+// Permissions are masked by the requested mode, and subdirectories inherit
+// it as their default ACL.
+func (o *Directory) inheritACL(meta *Meta) {
+	if o.Meta.DefaultACL == nil || meta.Mode&syscall.S_IFMT == syscall.S_IFLNK {
+		return
+	}
+	if meta.Mode&syscall.S_IFMT == syscall.S_IFDIR {
+		meta.DefaultACL = append(ACL{}, o.Meta.DefaultACL...)
+	}
+	acl := append(ACL{}, o.Meta.DefaultACL...)
+	class := acl.groupClass()
+	for i := range acl {
+		switch {
+		case acl[i].Tag == ACLUserObj:
+			acl[i].Perm &= uint16(meta.Mode >> 6 & 7)
+		case i == class:
+			acl[i].Perm &= uint16(meta.Mode >> 3 & 7)
+		case acl[i].Tag == ACLOther:
+			acl[i].Perm &= uint16(meta.Mode & 7)
+		}
+	}
+	setAccessACL(meta, acl)
+}
+
+// permitted returns true if the caller of context is granted mask (rwx bits)
+// by access ACL of meta, or its mode if it has none. Root is granted all but
+// execute, which needs any execute bit on non-directory. Supplementary groups
+// are not passed by FUSE, only the primary group is checked.
+func (s *Session) permitted(meta *Meta, mask uint32, context *fuse.Context) bool {
+	mask &= 7
+	if context.Uid == 0 {
+		return mask&1 == 0 || meta.Mode&syscall.S_IFMT == syscall.S_IFDIR || meta.Mode&0111 != 0
+	}
+	acl := meta.ACL
+	if acl == nil {
+		acl = aclOfMode(meta.Mode)
+	}
+	owner := s.hostOwner(meta)
+	uidMap, gidMap := idMap(s.config.UIDMap), idMap(s.config.GIDMap)
+	granted := func(e ACLEntry) bool { return uint32(e.Perm)&mask == mask }
+	masked := func(e ACLEntry) bool {
+		for _, m := range acl {
+			if m.Tag == ACLMask {
+				return granted(e) && granted(m)
+			}
+		}
+		return granted(e)
+	}
+
+	for _, e := range acl {
+		if e.Tag == ACLUserObj && context.Uid == owner.Uid {
+			return granted(e)
+		}
+	}
+	for _, e := range acl {
+		if e.Tag == ACLUser && context.Uid == uidMap.toHost(e.ID) {
+			return masked(e)
+		}
+	}
+	matched := false
+	for _, e := range acl {
+		if e.Tag == ACLGroupObj && context.Gid == owner.Gid ||
+			e.Tag == ACLGroup && context.Gid == gidMap.toHost(e.ID) {
+			if masked(e) {
+				return true
+			}
+			matched = true
+		}
+	}
+	if matched {
+		return false
+	}
+	for _, e := range acl {
+		if e.Tag == ACLOther {
+			return granted(e)
+		}
+	}
+	return false
+}
+
+// getACL returns xattr value of ACL of the node at name.
+func (f *FileSystem) getACL(name, attr string) ([]byte, fuse.Status) {
+	ctx, cancel := f.Sess.opContext()
+	defer cancel()
+	key, err := f.Sess.PathWalk(ctx, name)
+	if err != nil {
+		return nil, f.lookupStatus(ctx, err)
+	}
+	meta, err := f.Sess.currentMeta(ctx, key)
+	if err != nil {
+		return nil, f.lookupStatus(ctx, err)
+	}
+	acl := meta.ACL
+	if attr == ACLDefaultXAttr {
+		acl = meta.DefaultACL
+	}
+	if acl == nil {
+		return nil, fuse.ENOATTR
+	}
+	return f.Sess.marshalACL(acl), fuse.OK
+}
+
+// currentMeta returns Meta of key, of the opened file if any.
+func (s *Session) currentMeta(ctx context.Context, key ObjectKey) (*Meta, error) {
+	node, err := s.NewNode(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if file := s.openedFile(key); file != nil {
+		file.lock.Lock()
+		node.Meta = file.Meta
+		file.lock.Unlock()
+	}
+	return &node.Meta, nil
+}
+
+// setACL sets ACL xattr of the node at name, nil data removes it.
+func (f *FileSystem) setACL(name, attr string, data []byte) fuse.Status {
+	var acl ACL
+	if data != nil {
+		var err error
+		acl, err = f.Sess.parseACL(data)
+		if err != nil {
+			f.logger.Debug("fuse error", zap.Error(err))
+			return fuse.EINVAL
+		}
+	}
+	return f.updateNode(name, func(node interface{}, meta *Meta) fuse.Status {
+		switch {
+		case meta.Mode&syscall.S_IFMT == syscall.S_IFLNK:
+			// Linux doesn't have ACL of symlink
+			return fuse.Status(syscall.ENOTSUP)
+		case attr == ACLAccessXAttr && acl == nil:
+			meta.ACL = nil
+		case attr == ACLAccessXAttr:
+			setAccessACL(meta, acl)
+		case meta.Mode&syscall.S_IFMT != syscall.S_IFDIR:
+			return fuse.EACCES
+		default:
+			meta.DefaultACL = acl
+		}
+		return fuse.OK
+	})
+}
@@ -0,0 +1,138 @@
+package bucketsync
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// Masks of access(2)
+const (
+	readOK  = 4
+	writeOK = 2
+)
+
+// aclXAttr returns xattr value of entries in the Linux binary format.
+func aclXAttr(entries ...ACLEntry) []byte {
+	data := make([]byte, 4, 4+len(entries)*aclEntrySize)
+	binary.LittleEndian.PutUint32(data, aclVersion)
+	for _, e := range entries {
+		id := e.ID
+		if e.Tag != ACLUser && e.Tag != ACLGroup {
+			id = 0xffffffff
+		}
+		data = binary.LittleEndian.AppendUint16(data, e.Tag)
+		data = binary.LittleEndian.AppendUint16(data, e.Perm)
+		data = binary.LittleEndian.AppendUint32(data, id)
+	}
+	return data
+}
+
+// TestACLGrantsWrite sets an ACL granting a non-owner write access. It's
+// persisted, and honored by access checks.
+func TestACLGrantsWrite(t *testing.T) {
+	fs, fake := newTestFS(t, nil, nil)
+	f, st := fs.Create("report", 0, 0640, testContext)
+	if st != fuse.OK {
+		t.Fatal(st)
+	}
+	f.Release()
+	alice := &fuse.Context{Owner: fuse.Owner{Uid: 1001, Gid: 50}}
+	bob := &fuse.Context{Owner: fuse.Owner{Uid: 1002, Gid: 50}}
+	if st := fs.Access("report", writeOK, alice); st != fuse.EACCES {
+		t.Fatalf("access without ACL: %v", st)
+	}
+
+	acl := aclXAttr(
+		ACLEntry{Tag: ACLUserObj, Perm: 6},
+		ACLEntry{Tag: ACLUser, Perm: 6, ID: 1001},
+		ACLEntry{Tag: ACLGroupObj, Perm: 4},
+		ACLEntry{Tag: ACLMask, Perm: 6},
+		ACLEntry{Tag: ACLOther, Perm: 0},
+	)
+	for _, invalid := range [][]byte{
+		acl[:len(acl)-1],
+		aclXAttr(ACLEntry{Tag: ACLUserObj, Perm: 6}, ACLEntry{Tag: ACLUser, Perm: 6, ID: 1001},
+			ACLEntry{Tag: ACLGroupObj, Perm: 4}, ACLEntry{Tag: ACLOther, Perm: 0}),
+	} {
+		if st := fs.SetXAttr("report", ACLAccessXAttr, invalid, 0, testContext); st != fuse.EINVAL {
+			t.Fatalf("invalid ACL: %v", st)
+		}
+	}
+	if st := fs.SetXAttr("report", ACLAccessXAttr, acl, 0, testContext); st != fuse.OK {
+		t.Fatal(st)
+	}
+
+	reader, _ := newTestFS(t, fake, nil)
+	if got, st := reader.GetXAttr("report", ACLAccessXAttr, testContext); st != fuse.OK || !bytes.Equal(got, acl) {
+		t.Fatalf("ACL %x %v, want %x", got, st, acl)
+	}
+	if attr, _ := reader.GetAttr("report", testContext); attr.Mode != fuse.S_IFREG|0660 {
+		t.Fatalf("mode %o", attr.Mode)
+	}
+	for ctx, want := range map[*fuse.Context]fuse.Status{alice: fuse.OK, bob: fuse.EACCES, testContext: fuse.OK} {
+		if st := reader.Access("report", writeOK, ctx); st != want {
+			t.Fatalf("uid %d: %v, want %v", ctx.Uid, st, want)
+		}
+	}
+
+	// The mask limits the named user
+	if st := reader.Chmod("report", 0640, testContext); st != fuse.OK {
+		t.Fatal(st)
+	}
+	if st := reader.Access("report", writeOK, alice); st != fuse.EACCES {
+		t.Fatalf("access after chmod: %v", st)
+	}
+	if st := reader.Access("report", readOK, alice); st != fuse.OK {
+		t.Fatalf("read after chmod: %v", st)
+	}
+}
+
+// TestDefaultACLIsInherited sets a default ACL of a directory. A file
+// created in it grants the named user.
+func TestDefaultACLIsInherited(t *testing.T) {
+	fs, _ := newTestFS(t, nil, func(c *Config) { c.Unsupported = map[string]string{OpXAttr: PolicyLenient} })
+	if st := fs.Mkdir("shared", 0755, testContext); st != fuse.OK {
+		t.Fatal(st)
+	}
+	acl := aclXAttr(
+		ACLEntry{Tag: ACLUserObj, Perm: 7},
+		ACLEntry{Tag: ACLUser, Perm: 7, ID: 1001},
+		ACLEntry{Tag: ACLGroupObj, Perm: 5},
+		ACLEntry{Tag: ACLMask, Perm: 7},
+		ACLEntry{Tag: ACLOther, Perm: 0},
+	)
+	if st := fs.SetXAttr("shared", ACLDefaultXAttr, acl, 0, testContext); st != fuse.OK {
+		t.Fatal(st)
+	}
+	// The mask is masked by group bits of the requested mode
+	f, st := fs.Create("shared/f", 0, 0664, testContext)
+	if st != fuse.OK {
+		t.Fatal(st)
+	}
+	f.Release()
+	writeFile(t, fs, "shared/g", []byte("g"))
+	if st := fs.SetXAttr("shared/f", ACLDefaultXAttr, acl, 0, testContext); st != fuse.EACCES {
+		t.Fatalf("default ACL of a file: %v", st)
+	}
+	alice := &fuse.Context{Owner: fuse.Owner{Uid: 1001, Gid: 50}}
+	if st := fs.Access("shared/f", writeOK, alice); st != fuse.OK {
+		t.Fatalf("inherited ACL: %v", st)
+	}
+	if st := fs.Access("shared/g", writeOK, alice); st != fuse.EACCES {
+		t.Fatalf("inherited ACL of mode 0644: %v", st)
+	}
+	attrs, st := fs.ListXAttr("shared", testContext)
+	if st != fuse.OK {
+		t.Fatal(st)
+	}
+	found := false
+	for _, attr := range attrs {
+		found = found || attr == ACLDefaultXAttr
+	}
+	if !found {
+		t.Fatalf("xattrs %v", attrs)
+	}
+}
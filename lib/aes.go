@@ -3,12 +3,23 @@ package bucketsync
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/rand"
 	"crypto/sha256"
 	"io"
 
 	"github.com/pkg/errors"
 )
 
+// ErrKeyMismatch is returned by NewSession if the root of the password is
+// not found with RequireRoot. The root key is derived from the password, so
+// a wrong password shows as a missing root.
+var ErrKeyMismatch = errors.New("root of the password is not found, password may be wrong")
+
+// ErrDecrypt is returned when a sealed object fails authentication, or an
+// object isn't sealed though it must be. The key doesn't match, or the
+// object is tampered.
+var ErrDecrypt = errors.New("decryption failed, key mismatch or tampered object")
+
 type Cipher struct {
 	block cipher.Block
 }
@@ -41,3 +52,31 @@ func (c *Cipher) StreamWriter(out io.Writer, key ObjectKey) (cipher.StreamWriter
 	stream := cipher.NewCTR(c.block, iv)
 	return cipher.StreamWriter{S: stream, W: out}, nil
 }
+
+// Seal encrypts and authenticates plain by AES-GCM with random nonce. key is
+// authenticated along, so that a sealed object doesn't open as other key.
+func (c *Cipher) Seal(plain []byte, key ObjectKey) ([]byte, error) {
+	aead, err := cipher.NewGCM(c.block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plain)+aead.Overhead())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plain, []byte(key)), nil
+}
+
+// Open decrypts sealed of key by Seal.
+func (c *Cipher) Open(sealed []byte, key ObjectKey) ([]byte, error) {
+	aead, err := cipher.NewGCM(c.block)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("sealed object is too short")
+	}
+	nonce, data := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, data, []byte(key))
+}
@@ -0,0 +1,295 @@
+package bucketsync
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// AuditToLogger is AuditLog to write records to the structured logger.
+const AuditToLogger = "log"
+
+// AuditRecord is a mutation by a caller, written as a line of JSON.
+type AuditRecord struct {
+	Time  time.Time `json:"time"`
+	Mount string    `json:"mount"`
+	Op    string    `json:"op"`
+	Path  string    `json:"path"`
+	To    string    `json:"to,omitempty"`   // destination of rename, target of symlink
+	Mode  uint32    `json:"mode,omitempty"` // of create, mkdir and chmod
+	Size  int64     `json:"size,omitempty"` // bytes written, or size of truncate
+	UID   uint32    `json:"uid"`
+	GID   uint32    `json:"gid"`
+	PID   uint32    `json:"pid"`
+	Errno int       `json:"errno"` // 0 if succeeded
+}
+
+// auditLog writes AuditRecord to a file, or to the logger.
+type auditLog struct {
+	lock   sync.Mutex
+	mount  string
+	file   *os.File
+	logger *Logger
+}
+
+// newAuditLog opens sink of config.AuditLog, nil if not configured.
+func newAuditLog(config *Config, logger *Logger) (*auditLog, error) {
+	if config.AuditLog == "" {
+		return nil, nil
+	}
+	a := &auditLog{mount: config.AuditIdentity, logger: logger}
+	if a.mount == "" {
+		a.mount, _ = os.Hostname()
+	}
+	if config.AuditLog == AuditToLogger {
+		return a, nil
+	}
+	file, err := os.OpenFile(config.AuditLog, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, errors.Wrap(err, "audit log open failed")
+	}
+	a.file = file
+	return a, nil
+}
+
+// openAudit opens the audit log for a mount. Other commands don't mutate
+// through the filesystem, so they never open it.
+func (s *Session) openAudit() error {
+	audit, err := newAuditLog(s.config, s.logger)
+	if err != nil {
+		return err
+	}
+	s.audit = audit
+	return nil
+}
+
+func (a *auditLog) record(rec AuditRecord) {
+	rec.Time = time.Now().UTC()
+	rec.Mount = a.mount
+	if a.file == nil {
+		a.logger.Info("audit", zap.String("mount", rec.Mount), zap.String("op", rec.Op),
+			zap.String("path", rec.Path), zap.String("to", rec.To), zap.Uint32("mode", rec.Mode),
+			zap.Int64("size", rec.Size), zap.Uint32("uid", rec.UID), zap.Uint32("gid", rec.GID),
+			zap.Uint32("pid", rec.PID), zap.Int("errno", rec.Errno))
+		return
+	}
+	line, err := json.Marshal(&rec)
+	if err != nil {
+		a.logger.Error("audit record failed", zap.Error(err))
+		return
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	_, err = a.file.Write(append(line, '\n'))
+	if err != nil {
+		a.logger.Error("audit record failed", zap.Error(err))
+	}
+}
+
+func (a *auditLog) close() {
+	if a.file != nil {
+		a.file.Close()
+	}
+}
+
+// newRecord returns record of op on path by caller of context.
+func newRecord(op, path string, context *fuse.Context, status fuse.Status) AuditRecord {
+	rec := AuditRecord{Op: op, Path: path}
+	if context != nil {
+		rec.UID, rec.GID, rec.PID = context.Uid, context.Gid, context.Pid
+	}
+	if status != fuse.OK {
+		rec.Errno = int(status)
+	}
+	return rec
+}
+
+// auditFileSystem records mutating operations of fs with the caller.
+type auditFileSystem struct {
+	pathfs.FileSystem
+	log *auditLog
+}
+
+func (fs *auditFileSystem) Mknod(name string, mode uint32, dev uint32, context *fuse.Context) fuse.Status {
+	status := fs.FileSystem.Mknod(name, mode, dev, context)
+	rec := newRecord("mknod", name, context, status)
+	rec.Mode = mode
+	fs.log.record(rec)
+	return status
+}
+
+func (fs *auditFileSystem) Mkdir(name string, mode uint32, context *fuse.Context) fuse.Status {
+	status := fs.FileSystem.Mkdir(name, mode, context)
+	rec := newRecord("mkdir", name, context, status)
+	rec.Mode = mode
+	fs.log.record(rec)
+	return status
+}
+
+func (fs *auditFileSystem) Unlink(name string, context *fuse.Context) fuse.Status {
+	status := fs.FileSystem.Unlink(name, context)
+	fs.log.record(newRecord("unlink", name, context, status))
+	return status
+}
+
+func (fs *auditFileSystem) Rmdir(name string, context *fuse.Context) fuse.Status {
+	status := fs.FileSystem.Rmdir(name, context)
+	fs.log.record(newRecord("rmdir", name, context, status))
+	return status
+}
+
+func (fs *auditFileSystem) Symlink(value string, linkName string, context *fuse.Context) fuse.Status {
+	status := fs.FileSystem.Symlink(value, linkName, context)
+	rec := newRecord("symlink", linkName, context, status)
+	rec.To = value
+	fs.log.record(rec)
+	return status
+}
+
+func (fs *auditFileSystem) Rename(oldName string, newName string, context *fuse.Context) fuse.Status {
+	status := fs.FileSystem.Rename(oldName, newName, context)
+	rec := newRecord("rename", oldName, context, status)
+	rec.To = newName
+	fs.log.record(rec)
+	return status
+}
+
+func (fs *auditFileSystem) Link(oldName string, newName string, context *fuse.Context) fuse.Status {
+	status := fs.FileSystem.Link(oldName, newName, context)
+	rec := newRecord("link", oldName, context, status)
+	rec.To = newName
+	fs.log.record(rec)
+	return status
+}
+
+func (fs *auditFileSystem) Chmod(name string, mode uint32, context *fuse.Context) fuse.Status {
+	status := fs.FileSystem.Chmod(name, mode, context)
+	rec := newRecord("chmod", name, context, status)
+	rec.Mode = mode
+	fs.log.record(rec)
+	return status
+}
+
+func (fs *auditFileSystem) Chown(name string, uid uint32, gid uint32, context *fuse.Context) fuse.Status {
+	status := fs.FileSystem.Chown(name, uid, gid, context)
+	rec := newRecord("chown", name, context, status)
+	rec.To = fmt.Sprintf("%d:%d", uid, gid)
+	fs.log.record(rec)
+	return status
+}
+
+func (fs *auditFileSystem) Truncate(name string, size uint64, context *fuse.Context) fuse.Status {
+	status := fs.FileSystem.Truncate(name, size, context)
+	rec := newRecord("truncate", name, context, status)
+	rec.Size = int64(size)
+	fs.log.record(rec)
+	return status
+}
+
+func (fs *auditFileSystem) Utimens(name string, atime *time.Time, mtime *time.Time, context *fuse.Context) fuse.Status {
+	status := fs.FileSystem.Utimens(name, atime, mtime, context)
+	fs.log.record(newRecord("utimens", name, context, status))
+	return status
+}
+
+func (fs *auditFileSystem) SetXAttr(name string, attr string, data []byte, flags int, context *fuse.Context) fuse.Status {
+	status := fs.FileSystem.SetXAttr(name, attr, data, flags, context)
+	rec := newRecord("setxattr", name, context, status)
+	rec.To = attr
+	fs.log.record(rec)
+	return status
+}
+
+func (fs *auditFileSystem) RemoveXAttr(name string, attr string, context *fuse.Context) fuse.Status {
+	status := fs.FileSystem.RemoveXAttr(name, attr, context)
+	rec := newRecord("removexattr", name, context, status)
+	rec.To = attr
+	fs.log.record(rec)
+	return status
+}
+
+func (fs *auditFileSystem) Create(name string, flags uint32, mode uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	file, status := fs.FileSystem.Create(name, flags, mode, context)
+	rec := newRecord("create", name, context, status)
+	rec.Mode = mode
+	fs.log.record(rec)
+	if status != fuse.OK {
+		return file, status
+	}
+	return fs.auditWrites(file, newRecord("write", name, context, fuse.OK)), status
+}
+
+func (fs *auditFileSystem) Open(name string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	file, status := fs.FileSystem.Open(name, flags, context)
+	if flags&syscall.O_TRUNC != 0 {
+		fs.log.record(newRecord("truncate", name, context, status))
+	}
+	if status != fuse.OK || flags&fuse.O_ANYWRITE == 0 {
+		return file, status
+	}
+	return fs.auditWrites(file, newRecord("write", name, context, fuse.OK)), status
+}
+
+// auditWrites wraps file to record writes of the handle, keeping open flags.
+func (fs *auditFileSystem) auditWrites(file nodefs.File, rec AuditRecord) nodefs.File {
+	if flags, ok := file.(*nodefs.WithFlags); ok {
+		flags.File = &auditFile{File: flags.File, log: fs.log, rec: rec}
+		return flags
+	}
+	return &auditFile{File: file, log: fs.log, rec: rec}
+}
+
+func (fs *auditFileSystem) OnUnmount() {
+	fs.FileSystem.OnUnmount()
+	fs.log.close()
+}
+
+func (fs *auditFileSystem) String() string {
+	return fmt.Sprintf("auditFileSystem(%v)", fs.FileSystem)
+}
+
+// auditFile records bytes written through the handle once at release, and
+// truncates of the handle, with the caller who opened it.
+type auditFile struct {
+	nodefs.File
+	log     *auditLog
+	rec     AuditRecord
+	written int64
+}
+
+func (f *auditFile) Write(data []byte, off int64) (uint32, fuse.Status) {
+	n, status := f.File.Write(data, off)
+	atomic.AddInt64(&f.written, int64(n))
+	return n, status
+}
+
+func (f *auditFile) Truncate(size uint64) fuse.Status {
+	status := f.File.Truncate(size)
+	rec := f.rec
+	rec.Op = "truncate"
+	rec.Size = int64(size)
+	if status != fuse.OK {
+		rec.Errno = int(status)
+	}
+	f.log.record(rec)
+	return status
+}
+
+func (f *auditFile) Release() {
+	f.File.Release()
+	if written := atomic.LoadInt64(&f.written); written > 0 {
+		rec := f.rec
+		rec.Size = written
+		f.log.record(rec)
+	}
+}
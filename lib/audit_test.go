@@ -0,0 +1,105 @@
+package bucketsync
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// TestAuditLog performs mutations by two callers, and reads records of
+// them from the audit log.
+func TestAuditLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	sess, _ := newTestSession(t, nil, func(c *Config) {
+		c.AuditLog = path
+		c.AuditIdentity = "web1"
+	})
+	if err := sess.openAudit(); err != nil {
+		t.Fatal(err)
+	}
+	fs := wrapFileSystem(sess, &FileSystem{Sess: sess, logger: sess.logger})
+	other := &fuse.Context{Owner: fuse.Owner{Uid: 3, Gid: 4}, Pid: 42}
+
+	if st := fs.Mkdir("d", 0755, testContext); st != fuse.OK {
+		t.Fatal(st)
+	}
+	f, st := fs.Create("d/f", 0, 0644, other)
+	if st != fuse.OK {
+		t.Fatal(st)
+	}
+	if _, st := f.Write([]byte("written"), 0); st != fuse.OK {
+		t.Fatal(st)
+	}
+	f.Flush()
+	f.Release()
+	if st := fs.Rename("d/f", "d/g", other); st != fuse.OK {
+		t.Fatal(st)
+	}
+	if st := fs.Chmod("d/g", 0600, testContext); st != fuse.OK {
+		t.Fatal(st)
+	}
+	if st := fs.Unlink("d/missing", other); st != fuse.ENOENT {
+		t.Fatal(st)
+	}
+	if st := fs.Unlink("d/g", testContext); st != fuse.OK {
+		t.Fatal(st)
+	}
+	if _, st := fs.GetAttr("d", testContext); st != fuse.OK {
+		t.Fatal(st)
+	}
+
+	want := []AuditRecord{
+		{Op: "mkdir", Path: "d", Mode: 0755, UID: 1, GID: 2},
+		{Op: "create", Path: "d/f", Mode: 0644, UID: 3, GID: 4, PID: 42},
+		{Op: "write", Path: "d/f", Size: 7, UID: 3, GID: 4, PID: 42},
+		{Op: "rename", Path: "d/f", To: "d/g", UID: 3, GID: 4, PID: 42},
+		{Op: "chmod", Path: "d/g", Mode: 0600, UID: 1, GID: 2},
+		{Op: "unlink", Path: "d/missing", UID: 3, GID: 4, PID: 42, Errno: int(fuse.ENOENT)},
+		{Op: "unlink", Path: "d/g", UID: 1, GID: 2},
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var got []AuditRecord
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var rec AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			t.Fatalf("%q: %v", scanner.Text(), err)
+		}
+		if rec.Mount != "web1" || rec.Time.IsZero() {
+			t.Fatalf("record %+v", rec)
+		}
+		rec.Mount = ""
+		got = append(got, rec)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("records %+v", got)
+	}
+	for i := range want {
+		got[i].Time = want[i].Time
+		if got[i] != want[i] {
+			t.Fatalf("record %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+// TestAuditLogOfMountOnly opens a session for a command other than mount.
+// The audit log isn't created.
+func TestAuditLogOfMountOnly(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	sess, _ := newTestSession(t, nil, func(c *Config) { c.AuditLog = path })
+	if _, err := sess.Fsck(context.Background(), false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("audit log is opened: %v", err)
+	}
+}
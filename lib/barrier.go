@@ -0,0 +1,90 @@
+package bucketsync
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// Barrier makes all changes made before it durable. Objects are committed in
+// dependency order, so that the backend is a consistent prefix of operations
+// at any crash:
+//
+//	extents -> file metadata -> directory objects -> root
+//
+// File.Save uploads metadata only after its extents, and operations changing
+// entries save the node before its directory, and the directory by root
+// compare-and-swap synchronously. So Barrier saves modified open files, the
+// only changes not committed yet, and waits for all of them and evicted
+// ones. Unlinked files are unreachable, they're not saved. Batched uploads
+// are waited first, so that a file saved in place doesn't land before
+// directory operations issued earlier.
+func (s *Session) Barrier(ctx context.Context) error {
+	s.waitEvictions()
+	err := s.s3.WaitBatched(ctx)
+	if err != nil {
+		return errors.Wrap(err, "barrier failed")
+	}
+	s.openLock.Lock()
+	files := make([]*File, 0, len(s.openFiles))
+	for _, o := range s.openFiles {
+		files = append(files, o.file)
+	}
+	s.openLock.Unlock()
+
+	wg := sync.WaitGroup{}
+	errc := make(chan error, len(files))
+	for _, file := range files {
+		wg.Add(1)
+		go func(file *File) {
+			defer wg.Done()
+			file.lock.Lock()
+			defer file.lock.Unlock()
+			if !file.dirty || s.isUnlinked(file) {
+				return
+			}
+			err := file.Save(ctx)
+			if err != nil {
+				errc <- errors.Wrapf(err, "barrier failed. key = %s", file.Key)
+			}
+		}(file)
+	}
+	wg.Wait()
+	close(errc)
+	if err := <-errc; err != nil {
+		return err
+	}
+	err = s.s3.WaitBatched(ctx)
+	if err != nil {
+		return errors.Wrap(err, "barrier failed")
+	}
+	s.logger.Debug("Barrier", zap.Int("open files", len(files)))
+	return nil
+}
+
+// barrierPath runs Barrier by fsync, e.g. `sync .bucketsync/barrier`.
+var barrierPath = filepath.Join(controlDir, "barrier")
+
+type barrierFile struct {
+	nodefs.File
+	sess *Session
+}
+
+func (f *barrierFile) Fsync(flags int) fuse.Status {
+	ctx, cancel := f.sess.opContext()
+	defer cancel()
+	err := f.sess.Barrier(ctx)
+	if err != nil {
+		f.sess.logger.Error("Barrier failed", zap.Error(err))
+		if errors.Cause(err) == ErrReadOnly {
+			return fuse.EROFS
+		}
+		return writeStatus(ctx)
+	}
+	return fuse.OK
+}
@@ -0,0 +1,186 @@
+package bucketsync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func TestBarrierControlFile(t *testing.T) {
+	fs, fake := newTestFS(t, nil, nil)
+	f, st := fs.Create("f", 0, 0644, testContext)
+	if st != fuse.OK {
+		t.Fatal(st)
+	}
+	defer f.Release()
+	if _, st := f.Write([]byte("unsynced"), 0); st != fuse.OK {
+		t.Fatal(st)
+	}
+	reader, _ := newTestFS(t, fake, nil)
+	if got := readFile(t, reader, "f"); len(got) != 0 {
+		t.Fatalf("saved before barrier: %q", got)
+	}
+
+	barrier, st := fs.Open(barrierPath, 0, testContext)
+	if st != fuse.OK {
+		t.Fatal(st)
+	}
+	defer barrier.Release()
+	if st := barrier.Fsync(0); st != fuse.OK {
+		t.Fatal(st)
+	}
+	reader, _ = newTestFS(t, fake, nil)
+	if got := readFile(t, reader, "f"); string(got) != "unsynced" {
+		t.Fatalf("after barrier: %q", got)
+	}
+}
+
+// crashOps are the operations of TestCrashLeavesPrefix. The last one is
+// made durable by the barrier only.
+func crashOps(fs *FileSystem) []func() fuse.Status {
+	create := func(name string) fuse.Status {
+		f, st := fs.Create(name, 0, 0644, testContext)
+		if st == fuse.OK {
+			f.Release()
+		}
+		return st
+	}
+	write := func(name string, data []byte, off int64, sync func() fuse.Status) fuse.Status {
+		f, st := fs.Open(name, syscall.O_RDWR, testContext)
+		if st != fuse.OK {
+			return st
+		}
+		defer f.Release()
+		if _, st := f.Write(data, off); st != fuse.OK {
+			return st
+		}
+		if sync == nil {
+			sync = f.Flush
+		}
+		return sync()
+	}
+	barrier := func() fuse.Status {
+		f, st := fs.Open(barrierPath, 0, testContext)
+		if st != fuse.OK {
+			return st
+		}
+		defer f.Release()
+		return f.Fsync(0)
+	}
+	return []func() fuse.Status{
+		func() fuse.Status { return fs.Mkdir("d", 0755, testContext) },
+		func() fuse.Status { return create("d/a") },
+		func() fuse.Status { return write("d/a", []byte("0123456789abcdef0123456789abcdef!"), 0, nil) },
+		func() fuse.Status { return create("c") },
+		func() fuse.Status { return fs.Rename("d/a", "d/b", testContext) },
+		func() fuse.Status { return fs.Unlink("c", testContext) },
+		func() fuse.Status { return fs.Mkdir("d/e", 0755, testContext) },
+		func() fuse.Status { return write("d/b", []byte("rewritten"), 20, barrier) },
+	}
+}
+
+// snapshot returns the tree as seen by a new session on fake.
+func snapshot(t *testing.T, fake *fakeS3) string {
+	t.Helper()
+	fs, _ := newTestFS(t, fake, nil)
+	var lines []string
+	var walk func(dir string)
+	walk = func(dir string) {
+		entries, st := fs.OpenDir(dir, testContext)
+		if st != fuse.OK {
+			t.Fatalf("readdir %q: %v", dir, st)
+		}
+		for _, e := range entries {
+			path := strings.TrimPrefix(dir+"/"+e.Name, "/")
+			attr, st := fs.GetAttr(path, testContext)
+			if st != fuse.OK {
+				t.Fatalf("getattr %q: %v", path, st)
+			}
+			if attr.IsDir() {
+				lines = append(lines, path+"/")
+				walk(path)
+				continue
+			}
+			lines = append(lines, fmt.Sprintf("%s %q", path, readFile(t, fs, path)))
+		}
+	}
+	walk("")
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
+
+var errCrash = errors.New("crashed")
+
+// TestCrashLeavesPrefix crashes the operations after each put, so that no
+// later put is stored. The bucket is at the tree after the operations done,
+// or the one failing, and fsck finds nothing but orphans.
+func TestCrashLeavesPrefix(t *testing.T) {
+	for name, mod := range map[string]func(c *Config){
+		"sync":    nil,
+		"batched": func(c *Config) { c.MetaBatchWindow = time.Millisecond },
+	} {
+		t.Run(name, func(t *testing.T) {
+			// Trees after each operation, and number of puts of all
+			fs, fake := newTestFS(t, nil, mod)
+			trees := []string{snapshot(t, fake)}
+			puts := fake.totalPuts("")
+			for _, op := range crashOps(fs) {
+				if st := op(); st != fuse.OK {
+					t.Fatal(st)
+				}
+				if err := fs.Sess.Flush(context.Background()); err != nil {
+					t.Fatal(err)
+				}
+				trees = append(trees, snapshot(t, fake))
+			}
+			total := fake.totalPuts("") - puts
+
+			for crash := 0; crash < total; crash++ {
+				fs, fake := newTestFS(t, nil, mod)
+				stored := 0
+				fake.onPut = func(name string, body []byte) error {
+					if stored == crash {
+						return errCrash
+					}
+					stored++
+					return nil
+				}
+				done := 0
+				for _, op := range crashOps(fs) {
+					if op() != fuse.OK {
+						break
+					}
+					done++
+				}
+				fs.Sess.Flush(context.Background())
+				fake.mu.Lock()
+				fake.onPut = nil
+				fake.mu.Unlock()
+
+				got := snapshot(t, fake)
+				at := -1
+				for i, tree := range trees {
+					if tree == got {
+						at = i
+					}
+				}
+				if at < 0 || at > done+1 || (name == "sync" && at < done) {
+					t.Fatalf("crash after %d puts, %d operations done, tree:\n%s", crash, done, got)
+				}
+				report := runFsck(t, fake, false)
+				for _, issue := range report.Issues {
+					if issue.Kind != FsckOrphan {
+						t.Fatalf("crash after %d puts: %v", crash, report.Issues)
+					}
+				}
+			}
+		})
+	}
+}
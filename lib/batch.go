@@ -0,0 +1,194 @@
+package bucketsync
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// defaultMetaBatchConcurrency is number of batched uploads in flight
+const defaultMetaBatchConcurrency = 16
+
+// metaBatch uploads metadata objects behind operations. An upload waits for
+// the window, so that later uploads of the same key coalesce into it, and
+// for uploads of objects it refers, so that the bucket never has a directory
+// referring an unwritten child. Uploads run concurrently otherwise.
+type metaBatch struct {
+	window time.Duration
+	slots  chan struct{}
+
+	lock    sync.Mutex
+	pending map[ObjectKey]*batchEntry // latest upload of key not done
+	failed  error                     // first failure since WaitBatched of all
+}
+
+type batchEntry struct {
+	key     ObjectKey
+	data    []byte
+	deps    []*batchEntry // uploaded before it
+	prev    *batchEntry   // earlier version of key, stored first
+	started bool          // data is taken, new one isn't coalesced
+	done    chan struct{}
+	err     error
+}
+
+func newMetaBatch(config *Config) *metaBatch {
+	if config.MetaBatchWindow <= 0 {
+		return nil
+	}
+	concurrency := config.MetaBatchConcurrency
+	if concurrency <= 0 {
+		concurrency = defaultMetaBatchConcurrency
+	}
+	return &metaBatch{
+		window:  config.MetaBatchWindow,
+		slots:   make(chan struct{}, concurrency),
+		pending: make(map[ObjectKey]*batchEntry),
+	}
+}
+
+// UploadBatched stores metadata object of key, after objects of refs which
+// are being uploaded. It's readable immediately, and uploaded in background
+// if batching is enabled. WaitBatched waits for it to be stored.
+func (s *S3Session) UploadBatched(ctx context.Context, key ObjectKey, data []byte, refs []ObjectKey) error {
+	if s.batch == nil {
+		return s.UploadWithCache(ctx, MetaObject, key, bytes.NewReader(data))
+	}
+	if s.isReadOnly() {
+		return errors.Wrapf(ErrReadOnly, "batched upload failed. key = %s", key)
+	}
+	s.cache.Add(key, data)
+	s.prefetched.Remove(key)
+
+	b := s.batch
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	var deps []*batchEntry
+	for _, ref := range refs {
+		if e, ok := b.pending[ref]; ok {
+			deps = append(deps, e)
+		}
+	}
+	if e, ok := b.pending[key]; ok {
+		if !e.started {
+			e.data = data
+			// Refs of replaced data aren't waited for
+			e.deps = deps
+			return nil
+		}
+	}
+	// Versions of a key are stored in order
+	e := &batchEntry{key: key, data: data, deps: deps, prev: b.pending[key], done: make(chan struct{})}
+	b.pending[key] = e
+	go s.uploadEntry(e)
+	return nil
+}
+
+func (s *S3Session) uploadEntry(e *batchEntry) {
+	b := s.batch
+	time.Sleep(b.window)
+	b.lock.Lock()
+	e.started = true
+	data, deps := e.data, e.deps
+	if e.prev != nil {
+		deps = append(deps, e.prev)
+	}
+	e.deps, e.prev = nil, nil // older versions aren't kept alive
+	b.lock.Unlock()
+
+	for _, dep := range deps {
+		<-dep.done
+		if dep.err != nil && e.err == nil {
+			e.err = errors.Wrapf(dep.err, "upload of referred object failed. key = %s", e.key)
+		}
+	}
+	if e.err == nil {
+		b.slots <- struct{}{}
+		_, err := s.put(context.Background(), MetaObject, e.key, bytes.NewReader(data))
+		<-b.slots
+		e.err = err
+	}
+
+	b.lock.Lock()
+	if b.pending[e.key] == e {
+		delete(b.pending, e.key)
+	}
+	b.lock.Unlock()
+	if e.err != nil {
+		// Reads go to the bucket, rather than what's not stored
+		s.cache.Remove(e.key)
+		s.logger.Error("batched upload failed", zap.String("key", e.key), zap.Error(e.err))
+		b.lock.Lock()
+		if b.failed == nil {
+			b.failed = e.err
+		}
+		b.lock.Unlock()
+	}
+	close(e.done)
+}
+
+// lookupBatched returns content of key being uploaded.
+func (s *S3Session) lookupBatched(key ObjectKey) ([]byte, bool) {
+	if s.batch == nil {
+		return nil, false
+	}
+	s.batch.lock.Lock()
+	defer s.batch.lock.Unlock()
+	if e, ok := s.batch.pending[key]; ok {
+		return e.data, true
+	}
+	return nil, false
+}
+
+// Flush waits for evictions and all batched uploads, and returns failure of
+// any batched one. Commands call it before exit, uploads not done by then
+// are lost.
+func (s *Session) Flush(ctx context.Context) error {
+	s.waitEvictions()
+	return s.s3.WaitBatched(ctx)
+}
+
+// WaitBatched waits for uploads of keys, and objects they refer. If no key is
+// given, all uploads are waited, and it returns failure of any of them since
+// the last call.
+func (s *S3Session) WaitBatched(ctx context.Context, keys ...ObjectKey) error {
+	if s.batch == nil {
+		return nil
+	}
+	s.batch.lock.Lock()
+	entries := make([]*batchEntry, 0, len(s.batch.pending))
+	if len(keys) == 0 {
+		for _, e := range s.batch.pending {
+			entries = append(entries, e)
+		}
+	}
+	for _, key := range keys {
+		if e, ok := s.batch.pending[key]; ok {
+			entries = append(entries, e)
+		}
+	}
+	s.batch.lock.Unlock()
+
+	for _, e := range entries {
+		select {
+		case <-e.done:
+		case <-ctx.Done():
+			return errors.Wrapf(ctx.Err(), "batched upload is not done. key = %s", e.key)
+		}
+		if e.err != nil {
+			return e.err
+		}
+	}
+	if len(keys) == 0 {
+		s.batch.lock.Lock()
+		defer s.batch.lock.Unlock()
+		err := s.batch.failed
+		s.batch.failed = nil
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package bucketsync
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func pendingBatched(s *Session) int {
+	s.s3.batch.lock.Lock()
+	defer s.s3.batch.lock.Unlock()
+	return len(s.s3.batch.pending)
+}
+
+func TestFsckRepairFlushesBatched(t *testing.T) {
+	fs, fake := newTestFS(t, nil, func(c *Config) { c.MetaBatchWindow = 50 * time.Millisecond })
+	if st := fs.Mkdir("d", 0755, testContext); st != fuse.OK {
+		t.Fatal(st)
+	}
+	writeFile(t, fs, "d/f", []byte("x"))
+	if err := fs.Sess.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	fake.remove(fs.Sess.metaName(fs.mustKey(t, "d/f")))
+	fs.Sess.s3.cache = NewShardedCache(100, 1)
+
+	report, err := fs.Sess.Fsck(context.Background(), true)
+	if err != nil || len(report.Issues) != 1 || !report.Issues[0].Repaired {
+		t.Fatal(report, err)
+	}
+	if n := pendingBatched(fs.Sess); n != 0 {
+		t.Fatalf("%d uploads pending after fsck", n)
+	}
+	body, _ := fake.get(fs.Sess.metaName(fs.mustKey(t, "d")))
+	dir := &Directory{}
+	if err := json.Unmarshal(body, dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := dir.FileMeta["f"]; ok {
+		t.Fatal("pruned entry is not stored")
+	}
+}
+
+func TestSelfTestFlushesBatched(t *testing.T) {
+	fs, _ := newTestFS(t, nil, func(c *Config) { c.MetaBatchWindow = 50 * time.Millisecond })
+	steps, err := fs.Sess.SelfTest(context.Background())
+	if err != nil {
+		t.Fatal(steps, err)
+	}
+	if last := steps[len(steps)-1]; last.Name != "flush" || last.Error != "" {
+		t.Fatal(last)
+	}
+	if n := pendingBatched(fs.Sess); n != 0 {
+		t.Fatalf("%d uploads pending after selftest", n)
+	}
+}
+
+// BenchmarkMkdirTree creates a directory tree three levels deep, with
+// uploads taking a millisecond, and reports the uploads of metadata.
+func BenchmarkMkdirTree(b *testing.B) {
+	for _, window := range []time.Duration{0, 5 * time.Millisecond} {
+		b.Run(fmt.Sprintf("window=%v", window), func(b *testing.B) {
+			fake := newFakeS3()
+			fake.putDelay = time.Millisecond
+			fs, _ := newTestFS(b, fake, func(c *Config) { c.MetaBatchWindow = window })
+			puts := fake.totalPuts(fs.Sess.metaName(""))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				top := fmt.Sprintf("t%d", i)
+				if st := fs.Mkdir(top, 0755, testContext); st != fuse.OK {
+					b.Fatal(st)
+				}
+				for j := 0; j < 4; j++ {
+					dir := fmt.Sprintf("%s/d%d", top, j)
+					if st := fs.Mkdir(dir, 0755, testContext); st != fuse.OK {
+						b.Fatal(st)
+					}
+					for k := 0; k < 4; k++ {
+						if st := fs.Mkdir(fmt.Sprintf("%s/d%d", dir, k), 0755, testContext); st != fuse.OK {
+							b.Fatal(st)
+						}
+					}
+				}
+			}
+			if err := fs.Sess.Flush(context.Background()); err != nil {
+				b.Fatal(err)
+			}
+			b.StopTimer()
+			b.ReportMetric(float64(fake.totalPuts(fs.Sess.metaName(""))-puts)/float64(b.N), "puts/op")
+		})
+	}
+}
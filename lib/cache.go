@@ -12,6 +12,7 @@ type cache struct {
 	listHead       *keyValue
 	currentEntries int
 	maxEntries     int
+	currentBytes   int64
 }
 
 type keyValue struct {
@@ -38,8 +39,9 @@ func NewCache(maxEntries int) *cache {
 
 // Get value from cache if exist
 func (c *cache) Get(key ObjectKey) (data []byte, err error) {
-	c.lock.RLock()
-	defer c.lock.RUnlock()
+	// Write lock, because Get updates LRU list
+	c.lock.Lock()
+	defer c.lock.Unlock()
 	if kv, ok := c.hash[key]; ok {
 		if kv != c.listHead.next {
 			listRemove(kv)
@@ -61,6 +63,7 @@ func (c *cache) Add(key ObjectKey, data []byte) (err error) {
 			listRemove(kv)
 			listAdd(c.listHead, kv)
 		}
+		c.currentBytes += int64(len(data) - len(kv.value))
 		kv.value = data
 
 	} else {
@@ -71,6 +74,7 @@ func (c *cache) Add(key ObjectKey, data []byte) (err error) {
 			lastItem := c.listHead.prev
 			delete(c.hash, lastItem.key)
 			listRemove(lastItem)
+			c.currentBytes -= int64(len(lastItem.value))
 		}
 
 		kv := &keyValue{
@@ -79,6 +83,7 @@ func (c *cache) Add(key ObjectKey, data []byte) (err error) {
 		}
 		listAdd(c.listHead, kv)
 		c.hash[key] = kv
+		c.currentBytes += int64(len(data))
 	}
 	return nil
 }
@@ -90,11 +95,76 @@ func (c *cache) Remove(key ObjectKey) (err error) {
 	if kv, ok := c.hash[key]; ok {
 		delete(c.hash, key)
 		listRemove(kv)
+		c.currentEntries--
+		c.currentBytes -= int64(len(kv.value))
 
 	}
 	return nil
 }
 
+// shardedCache splits entries into shards by hash of key, each shard has
+// its own lock. LRU eviction is done per shard.
+type shardedCache struct {
+	shards []*cache
+}
+
+// NewShardedCache returns LRU Cache with maxEntries in total
+func NewShardedCache(maxEntries, shards int) *shardedCache {
+	if shards < 1 {
+		shards = 1
+	}
+	perShard := maxEntries / shards
+	if perShard < 1 {
+		perShard = 1
+	}
+	c := &shardedCache{
+		shards: make([]*cache, shards),
+	}
+	for i := range c.shards {
+		c.shards[i] = NewCache(perShard)
+	}
+	return c
+}
+
+// shard hashes key by FNV-1a inline, hash.Hash32 would allocate per call
+func (c *shardedCache) shard(key ObjectKey) *cache {
+	if len(c.shards) == 1 {
+		return c.shards[0]
+	}
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return c.shards[h%uint32(len(c.shards))]
+}
+
+// Get value from cache if exist
+func (c *shardedCache) Get(key ObjectKey) (data []byte, err error) {
+	return c.shard(key).Get(key)
+}
+
+// Add value to cache
+func (c *shardedCache) Add(key ObjectKey, data []byte) (err error) {
+	return c.shard(key).Add(key, data)
+}
+
+// Remove value from cache
+func (c *shardedCache) Remove(key ObjectKey) (err error) {
+	return c.shard(key).Remove(key)
+}
+
+// Usage returns number of entries and total bytes of values
+func (c *shardedCache) Usage() (entries, bytes int64) {
+	for _, shard := range c.shards {
+		shard.lock.Lock()
+		entries += int64(len(shard.hash))
+		bytes += shard.currentBytes
+		shard.lock.Unlock()
+	}
+	return entries, bytes
+}
+
 func listRemove(kv *keyValue) {
 	kv.prev.next = kv.next
 	kv.next.prev = kv.prev
@@ -0,0 +1,62 @@
+package bucketsync
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// TestShardedCacheConcurrent adds, gets and removes entries from several
+// goroutines. Values are never mixed up, and each shard keeps its limit.
+func TestShardedCacheConcurrent(t *testing.T) {
+	c := NewShardedCache(64, 8)
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				key := ObjectKey(fmt.Sprintf("key-%d", (g*7+i)%200))
+				switch i % 3 {
+				case 0:
+					c.Add(key, []byte(key))
+				case 1:
+					if data, err := c.Get(key); err == nil && string(data) != string(key) {
+						t.Errorf("%s = %q", key, data)
+					}
+				case 2:
+					c.Remove(key)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	for i, shard := range c.shards {
+		if len(shard.hash) > 8 || shard.currentEntries != len(shard.hash) {
+			t.Fatalf("shard %d has %d entries, counted %d", i, len(shard.hash), shard.currentEntries)
+		}
+	}
+	entries, _ := c.Usage()
+	if entries > 64 {
+		t.Fatalf("%d entries", entries)
+	}
+}
+
+func BenchmarkCacheGet(b *testing.B) {
+	for _, shards := range []int{1, 16} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			c := NewShardedCache(1024, shards)
+			keys := make([]ObjectKey, 1024)
+			for i := range keys {
+				keys[i] = ObjectKey(fmt.Sprintf("key-%d", i))
+				c.Add(keys[i], []byte("value"))
+			}
+			b.RunParallel(func(pb *testing.PB) {
+				for i := 0; pb.Next(); i++ {
+					c.Get(keys[i%len(keys)])
+				}
+			})
+		})
+	}
+}
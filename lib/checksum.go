@@ -0,0 +1,78 @@
+package bucketsync
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"hash"
+	"hash/crc32"
+	"io"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// Checksum algorithms of uploads, S3 verifies them on receive
+const (
+	ChecksumCRC32C = "crc32c"
+	ChecksumSHA256 = "sha256"
+)
+
+// ErrChecksum is returned if the backend echoes other checksum than sent.
+var ErrChecksum = errors.New("checksum mismatch")
+
+// setChecksum computes checksum of the body, and sets it to params.
+func (s *S3Session) setChecksum(params *s3.PutObjectInput) error {
+	var h hash.Hash
+	switch s.checksum {
+	case "":
+		return nil
+	case ChecksumCRC32C:
+		h = crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	case ChecksumSHA256:
+		h = sha256.New()
+	default:
+		return errors.Errorf("unknown checksum %s", s.checksum)
+	}
+	_, err := io.Copy(h, params.Body)
+	if err != nil {
+		return err
+	}
+	_, err = params.Body.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	sum := aws.String(base64.StdEncoding.EncodeToString(h.Sum(nil)))
+	if s.checksum == ChecksumCRC32C {
+		params.ChecksumAlgorithm = aws.String(s3.ChecksumAlgorithmCrc32c)
+		params.ChecksumCRC32C = sum
+	} else {
+		params.ChecksumAlgorithm = aws.String(s3.ChecksumAlgorithmSha256)
+		params.ChecksumSHA256 = sum
+	}
+	return nil
+}
+
+// verifyChecksum compares checksum echoed by the backend with the sent one.
+// Gateways which don't support checksums don't echo it, then it's logged.
+func (s *S3Session) verifyChecksum(params *s3.PutObjectInput, out *s3.PutObjectOutput, key ObjectKey) error {
+	var sent, echoed *string
+	switch s.checksum {
+	case ChecksumCRC32C:
+		sent, echoed = params.ChecksumCRC32C, out.ChecksumCRC32C
+	case ChecksumSHA256:
+		sent, echoed = params.ChecksumSHA256, out.ChecksumSHA256
+	default:
+		return nil
+	}
+	if echoed == nil {
+		s.logger.Debug("Checksum is not echoed", zap.String("key", key))
+		return nil
+	}
+	if aws.StringValue(sent) != aws.StringValue(echoed) {
+		return errors.Wrapf(ErrChecksum, "PutObject failed. key = %s, sent %s, echoed %s",
+			key, aws.StringValue(sent), aws.StringValue(echoed))
+	}
+	return nil
+}
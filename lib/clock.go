@@ -0,0 +1,72 @@
+package bucketsync
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Time sources of metadata timestamps
+const (
+	TimeLocal  = "local"
+	TimeServer = "server" // corrected by Date of S3 response
+)
+
+// clock gives timestamps of metadata, which never go backward in a session.
+type clock struct {
+	lock   sync.Mutex
+	offset time.Duration // server time - local time
+	last   time.Time
+}
+
+func (s *Session) now() time.Time {
+	s.clock.lock.Lock()
+	defer s.clock.lock.Unlock()
+	t := time.Now().Add(s.clock.offset)
+	if !t.After(s.clock.last) {
+		t = s.clock.last.Add(time.Nanosecond)
+	}
+	s.clock.last = t
+	return t
+}
+
+// syncClock sets offset to the server time, assuming the response is
+// generated at the middle of the round trip.
+func (s *Session) syncClock(ctx context.Context) error {
+	start := time.Now()
+	server, err := s.s3.ServerTime(ctx)
+	if err != nil {
+		return err
+	}
+	end := time.Now()
+	offset := server.Sub(start.Add(end.Sub(start) / 2))
+
+	s.clock.lock.Lock()
+	s.clock.offset = offset
+	s.clock.lock.Unlock()
+	s.logger.Info("clock synced to server", zap.Duration("offset", offset))
+	return nil
+}
+
+// clampTimes replaces timestamps beyond TimeClamp in the future with now,
+// and ones before Unix epoch with the epoch.
+func (s *Session) clampTimes(key ObjectKey, meta *Meta) {
+	if s.config.TimeClamp <= 0 {
+		return
+	}
+	now := s.now()
+	limit := now.Add(s.config.TimeClamp)
+	epoch := time.Unix(0, 0)
+	for _, t := range []*time.Time{&meta.Atime, &meta.Ctime, &meta.Mtime, &meta.Btime} {
+		switch {
+		case t.After(limit):
+			s.logger.Warn("future timestamp is clamped", zap.String("key", key), zap.Time("time", *t))
+			*t = now
+		case !t.IsZero() && t.Before(epoch):
+			s.logger.Warn("past timestamp is clamped", zap.String("key", key), zap.Time("time", *t))
+			*t = epoch
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package bucketsync
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// TestServerTime mounts with a local clock an hour behind the server.
+// Timestamps follow the server.
+func TestServerTime(t *testing.T) {
+	fake := newFakeS3()
+	fake.date = time.Now().Add(time.Hour)
+	fs, _ := newTestFS(t, fake, func(c *Config) { c.TimeSource = TimeServer })
+	writeFile(t, fs, "f", []byte("f"))
+	attr, st := fs.GetAttr("f", testContext)
+	if st != fuse.OK {
+		t.Fatal(st)
+	}
+	if d := time.Unix(int64(attr.Mtime), 0).Sub(fake.date); d < -time.Minute || d > time.Minute {
+		t.Fatalf("mtime is %v off the server", d)
+	}
+}
+
+// TestTimeClamp loads timestamps far in the future and before the epoch.
+func TestTimeClamp(t *testing.T) {
+	fs, fake := newTestFS(t, nil, nil)
+	writeFile(t, fs, "future", []byte("f"))
+	writeFile(t, fs, "past", []byte("p"))
+	future, past := time.Now().Add(1000*time.Hour), time.Unix(-100, 0)
+	fs.Utimens("future", &future, &future, testContext)
+	fs.Utimens("past", &past, &past, testContext)
+
+	clamped, _ := newTestFS(t, fake, func(c *Config) { c.TimeClamp = 24 * time.Hour })
+	attr, _ := clamped.GetAttr("future", testContext)
+	if d := time.Since(time.Unix(int64(attr.Mtime), 0)); d < -time.Minute || d > time.Minute {
+		t.Fatalf("future mtime is %v off now", d)
+	}
+	attr, _ = clamped.GetAttr("past", testContext)
+	if attr.Mtime != 0 || attr.Atime != 0 {
+		t.Fatalf("past times %d %d", attr.Mtime, attr.Atime)
+	}
+
+	unclamped, _ := newTestFS(t, fake, nil)
+	attr, _ = unclamped.GetAttr("future", testContext)
+	if int64(attr.Mtime) != future.Unix() {
+		t.Fatalf("unclamped mtime %d, want %d", attr.Mtime, future.Unix())
+	}
+}
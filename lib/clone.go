@@ -0,0 +1,208 @@
+package bucketsync
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// Extended attributes to clone a file into the file they are set on, instead
+// of FICLONE and FICLONERANGE ioctls which FUSE doesn't pass. Value of
+// CloneXAttr is path of the source relative to the mount, CloneRangeXAttr is
+// "src_offset src_length dst_offset path".
+const (
+	CloneXAttr      = "user.bucketsync.clone"
+	CloneRangeXAttr = "user.bucketsync.clone_range"
+)
+
+// errCloneRange is returned by Clone, if the files or the range can't be
+// cloned by sharing extents.
+var errCloneRange = errors.New("range can't be cloned")
+
+// errCloneTooLarge is returned by Clone, if dst grows beyond MaxFileSize.
+var errCloneTooLarge = errors.New("clone exceeds max file size")
+
+// Clone makes [srcOff, srcOff+length) of src the content of dst at dstOff by
+// sharing objects of the extents, without copying data. Offsets must be
+// aligned to extents, and so must the length unless the range ends at EOF of
+// src. Length 0 is up to EOF. If whole is true, dst becomes the same as src.
+// Extents are copy-on-write, writes to either file store modified extents as
+// new objects, like deduplicated content.
+func (s *Session) Clone(ctx context.Context, srcKey ObjectKey, srcOff, length int64, dstKey ObjectKey, dstOff int64, whole bool) error {
+	if srcKey == dstKey {
+		return errors.Wrap(errCloneRange, "source and destination are the same")
+	}
+	src, err := s.cloneFile(ctx, srcKey)
+	if err != nil {
+		return err
+	}
+	defer src.Release()
+	dst, err := s.cloneFile(ctx, dstKey)
+	if err != nil {
+		return err
+	}
+	defer dst.Release()
+
+	// Lock by order of keys, so that clones of the other direction don't
+	// deadlock.
+	first, second := src.file, dst.file
+	if dstKey < srcKey {
+		first, second = second, first
+	}
+	first.lock.Lock()
+	defer first.lock.Unlock()
+	second.lock.Lock()
+	defer second.lock.Unlock()
+	return s.cloneLocked(ctx, src.file, srcOff, length, dst.file, dstOff, whole)
+}
+
+// cloneFile opens regular file of key.
+func (s *Session) cloneFile(ctx context.Context, key ObjectKey) (*OpenedFile, error) {
+	file, err := s.acquireFile(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	opened := NewOpenedFile(file)
+	if file.Meta.Mode&syscall.S_IFMT != syscall.S_IFREG {
+		opened.Release()
+		return nil, errors.Wrapf(errCloneRange, "not a regular file. key = %s", key)
+	}
+	return opened, nil
+}
+
+func (s *Session) cloneLocked(ctx context.Context, src *File, srcOff, length int64, dst *File, dstOff int64, whole bool) error {
+	size := src.ExtentSize
+	if whole {
+		srcOff, length, dstOff = 0, src.Meta.Size, 0
+	}
+	if length == 0 {
+		length = src.Meta.Size - srcOff
+	}
+	end := srcOff + length
+	switch {
+	case dst.ExtentSize != size:
+		return errors.Wrap(errCloneRange, "extent sizes differ")
+	case srcOff < 0 || dstOff < 0 || length < 0 || end > src.Meta.Size:
+		return errors.Wrap(errCloneRange, "range is beyond EOF")
+	case srcOff%size != 0 || dstOff%size != 0:
+		return errors.Wrap(errCloneRange, "offset is not aligned to extents")
+	case length%size != 0 && end != src.Meta.Size:
+		return errors.Wrap(errCloneRange, "length is not aligned to extents")
+	case length%size != 0 && !whole && dstOff+length < dst.Meta.Size:
+		// The last extent would replace content of dst beyond length
+		return errors.Wrap(errCloneRange, "unaligned length ends before EOF of destination")
+	}
+	dstSize := dst.Meta.Size
+	if whole || dstOff+length > dstSize {
+		dstSize = dstOff + length
+	}
+	if dstSize > s.config.maxFileSize(size) {
+		return errCloneTooLarge
+	}
+
+	// Extents of src refer its objects after save
+	if src.dirty {
+		err := src.Save(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	err := s.reserveSpace(ctx, dstSize-dst.Meta.Size)
+	if err != nil {
+		return err
+	}
+
+	if whole {
+		for i, e := range dst.Extent {
+			e.release()
+			delete(dst.Extent, i)
+		}
+	}
+	count := (length + size - 1) / size
+	for i := int64(0); i < count; i++ {
+		si, di := srcOff/size+i, dstOff/size+i
+		if e, ok := dst.Extent[di]; ok {
+			e.release()
+			delete(dst.Extent, di)
+		}
+		e, ok := src.Extent[si]
+		if !ok {
+			continue // sparse
+		}
+		dst.Extent[di] = &Extent{
+			Key:         e.Key,
+			Chunks:      append([]ObjectKey(nil), e.Chunks...),
+			Compression: e.Compression,
+			Dict:        e.Dict,
+			Damaged:     e.Damaged,
+			sess:        s,
+		}
+	}
+	dst.Meta.Size = dstSize
+	dst.markDirty(0)
+	if whole {
+		// Content is the same as src
+		dst.Checksum = src.Checksum
+		dst.stale = false
+	}
+	dst.Meta.Mtime = s.now()
+	dst.Meta.Ctime = dst.Meta.Mtime
+	err = dst.Save(ctx)
+	if err != nil {
+		return err
+	}
+	s.logger.Debug("Cloned", zap.String("src", src.Key), zap.String("dst", dst.Key),
+		zap.Int64("extents", count))
+	return nil
+}
+
+// setClone clones the source of data into name.
+func (f *FileSystem) setClone(name, attr string, data []byte) fuse.Status {
+	var srcOff, length, dstOff int64
+	srcPath := string(data)
+	if attr == CloneRangeXAttr {
+		fields := strings.SplitN(srcPath, " ", 4)
+		if len(fields) != 4 {
+			return fuse.EINVAL
+		}
+		_, err := fmt.Sscan(strings.Join(fields[:3], " "), &srcOff, &length, &dstOff)
+		if err != nil {
+			return fuse.EINVAL
+		}
+		srcPath = fields[3]
+	}
+	srcPath = strings.TrimPrefix(srcPath, "/")
+	if srcPath == "" {
+		return fuse.EINVAL
+	}
+
+	ctx, cancel := f.Sess.opContext()
+	defer cancel()
+	srcKey, err := f.Sess.PathWalk(ctx, srcPath)
+	if err != nil {
+		f.logger.Debug("fuse error", zap.Error(err))
+		return f.lookupStatus(ctx, err)
+	}
+	dstKey, err := f.Sess.PathWalk(ctx, name)
+	if err != nil {
+		f.logger.Debug("fuse error", zap.Error(err))
+		return f.lookupStatus(ctx, err)
+	}
+	err = f.Sess.Clone(ctx, srcKey, srcOff, length, dstKey, dstOff, attr == CloneXAttr)
+	switch errors.Cause(err) {
+	case nil:
+		return fuse.OK
+	case errCloneRange:
+		f.logger.Debug("fuse error", zap.Error(err))
+		return fuse.EINVAL
+	case errCloneTooLarge:
+		return fuse.Status(syscall.EFBIG)
+	}
+	f.logger.Debug("fuse error", zap.Error(err))
+	return spaceStatus(ctx, errors.Cause(err))
+}
@@ -0,0 +1,69 @@
+package bucketsync
+
+import (
+	"bytes"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// TestCloneSharesExtents clones a file, and writes to the clone. Cloning
+// uploads and downloads no data, and the source is not affected.
+func TestCloneSharesExtents(t *testing.T) {
+	mod := func(c *Config) { c.DataPrefix = "data/" }
+	fs, fake := newTestFS(t, nil, mod)
+	data := testContent()
+	writeFile(t, fs, "big", data)
+	writeFile(t, fs, "copy", nil)
+	writeFile(t, fs, "part", nil)
+	prefix := fs.Sess.dataPrefix()
+	puts, gets := fake.totalPuts(prefix), fake.totalGets(prefix)
+
+	if st := fs.SetXAttr("copy", CloneXAttr, []byte("/big"), 0, testContext); st != fuse.OK {
+		t.Fatal(st)
+	}
+	if st := fs.SetXAttr("part", CloneRangeXAttr, []byte("16 32 0 big"), 0, testContext); st != fuse.OK {
+		t.Fatal(st)
+	}
+	if n, m := fake.totalPuts(prefix)-puts, fake.totalGets(prefix)-gets; n != 0 || m != 0 {
+		t.Fatalf("clone uploaded %d and downloaded %d objects", n, m)
+	}
+	for value, want := range map[string]fuse.Status{
+		"8 16 0 big":   fuse.EINVAL,
+		"0 20 0 big":   fuse.EINVAL,
+		"0 16 0 copy2": fuse.ENOENT,
+		"0 16 0":       fuse.EINVAL,
+		"0 16 0 part":  fuse.EINVAL,
+		"0 400 0 big":  fuse.EINVAL,
+		"x 16 0 big":   fuse.EINVAL,
+	} {
+		if st := fs.SetXAttr("part", CloneRangeXAttr, []byte(value), 0, testContext); st != want {
+			t.Fatalf("%q: %v, want %v", value, st, want)
+		}
+	}
+
+	f, st := fs.Open("copy", syscall.O_RDWR, testContext)
+	if st != fuse.OK {
+		t.Fatal(st)
+	}
+	if _, st := f.Write([]byte("modified"), 20); st != fuse.OK {
+		t.Fatal(st)
+	}
+	if st := f.Flush(); st != fuse.OK {
+		t.Fatal(st)
+	}
+	f.Release()
+	if n := fake.totalPuts(prefix) - puts; n != 1 {
+		t.Fatalf("%d extents uploaded for a write", n)
+	}
+
+	reader, _ := newTestFS(t, fake, mod)
+	modified := append([]byte(nil), data...)
+	copy(modified[20:], "modified")
+	for name, want := range map[string][]byte{"big": data, "copy": modified, "part": data[16:48]} {
+		if got := readFile(t, reader, name); !bytes.Equal(got, want) {
+			t.Fatalf("%s = %q, want %q", name, got, want)
+		}
+	}
+}
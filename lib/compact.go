@@ -0,0 +1,203 @@
+package bucketsync
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// compactGain is how many times fewer objects compaction must make
+const compactGain = 2
+
+// Compact merges small extents of the file at path into extents of
+// ExtentSize, and its chunks into ones of ChunkSize of the config, if it was
+// written with smaller ones, e.g. by an older config or write amplification
+// guard. Merged content is uploaded deduplicated, and replaced objects are
+// left for garbage collection like other overwritten extents. It returns
+// true if the file is compacted, only when it makes compactGain times fewer
+// objects.
+func (s *Session) Compact(ctx context.Context, path string) (bool, error) {
+	key, err := s.PathWalk(ctx, path)
+	if err != nil {
+		return false, err
+	}
+	return s.compactKey(ctx, key)
+}
+
+func (s *Session) compactKey(ctx context.Context, key ObjectKey) (bool, error) {
+	file, err := s.acquireFile(ctx, key)
+	if err != nil {
+		return false, err
+	}
+	opened := NewOpenedFile(file)
+	defer opened.Release()
+	if file.Meta.Mode&syscall.S_IFMT != syscall.S_IFREG {
+		return false, errors.Errorf("not a regular file. key = %s", key)
+	}
+	file.lock.Lock()
+	defer file.lock.Unlock()
+	return s.compactLocked(ctx, file)
+}
+
+// compactable returns true if compaction makes enough fewer objects.
+func compactable(before, after int) bool {
+	return before > 0 && after*compactGain <= before
+}
+
+// compactLayout returns extent and chunk size file is compacted to, and
+// numbers of objects before and after.
+func (s *Session) compactLayout(file *File) (extentSize, chunkSize int64, before, after int) {
+	extentSize, chunkSize = file.ExtentSize, file.ChunkSize
+	if target := s.config.ExtentSize; file.ExtentSize < target && target%file.ExtentSize == 0 {
+		extentSize = target
+	}
+	// Chunks only grow, or the file becomes unchunked
+	if target := s.config.chunkSize(); chunkSize != 0 && (target == 0 || chunkSize < target) && target < extentSize {
+		chunkSize = target
+	}
+
+	merged := make(map[int64]bool, len(file.Extent))
+	for i, e := range file.Extent {
+		before += len(e.Objects())
+		merged[i*file.ExtentSize/extentSize] = true
+	}
+	perExtent := 1
+	if chunkSize > 0 {
+		perExtent = int((extentSize + chunkSize - 1) / chunkSize)
+	}
+	return extentSize, chunkSize, before, len(merged) * perExtent
+}
+
+// compactLocked merges extents group by group, each merged extent is
+// uploaded and released before the next group is filled, so that only
+// extents of one merged extent are in memory. The file is replaced only
+// after all are uploaded, and restored if its save fails.
+func (s *Session) compactLocked(ctx context.Context, file *File) (bool, error) {
+	extentSize, chunkSize, before, after := s.compactLayout(file)
+	if !compactable(before, after) {
+		return false, nil
+	}
+	// Merged extents replace the current ones, they must be uploaded
+	if file.dirty {
+		err := file.Save(ctx)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	ratio := extentSize / file.ExtentSize
+	groups := make(map[int64][]int64, after)
+	for i := range file.Extent {
+		groups[i/ratio] = append(groups[i/ratio], i)
+	}
+	order := make([]int64, 0, len(groups))
+	for m := range groups {
+		order = append(order, m)
+	}
+	sort.Slice(order, func(a, b int) bool { return order[a] < order[b] })
+
+	stats := &SaveStats{}
+	saving := &sync.Map{}
+	extents := make(map[int64]*Extent, len(groups))
+	for _, m := range order {
+		merged := s.CreateExtent(extentSize)
+		for _, i := range groups[m] {
+			e := file.Extent[i]
+			resident := len(e.body) != 0
+			err := e.Fill(ctx)
+			if err != nil {
+				merged.release()
+				return false, err
+			}
+			copy(merged.body[(i%ratio)*file.ExtentSize:], e.body)
+			if !resident {
+				e.release()
+			}
+		}
+		merged.Key = merged.CurrentKey()
+		err := merged.upload(ctx, chunkSize, stats, saving)
+		merged.release()
+		if err != nil {
+			return false, err
+		}
+		extents[m] = merged
+	}
+
+	replaced, oldExtentSize, oldChunkSize := file.Extent, file.ExtentSize, file.ChunkSize
+	file.Extent = extents
+	file.ExtentSize, file.ChunkSize = extentSize, chunkSize
+	// Content is the same, so is Checksum
+	file.markMeta()
+	err := file.Save(ctx)
+	if err != nil {
+		file.Extent = replaced
+		file.ExtentSize, file.ChunkSize = oldExtentSize, oldChunkSize
+		file.clean()
+		return false, err
+	}
+	for _, e := range replaced {
+		e.release()
+	}
+	atomic.AddInt64(&s.counters.compactedFiles, 1)
+	s.logger.Debug("Compacted", zap.String("key", file.Key), zap.Int("objects before", before),
+		zap.Int("objects after", after))
+	return true, nil
+}
+
+// SweepCompact compacts all files which make fewer objects, and returns how
+// many are compacted.
+func (s *Session) SweepCompact(ctx context.Context) (int, error) {
+	var lock sync.Mutex
+	var keys []ObjectKey
+	err := s.Walk(ctx, "", s.RootKey(), WalkOptions{}, func(path string, key ObjectKey, node interface{}) error {
+		if file, ok := node.(*File); ok {
+			_, _, before, after := s.compactLayout(file)
+			if compactable(before, after) {
+				lock.Lock()
+				keys = append(keys, key)
+				lock.Unlock()
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	compacted := 0
+	for _, key := range keys {
+		ok, err := s.compactKey(ctx, key)
+		if err != nil {
+			return compacted, err
+		}
+		if ok {
+			compacted++
+		}
+	}
+	return compacted, nil
+}
+
+// compactor runs SweepCompact periodically until stop is closed.
+func (s *Session) compactor(interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		compacted, err := s.SweepCompact(ctx)
+		cancel()
+		if err != nil {
+			s.logger.Error("compaction sweep failed", zap.Error(err))
+		}
+		s.logger.Debug("compaction sweep", zap.Int("compacted", compacted))
+	}
+}
@@ -0,0 +1,109 @@
+package bucketsync
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// writeSmallExtents writes a file by a session of 16 bytes extents, and
+// returns a session compacting to 64 bytes ones.
+func writeSmallExtents(t *testing.T, data []byte) (*FileSystem, *fakeS3) {
+	old, fake := newTestFS(t, nil, nil)
+	writeFile(t, old, "f", data)
+	fs, _ := newTestFS(t, fake, func(c *Config) { c.ExtentSize = 64 })
+	return fs, fake
+}
+
+func testContent() []byte {
+	var data []byte
+	for i := 0; len(data) < 200; i++ {
+		data = append(data, fmt.Sprintf("line %d\n", i)...)
+	}
+	return data[:200]
+}
+
+func TestCompactKeepsContent(t *testing.T) {
+	data := testContent()
+	fs, fake := writeSmallExtents(t, data)
+
+	var ops []string
+	fake.fail = func(op, name string) error {
+		if strings.HasPrefix(name, fs.Sess.dataPrefix()) {
+			ops = append(ops, op)
+		}
+		return nil
+	}
+	ok, err := fs.Sess.Compact(context.Background(), "f")
+	if err != nil || !ok {
+		t.Fatal(ok, err)
+	}
+	fake.fail = nil
+
+	// A group is uploaded before the next one is read
+	firstPut := -1
+	for i, op := range ops {
+		if op == "PutObject" && firstPut < 0 {
+			firstPut = i
+		}
+		if op == "GetObject" && firstPut >= 0 {
+			break
+		}
+		if i == len(ops)-1 {
+			t.Fatalf("all groups are read before upload: %v", ops)
+		}
+	}
+
+	reader, _ := newTestFS(t, fake, nil)
+	if got := readFile(t, reader, "f"); !bytes.Equal(got, data) {
+		t.Fatalf("compacted content differs:\n%q\n%q", got, data)
+	}
+	file, _ := reader.getFile(context.Background(), "f")
+	if file.ExtentSize != 64 || len(file.Extent) != 4 {
+		t.Fatalf("extent size %d, %d extents", file.ExtentSize, len(file.Extent))
+	}
+}
+
+func TestCompactFailureKeepsFile(t *testing.T) {
+	data := testContent()
+	for _, failing := range []string{"data", "meta"} {
+		t.Run(failing, func(t *testing.T) {
+			fs, fake := writeSmallExtents(t, data)
+			file, _ := fs.getFile(context.Background(), "f")
+			extents := len(file.Extent)
+			meta := fs.Sess.metaName(file.Key)
+			prefix := fs.Sess.dataPrefix()
+			puts := 0
+			fake.fail = func(op, name string) error {
+				if op != "PutObject" {
+					return nil
+				}
+				if failing == "meta" && name == meta {
+					return errors.New("injected")
+				}
+				if failing == "data" && strings.HasPrefix(name, prefix) {
+					if puts++; puts == 2 {
+						return errors.New("injected")
+					}
+				}
+				return nil
+			}
+			file.lock.Lock()
+			ok, err := fs.Sess.compactLocked(context.Background(), file)
+			file.lock.Unlock()
+			if err == nil || ok {
+				t.Fatal("compact succeeded")
+			}
+			fake.fail = nil
+			if file.ExtentSize != 16 || len(file.Extent) != extents || file.dirty {
+				t.Fatalf("extent size %d, %d extents, dirty %v", file.ExtentSize, len(file.Extent), file.dirty)
+			}
+			if got := readFile(t, fs, "f"); !bytes.Equal(got, data) {
+				t.Fatalf("content after failure %q", got)
+			}
+		})
+	}
+}
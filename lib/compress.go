@@ -0,0 +1,404 @@
+package bucketsync
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+	"github.com/spaolacci/murmur3"
+	"go.uber.org/zap"
+)
+
+// Data objects are compressed by zstd if Compression is enabled. An extent
+// records the algorithm and dictionary, and its object key has suffix of
+// them, so the same content stored other way doesn't collide.
+const compressionZstd = "zstd"
+
+// Objects of compression "header" start with a header telling how the rest
+// is compressed, so that other tools can write compressed extents. The object
+// name has suffix ".header" like others.
+//
+//	offset  size  field
+//	0       4     magic "BSXH"
+//	4       1     version, 1
+//	5       1     algorithm, HeaderNone, HeaderGzip or HeaderZstd
+//	6       8     original size, big endian
+//	14            data
+const compressionHeader = "header"
+
+const (
+	headerMagic   = "BSXH"
+	headerVersion = 1
+	headerSize    = 14
+)
+
+// Algorithms of extent object header
+const (
+	HeaderNone = 0
+	HeaderGzip = 1
+	HeaderZstd = 2 // dictionary of the extent is used, if any
+)
+
+// EncodeHeader compresses body by algorithm, and prepends the header.
+func EncodeHeader(algorithm byte, body []byte) ([]byte, error) {
+	header := make([]byte, headerSize, headerSize+len(body))
+	copy(header, headerMagic)
+	header[4] = headerVersion
+	header[5] = algorithm
+	binary.BigEndian.PutUint64(header[6:], uint64(len(body)))
+
+	switch algorithm {
+	case HeaderNone:
+		return append(header, body...), nil
+	case HeaderGzip:
+		buf := bytes.NewBuffer(header)
+		w := gzip.NewWriter(buf)
+		if _, err := w.Write(body); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case HeaderZstd:
+		enc, err := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		defer enc.Close()
+		return enc.EncodeAll(body, header), nil
+	}
+	return nil, errors.Errorf("unknown header algorithm %d", algorithm)
+}
+
+// decodeHeader decompresses object with the header.
+func (s *Session) decodeHeader(ctx context.Context, data []byte, dict string) ([]byte, error) {
+	if len(data) < headerSize || string(data[:4]) != headerMagic {
+		return nil, errors.New("no extent header")
+	}
+	if data[4] != headerVersion {
+		return nil, errors.Errorf("unknown header version %d", data[4])
+	}
+	size := binary.BigEndian.Uint64(data[6:headerSize])
+	payload := data[headerSize:]
+
+	var body []byte
+	var err error
+	switch data[5] {
+	case HeaderNone:
+		body = payload
+	case HeaderGzip:
+		body, err = gunzip(payload)
+	case HeaderZstd:
+		body, err = s.decodeZstd(ctx, payload, dict)
+	default:
+		return nil, errors.Errorf("unknown header algorithm %d", data[5])
+	}
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(body)) != size {
+		return nil, errors.Errorf("size mismatch, header %d, decompressed %d", size, len(body))
+	}
+	return body, nil
+}
+
+// gunzip decompresses data, the reader is closed after reading it all.
+func gunzip(data []byte) (body []byte, err error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if cerr := zr.Close(); err == nil {
+			err = cerr
+		}
+	}()
+	return ioutil.ReadAll(zr)
+}
+
+// maxDictSize is the default dictionary size of zstd
+const maxDictSize = 112640
+
+// compressor holds zstd coders of each dictionary, "" is no dictionary.
+type compressor struct {
+	lock     sync.Mutex
+	loaded   bool
+	dict     string // current dictionary for new objects
+	encoders map[string]*zstd.Encoder
+	decoders map[string]*zstd.Decoder
+}
+
+func objectName(key ObjectKey, compression, dict string) ObjectKey {
+	if compression == "" {
+		return key
+	}
+	if dict == "" {
+		return key + "." + compression
+	}
+	return key + "." + compression + "." + dict
+}
+
+func (s *Session) dictPointerKey() ObjectKey {
+	return s.RootKey() + ".dict"
+}
+
+func dictKey(dict string) ObjectKey {
+	return "dict-" + dict
+}
+
+// compression returns algorithm and dictionary for new objects.
+func (s *Session) compression(ctx context.Context) (compression, dict string, err error) {
+	if !s.config.Compression {
+		return "", "", nil
+	}
+	s.compressor.lock.Lock()
+	loaded, dict := s.compressor.loaded, s.compressor.dict
+	s.compressor.lock.Unlock()
+	if loaded {
+		return compressionZstd, dict, nil
+	}
+
+	obj, err := s.s3.Download(ctx, MetaObject, s.dictPointerKey())
+	if err != nil && errors.Cause(err) != ErrNotFound {
+		return "", "", err
+	}
+	s.compressor.lock.Lock()
+	defer s.compressor.lock.Unlock()
+	if !s.compressor.loaded {
+		// Unless trained meanwhile
+		s.compressor.dict = string(obj)
+		s.compressor.loaded = true
+	}
+	return compressionZstd, s.compressor.dict, nil
+}
+
+func (s *Session) loadDict(ctx context.Context, dict string) ([]byte, error) {
+	if dict == "" {
+		return nil, nil
+	}
+	return s.s3.Download(ctx, DataObject, dictKey(dict))
+}
+
+// encoder returns encoder of dict. The lock is held only to look it up and
+// to store, not while its dictionary is downloaded.
+func (s *Session) encoder(ctx context.Context, dict string) (*zstd.Encoder, error) {
+	s.compressor.lock.Lock()
+	enc, ok := s.compressor.encoders[dict]
+	s.compressor.lock.Unlock()
+	if ok {
+		return enc, nil
+	}
+
+	d, err := s.loadDict(ctx, dict)
+	if err != nil {
+		return nil, err
+	}
+	var opts []zstd.EOption
+	if d != nil {
+		opts = append(opts, zstd.WithEncoderDict(d))
+	}
+	enc, err = zstd.NewWriter(nil, opts...)
+	if err != nil {
+		return nil, err
+	}
+	s.compressor.lock.Lock()
+	defer s.compressor.lock.Unlock()
+	if stored, ok := s.compressor.encoders[dict]; ok {
+		enc.Close() // made by other caller meanwhile
+		return stored, nil
+	}
+	s.compressor.encoders[dict] = enc
+	return enc, nil
+}
+
+// decoder returns decoder of dict, as encoder.
+func (s *Session) decoder(ctx context.Context, dict string) (*zstd.Decoder, error) {
+	s.compressor.lock.Lock()
+	dec, ok := s.compressor.decoders[dict]
+	s.compressor.lock.Unlock()
+	if ok {
+		return dec, nil
+	}
+
+	d, err := s.loadDict(ctx, dict)
+	if err != nil {
+		return nil, err
+	}
+	opts := []zstd.DOption{zstd.WithDecoderConcurrency(0)}
+	if d != nil {
+		opts = append(opts, zstd.WithDecoderDicts(d))
+	}
+	dec, err = zstd.NewReader(nil, opts...)
+	if err != nil {
+		return nil, err
+	}
+	s.compressor.lock.Lock()
+	defer s.compressor.lock.Unlock()
+	if stored, ok := s.compressor.decoders[dict]; ok {
+		dec.Close()
+		return stored, nil
+	}
+	s.compressor.decoders[dict] = dec
+	return dec, nil
+}
+
+func (s *Session) compress(ctx context.Context, body []byte, compression, dict string) ([]byte, error) {
+	if compression == "" {
+		return body, nil
+	}
+	if compression != compressionZstd {
+		return nil, errors.Errorf("unknown compression %s", compression)
+	}
+	// EncodeAll is safe for concurrent use
+	enc, err := s.encoder(ctx, dict)
+	if err != nil {
+		return nil, err
+	}
+	return enc.EncodeAll(body, nil), nil
+}
+
+func (s *Session) decompress(ctx context.Context, data []byte, compression, dict string) ([]byte, error) {
+	switch compression {
+	case "":
+		return data, nil
+	case compressionZstd:
+		return s.decodeZstd(ctx, data, dict)
+	case compressionHeader:
+		return s.decodeHeader(ctx, data, dict)
+	}
+	return nil, errors.Errorf("unknown compression %s", compression)
+}
+
+func (s *Session) decodeZstd(ctx context.Context, data []byte, dict string) ([]byte, error) {
+	dec, err := s.decoder(ctx, dict)
+	if err != nil {
+		return nil, err
+	}
+	return dec.DecodeAll(data, nil)
+}
+
+// TrainDictionary builds zstd dictionary from content of the files, and
+// makes it current for new objects. Old dictionaries are kept, objects
+// compressed with them are still readable.
+func (s *Session) TrainDictionary(ctx context.Context, samplePaths []string) (string, error) {
+	samples := make([][]byte, 0, len(samplePaths))
+	for _, path := range samplePaths {
+		key, err := s.PathWalk(ctx, path)
+		if err != nil {
+			return "", err
+		}
+		file, err := s.NewFile(ctx, key)
+		if err != nil {
+			return "", err
+		}
+		content, err := file.content(ctx)
+		if err != nil {
+			return "", errors.Wrapf(err, "sample load failed. path = %s", path)
+		}
+		if len(content) == 0 {
+			continue
+		}
+		samples = append(samples, content)
+	}
+	if len(samples) < 2 {
+		return "", errors.New("at least 2 non-empty samples are required")
+	}
+
+	// Half of samples are history, the others are to build tables. Tables
+	// can't be built from contents entirely matching history.
+	history := []byte{}
+	contents := [][]byte{}
+	for i, sample := range samples {
+		if i%2 == 0 && len(history) < maxDictSize {
+			history = append(history, sample...)
+		} else {
+			contents = append(contents, sample)
+		}
+	}
+	if len(history) > maxDictSize {
+		history = history[len(history)-maxDictSize:]
+	}
+
+	// murmur3.Sum32 of v1.1.0 walks data by uintptr arithmetic, which
+	// checkptr of -race rejects. The hasher reads it by index.
+	h := murmur3.New32()
+	h.Write(history)
+	id := h.Sum32()
+	// Frame header of zstd omits ID 0, frames of the dictionary must name it
+	if id == 0 {
+		id = 1
+	}
+	d, err := buildDict(zstd.BuildDictOptions{
+		ID:       id,
+		Contents: contents,
+		History:  history,
+		Offsets:  [3]int{1, 4, 8},
+		Level:    zstd.SpeedDefault,
+	})
+	if err != nil {
+		return "", err
+	}
+	dict := fmt.Sprintf("%08x", id)
+
+	err = s.s3.Upload(ctx, DataObject, dictKey(dict), bytes.NewReader(d))
+	if err != nil {
+		return "", err
+	}
+	err = s.s3.Upload(ctx, MetaObject, s.dictPointerKey(), bytes.NewReader([]byte(dict)))
+	if err != nil {
+		return "", err
+	}
+
+	s.compressor.lock.Lock()
+	s.compressor.dict = dict
+	s.compressor.loaded = true
+	s.compressor.lock.Unlock()
+	s.logger.Info("dictionary trained", zap.String("dict", dict),
+		zap.Int("samples", len(samples)), zap.Int("size", len(d)))
+	return dict, nil
+}
+
+// buildDict recovers panic of zstd.BuildDict on degenerate samples.
+func buildDict(opts zstd.BuildDictOptions) (d []byte, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.Errorf("dictionary build failed: %v", r)
+		}
+	}()
+	return zstd.BuildDict(opts)
+}
+
+// content returns whole content of file, sparse area is zero.
+func (o *File) content(ctx context.Context) ([]byte, error) {
+	indexes := make([]int64, 0, len(o.Extent))
+	for i := range o.Extent {
+		indexes = append(indexes, i)
+	}
+	sort.Slice(indexes, func(a, b int) bool { return indexes[a] < indexes[b] })
+
+	content := make([]byte, o.Meta.Size)
+	for _, i := range indexes {
+		if i*o.ExtentSize >= o.Meta.Size {
+			break
+		}
+		e := o.Extent[i]
+		resident := e.dirty || len(e.body) != 0
+		err := e.Fill(ctx)
+		if err != nil {
+			return nil, err
+		}
+		copy(content[i*o.ExtentSize:], e.body)
+		if !resident {
+			e.release()
+		}
+	}
+	return content, nil
+}
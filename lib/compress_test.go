@@ -0,0 +1,183 @@
+package bucketsync
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// TestSlowDictionaryDoesNotBlock downloads a dictionary slowly, while other
+// objects are compressed and decompressed without it.
+func TestSlowDictionaryDoesNotBlock(t *testing.T) {
+	sess, fake := newTestSession(t, nil, func(c *Config) { c.Compression = true })
+	ctx := context.Background()
+	bucket, name := sess.s3.location(DataObject, dictKey("slow"))
+	slow := bucket + "/" + name
+	fake.delayOf = func(op, name string) time.Duration {
+		if name == slow {
+			return 300 * time.Millisecond
+		}
+		return 0
+	}
+
+	body := bytes.Repeat([]byte("compressible "), 100)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sess.compress(ctx, body, compressionZstd, "slow")
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	start := time.Now()
+	data, err := sess.compress(ctx, body, compressionZstd, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := sess.decompress(ctx, data, compressionZstd, "")
+	if err != nil || !bytes.Equal(got, body) {
+		t.Fatalf("decompressed %q %v", got, err)
+	}
+	if d := time.Since(start); d > 150*time.Millisecond {
+		t.Fatalf("waited %v for other dictionary", d)
+	}
+	<-done
+}
+
+func TestConcurrentCompressShareEncoder(t *testing.T) {
+	sess, _ := newTestSession(t, nil, func(c *Config) { c.Compression = true })
+	ctx := context.Background()
+	errc := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		go func(i int) {
+			body := bytes.Repeat([]byte{byte(i)}, 1000)
+			data, err := sess.compress(ctx, body, compressionZstd, "")
+			if err == nil {
+				var got []byte
+				got, err = sess.decompress(ctx, data, compressionZstd, "")
+				if err == nil && !bytes.Equal(got, body) {
+					err = errors.New("content differs")
+				}
+			}
+			errc <- err
+		}(i)
+	}
+	for i := 0; i < 8; i++ {
+		if err := <-errc; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(sess.compressor.encoders); n != 1 {
+		t.Fatalf("%d encoders", n)
+	}
+}
+
+// TestDictionaryImprovesRatio stores a small file similar to samples, with
+// and without a dictionary trained from them.
+func TestDictionaryImprovesRatio(t *testing.T) {
+	compressed := func(c *Config) { c.Compression = true; c.ExtentSize = 4096 }
+	record := func(i int) []byte {
+		return []byte(fmt.Sprintf(`{"level":"info","service":"bucketsync","msg":"request %d done","path":"/data/%d","latency_ms":%d}`, i, i*7, i%13))
+	}
+	stored := func(fs *FileSystem, fake *fakeS3, name, dict string) int {
+		t.Helper()
+		file, _ := fs.getFile(context.Background(), name)
+		e := file.Extent[0]
+		if e.Compression != compressionZstd || e.Dict != dict {
+			t.Fatalf("compression %q dict %q, want %q", e.Compression, e.Dict, dict)
+		}
+		bucket, object := fs.Sess.s3.location(DataObject, e.Objects()[0])
+		data, ok := fake.get(bucket + "/" + object)
+		if !ok {
+			t.Fatal("no data object")
+		}
+		return len(data)
+	}
+
+	plain, plainFake := newTestFS(t, nil, compressed)
+	writeFile(t, plain, "new", record(1000))
+	without := stored(plain, plainFake, "new", "")
+
+	fs, fake := newTestFS(t, nil, compressed)
+	var paths []string
+	for i := 0; i < 40; i++ {
+		path := fmt.Sprintf("sample%d", i)
+		writeFile(t, fs, path, record(i))
+		paths = append(paths, path)
+	}
+	dict, err := fs.Sess.TrainDictionary(context.Background(), paths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, fs, "new", record(1000))
+	with := stored(fs, fake, "new", dict)
+	if with >= without {
+		t.Fatalf("%d bytes with dictionary, %d without", with, without)
+	}
+
+	reader, _ := newTestFS(t, fake, compressed)
+	if got := readFile(t, reader, "new"); !bytes.Equal(got, record(1000)) {
+		t.Fatalf("read %q", got)
+	}
+}
+
+// TestExternalHeaderExtents replaces extents of a file with objects in the
+// header format, as written by another tool. They are read as the content.
+func TestExternalHeaderExtents(t *testing.T) {
+	for _, algorithm := range []byte{HeaderNone, HeaderGzip, HeaderZstd} {
+		t.Run(fmt.Sprint(algorithm), func(t *testing.T) {
+			fs, fake := newTestFS(t, nil, nil)
+			data := testContent()
+			writeFile(t, fs, "f", data)
+			file, _ := fs.getFile(context.Background(), "f")
+			for _, e := range file.Extent {
+				bucket, name := fs.Sess.s3.location(DataObject, e.Objects()[0])
+				plain, _ := fake.get(bucket + "/" + name)
+				body, err := EncodeHeader(algorithm, plain)
+				if err != nil {
+					t.Fatal(err)
+				}
+				e.Compression = compressionHeader
+				bucket, name = fs.Sess.s3.location(DataObject, e.Objects()[0])
+				fake.set(bucket+"/"+name, body)
+			}
+			file.markMeta()
+			if err := file.Save(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+
+			reader, _ := newTestFS(t, fake, nil)
+			if got := readFile(t, reader, "f"); !bytes.Equal(got, data) {
+				t.Fatalf("read %q", got)
+			}
+
+			// Header of other size than the content
+			bucket, name := fs.Sess.s3.location(DataObject, file.Extent[0].Objects()[0])
+			body, _ := fake.get(bucket + "/" + name)
+			body = append([]byte(nil), body...)
+			body[13]++
+			fake.set(bucket+"/"+name, body)
+			reader, _ = newTestFS(t, fake, nil)
+			f, st := reader.Open("f", 0, testContext)
+			if st != fuse.OK {
+				t.Fatal(st)
+			}
+			defer f.Release()
+			if _, st := f.Read(make([]byte, 16), 0); st == fuse.OK {
+				t.Fatal("size mismatch is read")
+			}
+
+			// Stream cut short, the gzip trailer is missing
+			if algorithm == HeaderGzip {
+				body, _ := EncodeHeader(algorithm, data)
+				if _, err := fs.Sess.decodeHeader(context.Background(), body[:len(body)-4], ""); err == nil {
+					t.Fatal("truncated gzip is decoded")
+				}
+			}
+		})
+	}
+}
@@ -1,5 +1,12 @@
 package bucketsync
 
+import (
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
 type Config struct {
 	Bucket        string `yaml:"bucket"`
 	Region        string `yaml:"region"`
@@ -9,12 +16,417 @@ type Config struct {
 	Logging       string `yaml:"logging"`
 	LogOutputPath string `yaml:"log_output_path"`
 	CacheSize     int    `yaml:"cache_size"`
+	CacheShards   int    `yaml:"cache_shards"`
 	ExtentSize    int64  `yaml:"extent_size"`
 	Encryption    bool   `yaml:"encryption"`
 	Compression   bool   `yaml:"compression"`
+	MetaBucket    string `yaml:"meta_bucket"`
+	MetaPrefix    string `yaml:"meta_prefix"`
+	DataPrefix    string `yaml:"data_prefix"`
+	RestoreDays   int64  `yaml:"restore_days"`
+	// RequireRoot refuses to mount if the root of Password doesn't exist,
+	// instead of creating an empty one
+	RequireRoot bool `yaml:"require_root"`
+	// RootVersion mounts the version of the root read-only, with other metadata
+	// current while it was the latest. The bucket must have versioning enabled.
+	RootVersion string `yaml:"root_version"`
+	// AuditLog is path of a file to append records of mutations as JSON lines,
+	// or AuditToLogger. AuditIdentity names the mount in records, hostname
+	// by default.
+	AuditLog      string `yaml:"audit_log"`
+	AuditIdentity string `yaml:"audit_identity"`
+	// DryRun logs uploads instead of executing them, reads proceed. Mutating
+	// operations succeed, or fail with DryRunErrno if set.
+	DryRun      bool `yaml:"dry_run"`
+	DryRunErrno int  `yaml:"dry_run_errno"`
+	// LowerDir is a local directory the mount is overlaid on. Its files are
+	// read unless changed in the bucket, changes go to the bucket only, or
+	// also to LowerDir by LowerPopulate.
+	LowerDir      string `yaml:"lower_dir"`
+	LowerPopulate bool   `yaml:"lower_populate"`
+	// Endpoint of S3 compatible storage, path-style is used for it unless
+	// PathStyle is set
+	Endpoint           string `yaml:"endpoint"`
+	PathStyle          *bool  `yaml:"path_style"`
+	CACertFile         string `yaml:"ca_cert_file"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"` // only for development
+	// OperationBudget caps total time including retries of one FUSE operation
+	OperationBudget time.Duration `yaml:"operation_budget"`
+	// RequestTimeout bounds an attempt of backend request, and MaxRetries is
+	// number of attempts after failed one, SDK default if not set
+	RequestTimeout time.Duration `yaml:"request_timeout"`
+	MaxRetries     *int          `yaml:"max_retries"`
+	// Profile presets the timeouts, ProfileInteractive fails fast rather than
+	// retrying a slow backend. Settings given explicitly take precedence.
+	Profile string `yaml:"profile"`
+	// DirectIO bypasses the kernel page cache for all files, otherwise only
+	// for opens with O_DIRECT
+	DirectIO bool `yaml:"direct_io"`
+	// AttrTimeout and EntryTimeout are how long the kernel may cache
+	// attributes and directory entries. Use short ones if other mounts write.
+	AttrTimeout  time.Duration `yaml:"attr_timeout"`
+	EntryTimeout time.Duration `yaml:"entry_timeout"`
+	// NegativeTimeout is how long names not found are cached, by the kernel
+	// and the mount. Names created by other mounts are seen after it.
+	NegativeTimeout time.Duration `yaml:"negative_timeout"`
+	// Checksum is ChecksumCRC32C or ChecksumSHA256 sent with uploads
+	Checksum string `yaml:"checksum"`
+	// ConfirmTimeout enables to wait for metadata writes to be observable
+	ConfirmTimeout time.Duration `yaml:"confirm_timeout"`
+	// MetaBatchWindow uploads metadata of directory operations in background
+	// after it, coalescing uploads of the same object. MetaBatchConcurrency
+	// is number of them in flight.
+	MetaBatchWindow      time.Duration `yaml:"meta_batch_window"`
+	MetaBatchConcurrency int           `yaml:"meta_batch_concurrency"`
+	// FaultInjection injects failures into backend requests for resilience
+	// testing. It's refused unless FaultInjectionEnv is set too.
+	FaultInjection *FaultConfig `yaml:"fault_injection"`
+	// ChunkSize splits extents into chunks, so that small write re-uploads one
+	ChunkSize int64 `yaml:"chunk_size"`
+	// BodyPool reuses extent bodies of dropped extents, to reduce GC pressure
+	// of sustained throughput
+	BodyPool bool `yaml:"body_pool"`
+	// EventWebhook receives events of mutations by POST of JSON. EventTypes
+	// are ops of events published, all if empty. EventQueue is number of
+	// events waiting for the webhook, more are dropped.
+	EventWebhook string   `yaml:"event_webhook"`
+	EventTypes   []string `yaml:"event_types"`
+	EventQueue   int      `yaml:"event_queue"`
+	// KeyShardLevels places data objects under prefixes of 2 hex chars of
+	// their keys per level, e.g. "ab/cd/abcd..." by 2, to spread them across
+	// S3 partitions. It applies to a new root, existing ones keep their layout.
+	KeyShardLevels int `yaml:"key_shard_levels"`
+	// PrefetchFiles is number of files prefetched ahead, when files of a
+	// directory are opened in order of their names. PrefetchBuffer is number
+	// of prefetched objects kept apart from the cache until used.
+	PrefetchFiles  int `yaml:"prefetch_files"`
+	PrefetchBuffer int `yaml:"prefetch_buffer"`
+	// WriteAmplification switches a file to chunks of GuardChunkSize, if a
+	// save uploads more than this times of bytes written
+	WriteAmplification float64 `yaml:"write_amplification"`
+	GuardChunkSize     int64   `yaml:"guard_chunk_size"`
+	// MissingExtent is MissingExtentFail, MissingExtentZero or MissingExtentSkip
+	MissingExtent string `yaml:"missing_extent"`
+	// DecryptFailure is DecryptFailureFail or DecryptFailureNoData
+	DecryptFailure string `yaml:"decrypt_failure"`
+	// DedupSalt isolates deduplication scope of tenants sharing a bucket
+	DedupSalt string `yaml:"dedup_salt"`
+	// PrivateLayout seals metadata objects by encryption and pads them and
+	// compressed extents to fixed sizes, so that the bucket doesn't tell
+	// sizes of files. Encryption is required.
+	PrivateLayout bool `yaml:"private_layout"`
+	// Limits of a file, writes beyond them fail with EFBIG
+	MaxFileSize int64 `yaml:"max_file_size"`
+	MaxExtents  int   `yaml:"max_extents"`
+	// MaxOpenFiles is number of files kept in memory. Beyond it, least
+	// recently used ones without open handles are saved and dropped
+	MaxOpenFiles int `yaml:"max_open_files"`
+	// StorageLimit is total size of files, writes beyond it fail with ENOSPC
+	StorageLimit int64 `yaml:"storage_limit"`
+	// WalkConcurrency is number of objects loaded at once by tree walks
+	WalkConcurrency int `yaml:"walk_concurrency"`
+	// TimeSource is TimeLocal or TimeServer
+	TimeSource string `yaml:"time_source"`
+	// TimeClamp enables to clamp loaded timestamps further in the future
+	TimeClamp time.Duration `yaml:"time_clamp"`
+	// SymlinkMode is SymlinkKernel or SymlinkInternal
+	SymlinkMode string `yaml:"symlink_mode"`
+	// ExpirySweep is interval to delete expired files in background, they're
+	// deleted on access otherwise
+	ExpirySweep time.Duration `yaml:"expiry_sweep"`
+	// CompactSweep is interval to compact files of small extents or chunks
+	// in background
+	CompactSweep time.Duration `yaml:"compact_sweep"`
+	// Durability is the level of handles, flush-on-close if empty, unless the
+	// file's xattr or the first of DurabilityRules matching its path tells.
+	// FlushInterval of the background flusher is 5s if 0.
+	Durability      string           `yaml:"durability"`
+	DurabilityRules []DurabilityRule `yaml:"durability_rules"`
+	FlushInterval   time.Duration    `yaml:"flush_interval"`
+	// HealthAddr serves /livez and /readyz. Readiness probes the backend
+	// within HealthTimeout, liveness fails if an operation runs longer than
+	// StuckTimeout.
+	HealthAddr    string        `yaml:"health_addr"`
+	HealthTimeout time.Duration `yaml:"health_timeout"`
+	StuckTimeout  time.Duration `yaml:"stuck_timeout"`
+	// UIDMap and GIDMap map ids stored in the bucket to ids of the host.
+	// SquashUID, SquashGID and default owners of directories are stored ids.
+	UIDMap []IDRange `yaml:"uid_map"`
+	GIDMap []IDRange `yaml:"gid_map"`
+	// RecursiveRmdir enables rmdir of non-empty directory, leaving the
+	// subtree orphaned in the bucket
+	RecursiveRmdir bool `yaml:"recursive_rmdir"`
+	// MountLock makes mounts of the same root exclusive by a lock object
+	MountLock bool          `yaml:"mount_lock"`
+	LockTTL   time.Duration `yaml:"lock_ttl"`
+	// SquashOwner maps owner of all created objects to SquashUID/SquashGID
+	SquashOwner bool   `yaml:"squash_owner"`
+	SquashUID   uint32 `yaml:"squash_uid"`
+	SquashGID   uint32 `yaml:"squash_gid"`
+	// Unsupported maps operation class to PolicyStrict or PolicyLenient
+	Unsupported map[string]string `yaml:"unsupported"`
+}
+
+// Policy for operations bucketsync doesn't implement.
+//
+//	class     strict              lenient
+//	xattr     ENOTSUP             get: ENODATA, set/remove: OK (dropped),
+//	                              list: bucketsync's own
+//	lock      ENOSYS              get: unlocked, set: OK (not enforced)
+//	allocate  EOPNOTSUPP          OK (no preallocation)
+const (
+	PolicyStrict  = "strict"
+	PolicyLenient = "lenient"
+)
+
+// Operation classes for Unsupported
+const (
+	OpXAttr    = "xattr"
+	OpLock     = "lock"
+	OpAllocate = "allocate"
+)
+
+var defaultUnsupported = map[string]string{
+	OpXAttr:    PolicyStrict,
+	OpLock:     PolicyStrict,
+	OpAllocate: PolicyLenient,
+}
+
+func (c *Config) lenient(class string) bool {
+	policy, ok := c.Unsupported[class]
+	if !ok {
+		policy = defaultUnsupported[class]
+	}
+	return policy == PolicyLenient
+}
+
+// Read behavior when extent object is missing
+const (
+	MissingExtentFail = "fail" // EIO, default
+	MissingExtentZero = "zero" // read zeros for the extent
+	MissingExtentSkip = "skip" // short read ending at the extent
+)
+
+// Behavior when metadata fails decryption
+const (
+	DecryptFailureFail   = "fail"    // EIO, default
+	DecryptFailureNoData = "enodata" // ENODATA, the node reads as unavailable
+)
+
+// Symlink resolution by Session.Resolve
+const (
+	SymlinkKernel   = "kernel"   // never follow, the kernel resolves them, default
+	SymlinkInternal = "internal" // follow symlinks inside the filesystem
+)
+
+// Default limits of a file, the extent map is serialized in one object.
+const (
+	defaultMaxFileSize = 1 << 40
+	defaultMaxExtents  = 1 << 20
+)
+
+// Default kernel cache timeouts, same as go-fuse
+const (
+	defaultAttrTimeout  = time.Second
+	defaultEntryTimeout = time.Second
+)
+
+// pathStyle returns true if path-style addressing is used. Gateways other
+// than AWS mostly don't support virtual-hosted style.
+func (c *Config) pathStyle() bool {
+	if c.PathStyle != nil {
+		return *c.PathStyle
+	}
+	if c.Endpoint == "" {
+		return false
+	}
+	u, err := url.Parse(c.Endpoint)
+	if err != nil {
+		return true
+	}
+	return !strings.HasSuffix(u.Hostname(), ".amazonaws.com")
+}
+
+func (c *Config) attrTimeout() time.Duration {
+	if c.AttrTimeout == 0 {
+		return defaultAttrTimeout
+	}
+	return c.AttrTimeout
+}
+
+func (c *Config) entryTimeout() time.Duration {
+	if c.EntryTimeout == 0 {
+		return defaultEntryTimeout
+	}
+	return c.EntryTimeout
+}
+
+// readOnly returns true if the mount must not modify the bucket.
+func (c *Config) readOnly() bool {
+	return c.RootVersion != ""
+}
+
+// chunkSize returns ChunkSize if it splits an extent, otherwise 0.
+func (c *Config) chunkSize() int64 {
+	if c.ChunkSize <= 0 || c.ChunkSize >= c.ExtentSize {
+		return 0
+	}
+	return c.ChunkSize
+}
+
+// guardChunkSize returns chunk size for files of write amplification,
+// 1/16 of extentSize by default.
+func (c *Config) guardChunkSize(extentSize int64) int64 {
+	size := c.GuardChunkSize
+	if size <= 0 || size >= extentSize {
+		size = extentSize / 16
+	}
+	if size <= 0 {
+		size = 1
+	}
+	return size
+}
+
+// maxFileSize returns maximum size of a file with extentSize.
+func (c *Config) maxFileSize(extentSize int64) int64 {
+	size := c.MaxFileSize
+	if size <= 0 {
+		size = defaultMaxFileSize
+	}
+	extents := int64(c.MaxExtents)
+	if extents <= 0 {
+		extents = defaultMaxExtents
+	}
+	if size > extents*extentSize {
+		size = extents * extentSize
+	}
+	return size
+}
+
+// ProfileInteractive is Profile for desktop use, operations fail in a few
+// seconds instead of freezing applications.
+const ProfileInteractive = "interactive"
+
+// Settings of ProfileInteractive
+const (
+	interactiveBudget  = 3 * time.Second
+	interactiveRequest = time.Second
+	interactiveRetries = 1
+	interactiveHealth  = time.Second
+	interactiveStuck   = 10 * time.Second
+)
+
+// withProfile returns config with settings of Profile which are not given.
+func (c *Config) withProfile() *Config {
+	if c.Profile != ProfileInteractive {
+		return c
+	}
+	p := *c
+	if p.OperationBudget == 0 {
+		p.OperationBudget = interactiveBudget
+	}
+	if p.RequestTimeout == 0 {
+		p.RequestTimeout = interactiveRequest
+	}
+	if p.MaxRetries == nil {
+		retries := interactiveRetries
+		p.MaxRetries = &retries
+	}
+	if p.HealthTimeout == 0 {
+		p.HealthTimeout = interactiveHealth
+	}
+	if p.StuckTimeout == 0 {
+		p.StuckTimeout = interactiveStuck
+	}
+	return &p
 }
 
 func (c *Config) validate() bool {
-	// TODO
+	switch c.SymlinkMode {
+	case "", SymlinkKernel, SymlinkInternal:
+	default:
+		return false
+	}
+	switch c.MissingExtent {
+	case "", MissingExtentFail, MissingExtentZero, MissingExtentSkip:
+	default:
+		return false
+	}
+	switch c.DecryptFailure {
+	case "", DecryptFailureFail, DecryptFailureNoData:
+	default:
+		return false
+	}
+	switch c.Checksum {
+	case "", ChecksumCRC32C, ChecksumSHA256:
+	default:
+		return false
+	}
+	switch c.TimeSource {
+	case "", TimeLocal, TimeServer:
+	default:
+		return false
+	}
+	if !idMap(c.UIDMap).valid() || !idMap(c.GIDMap).valid() {
+		return false
+	}
+	if c.DryRunErrno < 0 {
+		return false
+	}
+	for _, op := range c.EventTypes {
+		switch op {
+		case EventCreate, EventModify, EventUnlink, EventRename, EventMkdir, EventRmdir, EventTruncate, EventSymlink:
+		default:
+			return false
+		}
+	}
+	switch c.Profile {
+	case "", ProfileInteractive:
+	default:
+		return false
+	}
+	if c.RequestTimeout < 0 || (c.MaxRetries != nil && *c.MaxRetries < 0) {
+		return false
+	}
+	if c.KeyShardLevels < 0 || c.KeyShardLevels > maxShardLevels {
+		return false
+	}
+	if c.PrefetchFiles < 0 || c.PrefetchBuffer < 0 {
+		return false
+	}
+	if c.WriteAmplification < 0 {
+		return false
+	}
+	if c.LowerPopulate && c.LowerDir == "" {
+		return false
+	}
+	if c.PrivateLayout && !c.Encryption {
+		return false
+	}
+	if c.CompactSweep < 0 {
+		return false
+	}
+	if (c.Durability != "" && !validDurability(c.Durability)) || c.FlushInterval < 0 {
+		return false
+	}
+	for _, rule := range c.DurabilityRules {
+		if _, err := filepath.Match(rule.Pattern, ""); err != nil || !validDurability(rule.Level) {
+			return false
+		}
+	}
+	if c.FaultInjection != nil && !c.FaultInjection.validate() {
+		return false
+	}
+	if c.MetaBatchWindow < 0 || c.MetaBatchConcurrency < 0 {
+		return false
+	}
+	if c.AttrTimeout < 0 || c.EntryTimeout < 0 || c.NegativeTimeout < 0 {
+		return false
+	}
+	for _, policy := range c.Unsupported {
+		if policy != PolicyStrict && policy != PolicyLenient {
+			return false
+		}
+	}
 	return true
 }
@@ -0,0 +1,173 @@
+package bucketsync
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"go.uber.org/zap"
+)
+
+// Extended attribute names to set defaults of a directory, inherited by
+// entries created in it like POSIX default ACLs. "" removes it.
+const (
+	// DefaultModeXAttr is octal permission bits, e.g. "0750"
+	DefaultModeXAttr = "user.bucketsync.default_mode"
+	// DefaultOwnerXAttr is "uid:gid", either can be empty, e.g. ":100"
+	DefaultOwnerXAttr = "user.bucketsync.default_owner"
+)
+
+// Defaults are applied to entries created in a directory, and inherited by
+// its subdirectories. Nil fields are not applied.
+type Defaults struct {
+	Mode *uint32 `json:"mode,omitempty"` // permission bits masked with requested mode
+	UID  *uint32 `json:"uid,omitempty"`
+	GID  *uint32 `json:"gid,omitempty"`
+}
+
+func (d *Defaults) empty() bool {
+	return d == nil || (d.Mode == nil && d.UID == nil && d.GID == nil)
+}
+
+func (d *Defaults) equal(other *Defaults) bool {
+	same := func(a, b *uint32) bool { return a == b || (a != nil && b != nil && *a == *b) }
+	if d.empty() || other.empty() {
+		return d.empty() == other.empty()
+	}
+	return same(d.Mode, other.Mode) && same(d.UID, other.UID) && same(d.GID, other.GID)
+}
+
+// inherit applies TTL and defaults of the directory to meta of a new entry.
+// The requested mode has umask applied by the kernel already, so default
+// mode only masks it, as a default ACL does.
+func (o *Directory) inherit(meta *Meta) {
+	meta.TTL = o.Meta.TTL
+	meta.Durability = o.Meta.Durability
+	o.inheritACL(meta)
+	d := o.Defaults
+	if d.empty() {
+		return
+	}
+	if d.Mode != nil && meta.Mode&syscall.S_IFMT != syscall.S_IFLNK {
+		meta.Mode &^= 07777 &^ *d.Mode
+	}
+	if d.UID != nil {
+		meta.UID = *d.UID
+	}
+	if d.GID != nil {
+		meta.GID = *d.GID
+	}
+}
+
+// getDefaults returns value of default xattr of the directory at name.
+func (f *FileSystem) getDefaults(name, attr string) ([]byte, fuse.Status) {
+	ctx, cancel := f.Sess.opContext()
+	defer cancel()
+	dir, status := f.getDirectory(ctx, name)
+	if status != fuse.OK {
+		return nil, status
+	}
+	d := dir.Defaults
+	if d == nil {
+		d = &Defaults{}
+	}
+	switch {
+	case attr == DefaultModeXAttr && d.Mode != nil:
+		return []byte(fmt.Sprintf("%04o", *d.Mode)), fuse.OK
+	case attr == DefaultOwnerXAttr && (d.UID != nil || d.GID != nil):
+		return []byte(formatID(d.UID) + ":" + formatID(d.GID)), fuse.OK
+	}
+	return nil, fuse.ENOATTR
+}
+
+// setDefaults updates default xattr of the directory at name.
+func (f *FileSystem) setDefaults(name, attr string, data []byte) fuse.Status {
+	value := strings.TrimSpace(string(data))
+	d := &Defaults{}
+	var err error
+	switch attr {
+	case DefaultModeXAttr:
+		if value != "" {
+			mode, err := strconv.ParseUint(value, 8, 32)
+			if err != nil || mode&^07777 != 0 {
+				return fuse.EINVAL
+			}
+			m := uint32(mode)
+			d.Mode = &m
+		}
+	case DefaultOwnerXAttr:
+		if value != "" {
+			ids := strings.SplitN(value, ":", 2)
+			if len(ids) != 2 {
+				return fuse.EINVAL
+			}
+			if d.UID, err = parseID(ids[0]); err != nil {
+				return fuse.EINVAL
+			}
+			if d.GID, err = parseID(ids[1]); err != nil {
+				return fuse.EINVAL
+			}
+		}
+	}
+	return f.updateNode(name, func(node interface{}, meta *Meta) fuse.Status {
+		dir, ok := node.(*Directory)
+		if !ok {
+			return fuse.ENOTDIR
+		}
+		merged := &Defaults{}
+		if dir.Defaults != nil {
+			*merged = *dir.Defaults
+		}
+		if attr == DefaultModeXAttr {
+			merged.Mode = d.Mode
+		} else {
+			merged.UID, merged.GID = d.UID, d.GID
+		}
+		if merged.empty() {
+			merged = nil
+		}
+		dir.Defaults = merged
+		return fuse.OK
+	})
+}
+
+// getDirectory returns directory at name
+func (f *FileSystem) getDirectory(ctx context.Context, name string) (*Directory, fuse.Status) {
+	key, err := f.Sess.PathWalk(ctx, name)
+	if err != nil {
+		f.logger.Debug("fuse error", zap.Error(err))
+		return nil, f.lookupStatus(ctx, err)
+	}
+	node, err := f.Sess.NewTypedNode(ctx, key)
+	if err != nil {
+		f.logger.Debug("fuse error", zap.Error(err))
+		return nil, f.lookupStatus(ctx, err)
+	}
+	dir, ok := node.(*Directory)
+	if !ok {
+		return nil, fuse.ENOTDIR
+	}
+	return dir, fuse.OK
+}
+
+func formatID(id *uint32) string {
+	if id == nil {
+		return ""
+	}
+	return strconv.FormatUint(uint64(*id), 10)
+}
+
+func parseID(s string) (*uint32, error) {
+	if s == "" {
+		return nil, nil
+	}
+	id, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	v := uint32(id)
+	return &v, nil
+}
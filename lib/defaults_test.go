@@ -0,0 +1,74 @@
+package bucketsync
+
+import (
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// TestDirectoryDefaults sets default mode and owner of a directory. Files
+// and subdirectories created under it inherit them.
+func TestDirectoryDefaults(t *testing.T) {
+	fs, fake := newTestFS(t, nil, nil)
+	if st := fs.Mkdir("shared", 0777, testContext); st != fuse.OK {
+		t.Fatal(st)
+	}
+	for attr, value := range map[string]string{DefaultModeXAttr: "0750", DefaultOwnerXAttr: ":100"} {
+		if st := fs.SetXAttr("shared", attr, []byte(value), 0, testContext); st != fuse.OK {
+			t.Fatal(st)
+		}
+		if got, st := fs.GetXAttr("shared", attr, testContext); st != fuse.OK || string(got) != value {
+			t.Fatalf("%s = %q %v", attr, got, st)
+		}
+	}
+	for _, value := range []string{"0750x", "010000"} {
+		if st := fs.SetXAttr("shared", DefaultModeXAttr, []byte(value), 0, testContext); st != fuse.EINVAL {
+			t.Fatalf("mode %q: %v", value, st)
+		}
+	}
+	if st := fs.SetXAttr("shared", DefaultOwnerXAttr, []byte("100"), 0, testContext); st != fuse.EINVAL {
+		t.Fatalf("owner without gid: %v", st)
+	}
+	if st := fs.Mkdir("shared/sub", 0777, testContext); st != fuse.OK {
+		t.Fatal(st)
+	}
+	writeFile(t, fs, "shared/f", []byte("f"))
+	writeFile(t, fs, "shared/sub/g", []byte("g"))
+	if st := fs.Symlink("f", "shared/link", testContext); st != fuse.OK {
+		t.Fatal(st)
+	}
+	writeFile(t, fs, "plain", []byte("p"))
+
+	reader, _ := newTestFS(t, fake, nil)
+	for name, want := range map[string]fuse.Attr{
+		"shared/sub":   {Mode: fuse.S_IFDIR | 0750, Owner: fuse.Owner{Uid: 1, Gid: 100}},
+		"shared/f":     {Mode: fuse.S_IFREG | 0640, Owner: fuse.Owner{Uid: 1, Gid: 100}},
+		"shared/sub/g": {Mode: fuse.S_IFREG | 0640, Owner: fuse.Owner{Uid: 1, Gid: 100}},
+		"shared/link":  {Mode: fuse.S_IFLNK, Owner: fuse.Owner{Uid: 1, Gid: 100}},
+		"plain":        {Mode: fuse.S_IFREG | 0644, Owner: fuse.Owner{Uid: 1, Gid: 2}},
+	} {
+		attr, st := reader.GetAttr(name, testContext)
+		if st != fuse.OK {
+			t.Fatal(name, st)
+		}
+		if attr.Mode != want.Mode || attr.Owner != want.Owner {
+			t.Fatalf("%s: mode %o owner %v, want %o %v", name, attr.Mode, attr.Owner, want.Mode, want.Owner)
+		}
+	}
+	if got, st := reader.GetXAttr("shared/sub", DefaultModeXAttr, testContext); st != fuse.OK || string(got) != "0750" {
+		t.Fatalf("subdirectory default mode %q %v", got, st)
+	}
+
+	for _, attr := range []string{DefaultModeXAttr, DefaultOwnerXAttr} {
+		if st := fs.RemoveXAttr("shared", attr, testContext); st != fuse.OK {
+			t.Fatal(st)
+		}
+		if _, st := fs.GetXAttr("shared", attr, testContext); st != fuse.ENOATTR {
+			t.Fatalf("removed %s: %v", attr, st)
+		}
+	}
+	writeFile(t, fs, "shared/h", []byte("h"))
+	if attr, _ := fs.GetAttr("shared/h", testContext); attr.Mode != fuse.S_IFREG|0644 || attr.Gid != 2 {
+		t.Fatalf("after removal: mode %o gid %d", attr.Mode, attr.Gid)
+	}
+}
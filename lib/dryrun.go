@@ -0,0 +1,167 @@
+package bucketsync
+
+import (
+	"fmt"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+)
+
+// DryRun returns true if uploads are logged instead of executed.
+func (s *Session) DryRun() bool {
+	return s.config.DryRun
+}
+
+// wrapFileSystem restricts mutating operations of fs by config, publishes
+// events of succeeded ones, and records them to audit log including denied
+// ones.
+func wrapFileSystem(sess *Session, fs pathfs.FileSystem) pathfs.FileSystem {
+	config := sess.config
+	switch {
+	case config.readOnly():
+		fs = pathfs.NewReadonlyFileSystem(fs)
+	case config.DryRun && config.DryRunErrno != 0:
+		fs = &denyFileSystem{FileSystem: fs, status: fuse.Status(config.DryRunErrno)}
+	default:
+		// Read-only once the mount lock is lost
+		fs = &denyFileSystem{FileSystem: fs, status: fuse.EROFS, denied: sess.s3.isReadOnly}
+	}
+	fs = &eventFileSystem{FileSystem: fs, events: sess.events}
+	if sess.audit != nil {
+		fs = &auditFileSystem{FileSystem: fs, log: sess.audit}
+	}
+	return fs
+}
+
+// denyFileSystem fails mutating operations with status while denied returns
+// true, always if it's nil, like pathfs.NewReadonlyFileSystem with
+// configurable errno.
+type denyFileSystem struct {
+	pathfs.FileSystem
+	status fuse.Status
+	denied func() bool
+}
+
+func (fs *denyFileSystem) deny() bool {
+	return fs.denied == nil || fs.denied()
+}
+
+func (fs *denyFileSystem) Mknod(name string, mode uint32, dev uint32, context *fuse.Context) fuse.Status {
+	if fs.deny() {
+		return fs.status
+	}
+	return fs.FileSystem.Mknod(name, mode, dev, context)
+}
+
+func (fs *denyFileSystem) Mkdir(name string, mode uint32, context *fuse.Context) fuse.Status {
+	if fs.deny() {
+		return fs.status
+	}
+	return fs.FileSystem.Mkdir(name, mode, context)
+}
+
+func (fs *denyFileSystem) Unlink(name string, context *fuse.Context) fuse.Status {
+	if fs.deny() {
+		return fs.status
+	}
+	return fs.FileSystem.Unlink(name, context)
+}
+
+func (fs *denyFileSystem) Rmdir(name string, context *fuse.Context) fuse.Status {
+	if fs.deny() {
+		return fs.status
+	}
+	return fs.FileSystem.Rmdir(name, context)
+}
+
+func (fs *denyFileSystem) Symlink(value string, linkName string, context *fuse.Context) fuse.Status {
+	if fs.deny() {
+		return fs.status
+	}
+	return fs.FileSystem.Symlink(value, linkName, context)
+}
+
+func (fs *denyFileSystem) Rename(oldName string, newName string, context *fuse.Context) fuse.Status {
+	if fs.deny() {
+		return fs.status
+	}
+	return fs.FileSystem.Rename(oldName, newName, context)
+}
+
+func (fs *denyFileSystem) Link(oldName string, newName string, context *fuse.Context) fuse.Status {
+	if fs.deny() {
+		return fs.status
+	}
+	return fs.FileSystem.Link(oldName, newName, context)
+}
+
+func (fs *denyFileSystem) Chmod(name string, mode uint32, context *fuse.Context) fuse.Status {
+	if fs.deny() {
+		return fs.status
+	}
+	return fs.FileSystem.Chmod(name, mode, context)
+}
+
+func (fs *denyFileSystem) Chown(name string, uid uint32, gid uint32, context *fuse.Context) fuse.Status {
+	if fs.deny() {
+		return fs.status
+	}
+	return fs.FileSystem.Chown(name, uid, gid, context)
+}
+
+func (fs *denyFileSystem) Truncate(name string, offset uint64, context *fuse.Context) fuse.Status {
+	if fs.deny() {
+		return fs.status
+	}
+	return fs.FileSystem.Truncate(name, offset, context)
+}
+
+func (fs *denyFileSystem) Utimens(name string, atime *time.Time, mtime *time.Time, context *fuse.Context) fuse.Status {
+	if fs.deny() {
+		return fs.status
+	}
+	return fs.FileSystem.Utimens(name, atime, mtime, context)
+}
+
+func (fs *denyFileSystem) Open(name string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	if !fs.deny() {
+		return fs.FileSystem.Open(name, flags, context)
+	}
+	if flags&fuse.O_ANYWRITE != 0 || flags&syscall.O_TRUNC != 0 {
+		return nil, fs.status
+	}
+	file, status := fs.FileSystem.Open(name, flags, context)
+	if status != fuse.OK {
+		return nil, status
+	}
+	return nodefs.NewReadOnlyFile(file), status
+}
+
+func (fs *denyFileSystem) Create(name string, flags uint32, mode uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	if fs.deny() {
+		return nil, fs.status
+	}
+	return fs.FileSystem.Create(name, flags, mode, context)
+}
+
+// SetXAttr passes hints, which don't modify the bucket.
+func (fs *denyFileSystem) SetXAttr(name string, attr string, data []byte, flags int, context *fuse.Context) fuse.Status {
+	if attr == DontNeedXAttr || !fs.deny() {
+		return fs.FileSystem.SetXAttr(name, attr, data, flags, context)
+	}
+	return fs.status
+}
+
+func (fs *denyFileSystem) RemoveXAttr(name string, attr string, context *fuse.Context) fuse.Status {
+	if fs.deny() {
+		return fs.status
+	}
+	return fs.FileSystem.RemoveXAttr(name, attr, context)
+}
+
+func (fs *denyFileSystem) String() string {
+	return fmt.Sprintf("denyFileSystem(%v)", fs.FileSystem)
+}
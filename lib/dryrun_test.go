@@ -0,0 +1,88 @@
+package bucketsync
+
+import (
+	"bytes"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// TestDryRun writes, creates and renames by a dry run session. They succeed,
+// nothing is uploaded, and existing content is read.
+func TestDryRun(t *testing.T) {
+	plain, fake := newTestFS(t, nil, nil)
+	data := testContent()
+	writeFile(t, plain, "existing", data)
+	before := map[string][]byte{}
+	for _, name := range fake.names("") {
+		before[name], _ = fake.get(name)
+	}
+
+	fs, _ := newTestFS(t, fake, func(c *Config) { c.DryRun = true })
+	var puts []string
+	fake.fail = func(op, name string) error {
+		if op == "PutObject" {
+			puts = append(puts, name)
+		}
+		return nil
+	}
+	if got := readFile(t, fs, "existing"); !bytes.Equal(got, data) {
+		t.Fatalf("existing = %q", got)
+	}
+	if st := fs.Mkdir("d", 0755, testContext); st != fuse.OK {
+		t.Fatal(st)
+	}
+	writeFile(t, fs, "d/new", []byte("new"))
+	f, st := fs.Open("existing", syscall.O_RDWR, testContext)
+	if st != fuse.OK {
+		t.Fatal(st)
+	}
+	if _, st := f.Write([]byte("overwritten"), 0); st != fuse.OK {
+		t.Fatal(st)
+	}
+	if st := f.Flush(); st != fuse.OK {
+		t.Fatal(st)
+	}
+	f.Release()
+	if st := fs.Rename("d/new", "renamed", testContext); st != fuse.OK {
+		t.Fatal(st)
+	}
+	fake.fail = nil
+	if len(puts) != 0 {
+		t.Fatalf("dry run uploaded %v", puts)
+	}
+	if len(fake.names("")) != len(before) {
+		t.Fatalf("objects %v", fake.names(""))
+	}
+	for name, body := range before {
+		if got, _ := fake.get(name); !bytes.Equal(got, body) {
+			t.Fatalf("%s is modified", name)
+		}
+	}
+
+	reader, _ := newTestFS(t, fake, nil)
+	if got := readFile(t, reader, "existing"); !bytes.Equal(got, data) {
+		t.Fatalf("after dry run = %q", got)
+	}
+	if _, st := reader.GetAttr("d", testContext); st != fuse.ENOENT {
+		t.Fatalf("dry run directory: %v", st)
+	}
+}
+
+func TestDryRunErrno(t *testing.T) {
+	sess, fake := newTestSession(t, nil, func(c *Config) {
+		c.DryRun = true
+		c.DryRunErrno = int(syscall.EROFS)
+	})
+	fs := wrapFileSystem(sess, &FileSystem{Sess: sess, logger: sess.logger})
+	if _, st := fs.Create("f", 0, 0644, testContext); st != fuse.EROFS {
+		t.Fatalf("create: %v", st)
+	}
+	if st := fs.Mkdir("d", 0755, testContext); st != fuse.EROFS {
+		t.Fatalf("mkdir: %v", st)
+	}
+	if n := fake.totalPuts(""); n != 0 {
+		t.Fatalf("%d puts", n)
+	}
+}
@@ -0,0 +1,234 @@
+package bucketsync
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"go.uber.org/zap"
+)
+
+// Durability levels decide when writes of a handle are saved. Fsync saves
+// at any level.
+const (
+	// DurabilityAsync saves by the background flusher only, writes of the
+	// last flush_interval may be lost
+	DurabilityAsync = "async"
+	// DurabilityFlushOnClose saves at close, the default
+	DurabilityFlushOnClose = "flush-on-close"
+	// DurabilitySyncEveryWrite saves each write before it returns
+	DurabilitySyncEveryWrite = "sync-every-write"
+)
+
+// DurabilityXAttr is durability level of the file, or default of new files
+// of the directory. "" removes it.
+const DurabilityXAttr = "user.bucketsync.durability"
+
+// defaultFlushInterval is interval of the background flusher
+const defaultFlushInterval = 5 * time.Second
+
+// DurabilityRule applies Level to files matching Pattern of filepath.Match.
+// A pattern without "/" matches the base name, otherwise the path in the
+// mount.
+type DurabilityRule struct {
+	Pattern string `yaml:"pattern"`
+	Level   string `yaml:"level"`
+}
+
+func validDurability(level string) bool {
+	switch level {
+	case DurabilityAsync, DurabilityFlushOnClose, DurabilitySyncEveryWrite:
+		return true
+	}
+	return false
+}
+
+func (r *DurabilityRule) match(name string) bool {
+	target := name
+	if !strings.Contains(r.Pattern, "/") {
+		target = filepath.Base(name)
+	}
+	ok, _ := filepath.Match(r.Pattern, target)
+	return ok
+}
+
+func (c *Config) flushInterval() time.Duration {
+	if c.FlushInterval > 0 {
+		return c.FlushInterval
+	}
+	return defaultFlushInterval
+}
+
+// durability returns level of file opened at name: of its xattr, the first
+// rule matching, or the config.
+func (s *Session) durability(name string, file *File) string {
+	file.lock.Lock()
+	level := file.Meta.Durability
+	file.lock.Unlock()
+	if level != "" {
+		return level
+	}
+	for _, rule := range s.config.DurabilityRules {
+		if rule.match(name) {
+			return rule.Level
+		}
+	}
+	if s.config.Durability != "" {
+		return s.config.Durability
+	}
+	return DurabilityFlushOnClose
+}
+
+// openLevel sets level of handle opened. Async ones are counted on the file
+// to be saved by the flusher, which starts at the first one.
+func (s *Session) openLevel(opened *OpenedFile, level string) {
+	opened.durability = level
+	if level != DurabilityAsync {
+		return
+	}
+	s.openLock.Lock()
+	if o, ok := s.openFiles[opened.file.Key]; ok && o.file == opened.file {
+		o.async++
+	}
+	s.openLock.Unlock()
+	if s.flushStop != nil {
+		s.flushOnce.Do(func() { go s.flusher(s.config.flushInterval(), s.flushStop) })
+	}
+}
+
+// closeAsync removes an async handle counted by openLevel.
+func (s *Session) closeAsync(file *File) {
+	s.openLock.Lock()
+	defer s.openLock.Unlock()
+	if o, ok := s.openFiles[file.Key]; ok && o.file == file && o.async > 0 {
+		o.async--
+	}
+}
+
+// lingerFile keeps modified file open after its async handle is closed, until
+// the flusher saves it. It returns false if it's not modified.
+func (s *Session) lingerFile(file *File) bool {
+	file.lock.Lock()
+	dirty := file.dirty
+	file.lock.Unlock()
+	if !dirty {
+		return false
+	}
+	s.openLock.Lock()
+	defer s.openLock.Unlock()
+	o, ok := s.openFiles[file.Key]
+	if !ok || o.file != file {
+		return false
+	}
+	if !o.lingering {
+		o.lingering = true
+		o.handles++
+	}
+	return true
+}
+
+// flushFiles saves modified files of async handles and lingering ones, and
+// closes lingering ones saved. Other levels save by their handles. If force
+// is true, for unmount, all modified open files are saved, and lingering
+// ones are closed even if save fails.
+func (s *Session) flushFiles(ctx context.Context, force bool) int {
+	if s.s3.isReadOnly() && !force {
+		return 0 // saves fail until unmount
+	}
+	s.openLock.Lock()
+	files := make([]*openFile, 0, len(s.openFiles))
+	for _, o := range s.openFiles {
+		if force || o.async > 0 || o.lingering {
+			files = append(files, o)
+		}
+	}
+	s.openLock.Unlock()
+
+	saved := 0
+	for _, o := range files {
+		file := o.file
+		var err error
+		if !s.isUnlinked(file) {
+			file.lock.Lock()
+			if file.dirty {
+				err = file.Save(ctx)
+				if err == nil {
+					err = s.s3.WaitBatched(ctx, file.Key)
+				}
+				if err == nil {
+					saved++
+				}
+			}
+			file.lock.Unlock()
+		}
+		if err != nil {
+			s.logger.Error("Save by flusher failed", zap.String("key", file.Key), zap.Error(err))
+			if !force {
+				continue
+			}
+		}
+		s.openLock.Lock()
+		lingering := o.lingering
+		o.lingering = false
+		s.openLock.Unlock()
+		if lingering {
+			s.closeFile(file)
+		}
+	}
+	return saved
+}
+
+// flusher runs flushFiles periodically until stop is closed.
+func (s *Session) flusher(interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		saved := s.flushFiles(ctx, false)
+		cancel()
+		if saved != 0 {
+			s.logger.Debug("flusher", zap.Int("saved", saved))
+		}
+	}
+}
+
+// getDurability returns durability xattr of the node at name.
+func (f *FileSystem) getDurability(name string) ([]byte, fuse.Status) {
+	ctx, cancel := f.Sess.opContext()
+	defer cancel()
+	key, err := f.Sess.PathWalk(ctx, name)
+	if err != nil {
+		return nil, f.lookupStatus(ctx, err)
+	}
+	meta, err := f.Sess.currentMeta(ctx, key)
+	if err != nil {
+		return nil, f.lookupStatus(ctx, err)
+	}
+	if meta.Durability == "" {
+		return nil, fuse.ENOATTR
+	}
+	return []byte(meta.Durability), fuse.OK
+}
+
+// setDurability sets durability xattr of the node at name. Handles opened
+// already keep their level.
+func (f *FileSystem) setDurability(name string, data []byte) fuse.Status {
+	level := strings.TrimSpace(string(data))
+	if level != "" && !validDurability(level) {
+		return fuse.EINVAL
+	}
+	return f.updateNode(name, func(node interface{}, meta *Meta) fuse.Status {
+		if _, ok := node.(*SymLink); ok {
+			return fuse.EINVAL
+		}
+		meta.Durability = level
+		return fuse.OK
+	})
+}
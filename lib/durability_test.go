@@ -0,0 +1,207 @@
+package bucketsync
+
+import (
+	"context"
+	"fmt"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// TestDurabilityLevels writes a file at each level, chosen by config, rule,
+// or xattr of the file or its directory, and counts data uploads after
+// Write, Flush, Release and the flusher.
+func TestDurabilityLevels(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		path  string
+		mod   func(c *Config)
+		xattr string // set on file, or on d for paths under it
+		level string
+	}{
+		{"default", "f", nil, "", DurabilityFlushOnClose},
+		{"config", "f", func(c *Config) { c.Durability = DurabilityAsync }, "", DurabilityAsync},
+		{"rule", "f.tmp", func(c *Config) {
+			c.Durability = DurabilitySyncEveryWrite
+			c.DurabilityRules = []DurabilityRule{{Pattern: "*.tmp", Level: DurabilityAsync}}
+		}, "", DurabilityAsync},
+		{"file xattr", "f", nil, DurabilitySyncEveryWrite, DurabilitySyncEveryWrite},
+		{"dir xattr", "d/f", nil, DurabilityAsync, DurabilityAsync},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fs, fake := newTestFS(t, nil, func(c *Config) {
+				c.DataPrefix = "data/"
+				c.FlushInterval = time.Hour
+				if tc.mod != nil {
+					tc.mod(c)
+				}
+			})
+			if st := fs.Mkdir("d", 0755, testContext); st != fuse.OK {
+				t.Fatal(st)
+			}
+			target := tc.path
+			if tc.path == "d/f" {
+				target = "d"
+			}
+			if target == tc.path {
+				writeFile(t, fs, tc.path, []byte("initial"))
+			}
+			if tc.xattr != "" {
+				if st := fs.SetXAttr(target, DurabilityXAttr, []byte(tc.xattr), 0, testContext); st != fuse.OK {
+					t.Fatal(st)
+				}
+			}
+			if target != tc.path {
+				writeFile(t, fs, tc.path, []byte("initial"))
+			}
+
+			f, st := fs.Open(tc.path, syscall.O_RDWR, testContext)
+			if st != fuse.OK {
+				t.Fatal(st)
+			}
+			puts := func() int { return fake.totalPuts(fs.Sess.dataPrefix()) }
+			before := puts()
+			for i := 0; i < 3; i++ {
+				if _, st := f.Write([]byte(fmt.Sprintf("write %d", i)), int64(i*16)); st != fuse.OK {
+					t.Fatal(st)
+				}
+				n := puts() - before
+				if tc.level == DurabilitySyncEveryWrite && n != i+1 {
+					t.Fatalf("%d puts after write %d", n, i)
+				}
+				if tc.level != DurabilitySyncEveryWrite && n != 0 {
+					t.Fatalf("%d puts after write %d", n, i)
+				}
+			}
+			written := puts()
+
+			if st := f.Flush(); st != fuse.OK {
+				t.Fatal(st)
+			}
+			flushed := puts() - written
+			if tc.level == DurabilityFlushOnClose && flushed == 0 {
+				t.Fatal("flush-on-close didn't save at flush")
+			}
+			if tc.level != DurabilityFlushOnClose && flushed != 0 {
+				t.Fatalf("%d puts at flush", flushed)
+			}
+			f.Release()
+			if tc.level != DurabilityAsync {
+				return
+			}
+
+			if puts() != written {
+				t.Fatal("async saved at release")
+			}
+			if fs.Sess.openedFile(fs.mustKey(t, tc.path)) == nil {
+				t.Fatal("modified async file isn't lingering")
+			}
+			if n := fs.Sess.flushFiles(context.Background(), false); n != 1 {
+				t.Fatalf("flusher saved %d files", n)
+			}
+			if fs.Sess.openedFile(fs.mustKey(t, tc.path)) != nil {
+				t.Fatal("saved file is still lingering")
+			}
+			reader, _ := newTestFS(t, fake, func(c *Config) { c.DataPrefix = "data/" })
+			pad := string(make([]byte, 9))
+			want := "write 0" + pad + "write 1" + pad + "write 2"
+			if got := readFile(t, reader, tc.path); string(got) != want {
+				t.Fatalf("flushed content %q", got)
+			}
+		})
+	}
+}
+
+func TestDurabilityXAttr(t *testing.T) {
+	fs, fake := newTestFS(t, nil, func(c *Config) {
+		c.DataPrefix = "data/"
+		c.Durability = DurabilityAsync
+		c.FlushInterval = time.Hour
+	})
+	writeFile(t, fs, "f", []byte("initial"))
+	if st := fs.SetXAttr("f", DurabilityXAttr, []byte("sometimes"), 0, testContext); st != fuse.EINVAL {
+		t.Fatalf("invalid level: %v", st)
+	}
+	if st := fs.SetXAttr("f", DurabilityXAttr, []byte(DurabilitySyncEveryWrite), 0, testContext); st != fuse.OK {
+		t.Fatal(st)
+	}
+	if got, st := fs.GetXAttr("f", DurabilityXAttr, testContext); st != fuse.OK || string(got) != DurabilitySyncEveryWrite {
+		t.Fatalf("xattr %q %v", got, st)
+	}
+	if st := fs.RemoveXAttr("f", DurabilityXAttr, testContext); st != fuse.OK {
+		t.Fatal(st)
+	}
+
+	// Async again, but fsync saves
+	f, st := fs.Open("f", syscall.O_RDWR, testContext)
+	if st != fuse.OK {
+		t.Fatal(st)
+	}
+	defer f.Release()
+	prefix := fs.Sess.dataPrefix()
+	puts := fake.totalPuts(prefix)
+	if _, st := f.Write([]byte("synced"), 0); st != fuse.OK {
+		t.Fatal(st)
+	}
+	if st := f.Flush(); st != fuse.OK || fake.totalPuts(prefix) != puts {
+		t.Fatalf("async saved at flush: %v", st)
+	}
+	if st := f.Fsync(0); st != fuse.OK {
+		t.Fatal(st)
+	}
+	if fake.totalPuts(prefix) == puts {
+		t.Fatal("fsync didn't save")
+	}
+	reader, _ := newTestFS(t, fake, func(c *Config) { c.DataPrefix = "data/" })
+	if got := readFile(t, reader, "f"); string(got) != "syncedl" {
+		t.Fatalf("fsynced content %q", got)
+	}
+}
+
+// TestFlusherSavesAsyncOnly keeps a flush-on-close handle modified across
+// flush intervals. The flusher doesn't save it, nor runs until an async
+// handle is opened, which it saves.
+func TestFlusherSavesAsyncOnly(t *testing.T) {
+	fake := newFakeS3()
+	fs := newTestMount(t, fake, func(c *Config) {
+		c.DataPrefix = "data/"
+		c.FlushInterval = 10 * time.Millisecond
+		c.DurabilityRules = []DurabilityRule{{Pattern: "*.tmp", Level: DurabilityAsync}}
+	})
+	writeFile(t, fs, "f", []byte("initial"))
+	prefix := fs.Sess.dataPrefix()
+	puts := fake.totalPuts(prefix)
+	f, st := fs.Open("f", syscall.O_RDWR, testContext)
+	if st != fuse.OK {
+		t.Fatal(st)
+	}
+	defer f.Release()
+	if _, st := f.Write([]byte("closing"), 0); st != fuse.OK {
+		t.Fatal(st)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if fake.totalPuts(prefix) != puts {
+		t.Fatal("flush-on-close handle is saved by the flusher")
+	}
+
+	tmp, st := fs.Create("f.tmp", 0, 0644, testContext)
+	if st != fuse.OK {
+		t.Fatal(st)
+	}
+	defer tmp.Release()
+	if _, st := tmp.Write([]byte("flushed"), 0); st != fuse.OK {
+		t.Fatal(st)
+	}
+	deadline := time.Now().Add(time.Second)
+	for fake.totalPuts(prefix) == puts && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if fake.totalPuts(prefix) != puts+1 {
+		t.Fatalf("%d puts by the flusher", fake.totalPuts(prefix)-puts)
+	}
+	if fs.Sess.openedFile(fs.mustKey(t, "f")).dirty != true {
+		t.Fatal("flush-on-close file is saved")
+	}
+}
@@ -0,0 +1,303 @@
+package bucketsync
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+	"go.uber.org/zap"
+)
+
+// Operations of Event
+const (
+	EventCreate = "create"
+	EventModify = "modify" // written data is flushed
+	EventUnlink = "unlink"
+	EventRename = "rename"
+	EventMkdir  = "mkdir"
+	EventRmdir  = "rmdir"
+	// A path is truncated, or opened with O_TRUNC. Truncate of a handle is
+	// part of its EventModify.
+	EventTruncate = "truncate"
+	EventSymlink  = "symlink"
+)
+
+// Defaults of event delivery
+const (
+	defaultEventQueue   = 1024
+	eventWebhookTimeout = 10 * time.Second
+)
+
+// Event is a mutation succeeded on the mount.
+type Event struct {
+	Time time.Time `json:"time"`
+	Op   string    `json:"op"`
+	Path string    `json:"path"`
+	To   string    `json:"to,omitempty"` // destination of rename, target of symlink
+	Size int64     `json:"size"`         // of the file created, modified or truncated
+}
+
+// events publishes Event to subscribed channels and the webhook. Publish
+// never blocks operations, events are dropped if a receiver is behind.
+type events struct {
+	types   map[string]bool // nil is all
+	logger  *Logger
+	now     func() time.Time // of Session, so that events agree with mtimes
+	dropped int64
+
+	lock        sync.Mutex
+	subscribers []chan<- Event
+	webhook     chan Event
+}
+
+func newEvents(config *Config, logger *Logger, now func() time.Time) *events {
+	e := &events{logger: logger, now: now}
+	if len(config.EventTypes) != 0 {
+		e.types = make(map[string]bool, len(config.EventTypes))
+		for _, op := range config.EventTypes {
+			e.types[op] = true
+		}
+	}
+	if config.EventWebhook != "" {
+		queue := config.EventQueue
+		if queue <= 0 {
+			queue = defaultEventQueue
+		}
+		e.webhook = make(chan Event, queue)
+		go e.deliver(config.EventWebhook, e.webhook)
+	}
+	return e
+}
+
+// SubscribeEvents sends events of the mount to ch. Events are dropped while
+// ch is full, so it should be buffered.
+func (s *Session) SubscribeEvents(ch chan<- Event) {
+	s.events.lock.Lock()
+	defer s.events.lock.Unlock()
+	s.events.subscribers = append(s.events.subscribers, ch)
+}
+
+// DroppedEvents returns number of events not delivered since a receiver was
+// behind.
+func (s *Session) DroppedEvents() int64 {
+	return atomic.LoadInt64(&s.events.dropped)
+}
+
+func (e *events) publish(op, path, to string, size int64) {
+	if e.types != nil && !e.types[op] {
+		return
+	}
+	ev := Event{Time: e.now().UTC(), Op: op, Path: path, To: to, Size: size}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	for _, ch := range e.subscribers {
+		e.send(ch, ev)
+	}
+	if e.webhook != nil {
+		e.send(e.webhook, ev)
+	}
+}
+
+func (e *events) send(ch chan<- Event, ev Event) {
+	select {
+	case ch <- ev:
+	default:
+		atomic.AddInt64(&e.dropped, 1)
+		e.logger.Warn("event dropped", zap.String("op", ev.Op), zap.String("path", ev.Path))
+	}
+}
+
+// deliver posts events of queue to url as JSON one by one.
+func (e *events) deliver(url string, queue <-chan Event) {
+	client := &http.Client{Timeout: eventWebhookTimeout}
+	for ev := range queue {
+		body, err := json.Marshal(&ev)
+		if err != nil {
+			e.logger.Error("event webhook failed", zap.Error(err))
+			continue
+		}
+		resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			e.logger.Error("event webhook failed", zap.String("op", ev.Op),
+				zap.String("path", ev.Path), zap.Error(err))
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			e.logger.Error("event webhook failed", zap.String("op", ev.Op),
+				zap.String("path", ev.Path), zap.Int("status", resp.StatusCode))
+		}
+	}
+}
+
+func (e *events) close() {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.webhook != nil {
+		close(e.webhook)
+		e.webhook = nil
+	}
+}
+
+// eventFileSystem publishes events of succeeded mutations of fs.
+type eventFileSystem struct {
+	pathfs.FileSystem
+	events *events
+}
+
+func (fs *eventFileSystem) Mkdir(name string, mode uint32, context *fuse.Context) fuse.Status {
+	status := fs.FileSystem.Mkdir(name, mode, context)
+	if status == fuse.OK {
+		fs.events.publish(EventMkdir, name, "", 0)
+	}
+	return status
+}
+
+func (fs *eventFileSystem) Unlink(name string, context *fuse.Context) fuse.Status {
+	status := fs.FileSystem.Unlink(name, context)
+	if status == fuse.OK {
+		fs.events.publish(EventUnlink, name, "", 0)
+	}
+	return status
+}
+
+func (fs *eventFileSystem) Rmdir(name string, context *fuse.Context) fuse.Status {
+	status := fs.FileSystem.Rmdir(name, context)
+	if status == fuse.OK {
+		fs.events.publish(EventRmdir, name, "", 0)
+	}
+	return status
+}
+
+func (fs *eventFileSystem) Rename(oldName string, newName string, context *fuse.Context) fuse.Status {
+	status := fs.FileSystem.Rename(oldName, newName, context)
+	if status == fuse.OK {
+		fs.events.publish(EventRename, oldName, newName, 0)
+	}
+	return status
+}
+
+func (fs *eventFileSystem) Truncate(name string, size uint64, context *fuse.Context) fuse.Status {
+	status := fs.FileSystem.Truncate(name, size, context)
+	if status == fuse.OK {
+		fs.events.publish(EventTruncate, name, "", int64(size))
+	}
+	return status
+}
+
+func (fs *eventFileSystem) Symlink(value string, linkName string, context *fuse.Context) fuse.Status {
+	status := fs.FileSystem.Symlink(value, linkName, context)
+	if status == fuse.OK {
+		fs.events.publish(EventSymlink, linkName, value, 0)
+	}
+	return status
+}
+
+func (fs *eventFileSystem) Create(name string, flags uint32, mode uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	file, status := fs.FileSystem.Create(name, flags, mode, context)
+	if status != fuse.OK {
+		return file, status
+	}
+	fs.events.publish(EventCreate, name, "", 0)
+	return fs.eventWrites(file, name), status
+}
+
+func (fs *eventFileSystem) Open(name string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	file, status := fs.FileSystem.Open(name, flags, context)
+	if status != fuse.OK || flags&fuse.O_ANYWRITE == 0 {
+		return file, status
+	}
+	if flags&syscall.O_TRUNC != 0 {
+		fs.events.publish(EventTruncate, name, "", 0)
+	}
+	return fs.eventWrites(file, name), status
+}
+
+// eventWrites wraps file to publish its writes, keeping open flags.
+func (fs *eventFileSystem) eventWrites(file nodefs.File, name string) nodefs.File {
+	if flags, ok := file.(*nodefs.WithFlags); ok {
+		flags.File = &eventFile{File: flags.File, events: fs.events, path: name}
+		return flags
+	}
+	return &eventFile{File: file, events: fs.events, path: name}
+}
+
+func (fs *eventFileSystem) OnUnmount() {
+	fs.FileSystem.OnUnmount()
+	fs.events.close()
+}
+
+func (fs *eventFileSystem) String() string {
+	return fmt.Sprintf("eventFileSystem(%v)", fs.FileSystem)
+}
+
+// eventFile publishes one EventModify at flush of the writes before it.
+type eventFile struct {
+	nodefs.File
+	events  *events
+	path    string
+	written int32 // written since last event, atomic
+}
+
+func (f *eventFile) Write(data []byte, off int64) (uint32, fuse.Status) {
+	n, status := f.File.Write(data, off)
+	if n > 0 {
+		atomic.StoreInt32(&f.written, 1)
+	}
+	return n, status
+}
+
+func (f *eventFile) Truncate(size uint64) fuse.Status {
+	status := f.File.Truncate(size)
+	if status == fuse.OK {
+		atomic.StoreInt32(&f.written, 1)
+	}
+	return status
+}
+
+// modified publishes EventModify if written since the last one.
+func (f *eventFile) modified(status fuse.Status) {
+	if status != fuse.OK || !atomic.CompareAndSwapInt32(&f.written, 1, 0) {
+		return
+	}
+	f.events.publish(EventModify, f.path, "", f.size())
+}
+
+func (f *eventFile) size() int64 {
+	attr := &fuse.Attr{}
+	f.File.GetAttr(attr)
+	return int64(attr.Size)
+}
+
+func (f *eventFile) Flush() fuse.Status {
+	status := f.File.Flush()
+	f.modified(status)
+	return status
+}
+
+func (f *eventFile) Fsync(flags int) fuse.Status {
+	status := f.File.Fsync(flags)
+	f.modified(status)
+	return status
+}
+
+// Release saves writes not flushed, so they are published after it.
+func (f *eventFile) Release() {
+	written := atomic.SwapInt32(&f.written, 0) == 1
+	var size int64
+	if written {
+		size = f.size()
+	}
+	f.File.Release()
+	if written {
+		f.events.publish(EventModify, f.path, "", size)
+	}
+}
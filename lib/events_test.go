@@ -0,0 +1,157 @@
+package bucketsync
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+)
+
+func eventFS(t *testing.T, mod func(c *Config)) (pathfs.FileSystem, chan Event) {
+	t.Helper()
+	sess, _ := newTestSession(t, nil, mod)
+	events := make(chan Event, 16)
+	sess.SubscribeEvents(events)
+	return wrapFileSystem(sess, &FileSystem{Sess: sess, logger: sess.logger}), events
+}
+
+// createAndFlush creates f, writes it by 3 writes, and flushes twice.
+func createAndFlush(t *testing.T, fs pathfs.FileSystem) {
+	t.Helper()
+	f, st := fs.Create("f", 0, 0644, testContext)
+	if st != fuse.OK {
+		t.Fatal(st)
+	}
+	for i := int64(0); i < 3; i++ {
+		if _, st := f.Write([]byte("0123"), i*4); st != fuse.OK {
+			t.Fatal(st)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if st := f.Flush(); st != fuse.OK {
+			t.Fatal(st)
+		}
+	}
+	f.Release()
+}
+
+func receiveEvents(t *testing.T, events chan Event, want []Event) {
+	t.Helper()
+	for _, w := range want {
+		select {
+		case ev := <-events:
+			if ev.Time.IsZero() {
+				t.Fatalf("event %+v has no time", ev)
+			}
+			ev.Time = time.Time{}
+			if ev != w {
+				t.Fatalf("event %+v, want %+v", ev, w)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no event, want %+v", w)
+		}
+	}
+	select {
+	case ev := <-events:
+		t.Fatalf("unexpected event %+v", ev)
+	default:
+	}
+}
+
+func TestEvents(t *testing.T) {
+	fs, events := eventFS(t, nil)
+	createAndFlush(t, fs)
+	if st := fs.Rename("f", "g", testContext); st != fuse.OK {
+		t.Fatal(st)
+	}
+	if st := fs.Unlink("missing", testContext); st != fuse.ENOENT {
+		t.Fatal(st)
+	}
+	if st := fs.Unlink("g", testContext); st != fuse.OK {
+		t.Fatal(st)
+	}
+	receiveEvents(t, events, []Event{
+		{Op: EventCreate, Path: "f"},
+		{Op: EventModify, Path: "f", Size: 12},
+		{Op: EventRename, Path: "f", To: "g"},
+		{Op: EventUnlink, Path: "g"},
+	})
+}
+
+func TestEventsOfTruncateAndSymlink(t *testing.T) {
+	fs, events := eventFS(t, nil)
+	createAndFlush(t, fs)
+	if st := fs.Truncate("f", 5, testContext); st != fuse.OK {
+		t.Fatal(st)
+	}
+	f, st := fs.Open("f", syscall.O_WRONLY|syscall.O_TRUNC, testContext)
+	if st != fuse.OK {
+		t.Fatal(st)
+	}
+	f.Release()
+	if st := fs.Symlink("f", "l", testContext); st != fuse.OK {
+		t.Fatal(st)
+	}
+	receiveEvents(t, events, []Event{
+		{Op: EventCreate, Path: "f"},
+		{Op: EventModify, Path: "f", Size: 12},
+		{Op: EventTruncate, Path: "f", Size: 5},
+		{Op: EventTruncate, Path: "f"},
+		{Op: EventSymlink, Path: "l", To: "f"},
+	})
+}
+
+// TestEventTime sets the session clock ahead. Events are stamped by it,
+// as mtimes are.
+func TestEventTime(t *testing.T) {
+	sess, _ := newTestSession(t, nil, nil)
+	sess.clock.offset = time.Hour
+	events := make(chan Event, 16)
+	sess.SubscribeEvents(events)
+	fs := wrapFileSystem(sess, &FileSystem{Sess: sess, logger: sess.logger})
+	if st := fs.Mkdir("d", 0755, testContext); st != fuse.OK {
+		t.Fatal(st)
+	}
+	ev := <-events
+	attr, st := fs.GetAttr("d", testContext)
+	if st != fuse.OK {
+		t.Fatal(st)
+	}
+	if d := ev.Time.Sub(attr.ModTime()); d < 0 || d > time.Minute {
+		t.Fatalf("event at %v, mtime %v", ev.Time, attr.ModTime())
+	}
+}
+
+func TestEventTypes(t *testing.T) {
+	if (&Config{EventTypes: []string{"chmod"}}).validate() {
+		t.Fatal("unknown event type is valid")
+	}
+	fs, events := eventFS(t, func(c *Config) { c.EventTypes = []string{EventModify} })
+	createAndFlush(t, fs)
+	receiveEvents(t, events, []Event{{Op: EventModify, Path: "f", Size: 12}})
+}
+
+func TestEventWebhook(t *testing.T) {
+	posted := make(chan Event, 16)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ev Event
+		if r.Method != http.MethodPost || json.NewDecoder(r.Body).Decode(&ev) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		posted <- ev
+	}))
+	defer server.Close()
+	fs, _ := eventFS(t, func(c *Config) { c.EventWebhook = server.URL })
+	defer fs.OnUnmount()
+	createAndFlush(t, fs)
+	receiveEvents(t, posted, []Event{
+		{Op: EventCreate, Path: "f"},
+		{Op: EventModify, Path: "f", Size: 12},
+	})
+}
@@ -0,0 +1,179 @@
+package bucketsync
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"go.uber.org/zap"
+)
+
+// TTLXAttr is extended attribute name to set TTL of a file as duration,
+// e.g. "24h". The file is deleted when TTL elapsed since its mtime. On a
+// directory, it's TTL of entries created in it. "0" clears it.
+const TTLXAttr = "user.bucketsync.ttl"
+
+// expired returns true if TTL of the non-directory node has elapsed.
+func (s *Session) expired(meta *Meta) bool {
+	if meta.TTL <= 0 || meta.Mode&syscall.S_IFMT == syscall.S_IFDIR {
+		return false
+	}
+	return s.now().After(meta.Mtime.Add(meta.TTL))
+}
+
+// expire removes name of expired node from parent, and orphans it. Open
+// files are kept until closed, and nothing is removed on a read-only mount.
+func (s *Session) expire(ctx context.Context, parent *Directory, name string, key ObjectKey) error {
+	if s.config.readOnly() {
+		return nil
+	}
+	if parent.FileMeta[name] != key || s.openedFile(key) != nil {
+		return nil
+	}
+	parent.removeChild(name)
+	err := parent.Save(ctx)
+	if err != nil {
+		return err
+	}
+	s.orphan(key)
+	s.invalidateUsage()
+	s.logger.Info("Expired", zap.String("name", name), zap.String("key", key))
+	return nil
+}
+
+// SweepExpired removes all expired nodes, and returns how many are removed.
+func (s *Session) SweepExpired(ctx context.Context) (int, error) {
+	if s.config.readOnly() {
+		return 0, nil
+	}
+	var lock sync.Mutex
+	expired := map[string]ObjectKey{}
+	err := s.Walk(ctx, "", s.RootKey(), WalkOptions{}, func(path string, key ObjectKey, node interface{}) error {
+		var meta *Meta
+		switch typed := node.(type) {
+		case *File:
+			meta = &typed.Meta
+		case *SymLink:
+			meta = &typed.Meta
+		default:
+			return nil
+		}
+		if s.expired(meta) {
+			lock.Lock()
+			expired[path] = key
+			lock.Unlock()
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for path, key := range expired {
+		parentKey, err := s.PathWalk(ctx, filepath.Dir(path))
+		if err != nil {
+			continue // removed meanwhile
+		}
+		parent, err := s.NewDirectory(ctx, parentKey)
+		if err != nil {
+			return removed, err
+		}
+		err = s.expire(ctx, parent, filepath.Base(path), key)
+		if err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// sweeper runs SweepExpired periodically until stop is closed.
+func (s *Session) sweeper(interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		removed, err := s.SweepExpired(ctx)
+		cancel()
+		if err != nil {
+			s.logger.Error("expiry sweep failed", zap.Error(err))
+		}
+		s.logger.Debug("expiry sweep", zap.Int("removed", removed))
+	}
+}
+
+// hideExpired returns true if the node is expired and not open. It's hidden
+// until SweepExpired removes it, lookups never write.
+func (f *FileSystem) hideExpired(key ObjectKey, meta *Meta) bool {
+	return f.Sess.expired(meta) && f.Sess.openedFile(key) == nil
+}
+
+// expiredEntries returns names of dir hidden as expired. Entries are loaded
+// WalkConcurrency at once, ones failing to load are not hidden.
+func (f *FileSystem) expiredEntries(ctx context.Context, dir *Directory) map[string]bool {
+	concurrency := f.Sess.config.WalkConcurrency
+	if concurrency <= 0 {
+		concurrency = defaultWalkConcurrency
+	}
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, concurrency)
+	hidden := map[string]bool{}
+	for name, key := range dir.FileMeta {
+		if isEmptyDirKey(key) {
+			continue // directories never expire
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(name string, key ObjectKey) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			node, err := f.Sess.NewNode(ctx, key)
+			if err != nil || !f.hideExpired(key, &node.Meta) {
+				return
+			}
+			lock.Lock()
+			hidden[name] = true
+			lock.Unlock()
+		}(name, key)
+	}
+	wg.Wait()
+	return hidden
+}
+
+// freeName returns OK if name is not in dir, or its node is hidden as
+// expired. Key of the expired one is returned, the new entry replaces it.
+func (f *FileSystem) freeName(ctx context.Context, dir *Directory, name string) (ObjectKey, fuse.Status) {
+	key, ok := dir.FileMeta[name]
+	if !ok {
+		return "", fuse.OK
+	}
+	node, err := f.Sess.NewNode(ctx, key)
+	if err != nil || !f.hideExpired(key, &node.Meta) {
+		return "", fuse.Status(syscall.EEXIST)
+	}
+	return key, fuse.OK
+}
+
+// setTTL updates TTL of name, open file is saved with its modification.
+func (f *FileSystem) setTTL(name string, data []byte) fuse.Status {
+	ttl, err := time.ParseDuration(string(data))
+	if err != nil || ttl < 0 {
+		return fuse.EINVAL
+	}
+	return f.updateNode(name, func(node interface{}, meta *Meta) fuse.Status {
+		meta.TTL = ttl
+		return fuse.OK
+	})
+}
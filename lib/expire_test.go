@@ -0,0 +1,115 @@
+package bucketsync
+
+import (
+	"bytes"
+	"context"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func TestExpiredHiddenUntilSweep(t *testing.T) {
+	fs, fake := newTestFS(t, nil, nil)
+	writeFile(t, fs, "f", []byte("scratch"))
+	if st := fs.SetXAttr("f", TTLXAttr, []byte("1ns"), 0, testContext); st != fuse.OK {
+		t.Fatal(st)
+	}
+	rootName := fs.Sess.metaName(fs.Sess.RootKey())
+	before, _ := fake.get(rootName)
+
+	if _, st := fs.GetAttr("f", testContext); st != fuse.ENOENT {
+		t.Fatalf("GetAttr = %v, want ENOENT", st)
+	}
+	if _, st := fs.Open("f", 0, testContext); st != fuse.ENOENT {
+		t.Fatalf("Open = %v, want ENOENT", st)
+	}
+	if after, _ := fake.get(rootName); !bytes.Equal(before, after) {
+		t.Fatal("lookup of expired file wrote root")
+	}
+
+	removed, err := fs.Sess.SweepExpired(context.Background())
+	if err != nil || removed != 1 {
+		t.Fatal(removed, err)
+	}
+	root, err := fs.Sess.loadRoot(context.Background(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := root.FileMeta["f"]; ok {
+		t.Fatal("expired file is not removed by sweep")
+	}
+}
+
+func TestExpiredNotRemovedFromRootVersion(t *testing.T) {
+	fs, fake := newTestFS(t, nil, nil)
+	writeFile(t, fs, "f", []byte("scratch"))
+	if st := fs.SetXAttr("f", TTLXAttr, []byte("1ns"), 0, testContext); st != fuse.OK {
+		t.Fatal(st)
+	}
+	rootName := fs.Sess.metaName(fs.Sess.RootKey())
+	versions, err := fs.Sess.s3.ListVersions(context.Background(), MetaObject, fs.Sess.RootKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, fs, "g", []byte("live"))
+	live, _ := fake.get(rootName)
+	puts := fake.totalPuts("")
+
+	pinned, _ := newTestFS(t, fake, func(c *Config) { c.RootVersion = versions[0].ID })
+	if _, st := pinned.GetAttr("f", testContext); st != fuse.ENOENT {
+		t.Fatalf("GetAttr = %v, want ENOENT", st)
+	}
+	if _, st := pinned.Open("f", 0, testContext); st != fuse.ENOENT {
+		t.Fatalf("Open = %v, want ENOENT", st)
+	}
+	if removed, err := pinned.Sess.SweepExpired(context.Background()); err != nil || removed != 0 {
+		t.Fatal(removed, err)
+	}
+	if current, _ := fake.get(rootName); !bytes.Equal(current, live) || fake.totalPuts("") != puts {
+		t.Fatal("root_version mount wrote the bucket")
+	}
+}
+
+// TestExpiredNamesAreFree lists a directory with expired entries, and creates
+// new ones at their names before the sweep.
+func TestExpiredNamesAreFree(t *testing.T) {
+	fs, _ := newTestFS(t, nil, nil)
+	writeFile(t, fs, "f", []byte("scratch"))
+	writeFile(t, fs, "live", []byte("live"))
+	if st := fs.Symlink("target", "l", testContext); st != fuse.OK {
+		t.Fatal(st)
+	}
+	for _, name := range []string{"f", "l"} {
+		if st := fs.SetXAttr(name, TTLXAttr, []byte("1ns"), 0, testContext); st != fuse.OK {
+			t.Fatal(st)
+		}
+	}
+	entries, st := fs.OpenDir("", testContext)
+	if st != fuse.OK || len(entries) != 1 || entries[0].Name != "live" {
+		t.Fatalf("listing %v %v", entries, st)
+	}
+
+	orphans := orphaned(fs)
+	if st := fs.Mkdir("f", 0755, testContext); st != fuse.OK {
+		t.Fatalf("Mkdir over expired: %v", st)
+	}
+	if st := fs.Symlink("other", "l", testContext); st != fuse.OK {
+		t.Fatalf("Symlink over expired: %v", st)
+	}
+	if st := fs.Mkdir("live", 0755, testContext); st != fuse.Status(syscall.EEXIST) {
+		t.Fatalf("Mkdir over live: %v", st)
+	}
+	if orphaned(fs) != orphans+1 {
+		t.Fatal("replaced expired file isn't orphaned")
+	}
+	if attr, st := fs.GetAttr("f", testContext); st != fuse.OK || !attr.IsDir() {
+		t.Fatalf("f = %v %v", attr, st)
+	}
+	if to, st := fs.Readlink("l", testContext); st != fuse.OK || to != "other" {
+		t.Fatalf("l -> %q %v", to, st)
+	}
+	if entries, _ := fs.OpenDir("", testContext); len(entries) != 3 {
+		t.Fatalf("listing %v", entries)
+	}
+}
@@ -0,0 +1,405 @@
+package bucketsync
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// ExportManifest is the file in the destination of Export, recording what's
+// exported already.
+const ExportManifest = ".bucketsync-export.json"
+
+// exportManifestInterval is how often the manifest is saved during export
+const exportManifestInterval = time.Second
+
+type ExportOptions struct {
+	// Concurrency is number of nodes exported at once, WalkConcurrency if 0
+	Concurrency int
+	// Progress is called after each file and extent exported.
+	Progress func(ExportProgress)
+	// Verify compares SHA-256 of exported files with their stored checksum.
+	Verify bool
+}
+
+// ExportProgress counts files and bytes of an export, and extents downloaded
+// or skipped as exported by an earlier run.
+type ExportProgress struct {
+	Files   int64 `json:"files"`
+	Bytes   int64 `json:"bytes"`
+	Extents int64 `json:"extents"`
+	Skipped int64 `json:"skipped"`
+}
+
+// ExportReport is result of Export. Mismatched are paths of files whose
+// content differs from the checksum in the bucket.
+type ExportReport struct {
+	ExportProgress
+	Verified   int64    `json:"verified"`
+	Mismatched []string `json:"mismatched"`
+}
+
+// exportEntry records a file exported, Extents are content keys of extents
+// written by index. Done is set when all are written.
+type exportEntry struct {
+	Key        ObjectKey           `json:"key"`
+	Size       int64               `json:"size"`
+	ExtentSize int64               `json:"extent_size"`
+	Extents    map[int64]ObjectKey `json:"extents"`
+	Done       bool                `json:"done"`
+}
+
+type exportManifest struct {
+	Files map[string]*exportEntry `json:"files"`
+}
+
+type exporter struct {
+	sess *Session
+	ctx  context.Context
+	dest string
+	opts ExportOptions
+
+	lock     sync.Mutex
+	manifest exportManifest
+	saved    time.Time
+	progress ExportProgress
+	report   ExportReport
+	dirs     map[string]Meta
+}
+
+// Export copies the tree to dest, a local directory. Progress is recorded in
+// ExportManifest in dest, so that an export interrupted is resumed by running
+// it again: done files are skipped, and extents written already with the same
+// content key are not downloaded again. Files changed since are written
+// again. Modes and times are restored, owners are not.
+func (s *Session) Export(ctx context.Context, dest string, opts ExportOptions) (*ExportReport, error) {
+	e := &exporter{
+		sess:     s,
+		ctx:      ctx,
+		dest:     dest,
+		opts:     opts,
+		manifest: exportManifest{Files: map[string]*exportEntry{}},
+		dirs:     map[string]Meta{},
+	}
+	err := os.MkdirAll(dest, 0755)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(e.manifestPath())
+	if err == nil {
+		err = json.Unmarshal(data, &e.manifest)
+		if err != nil {
+			return nil, errors.Wrap(err, "manifest is corrupt")
+		}
+		if e.manifest.Files == nil {
+			e.manifest.Files = map[string]*exportEntry{}
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	err = s.Walk(ctx, "", s.RootKey(), WalkOptions{Concurrency: opts.Concurrency}, e.export)
+	if serr := e.saveManifest(true); err == nil {
+		err = serr
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Modes of directories are set last, not to deny writes into them
+	for path, meta := range e.dirs {
+		err := e.setAttr(e.target(path), &meta)
+		if err != nil {
+			return nil, err
+		}
+	}
+	e.report.ExportProgress = e.progress
+	sort.Strings(e.report.Mismatched)
+	s.logger.Info("Export done", zap.String("dest", dest), zap.Int64("files", e.report.Files),
+		zap.Int64("extents", e.report.Extents), zap.Int64("skipped", e.report.Skipped))
+	return &e.report, nil
+}
+
+func (e *exporter) manifestPath() string {
+	return filepath.Join(e.dest, ExportManifest)
+}
+
+func (e *exporter) target(path string) string {
+	return filepath.Join(e.dest, path)
+}
+
+// saveManifest writes the manifest, at most every exportManifestInterval
+// unless force is true.
+func (e *exporter) saveManifest(force bool) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if !force && time.Since(e.saved) < exportManifestInterval {
+		return nil
+	}
+	data, err := json.Marshal(&e.manifest)
+	if err != nil {
+		return err
+	}
+	e.saved = time.Now()
+	tmp := e.manifestPath() + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, e.manifestPath())
+}
+
+func (e *exporter) update(fn func(p *ExportProgress)) {
+	e.lock.Lock()
+	fn(&e.progress)
+	progress := e.progress
+	e.lock.Unlock()
+	if e.opts.Progress != nil {
+		e.opts.Progress(progress)
+	}
+}
+
+func (e *exporter) export(path string, key ObjectKey, node interface{}) error {
+	target := e.target(path)
+	switch typed := node.(type) {
+	case *Directory:
+		e.lock.Lock()
+		e.dirs[path] = typed.Meta
+		e.lock.Unlock()
+		// Other than a directory is replaced, so that a symlink put in the
+		// destination doesn't lead writes out of it
+		if info, err := os.Lstat(target); err == nil && !info.IsDir() {
+			err = os.Remove(target)
+			if err != nil {
+				return err
+			}
+		}
+		err := os.MkdirAll(target, 0700)
+		if err != nil {
+			return err
+		}
+		// Mode set by an earlier run may deny writes
+		return os.Chmod(target, 0700)
+	case *SymLink:
+		if current, err := os.Readlink(target); err == nil && current == typed.LinkTo {
+			return nil
+		}
+		os.Remove(target)
+		return os.Symlink(typed.LinkTo, target)
+	case *File:
+		return e.exportFile(path, typed)
+	}
+	return nil
+}
+
+// entry returns manifest entry of file at path, a new one if it's changed,
+// and true if the file is exported already.
+func (e *exporter) entry(path string, file *File) (*exportEntry, bool) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	entry, ok := e.manifest.Files[path]
+	if ok && entry.Key == file.Key && entry.Size == file.Meta.Size && entry.ExtentSize == file.ExtentSize {
+		return entry, entry.Done && entry.written(file)
+	}
+	entry = &exportEntry{
+		Key:        file.Key,
+		Size:       file.Meta.Size,
+		ExtentSize: file.ExtentSize,
+		Extents:    map[int64]ObjectKey{},
+	}
+	e.manifest.Files[path] = entry
+	return entry, false
+}
+
+// written returns true if the extents written are all extents of file.
+func (entry *exportEntry) written(file *File) bool {
+	n := 0
+	for i, extent := range file.Extent {
+		if i*file.ExtentSize >= file.Meta.Size {
+			continue
+		}
+		if entry.Extents[i] != extent.Key {
+			return false
+		}
+		n++
+	}
+	return n == len(entry.Extents)
+}
+
+func (e *exporter) exportFile(path string, file *File) error {
+	if file.Meta.Mode&syscall.S_IFMT != syscall.S_IFREG {
+		return nil
+	}
+	target := e.target(path)
+	entry, done := e.entry(path, file)
+	info, err := os.Lstat(target)
+	if err == nil && !info.Mode().IsRegular() {
+		// Replaced, a symlink would lead writes out of the destination
+		err = os.Remove(target)
+		if err != nil {
+			return err
+		}
+		err = os.ErrNotExist
+	}
+	if done && err == nil {
+		e.lock.Lock()
+		skipped := int64(len(entry.Extents))
+		e.lock.Unlock()
+		e.update(func(p *ExportProgress) {
+			p.Files++
+			p.Bytes += file.Meta.Size
+			p.Skipped += skipped
+		})
+		return e.verify(path, file)
+	}
+	if err != nil {
+		// Removed from the destination, or not created yet
+		e.lock.Lock()
+		entry.Done, entry.Extents = false, map[int64]ObjectKey{}
+		e.lock.Unlock()
+	} else {
+		// Mode set by an earlier run may deny writes
+		os.Chmod(target, 0600)
+	}
+
+	flags := os.O_RDWR | os.O_CREATE | syscall.O_NOFOLLOW
+	e.lock.Lock()
+	if len(entry.Extents) == 0 {
+		flags |= os.O_TRUNC
+	}
+	written := make(map[int64]ObjectKey, len(entry.Extents))
+	for i, key := range entry.Extents {
+		written[i] = key
+	}
+	e.lock.Unlock()
+	out, err := os.OpenFile(target, flags, 0600)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	// Extents written but removed since are holes now
+	for i := range written {
+		if _, ok := file.Extent[i]; !ok && i*file.ExtentSize < file.Meta.Size {
+			_, err := out.WriteAt(make([]byte, file.ExtentSize), i*file.ExtentSize)
+			if err != nil {
+				return err
+			}
+			e.lock.Lock()
+			delete(entry.Extents, i)
+			e.lock.Unlock()
+		}
+	}
+	indexes := make([]int64, 0, len(file.Extent))
+	for i := range file.Extent {
+		if i*file.ExtentSize < file.Meta.Size {
+			indexes = append(indexes, i)
+		}
+	}
+	sort.Slice(indexes, func(a, b int) bool { return indexes[a] < indexes[b] })
+	for _, i := range indexes {
+		extent := file.Extent[i]
+		if written[i] == extent.Key {
+			e.update(func(p *ExportProgress) { p.Skipped++ })
+			continue
+		}
+		err := e.exportExtent(out, file, i, extent)
+		if err != nil {
+			return errors.Wrapf(err, "export failed. path = %s", path)
+		}
+		e.lock.Lock()
+		entry.Extents[i] = extent.Key
+		e.lock.Unlock()
+		e.update(func(p *ExportProgress) { p.Extents++ })
+		err = e.saveManifest(false)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = out.Truncate(file.Meta.Size)
+	if err != nil {
+		return err
+	}
+	err = out.Close()
+	if err != nil {
+		return err
+	}
+	err = e.setAttr(target, &file.Meta)
+	if err != nil {
+		return err
+	}
+	e.lock.Lock()
+	entry.Done = true
+	e.lock.Unlock()
+	e.update(func(p *ExportProgress) {
+		p.Files++
+		p.Bytes += file.Meta.Size
+	})
+	return e.verify(path, file)
+}
+
+func (e *exporter) exportExtent(out *os.File, file *File, i int64, extent *Extent) error {
+	err := extent.Fill(e.ctx)
+	if err != nil {
+		return err
+	}
+	defer extent.release()
+	body := extent.body
+	if end := file.Meta.Size - i*file.ExtentSize; int64(len(body)) > end {
+		body = body[:end]
+	}
+	_, err = out.WriteAt(body, i*file.ExtentSize)
+	return err
+}
+
+func (e *exporter) setAttr(target string, meta *Meta) error {
+	err := os.Chmod(target, os.FileMode(meta.Mode&0777))
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(target, meta.Atime, meta.Mtime)
+}
+
+// verify compares SHA-256 of the exported file with checksum of file, which
+// is calculated from the bucket unless it's recorded.
+func (e *exporter) verify(path string, file *File) error {
+	if !e.opts.Verify {
+		return nil
+	}
+	checksum, err := file.ContentChecksum(e.ctx)
+	if err != nil {
+		return errors.Wrapf(err, "checksum failed. path = %s", path)
+	}
+	in, err := os.OpenFile(e.target(path), os.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, in)
+	if err != nil {
+		return err
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.report.Verified++
+	if hex.EncodeToString(h.Sum(nil)) != checksum {
+		e.report.Mismatched = append(e.report.Mismatched, path)
+		// Exported again by the next run
+		e.manifest.Files[path].Done = false
+		e.manifest.Files[path].Extents = map[int64]ObjectKey{}
+	}
+	return nil
+}
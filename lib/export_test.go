@@ -0,0 +1,135 @@
+package bucketsync
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// TestExportReplacesSymlinks plants symlinks in the destination, where a
+// directory and a file are exported. Export never writes through them.
+func TestExportReplacesSymlinks(t *testing.T) {
+	fs, _ := newTestFS(t, nil, nil)
+	if st := fs.Mkdir("d", 0755, testContext); st != fuse.OK {
+		t.Fatal(st)
+	}
+	writeFile(t, fs, "d/x", []byte("x"))
+	writeFile(t, fs, "f", []byte("exported"))
+
+	dest, outside := t.TempDir(), t.TempDir()
+	victim := filepath.Join(outside, "victim")
+	if err := ioutil.WriteFile(victim, []byte("victim"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	check := func() {
+		t.Helper()
+		if got, _ := ioutil.ReadFile(victim); string(got) != "victim" {
+			t.Fatalf("victim = %q", got)
+		}
+		if _, err := os.Lstat(filepath.Join(outside, "x")); err == nil {
+			t.Fatal("exported out of the destination")
+		}
+		for name, want := range map[string]string{"f": "exported", "d/x": "x"} {
+			target := filepath.Join(dest, name)
+			info, err := os.Lstat(target)
+			if err != nil || !info.Mode().IsRegular() {
+				t.Fatalf("%s: %v %v", name, info, err)
+			}
+			if got, _ := ioutil.ReadFile(target); string(got) != want {
+				t.Fatalf("%s = %q", name, got)
+			}
+		}
+	}
+	plant := func() {
+		t.Helper()
+		for name, to := range map[string]string{"d": outside, "f": victim} {
+			os.RemoveAll(filepath.Join(dest, name))
+			if err := os.Symlink(to, filepath.Join(dest, name)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	plant()
+	if _, err := fs.Sess.Export(context.Background(), dest, ExportOptions{Verify: true}); err != nil {
+		t.Fatal(err)
+	}
+	check()
+
+	// Done by the manifest, but replaced since
+	plant()
+	if _, err := fs.Sess.Export(context.Background(), dest, ExportOptions{Verify: true}); err != nil {
+		t.Fatal(err)
+	}
+	check()
+}
+
+// TestExportResumes interrupts an export by a failing download, and runs it
+// again. Extents written already are not downloaded again, and a finished
+// export downloads only the file changed since.
+func TestExportResumes(t *testing.T) {
+	mod := func(c *Config) { c.DataPrefix = "data/" }
+	fs, fake := newTestFS(t, nil, mod)
+	data := testContent()
+	writeFile(t, fs, "f", data)
+	writeFile(t, fs, "g", []byte("unchanged"))
+	dest := t.TempDir()
+	opts := ExportOptions{Concurrency: 1}
+	export := func() (*ExportReport, int, error) {
+		t.Helper()
+		// A fresh session has no extent cached
+		sess, _ := newTestSession(t, fake, mod)
+		prefix := sess.dataPrefix()
+		gets := fake.totalGets(prefix)
+		report, err := sess.Export(context.Background(), dest, opts)
+		return report, fake.totalGets(prefix) - gets, err
+	}
+
+	prefix := fs.Sess.dataPrefix()
+	n := 0
+	fake.fail = func(op, name string) error {
+		if op == "GetObject" && strings.HasPrefix(name, prefix) {
+			if n++; n == 5 {
+				return errors.New("injected")
+			}
+		}
+		return nil
+	}
+	if _, _, err := export(); err == nil {
+		t.Fatal("interrupted export succeeded")
+	}
+	fake.fail = nil
+
+	report, gets, err := export()
+	if err != nil {
+		t.Fatal(err)
+	}
+	total := len(data)/16 + 2
+	if report.Skipped < 4 || gets > total-4 {
+		t.Fatalf("resumed export skipped %d, downloaded %d of %d", report.Skipped, gets, total)
+	}
+	for name, want := range map[string][]byte{"f": data, "g": []byte("unchanged")} {
+		if got, _ := ioutil.ReadFile(filepath.Join(dest, name)); !bytes.Equal(got, want) {
+			t.Fatalf("%s = %q", name, got)
+		}
+	}
+
+	writeFile(t, fs, "g", []byte("changed"))
+	report, gets, err = export()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gets != 1 || report.Extents != 1 || report.Files != 2 {
+		t.Fatalf("downloaded %d, exported %d extents of %d files", gets, report.Extents, report.Files)
+	}
+	if got, _ := ioutil.ReadFile(filepath.Join(dest, "g")); string(got) != "changed" {
+		t.Fatalf("g = %q", got)
+	}
+}
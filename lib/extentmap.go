@@ -0,0 +1,166 @@
+package bucketsync
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"go.uber.org/zap"
+)
+
+// extentsPath mirrors the tree, each file is extent map of the file as JSON.
+var extentsPath = filepath.Join(controlDir, "extents")
+
+// ExtentInfo is a range of a file, stored as an extent or a hole.
+type ExtentInfo struct {
+	Offset  int64       `json:"offset"`
+	Size    int64       `json:"size"`
+	Hole    bool        `json:"hole"`
+	Key     ObjectKey   `json:"key,omitempty"`     // content address of the extent
+	Objects []ObjectKey `json:"objects,omitempty"` // data objects storing it
+	Dirty   bool        `json:"dirty,omitempty"`   // modified and not saved yet
+	Damaged bool        `json:"damaged,omitempty"` // quarantined by repair
+}
+
+// ExtentMap is layout of a file, extents cover the size in order and
+// consecutive holes are merged. Unchanged Key of an extent means unchanged
+// content, so that incremental backups copy only changed extents.
+type ExtentMap struct {
+	Key        ObjectKey    `json:"key"`
+	Size       int64        `json:"size"`
+	ExtentSize int64        `json:"extent_size"`
+	Extents    []ExtentInfo `json:"extents"`
+}
+
+// ExtentMap returns layout of file of key, including changes of open file.
+func (s *Session) ExtentMap(ctx context.Context, key ObjectKey) (*ExtentMap, error) {
+	file := s.openedFile(key)
+	if file != nil {
+		file.lock.Lock()
+		defer file.lock.Unlock()
+	} else {
+		var err error
+		file, err = s.NewFile(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	m := &ExtentMap{Key: file.Key, Size: file.Meta.Size, ExtentSize: file.ExtentSize, Extents: []ExtentInfo{}}
+	indexes := make([]int64, 0, len(file.Extent))
+	for i := range file.Extent {
+		if i*file.ExtentSize < file.Meta.Size {
+			indexes = append(indexes, i)
+		}
+	}
+	sort.Slice(indexes, func(a, b int) bool { return indexes[a] < indexes[b] })
+
+	var offset int64
+	hole := func(end int64) {
+		if end > offset {
+			m.Extents = append(m.Extents, ExtentInfo{Offset: offset, Size: end - offset, Hole: true})
+		}
+	}
+	for _, i := range indexes {
+		e := file.Extent[i]
+		start := i * file.ExtentSize
+		hole(start)
+		size := file.ExtentSize
+		if start+size > file.Meta.Size {
+			size = file.Meta.Size - start
+		}
+		info := ExtentInfo{Offset: start, Size: size, Key: e.Key, Dirty: e.dirty, Damaged: e.Damaged}
+		if !e.dirty {
+			info.Objects = e.Objects()
+		}
+		m.Extents = append(m.Extents, info)
+		offset = start + size
+	}
+	hole(file.Meta.Size)
+	return m, nil
+}
+
+// extentsTarget returns path in the tree of name under extentsPath.
+func extentsTarget(name string) (string, bool) {
+	if name == extentsPath {
+		return "", true
+	}
+	if strings.HasPrefix(name, extentsPath+"/") {
+		return strings.TrimPrefix(name, extentsPath+"/"), true
+	}
+	return "", false
+}
+
+// extentMapJSON returns extent map of regular file at name, or nil with
+// attributes of the directory.
+func (f *FileSystem) extentMapJSON(ctx context.Context, name string) ([]byte, *fuse.Attr, fuse.Status) {
+	key, err := f.Sess.PathWalk(ctx, name)
+	if err != nil {
+		f.logger.Debug("fuse error", zap.Error(err))
+		return nil, nil, f.lookupStatus(ctx, err)
+	}
+	node, err := f.Sess.NewNode(ctx, key)
+	if err != nil {
+		f.logger.Debug("fuse error", zap.Error(err))
+		return nil, nil, f.lookupStatus(ctx, err)
+	}
+	switch node.Meta.Mode & syscall.S_IFMT {
+	case fuse.S_IFDIR:
+		return nil, &fuse.Attr{Mode: fuse.S_IFDIR | 0555, Nlink: 1}, fuse.OK
+	case fuse.S_IFREG:
+	default:
+		return nil, nil, fuse.ENOENT
+	}
+	m, err := f.Sess.ExtentMap(ctx, key)
+	if err != nil {
+		f.logger.Debug("fuse error", zap.Error(err))
+		return nil, nil, errStatus(ctx, fuse.EIO)
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, nil, fuse.EIO
+	}
+	data = append(data, '\n')
+	attr := &fuse.Attr{Mode: fuse.S_IFREG | 0444, Nlink: 1, Size: uint64(len(data))}
+	return data, attr, fuse.OK
+}
+
+func (f *FileSystem) extentsAttr(name string) (*fuse.Attr, fuse.Status) {
+	ctx, cancel := f.Sess.opContext()
+	defer cancel()
+	_, attr, status := f.extentMapJSON(ctx, name)
+	return attr, status
+}
+
+func (f *FileSystem) openExtents(name string) (nodefs.File, fuse.Status) {
+	ctx, cancel := f.Sess.opContext()
+	defer cancel()
+	data, _, status := f.extentMapJSON(ctx, name)
+	if status != fuse.OK {
+		return nil, status
+	}
+	if data == nil {
+		return nil, fuse.EISDIR
+	}
+	// Content changes, so bypass page cache.
+	return &nodefs.WithFlags{
+		File:      nodefs.NewReadOnlyFile(nodefs.NewDataFile(data)),
+		FuseFlags: fuse.FOPEN_DIRECT_IO,
+	}, fuse.OK
+}
+
+func (f *FileSystem) openExtentsDir(name string) ([]fuse.DirEntry, fuse.Status) {
+	attr, status := f.extentsAttr(name)
+	if status != fuse.OK {
+		return nil, status
+	}
+	if attr.Mode&syscall.S_IFMT != fuse.S_IFDIR {
+		return nil, fuse.ENOTDIR
+	}
+	return f.OpenDir(name, nil)
+}
@@ -0,0 +1,75 @@
+package bucketsync
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func readExtentMap(t *testing.T, fs *FileSystem, name string) *ExtentMap {
+	t.Helper()
+	data := readFile(t, fs, filepath.Join(extentsPath, name))
+	m := &ExtentMap{}
+	if err := json.Unmarshal(data, m); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// TestExtentMap writes extents with a hole between and at the end. The
+// extent map matches the layout.
+func TestExtentMap(t *testing.T) {
+	fs, fake := newTestFS(t, nil, nil)
+	if st := fs.Mkdir("d", 0755, testContext); st != fuse.OK {
+		t.Fatal(st)
+	}
+	f, st := fs.Create("d/f", 0, 0644, testContext)
+	if st != fuse.OK {
+		t.Fatal(st)
+	}
+	data := testContent()
+	if _, st := f.Write(data[:20], 0); st != fuse.OK {
+		t.Fatal(st)
+	}
+	if _, st := f.Write(data[:8], 64); st != fuse.OK {
+		t.Fatal(st)
+	}
+	if st := f.Truncate(100); st != fuse.OK {
+		t.Fatal(st)
+	}
+	if m := readExtentMap(t, fs, "d/f"); !m.Extents[0].Dirty || m.Extents[0].Objects != nil {
+		t.Fatalf("unsaved extent %+v", m.Extents[0])
+	}
+	if st := f.Flush(); st != fuse.OK {
+		t.Fatal(st)
+	}
+	f.Release()
+
+	reader, _ := newTestFS(t, fake, nil)
+	file, _ := reader.getFile(context.Background(), "d/f")
+	extent := func(i int64, size int64) ExtentInfo {
+		e := file.Extent[i]
+		return ExtentInfo{Offset: i * 16, Size: size, Key: e.Key, Objects: e.Objects()}
+	}
+	want := &ExtentMap{Key: file.Key, Size: 100, ExtentSize: 16, Extents: []ExtentInfo{
+		extent(0, 16),
+		extent(1, 16),
+		{Offset: 32, Size: 32, Hole: true},
+		extent(4, 16),
+		{Offset: 80, Size: 20, Hole: true},
+	}}
+	if m := readExtentMap(t, reader, "d/f"); !reflect.DeepEqual(m, want) {
+		t.Fatalf("extent map %+v, want %+v", m, want)
+	}
+
+	if attr, st := reader.GetAttr(filepath.Join(extentsPath, "d"), testContext); st != fuse.OK || !attr.IsDir() {
+		t.Fatalf("directory %v %v", attr, st)
+	}
+	if _, st := reader.GetAttr(filepath.Join(extentsPath, "missing"), testContext); st != fuse.ENOENT {
+		t.Fatalf("missing file: %v", st)
+	}
+}
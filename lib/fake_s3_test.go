@@ -0,0 +1,557 @@
+package bucketsync
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client/metadata"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// fakeS3 is an in-memory backend serving the calls of S3Session. Objects
+// are keyed by bucket/name, and every put or delete adds a version.
+type fakeS3 struct {
+	s3iface.S3API // not implemented calls panic
+
+	mu       sync.Mutex
+	objects  map[string][]byte
+	versions map[string][]fakeVersion
+	classes  map[string]string // storage class of archived objects
+	restores map[string]string // Restore header of archived objects
+	puts     map[string]int
+	gets     map[string]int
+	tick     int
+
+	// fail returns error of the call op on name, nil to serve it
+	fail func(op, name string) error
+	// onPut is called with mu held before a put is applied, the put fails
+	// with error returned
+	onPut     func(name string, body []byte) error
+	putDelay  time.Duration
+	getDelay  time.Duration
+	headDelay time.Duration
+	// delayOf returns additional delay of the call op on name
+	delayOf func(op, name string) time.Duration
+	// checksums is "reject" to fail puts with checksum, "wrong" to echo
+	// other checksum than sent
+	checksums string
+	date      time.Time // of HeadBucket, now if zero
+}
+
+type fakeVersion struct {
+	id       string
+	body     []byte
+	modified time.Time
+	deleted  bool
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{
+		objects:  map[string][]byte{},
+		versions: map[string][]fakeVersion{},
+		classes:  map[string]string{},
+		restores: map[string]string{},
+		puts:     map[string]int{},
+		gets:     map[string]int{},
+	}
+}
+
+func etagOf(b []byte) string { return fmt.Sprintf("\"%x\"", md5.Sum(b)) }
+
+func fakeName(bucket, key *string) string {
+	return aws.StringValue(bucket) + "/" + aws.StringValue(key)
+}
+
+func notFound(code string) error {
+	return awserr.NewRequestFailure(awserr.New(code, "not found", nil), http.StatusNotFound, "")
+}
+
+// wait sleeps for delay, or until ctx is done.
+func wait(ctx aws.Context, delay time.Duration) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if delay > 0 {
+		select {
+		case <-ctx.Done():
+		case <-time.After(delay):
+		}
+	}
+	return ctx.Err()
+}
+
+func (f *fakeS3) delay(op, name string) time.Duration {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var delay time.Duration
+	switch op {
+	case "PutObject":
+		delay = f.putDelay
+	case "GetObject":
+		delay = f.getDelay
+	case "HeadObject":
+		delay = f.headDelay
+	}
+	if f.delayOf != nil {
+		delay += f.delayOf(op, name)
+	}
+	return delay
+}
+
+// begin waits for delay of op, and returns error of it. It takes mu unless
+// an error is returned.
+func (f *fakeS3) begin(ctx aws.Context, op, name string) error {
+	err := wait(ctx, f.delay(op, name))
+	if err != nil {
+		return awserr.New(request.CanceledErrorCode, "canceled", err)
+	}
+	f.mu.Lock()
+	if f.fail != nil {
+		if err := f.fail(op, name); err != nil {
+			f.mu.Unlock()
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *fakeS3) addVersion(name string, body []byte, deleted bool) string {
+	f.tick++
+	id := fmt.Sprintf("v%d", f.tick)
+	f.versions[name] = append(f.versions[name], fakeVersion{
+		id:       id,
+		body:     body,
+		modified: time.Unix(1600000000+int64(f.tick), 0).UTC(),
+		deleted:  deleted,
+	})
+	return id
+}
+
+// set stores body at name as if it's put by someone else.
+func (f *fakeS3) set(name string, body []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.objects[name] = body
+	f.addVersion(name, body, false)
+}
+
+// get returns body stored at name.
+func (f *fakeS3) get(name string) ([]byte, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	body, ok := f.objects[name]
+	return body, ok
+}
+
+// remove deletes name as if it's deleted by someone else.
+func (f *fakeS3) remove(name string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.objects, name)
+	f.addVersion(name, nil, true)
+}
+
+// names returns names of objects with prefix, sorted.
+func (f *fakeS3) names(prefix string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var names []string
+	for name := range f.objects {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// totalPuts returns number of puts applied to names with prefix.
+func (f *fakeS3) totalPuts(prefix string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for name, c := range f.puts {
+		if strings.HasPrefix(name, prefix) {
+			n += c
+		}
+	}
+	return n
+}
+
+// totalGets returns number of downloads of names with prefix.
+func (f *fakeS3) totalGets(prefix string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for name, c := range f.gets {
+		if strings.HasPrefix(name, prefix) {
+			n += c
+		}
+	}
+	return n
+}
+
+func (f *fakeS3) GetObjectWithContext(ctx aws.Context, in *s3.GetObjectInput, _ ...request.Option) (*s3.GetObjectOutput, error) {
+	name := fakeName(in.Bucket, in.Key)
+	if err := f.begin(ctx, "GetObject", name); err != nil {
+		return nil, err
+	}
+	defer f.mu.Unlock()
+
+	var body []byte
+	if id := aws.StringValue(in.VersionId); id != "" {
+		found := false
+		for _, v := range f.versions[name] {
+			if v.id == id && !v.deleted {
+				body, found = v.body, true
+			}
+		}
+		if !found {
+			return nil, notFound("NoSuchVersion")
+		}
+	} else {
+		var ok bool
+		body, ok = f.objects[name]
+		if !ok {
+			return nil, notFound(s3.ErrCodeNoSuchKey)
+		}
+		if f.classes[name] != "" && !strings.Contains(f.restores[name], `ongoing-request="false"`) {
+			return nil, awserr.NewRequestFailure(awserr.New(s3.ErrCodeInvalidObjectState, "archived", nil), http.StatusForbidden, "")
+		}
+	}
+	f.gets[name]++
+	return &s3.GetObjectOutput{
+		Body:          ioutil.NopCloser(bytes.NewReader(append([]byte(nil), body...))),
+		ContentLength: aws.Int64(int64(len(body))),
+		ETag:          aws.String(etagOf(body)),
+	}, nil
+}
+
+func (f *fakeS3) PutObjectWithContext(ctx aws.Context, in *s3.PutObjectInput, _ ...request.Option) (*s3.PutObjectOutput, error) {
+	return f.put(ctx, in, http.Header{})
+}
+
+func (f *fakeS3) PutObjectRequest(in *s3.PutObjectInput) (*request.Request, *s3.PutObjectOutput) {
+	out := &s3.PutObjectOutput{}
+	req := f.request("PutObject", in, out, func(r *request.Request) {
+		res, err := f.put(r.Context(), in, r.HTTPRequest.Header)
+		if err != nil {
+			r.Error = err
+			return
+		}
+		*out = *res
+	})
+	return req, out
+}
+
+func (f *fakeS3) put(ctx aws.Context, in *s3.PutObjectInput, header http.Header) (*s3.PutObjectOutput, error) {
+	name := fakeName(in.Bucket, in.Key)
+	body, err := ioutil.ReadAll(in.Body)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.begin(ctx, "PutObject", name); err != nil {
+		return nil, err
+	}
+	defer f.mu.Unlock()
+
+	if f.onPut != nil {
+		if err := f.onPut(name, body); err != nil {
+			return nil, err
+		}
+	}
+	current, exists := f.objects[name]
+	if match := header.Get("If-Match"); match != "" && (!exists || etagOf(current) != match) {
+		return nil, awserr.NewRequestFailure(awserr.New("PreconditionFailed", "etag", nil), http.StatusPreconditionFailed, "")
+	}
+	if header.Get("If-None-Match") == "*" && exists {
+		return nil, awserr.NewRequestFailure(awserr.New("PreconditionFailed", "exists", nil), http.StatusPreconditionFailed, "")
+	}
+
+	out := &s3.PutObjectOutput{ETag: aws.String(etagOf(body))}
+	if in.ChecksumCRC32C != nil || in.ChecksumSHA256 != nil {
+		var want string
+		if in.ChecksumCRC32C != nil {
+			h := crc32.New(crc32.MakeTable(crc32.Castagnoli))
+			h.Write(body)
+			want = base64.StdEncoding.EncodeToString(h.Sum(nil))
+			out.ChecksumCRC32C = aws.String(want)
+		} else {
+			sum := sha256.Sum256(body)
+			want = base64.StdEncoding.EncodeToString(sum[:])
+			out.ChecksumSHA256 = aws.String(want)
+		}
+		sent := aws.StringValue(in.ChecksumCRC32C) + aws.StringValue(in.ChecksumSHA256)
+		if sent != want || f.checksums == "reject" {
+			return nil, awserr.NewRequestFailure(awserr.New("BadDigest", "checksum", nil), http.StatusBadRequest, "")
+		}
+		if f.checksums == "wrong" && out.ChecksumCRC32C != nil {
+			out.ChecksumCRC32C = aws.String("AAAAAA==")
+		} else if f.checksums == "wrong" {
+			out.ChecksumSHA256 = aws.String("AAAAAA==")
+		}
+	}
+	f.objects[name] = body
+	out.VersionId = aws.String(f.addVersion(name, body, false))
+	f.puts[name]++
+	return out, nil
+}
+
+func (f *fakeS3) HeadObjectWithContext(ctx aws.Context, in *s3.HeadObjectInput, _ ...request.Option) (*s3.HeadObjectOutput, error) {
+	name := fakeName(in.Bucket, in.Key)
+	if err := f.begin(ctx, "HeadObject", name); err != nil {
+		return nil, err
+	}
+	defer f.mu.Unlock()
+	body, ok := f.objects[name]
+	if !ok {
+		return nil, notFound("NotFound")
+	}
+	out := &s3.HeadObjectOutput{
+		ContentLength: aws.Int64(int64(len(body))),
+		ETag:          aws.String(etagOf(body)),
+	}
+	if class := f.classes[name]; class != "" {
+		out.StorageClass = aws.String(class)
+	}
+	if restore := f.restores[name]; restore != "" {
+		out.Restore = aws.String(restore)
+	}
+	return out, nil
+}
+
+func (f *fakeS3) ListObjectsV2PagesWithContext(ctx aws.Context, in *s3.ListObjectsV2Input, fn func(*s3.ListObjectsV2Output, bool) bool, _ ...request.Option) error {
+	prefix := fakeName(in.Bucket, in.Prefix)
+	if err := f.begin(ctx, "ListObjectsV2", prefix); err != nil {
+		return err
+	}
+	page := &s3.ListObjectsV2Output{}
+	for name, body := range f.objects {
+		if strings.HasPrefix(name, prefix) {
+			page.Contents = append(page.Contents, &s3.Object{
+				Key:  aws.String(strings.TrimPrefix(name, aws.StringValue(in.Bucket)+"/")),
+				Size: aws.Int64(int64(len(body))),
+				ETag: aws.String(etagOf(body)),
+			})
+		}
+	}
+	f.mu.Unlock()
+	sort.Slice(page.Contents, func(i, j int) bool {
+		return aws.StringValue(page.Contents[i].Key) < aws.StringValue(page.Contents[j].Key)
+	})
+	fn(page, true)
+	return nil
+}
+
+func (f *fakeS3) ListObjectVersionsPagesWithContext(ctx aws.Context, in *s3.ListObjectVersionsInput, fn func(*s3.ListObjectVersionsOutput, bool) bool, _ ...request.Option) error {
+	prefix := fakeName(in.Bucket, in.Prefix)
+	if err := f.begin(ctx, "ListObjectVersions", prefix); err != nil {
+		return err
+	}
+	page := &s3.ListObjectVersionsOutput{}
+	for name, versions := range f.versions {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		key := aws.String(strings.TrimPrefix(name, aws.StringValue(in.Bucket)+"/"))
+		for i, v := range versions {
+			latest := aws.Bool(i == len(versions)-1)
+			if v.deleted {
+				page.DeleteMarkers = append(page.DeleteMarkers, &s3.DeleteMarkerEntry{
+					Key: key, VersionId: aws.String(v.id), IsLatest: latest, LastModified: aws.Time(v.modified),
+				})
+				continue
+			}
+			page.Versions = append(page.Versions, &s3.ObjectVersion{
+				Key: key, VersionId: aws.String(v.id), IsLatest: latest, LastModified: aws.Time(v.modified),
+			})
+		}
+	}
+	f.mu.Unlock()
+	fn(page, true)
+	return nil
+}
+
+func (f *fakeS3) HeadBucketRequest(in *s3.HeadBucketInput) (*request.Request, *s3.HeadBucketOutput) {
+	out := &s3.HeadBucketOutput{}
+	req := f.request("HeadBucket", in, out, func(r *request.Request) {
+		if err := f.begin(r.Context(), "HeadBucket", aws.StringValue(in.Bucket)); err != nil {
+			r.Error = err
+			return
+		}
+		date := f.date
+		f.mu.Unlock()
+		if date.IsZero() {
+			date = time.Now()
+		}
+		r.HTTPResponse = &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Date": []string{date.UTC().Format(http.TimeFormat)}},
+			Body:       ioutil.NopCloser(&bytes.Buffer{}),
+		}
+	})
+	return req, out
+}
+
+func (f *fakeS3) RestoreObjectWithContext(ctx aws.Context, in *s3.RestoreObjectInput, _ ...request.Option) (*s3.RestoreObjectOutput, error) {
+	name := fakeName(in.Bucket, in.Key)
+	if err := f.begin(ctx, "RestoreObject", name); err != nil {
+		return nil, err
+	}
+	defer f.mu.Unlock()
+	if _, ok := f.objects[name]; !ok {
+		return nil, notFound(s3.ErrCodeNoSuchKey)
+	}
+	if strings.Contains(f.restores[name], `ongoing-request="true"`) {
+		return nil, awserr.NewRequestFailure(awserr.New("RestoreAlreadyInProgress", "in progress", nil), http.StatusConflict, "")
+	}
+	f.restores[name] = `ongoing-request="true"`
+	return &s3.RestoreObjectOutput{}, nil
+}
+
+// request returns a request of op, which is sent by send.
+func (f *fakeS3) request(op string, params, data interface{}, send func(r *request.Request)) *request.Request {
+	var handlers request.Handlers
+	handlers.Send.PushBack(send)
+	return request.New(aws.Config{}, metadata.ClientInfo{Endpoint: "http://fake"}, handlers, nil,
+		&request.Operation{Name: op, HTTPMethod: "PUT", HTTPPath: "/"}, params, data)
+}
+
+// testBucket is bucket of sessions made by newTestSession
+const testBucket = "b"
+
+// testConfig returns config of sessions on the fake, modified by mod.
+func testConfig(t testing.TB, mod func(c *Config)) *Config {
+	config := &Config{
+		Bucket:        testBucket,
+		Region:        "us-east-1",
+		AccessKey:     "a",
+		SecretKey:     "s",
+		Password:      "password",
+		LogOutputPath: t.TempDir() + "/log",
+		CacheSize:     100,
+		ExtentSize:    16,
+	}
+	if mod != nil {
+		mod(config)
+	}
+	return config
+}
+
+// onFake runs fn with sessions made on fake.
+func onFake(fake *fakeS3, fn func()) {
+	orig := newS3API
+	newS3API = func(*session.Session, *aws.Config) s3iface.S3API { return fake }
+	defer func() { newS3API = orig }()
+	fn()
+}
+
+// newTestSession returns a session on fake, which is a new backend if nil.
+// mod modifies the config before the session is made.
+func newTestSession(t testing.TB, fake *fakeS3, mod func(c *Config)) (*Session, *fakeS3) {
+	t.Helper()
+	if fake == nil {
+		fake = newFakeS3()
+	}
+	var sess *Session
+	var err error
+	onFake(fake, func() { sess, err = NewSession(testConfig(t, mod)) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sess, fake
+}
+
+// newTestMount returns a FileSystem as mounted, with background tasks of
+// config. It's unmounted by cleanup.
+func newTestMount(t testing.TB, fake *fakeS3, mod func(c *Config)) *FileSystem {
+	t.Helper()
+	var fs *FileSystem
+	onFake(fake, func() { fs = newFileSystem(testConfig(t, mod)) })
+	t.Cleanup(fs.OnUnmount)
+	return fs
+}
+
+// newTestFS returns a FileSystem of newTestSession, not mounted.
+func newTestFS(t testing.TB, fake *fakeS3, mod func(c *Config)) (*FileSystem, *fakeS3) {
+	t.Helper()
+	sess, fake := newTestSession(t, fake, mod)
+	return &FileSystem{Sess: sess, logger: sess.logger}, fake
+}
+
+// metaName returns name of metadata object of key in the fake
+func (s *Session) metaName(key ObjectKey) string {
+	bucket, name := s.s3.location(MetaObject, key)
+	return bucket + "/" + name
+}
+
+// dataPrefix returns prefix of names of data objects in the fake
+func (s *Session) dataPrefix() string {
+	bucket, name := s.s3.location(DataObject, "")
+	return bucket + "/" + name
+}
+
+var testContext = &fuse.Context{Owner: fuse.Owner{Uid: 1, Gid: 2}}
+
+func writeFile(t testing.TB, fs *FileSystem, name string, data []byte) {
+	t.Helper()
+	f, st := fs.Create(name, 0, 0644, testContext)
+	if st != fuse.OK {
+		t.Fatalf("create %s: %v", name, st)
+	}
+	defer f.Release()
+	n, st := f.Write(data, 0)
+	if st != fuse.OK || int(n) != len(data) {
+		t.Fatalf("write %s: %v", name, st)
+	}
+	if st := f.Flush(); st != fuse.OK {
+		t.Fatalf("flush %s: %v", name, st)
+	}
+}
+
+func readFile(t testing.TB, fs *FileSystem, name string) []byte {
+	t.Helper()
+	attr, st := fs.GetAttr(name, testContext)
+	if st != fuse.OK {
+		t.Fatalf("getattr %s: %v", name, st)
+	}
+	f, st := fs.Open(name, 0, testContext)
+	if st != fuse.OK {
+		t.Fatalf("open %s: %v", name, st)
+	}
+	defer f.Release()
+	buf := make([]byte, attr.Size)
+	res, st := f.Read(buf, 0)
+	if st != fuse.OK {
+		t.Fatalf("read %s: %v", name, st)
+	}
+	data, _ := res.Bytes(nil)
+	return data
+}
+
+func (f *FileSystem) mustKey(t testing.TB, name string) ObjectKey {
+	t.Helper()
+	key, err := f.Sess.PathWalk(context.Background(), name)
+	if err != nil {
+		t.Fatalf("walk %s: %v", name, err)
+	}
+	return key
+}
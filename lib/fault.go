@@ -0,0 +1,223 @@
+package bucketsync
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// FaultInjectionEnv must be "1" in the environment for FaultInjection to be
+// applied, so that a config copied to production doesn't break a mount.
+const FaultInjectionEnv = "BUCKETSYNC_FAULT_INJECTION"
+
+// Operations of FaultConfig
+const (
+	FaultGet    = "get"
+	FaultPut    = "put"
+	FaultHead   = "head"
+	FaultDelete = "delete"
+	FaultList   = "list"
+)
+
+// FaultConfig injects failures into backend requests, for testing retries
+// and recovery. Rates are fractions of matching requests.
+type FaultConfig struct {
+	// Ops are operations injected, all if empty. KeyPrefix limits to object
+	// names with it, including MetaPrefix or DataPrefix.
+	Ops       []string `yaml:"ops"`
+	KeyPrefix string   `yaml:"key_prefix"`
+	// ErrorRate fails requests by 503 SlowDown, which is retried
+	ErrorRate float64 `yaml:"error_rate"`
+	// LatencyRate delays requests by Latency
+	LatencyRate float64       `yaml:"latency_rate"`
+	Latency     time.Duration `yaml:"latency"`
+	// CorruptRate flips a byte of GET response bodies
+	CorruptRate float64 `yaml:"corrupt_rate"`
+	// Seed makes injection reproducible, random if 0
+	Seed int64 `yaml:"seed"`
+}
+
+func (c *FaultConfig) validate() bool {
+	for _, rate := range []float64{c.ErrorRate, c.LatencyRate, c.CorruptRate} {
+		if rate < 0 || rate > 1 {
+			return false
+		}
+	}
+	for _, op := range c.Ops {
+		switch op {
+		case FaultGet, FaultPut, FaultHead, FaultDelete, FaultList:
+		default:
+			return false
+		}
+	}
+	return c.Latency >= 0
+}
+
+// faultTransport injects faults of config into requests sent by next.
+type faultTransport struct {
+	next      http.RoundTripper
+	config    FaultConfig
+	ops       map[string]bool // nil is all
+	pathStyle bool
+	logger    *Logger
+	injected  int64
+
+	lock sync.Mutex
+	rand *rand.Rand
+}
+
+// injectFaults makes awsConfig inject faults, if it's enabled by both config
+// and environment. It returns the transport injecting them.
+func injectFaults(config *Config, awsConfig *aws.Config, logger *Logger) (*faultTransport, error) {
+	if config.FaultInjection == nil {
+		return nil, nil
+	}
+	if os.Getenv(FaultInjectionEnv) != "1" {
+		return nil, errors.Errorf("fault_injection is set, but %s=1 is not", FaultInjectionEnv)
+	}
+	fault := *config.FaultInjection
+	seed := fault.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	if awsConfig.HTTPClient == nil {
+		awsConfig.HTTPClient = &http.Client{}
+	}
+	next := awsConfig.HTTPClient.Transport
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	t := &faultTransport{
+		next:      next,
+		config:    fault,
+		pathStyle: config.pathStyle(),
+		logger:    logger,
+		rand:      rand.New(rand.NewSource(seed)),
+	}
+	if len(fault.Ops) != 0 {
+		t.ops = make(map[string]bool, len(fault.Ops))
+		for _, op := range fault.Ops {
+			t.ops[op] = true
+		}
+	}
+	awsConfig.HTTPClient.Transport = t
+	logger.Warn("FAULT INJECTION IS ENABLED, backend requests fail on purpose",
+		zap.Float64("error rate", fault.ErrorRate), zap.Float64("latency rate", fault.LatencyRate),
+		zap.Float64("corrupt rate", fault.CorruptRate), zap.Int64("seed", seed))
+	return t, nil
+}
+
+// roll returns true at rate.
+func (t *faultTransport) roll(rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.rand.Float64() < rate
+}
+
+// target returns operation and object name of req.
+func (t *faultTransport) target(req *http.Request) (op, name string) {
+	name = strings.TrimPrefix(req.URL.Path, "/")
+	if t.pathStyle {
+		// Bucket is the first segment
+		i := strings.IndexByte(name, '/')
+		name = name[i+1:]
+		if i < 0 {
+			name = ""
+		}
+	}
+	switch req.Method {
+	case http.MethodGet:
+		if name == "" {
+			return FaultList, name
+		}
+		return FaultGet, name
+	case http.MethodPut:
+		return FaultPut, name
+	case http.MethodHead:
+		return FaultHead, name
+	case http.MethodDelete:
+		return FaultDelete, name
+	}
+	return strings.ToLower(req.Method), name
+}
+
+func (t *faultTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	op, name := t.target(req)
+	if t.ops != nil && !t.ops[op] || !strings.HasPrefix(name, t.config.KeyPrefix) {
+		return t.next.RoundTrip(req)
+	}
+	if t.roll(t.config.LatencyRate) {
+		t.inject("latency", op, name)
+		select {
+		case <-time.After(t.config.Latency):
+		case <-req.Context().Done():
+			if req.Body != nil {
+				req.Body.Close()
+			}
+			return nil, req.Context().Err()
+		}
+	}
+	if t.roll(t.config.ErrorRate) {
+		t.inject("error", op, name)
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		body := "<Error><Code>SlowDown</Code><Message>injected fault</Message></Error>"
+		return &http.Response{
+			Status:        "503 Service Unavailable",
+			StatusCode:    http.StatusServiceUnavailable,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        http.Header{"Content-Type": []string{"application/xml"}},
+			Body:          ioutil.NopCloser(strings.NewReader(body)),
+			ContentLength: int64(len(body)),
+			Request:       req,
+		}, nil
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil || op != FaultGet || resp.StatusCode != http.StatusOK || !t.roll(t.config.CorruptRate) {
+		return resp, err
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != 0 {
+		t.inject("corruption", op, name)
+		t.lock.Lock()
+		data[t.rand.Intn(len(data))] ^= 0xff
+		t.lock.Unlock()
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(data))
+	return resp, nil
+}
+
+func (t *faultTransport) inject(fault, op, name string) {
+	atomic.AddInt64(&t.injected, 1)
+	t.logger.Debug("Fault injected", zap.String("fault", fault), zap.String("op", op),
+		zap.String("name", name))
+}
+
+// InjectedFaults returns number of faults injected into backend requests.
+func (s *S3Session) InjectedFaults() int64 {
+	if s.fault == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&s.fault.injected)
+}
@@ -0,0 +1,185 @@
+package bucketsync
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// serveFake serves objects of fake by S3 REST API of path style, so that
+// requests pass the HTTP transport.
+func serveFake(t *testing.T, fake *fakeS3) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+		bucket, key := aws.String(path[0]), aws.String("")
+		if len(path) == 2 {
+			key = aws.String(path[1])
+		}
+		var etag string
+		var body []byte
+		var err error
+		switch r.Method {
+		case http.MethodGet:
+			var out *s3.GetObjectOutput
+			out, err = fake.GetObjectWithContext(r.Context(), &s3.GetObjectInput{Bucket: bucket, Key: key})
+			if err == nil {
+				body, _ = ioutil.ReadAll(out.Body)
+				etag = aws.StringValue(out.ETag)
+			}
+		case http.MethodHead:
+			var out *s3.HeadObjectOutput
+			out, err = fake.HeadObjectWithContext(r.Context(), &s3.HeadObjectInput{Bucket: bucket, Key: key})
+			if err == nil {
+				etag = aws.StringValue(out.ETag)
+			}
+		case http.MethodPut:
+			data, _ := ioutil.ReadAll(r.Body)
+			var out *s3.PutObjectOutput
+			out, err = fake.put(r.Context(), &s3.PutObjectInput{Bucket: bucket, Key: key, Body: bytes.NewReader(data)}, r.Header)
+			if err == nil {
+				etag = aws.StringValue(out.ETag)
+			}
+		default:
+			w.WriteHeader(http.StatusNotImplemented)
+			return
+		}
+		if failure, ok := err.(awserr.RequestFailure); ok {
+			w.WriteHeader(failure.StatusCode())
+			fmt.Fprintf(w, "<Error><Code>%s</Code></Error>", failure.Code())
+			return
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Write(body)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// newFaultFS returns a FileSystem on fake through server with faults of
+// fault, retrying without backoff.
+func newFaultFS(t *testing.T, fake *fakeS3, fault *FaultConfig, mod func(c *Config)) (*FileSystem, error) {
+	server := serveFake(t, fake)
+	orig := newS3API
+	newS3API = func(sess *session.Session, awsConfig *aws.Config) s3iface.S3API {
+		awsConfig.Retryer = client.DefaultRetryer{
+			NumMaxRetries:    10,
+			MinRetryDelay:    time.Millisecond,
+			MaxRetryDelay:    time.Millisecond,
+			MinThrottleDelay: time.Millisecond,
+			MaxThrottleDelay: time.Millisecond,
+		}
+		return s3.New(sess, awsConfig)
+	}
+	defer func() { newS3API = orig }()
+	sess, err := NewSession(testConfig(t, func(c *Config) {
+		c.Endpoint = server.URL
+		c.DataPrefix = "data/"
+		c.FaultInjection = fault
+		if mod != nil {
+			mod(c)
+		}
+	}))
+	if err != nil {
+		return nil, err
+	}
+	return &FileSystem{Sess: sess, logger: sess.logger}, nil
+}
+
+func TestFaultInjectionRequiresEnv(t *testing.T) {
+	if (&Config{FaultInjection: &FaultConfig{ErrorRate: 2}}).validate() {
+		t.Fatal("error rate 2 is valid")
+	}
+	if (&Config{FaultInjection: &FaultConfig{Ops: []string{"post"}}}).validate() {
+		t.Fatal("unknown op is valid")
+	}
+	t.Setenv(FaultInjectionEnv, "")
+	if _, err := newFaultFS(t, newFakeS3(), &FaultConfig{ErrorRate: 0.5}, nil); err == nil {
+		t.Fatal("fault injection without the environment")
+	}
+}
+
+// TestInjectedErrorsAreRetried fails a third of requests. Writes and
+// reads succeed by retries.
+func TestInjectedErrorsAreRetried(t *testing.T) {
+	t.Setenv(FaultInjectionEnv, "1")
+	fake := newFakeS3()
+	fs, err := newFaultFS(t, fake, &FaultConfig{ErrorRate: 0.3, Seed: 1}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := testContent()
+	writeFile(t, fs, "f", data)
+	reader, err := newFaultFS(t, fake, &FaultConfig{ErrorRate: 0.3, Seed: 2}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, reader, "f"); !bytes.Equal(got, data) {
+		t.Fatalf("read %q", got)
+	}
+	for _, fs := range []*FileSystem{fs, reader} {
+		if n := fs.Sess.Stats().InjectedFaults; n == 0 {
+			t.Fatal("no fault is injected")
+		}
+	}
+}
+
+// TestInjectedCorruptionIsRepaired corrupts downloads of data objects.
+// Repair finds every object damaged, and uploads it again from the open file.
+func TestInjectedCorruptionIsRepaired(t *testing.T) {
+	t.Setenv(FaultInjectionEnv, "1")
+	fake := newFakeS3()
+	fault := &FaultConfig{Ops: []string{FaultGet}, KeyPrefix: "data/", CorruptRate: 1, Seed: 1}
+	fs, err := newFaultFS(t, fake, fault, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := testContent()
+	f, st := fs.Create("f", 0, 0644, testContext)
+	if st != fuse.OK {
+		t.Fatal(st)
+	}
+	defer f.Release()
+	if _, st := f.Write(data, 0); st != fuse.OK {
+		t.Fatal(st)
+	}
+	if st := f.Flush(); st != fuse.OK {
+		t.Fatal(st)
+	}
+	puts := fake.totalPuts(fs.Sess.dataPrefix())
+
+	report, err := fs.Sess.Repair(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Checked == 0 || report.Damaged != report.Checked || report.Repaired != report.Damaged || report.Quarantined != 0 {
+		t.Fatalf("report %+v", report)
+	}
+	if n := fake.totalPuts(fs.Sess.dataPrefix()) - puts; n != report.Repaired {
+		t.Fatalf("%d uploads for %d repaired", n, report.Repaired)
+	}
+	if n := fs.Sess.Stats().InjectedFaults; n < int64(report.Damaged) {
+		t.Fatalf("%d faults injected", n)
+	}
+	reader, _ := newTestFS(t, fake, func(c *Config) { c.DataPrefix = "data/" })
+	if got := readFile(t, reader, "f"); !bytes.Equal(got, data) {
+		t.Fatalf("read %q", got)
+	}
+}
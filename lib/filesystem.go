@@ -2,12 +2,18 @@ package bucketsync
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"encoding/json"
 
 	"github.com/hanwen/go-fuse/fuse"
+	"github.com/pkg/errors"
 	"go.uber.org/zap"
 )
 
@@ -20,6 +26,102 @@ type Meta struct {
 	Atime time.Time `json:"atime"`
 	Ctime time.Time `json:"ctime"`
 	Mtime time.Time `json:"mtime"`
+	Btime time.Time `json:"btime"` // creation, never updated
+	// TTL since Mtime to delete the file, or default TTL of entries of
+	// the directory
+	TTL time.Duration `json:"ttl,omitempty"`
+	// POSIX ACLs, nil if mode is all. DefaultACL is for a directory.
+	ACL        ACL `json:"acl,omitempty"`
+	DefaultACL ACL `json:"default_acl,omitempty"`
+	// Durability level of the file, or default of entries of the directory
+	Durability string `json:"durability,omitempty"`
+}
+
+// metaJSON is serialized form of Meta, times are in Unix nanoseconds.
+type metaJSON struct {
+	Size  int64           `json:"size"`
+	Mode  uint32          `json:"mode"`
+	UID   uint32          `json:"uid"`
+	GID   uint32          `json:"gid"`
+	Atime json.RawMessage `json:"atime"`
+	Ctime json.RawMessage `json:"ctime"`
+	Mtime json.RawMessage `json:"mtime"`
+	Btime json.RawMessage `json:"btime"`
+	TTL   time.Duration   `json:"ttl,omitempty"`
+
+	ACL        ACL    `json:"acl,omitempty"`
+	DefaultACL ACL    `json:"default_acl,omitempty"`
+	Durability string `json:"durability,omitempty"`
+}
+
+func (m Meta) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&metaJSON{
+		Size:  m.Size,
+		Mode:  m.Mode,
+		UID:   m.UID,
+		GID:   m.GID,
+		Atime: marshalTime(m.Atime),
+		Ctime: marshalTime(m.Ctime),
+		Mtime: marshalTime(m.Mtime),
+		Btime: marshalTime(m.Btime),
+		TTL:   m.TTL,
+
+		ACL:        m.ACL,
+		DefaultACL: m.DefaultACL,
+		Durability: m.Durability,
+	})
+}
+
+// UnmarshalJSON accepts both Unix nanoseconds and legacy RFC3339 string.
+func (m *Meta) UnmarshalJSON(data []byte) error {
+	raw := &metaJSON{}
+	err := json.Unmarshal(data, raw)
+	if err != nil {
+		return err
+	}
+	m.Size = raw.Size
+	m.Mode = raw.Mode
+	m.UID = raw.UID
+	m.GID = raw.GID
+	m.TTL = raw.TTL
+	m.ACL, m.DefaultACL = raw.ACL, raw.DefaultACL
+	m.Durability = raw.Durability
+	if m.Atime, err = unmarshalTime(raw.Atime); err != nil {
+		return err
+	}
+	if m.Ctime, err = unmarshalTime(raw.Ctime); err != nil {
+		return err
+	}
+	if m.Mtime, err = unmarshalTime(raw.Mtime); err != nil {
+		return err
+	}
+	if m.Btime, err = unmarshalTime(raw.Btime); err != nil {
+		return err
+	}
+	return nil
+}
+
+func marshalTime(t time.Time) json.RawMessage {
+	if t.IsZero() {
+		return json.RawMessage("null")
+	}
+	return json.RawMessage(strconv.FormatInt(t.UnixNano(), 10))
+}
+
+func unmarshalTime(raw json.RawMessage) (time.Time, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return time.Time{}, nil
+	}
+	if raw[0] == '"' {
+		t := time.Time{}
+		err := json.Unmarshal(raw, &t)
+		return t, err
+	}
+	nsec, err := strconv.ParseInt(string(raw), 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, nsec), nil
 }
 
 // Node is common part of Directory, File, and SymLink
@@ -32,98 +134,583 @@ type Directory struct {
 	Key      ObjectKey            `json:"key"`
 	Meta     Meta                 `json:"meta"`
 	FileMeta map[string]ObjectKey `json:"children"`
+	Defaults *Defaults            `json:"defaults,omitempty"`
 	sess     *Session
+	etag     string     // root only, ETag of loaded object
+	base     *Directory // root only, as loaded
 }
 
-func (o *Directory) Save() error {
+func (o *Directory) Save(ctx context.Context) error {
+	if o.Key == o.sess.RootKey() {
+		return o.sess.commitRoot(ctx, o)
+	}
 	result, err := json.Marshal(o)
 	if err != nil {
 		return err
 	}
-	return o.sess.s3.UploadWithCache(o.Key, bytes.NewReader(result))
+	refs := make([]ObjectKey, 0, len(o.FileMeta))
+	for _, key := range o.FileMeta {
+		refs = append(refs, key)
+	}
+	return o.sess.s3.UploadBatched(ctx, o.Key, result, refs)
+}
+
+// setChild adds or replaces an entry, it's a change of directory content.
+func (o *Directory) setChild(name string, key ObjectKey) {
+	o.FileMeta[name] = key
+	o.sess.removeNegative(o.Key, name)
+	o.Meta.Mtime = o.sess.now()
+	o.Meta.Ctime = o.Meta.Mtime
+}
+
+// removeChild removes an entry, it's a change of directory content.
+func (o *Directory) removeChild(name string) {
+	delete(o.FileMeta, name)
+	o.Meta.Mtime = o.sess.now()
+	o.Meta.Ctime = o.Meta.Mtime
+}
+
+// setBase records the root as loaded or committed, for rebase.
+func (o *Directory) setBase() {
+	base := &Directory{Key: o.Key, Meta: o.Meta, FileMeta: make(map[string]ObjectKey, len(o.FileMeta))}
+	for name, key := range o.FileMeta {
+		base.FileMeta[name] = key
+	}
+	base.Meta.ACL = append(ACL(nil), o.Meta.ACL...)
+	base.Meta.DefaultACL = append(ACL(nil), o.Meta.DefaultACL...)
+	if o.Defaults != nil {
+		d := *o.Defaults
+		base.Defaults = &d
+	}
+	o.base = base
 }
 
+// rebase reapplies changes of children, meta and defaults since load onto
+// latest. A field changed since load is taken from o, others from latest.
+func (o *Directory) rebase(latest *Directory) {
+	base := o.base
+	if base == nil {
+		base = &Directory{FileMeta: map[string]ObjectKey{}}
+	}
+	for name, key := range o.FileMeta {
+		if old, ok := base.FileMeta[name]; !ok || old != key {
+			latest.FileMeta[name] = key
+		}
+	}
+	for name := range base.FileMeta {
+		if _, ok := o.FileMeta[name]; !ok {
+			delete(latest.FileMeta, name)
+		}
+	}
+	o.FileMeta = latest.FileMeta
+
+	ours, old := &o.Meta, &base.Meta
+	meta := latest.Meta
+	if ours.Size != old.Size {
+		meta.Size = ours.Size
+	}
+	if ours.Mode != old.Mode {
+		meta.Mode = ours.Mode
+	}
+	if ours.UID != old.UID {
+		meta.UID = ours.UID
+	}
+	if ours.GID != old.GID {
+		meta.GID = ours.GID
+	}
+	if !ours.Atime.Equal(old.Atime) {
+		meta.Atime = ours.Atime
+	}
+	if !ours.Ctime.Equal(old.Ctime) {
+		meta.Ctime = ours.Ctime
+	}
+	if !ours.Mtime.Equal(old.Mtime) {
+		meta.Mtime = ours.Mtime
+	}
+	if !ours.Btime.Equal(old.Btime) {
+		meta.Btime = ours.Btime
+	}
+	if ours.TTL != old.TTL {
+		meta.TTL = ours.TTL
+	}
+	if !ours.ACL.equal(old.ACL) {
+		meta.ACL = ours.ACL
+	}
+	if !ours.DefaultACL.equal(old.DefaultACL) {
+		meta.DefaultACL = ours.DefaultACL
+	}
+	if ours.Durability != old.Durability {
+		meta.Durability = ours.Durability
+	}
+	o.Meta = meta
+	if !o.Defaults.equal(base.Defaults) {
+		latest.Defaults = o.Defaults
+	}
+	o.Defaults = latest.Defaults
+
+	o.base = latest.base
+	o.etag = latest.etag
+}
+
+// ChecksumXAttr is extended attribute name to get whole-file checksum
+const ChecksumXAttr = "user.bucketsync.checksum"
+
+// DontNeedXAttr is extended attribute name to set "offset length" range as
+// fadvise DONTNEED, since FUSE doesn't pass the hint. Length 0 is to the end.
+const DontNeedXAttr = "user.bucketsync.dontneed"
+
 type File struct {
 	Key        ObjectKey         `json:"key"`
 	Meta       Meta              `json:"meta"`
 	ExtentSize int64             `json:"extent_size"`
+	ChunkSize  int64             `json:"chunk_size,omitempty"` // 0 is not chunked
 	Extent     map[int64]*Extent `json:"extent"`
+	Checksum   string            `json:"checksum,omitempty"` // SHA-256 of whole content, "" if modified
 	sess       *Session
-	dirty      bool
+	lock       sync.Mutex // held by handles while accessing
+	dirty      bool       // changed since last save
+	stale      bool       // content is changed, so Checksum is outdated
+	dirtyBytes int64      // written since last save
+	lastSave   SaveStats
+
+	// indexes of extents modified since last save, so that Save doesn't scan
+	// all of them
+	dirtyExtents map[int64]struct{}
+}
+
+// markDirty records n bytes are modified since last save.
+func (o *File) markDirty(n int64) {
+	o.markMeta()
+	o.stale = true
+	o.dirtyBytes += n
+	atomic.AddInt64(&o.sess.counters.dirtyBytes, n)
+}
+
+// markExtent records extent of index is modified since last save.
+func (o *File) markExtent(index int64) {
+	o.Extent[index].dirty = true
+	if o.dirtyExtents == nil {
+		o.dirtyExtents = make(map[int64]struct{})
+	}
+	o.dirtyExtents[index] = struct{}{}
+}
+
+// markMeta records only metadata is modified since last save.
+func (o *File) markMeta() {
+	if !o.dirty {
+		atomic.AddInt64(&o.sess.counters.dirtyFiles, 1)
+	}
+	o.dirty = true
+}
+
+// clean resets dirty state
+func (o *File) clean() {
+	if o.dirty {
+		atomic.AddInt64(&o.sess.counters.dirtyFiles, -1)
+		atomic.AddInt64(&o.sess.counters.dirtyBytes, -o.dirtyBytes)
+	}
+	o.dirty = false
+	o.stale = false
+	o.dirtyBytes = 0
+	o.dirtyExtents = nil
+}
+
+// SaveStats is summary of data objects written by File.Save
+type SaveStats struct {
+	Extents      int64 `json:"extents"`       // dirty extents
+	Uploaded     int64 `json:"uploaded"`      // objects uploaded
+	Deduped      int64 `json:"deduped"`       // objects already stored, not unchanged chunks
+	DedupedBytes int64 `json:"deduped_bytes"` // size of deduped objects before compression
+	// size of uploaded objects before compression
+	UploadedBytes int64 `json:"uploaded_bytes"`
+}
+
+func (st *SaveStats) dedup(size int) {
+	atomic.AddInt64(&st.Deduped, 1)
+	atomic.AddInt64(&st.DedupedBytes, int64(size))
 }
 
-func (o *File) Save() error {
+// LastSave returns summary of the last successful Save.
+func (o *File) LastSave() SaveStats {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return o.lastSave
+}
+
+// Save uploads dirty extents, then the metadata referring them. Objects of
+// all extents are confirmed concurrently, by HEAD of existing ones or
+// upload, and the metadata is uploaded only after all of them are present,
+// so that a crash never leaves metadata referring a missing object.
+func (o *File) Save(ctx context.Context) error {
+	if o.stale {
+		// Calculated on demand by ContentChecksum, a save never reads
+		// extents not modified
+		o.Checksum = ""
+	}
+
+	stats := &SaveStats{}
+	saving := &sync.Map{}
 	wg := sync.WaitGroup{}
-	errc := make(chan error)
-	done := make(chan struct{})
-	for _, e := range o.Extent {
+	errc := make(chan error, len(o.dirtyExtents))
+	for i := range o.dirtyExtents {
+		e, ok := o.Extent[i]
+		if !ok || !e.dirty {
+			continue // dropped or saved already
+		}
 		wg.Add(1)
 		go func(e *Extent) {
-			if !e.dirty {
-				wg.Done()
-				return
-			}
-			key := e.CurrentKey()
-			if o.sess.s3.IsExist(key) {
-				wg.Done()
-				return
-			}
-			err := o.sess.s3.Upload(key, bytes.NewReader(e.body))
+			defer wg.Done()
+			atomic.AddInt64(&stats.Extents, 1)
+			err := e.upload(ctx, o.ChunkSize, stats, saving)
 			if err != nil {
 				errc <- err
 				return
 			}
 			e.dirty = false
-			wg.Done()
 		}(e)
 	}
-	go func() {
-		wg.Wait()
-		close(done)
-	}()
+	// Wait all uploads even on failure, so that none of them outlives the
+	// lock held by caller and readers only see resident bodies or uploaded
+	// objects.
+	wg.Wait()
+	close(errc)
+	if err := <-errc; err != nil {
+		return err
+	}
+
+	o.guardAmplification(stats)
+
+	result, err := json.Marshal(o)
+	if err != nil {
+		return err
+	}
+	err = o.sess.s3.UploadBatched(ctx, o.Key, result, nil)
+	if err != nil {
+		return err
+	}
+	o.clean()
+	o.lastSave = *stats
+	o.sess.counters.addSave(stats)
+	o.sess.logger.Debug("File saved", zap.String("key", o.Key),
+		zap.Int64("extents", stats.Extents), zap.Int64("uploaded", stats.Uploaded),
+		zap.Int64("deduped", stats.Deduped), zap.Int64("deduped bytes", stats.DedupedBytes))
+	return nil
+}
 
-	select {
-	case err := <-errc:
+// guardAmplification switches the file to smaller chunks, if the save
+// uploaded more than WriteAmplification times of bytes written. Extents are
+// read regardless of their chunks, so it applies from the next save.
+func (o *File) guardAmplification(stats *SaveStats) {
+	threshold := o.sess.WriteAmplification()
+	if threshold <= 0 || o.dirtyBytes <= 0 {
+		return
+	}
+	amplification := float64(stats.UploadedBytes) / float64(o.dirtyBytes)
+	if amplification <= threshold {
+		return
+	}
+	size := o.sess.config.guardChunkSize(o.ExtentSize)
+	if o.ChunkSize > 0 && o.ChunkSize <= size {
+		return
+	}
+	o.ChunkSize = size
+	o.sess.logger.Info("Smaller chunks for write amplification", zap.String("key", o.Key),
+		zap.Float64("amplification", amplification), zap.Int64("chunk size", size))
+}
+
+// ContentChecksum returns SHA-256 of content, Checksum if it's recorded.
+// Otherwise it's calculated extent by extent, sparse area is hashed as zero.
+// Extents filled for it are released right after, so it doesn't hold more
+// than an extent.
+func (o *File) ContentChecksum(ctx context.Context) (string, error) {
+	if o.Checksum != "" {
+		return o.Checksum, nil
+	}
+	h := sha256.New()
+	for i, remain := int64(0), o.Meta.Size; remain > 0; i++ {
+		n := o.ExtentSize
+		if remain < n {
+			n = remain
+		}
+		body := []byte{}
+		if e, ok := o.Extent[i]; ok {
+			resident := e.dirty || len(e.body) != 0
+			err := e.Fill(ctx)
+			if err != nil {
+				return "", err
+			}
+			body = e.body
+			if int64(len(body)) > n {
+				body = body[:n]
+			}
+			h.Write(body)
+			if !resident {
+				e.release()
+			}
+		}
+		h.Write(make([]byte, n-int64(len(body))))
+		remain -= n
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Truncate drops extents entirely beyond size and sets size.
+func (o *File) Truncate(ctx context.Context, size int64) error {
+	var err error
+	if size < o.Meta.Size {
+		err = o.zeroRange(ctx, size, o.Meta.Size)
+	} else {
+		err = o.zeroRange(ctx, o.Meta.Size, size)
+	}
+	if err != nil {
+		return err
+	}
+	err = o.sess.reserveSpace(ctx, size-o.Meta.Size)
+	if err != nil {
 		return err
-	case <-done:
-		result, err := json.Marshal(o)
+	}
+	for i, e := range o.Extent {
+		if i*o.ExtentSize >= size {
+			e.release()
+			delete(o.Extent, i)
+		}
+	}
+	o.Meta.Size = size
+	o.markDirty(0)
+	o.Meta.Mtime = o.sess.now()
+	o.Meta.Ctime = o.Meta.Mtime
+	return nil
+}
+
+// zeroRange makes content of [from, to) zero, extents entirely in it are
+// dropped as sparse. Extents can have stale bytes beyond size, so it's
+// needed when size grows.
+func (o *File) zeroRange(ctx context.Context, from, to int64) error {
+	for i, e := range o.Extent {
+		start, end := i*o.ExtentSize, (i+1)*o.ExtentSize
+		if end <= from || to <= start {
+			continue
+		}
+		if from <= start && end <= to {
+			e.release()
+			delete(o.Extent, i)
+			continue
+		}
+		err := e.Fill(ctx)
 		if err != nil {
 			return err
 		}
-		err = o.sess.s3.UploadWithCache(o.Key, bytes.NewReader(result))
+		lo, hi := from-start, to-start
+		if lo < 0 {
+			lo = 0
+		}
+		if hi > int64(len(e.body)) {
+			hi = int64(len(e.body))
+		}
+		if lo >= hi {
+			continue
+		}
+		for j := lo; j < hi; j++ {
+			e.body[j] = 0
+		}
+		o.markExtent(i)
+		e.Key = e.CurrentKey()
+	}
+	return nil
+}
+
+// DropCache releases bodies of clean extents overlapping the range,
+// and returns number of dropped extents. length 0 is to the end.
+func (o *File) DropCache(off, length int64) int {
+	dropped := 0
+	for i, e := range o.Extent {
+		start, end := i*o.ExtentSize, (i+1)*o.ExtentSize
+		if end <= off || (length > 0 && off+length <= start) {
+			continue
+		}
+		if e.dirty || len(e.body) == 0 {
+			continue
+		}
+		e.release()
+		dropped++
+	}
+	return dropped
+}
+
+// Blocks returns number of 512-byte blocks allocated by extents, of their
+// bytes within the file size. Sparse area has no extent, so it doesn't count.
+func (o *File) Blocks() uint64 {
+	var allocated int64
+	for i := range o.Extent {
+		n := o.Meta.Size - i*o.ExtentSize
+		if n > o.ExtentSize {
+			n = o.ExtentSize
+		}
+		if n > 0 {
+			allocated += n
+		}
+	}
+	return uint64((allocated + 511) / 512)
+}
+
+// Extent is a part of file. If it's chunked, body is stored as Chunks and
+// Key is only its identity, otherwise body is stored as Key.
+type Extent struct {
+	Key         ObjectKey   `json:"key"`
+	Chunks      []ObjectKey `json:"chunks,omitempty"`
+	Compression string      `json:"compression,omitempty"`
+	Dict        string      `json:"dict,omitempty"`
+	Damaged     bool        `json:"damaged,omitempty"` // quarantined by Repair
+	body        []byte      // call Fill() to use this
+	dirty       bool
+	sess        *Session
+}
+
+// Objects returns keys of data objects storing the extent.
+func (e *Extent) Objects() []ObjectKey {
+	keys := e.Chunks
+	if len(keys) == 0 {
+		keys = []ObjectKey{e.Key}
+	}
+	objects := make([]ObjectKey, 0, len(keys))
+	for _, key := range keys {
+		objects = append(objects, objectName(key, e.Compression, e.Dict))
+	}
+	return objects
+}
+
+// upload stores body, only chunks which are changed or don't exist.
+// saving has names of objects stored by the same save.
+func (e *Extent) upload(ctx context.Context, chunkSize int64, stats *SaveStats, saving *sync.Map) error {
+	compression, dict, err := e.sess.compression(ctx)
+	if err != nil {
+		return err
+	}
+	put := func(key ObjectKey, body []byte) error {
+		name := objectName(key, compression, dict)
+		if _, ok := saving.LoadOrStore(name, true); ok {
+			stats.dedup(len(body)) // by other extent of this save
+			return nil
+		}
+		if e.sess.s3.IsExist(ctx, DataObject, name) {
+			stats.dedup(len(body))
+			return nil
+		}
+		data, err := e.sess.compress(ctx, body, compression, dict)
+		if err != nil {
+			return err
+		}
+		if compression != "" && e.sess.config.PrivateLayout {
+			data = padZstd(data)
+		}
+		err = e.sess.s3.Upload(ctx, DataObject, name, bytes.NewReader(data))
 		if err != nil {
 			return err
 		}
+		atomic.AddInt64(&stats.Uploaded, 1)
+		atomic.AddInt64(&stats.UploadedBytes, int64(len(body)))
 		return nil
 	}
 
-}
+	if chunkSize <= 0 {
+		err = put(e.CurrentKey(), e.body)
+		if err != nil {
+			return err
+		}
+		e.Compression, e.Dict = compression, dict
+		return nil
+	}
 
-type Extent struct {
-	Key   ObjectKey `json:"key"`
-	body  []byte    // call Fill() to use this
-	dirty bool
-	sess  *Session
+	// Chunks are confirmed concurrently, so a dedup-heavy extent takes one
+	// round trip of HEAD rather than one per chunk.
+	same := compression == e.Compression && dict == e.Dict
+	chunks := make([]ObjectKey, 0, (int64(len(e.body))+chunkSize-1)/chunkSize)
+	wg := sync.WaitGroup{}
+	errc := make(chan error, cap(chunks))
+	for i, off := 0, int64(0); off < int64(len(e.body)); i, off = i+1, off+chunkSize {
+		end := off + chunkSize
+		if end > int64(len(e.body)) {
+			end = int64(len(e.body))
+		}
+		chunk := e.body[off:end]
+		key := e.sess.KeyGen(chunk)
+		chunks = append(chunks, key)
+		if same && i < len(e.Chunks) && e.Chunks[i] == key {
+			continue
+		}
+		wg.Add(1)
+		go func(key ObjectKey, chunk []byte) {
+			defer wg.Done()
+			err := put(key, chunk)
+			if err != nil {
+				errc <- err
+			}
+		}(key, chunk)
+	}
+	wg.Wait()
+	close(errc)
+	if err := <-errc; err != nil {
+		return err
+	}
+	e.Chunks = chunks
+	e.Compression, e.Dict = compression, dict
+	return nil
 }
 
 func (e *Extent) CurrentKey() ObjectKey {
 	return e.sess.KeyGen(e.body)
 }
 
-func (e *Extent) Fill() error {
+func (e *Extent) Fill(ctx context.Context) error {
 	if e.dirty || len(e.body) != 0 {
 		e.sess.logger.Debug("Already filled")
 		return nil
 	}
-	body, err := e.sess.s3.Download(e.Key)
+	body, err := e.download(ctx)
 	if err != nil {
 		return err
 	}
-	e.body = body
+	e.hold(body)
 	e.sess.logger.Debug("Fill Extent", zap.Int("body size", len(e.body)))
 	return nil
 }
 
+// download returns body stored in the objects of the extent, from the pool.
+func (e *Extent) download(ctx context.Context) ([]byte, error) {
+	if e.Damaged {
+		return nil, errors.Wrapf(ErrNotFound, "extent is damaged. key = %s", e.Key)
+	}
+	body := e.sess.bodies.getEmpty()
+	for _, key := range e.Objects() {
+		data, err := e.sess.s3.Download(ctx, DataObject, key)
+		if err != nil {
+			e.sess.bodies.put(body)
+			return nil, err
+		}
+		chunk, err := e.sess.decompress(ctx, data, e.Compression, e.Dict)
+		if err != nil {
+			e.sess.bodies.put(body)
+			return nil, errors.Wrapf(err, "decompress failed. key = %s", key)
+		}
+		body = append(body, chunk...)
+	}
+	return body, nil
+}
+
+// sameObjects returns true if e and o are stored in the same objects.
+func (e *Extent) sameObjects(o *Extent) bool {
+	if e.Key != o.Key || e.Compression != o.Compression || e.Dict != o.Dict || e.Damaged != o.Damaged ||
+		len(e.Chunks) != len(o.Chunks) {
+		return false
+	}
+	for i := range e.Chunks {
+		if e.Chunks[i] != o.Chunks[i] {
+			return false
+		}
+	}
+	return true
+}
+
 type SymLink struct {
 	Key    ObjectKey `json:"key"`
 	Meta   Meta      `json:"meta"`
@@ -131,12 +718,13 @@ type SymLink struct {
 	sess   *Session
 }
 
-func (o *SymLink) Save() error {
+func (o *SymLink) Save(ctx context.Context) error {
 	result, err := json.Marshal(o)
 	if err != nil {
 		return err
 	}
-	return o.sess.s3.UploadWithCache(o.Key, bytes.NewReader(result))
+	o.sess.links.Add(o.Key, []byte(o.LinkTo))
+	return o.sess.s3.UploadBatched(ctx, o.Key, result, nil)
 }
 
 func NewMeta(mode uint32, context *fuse.Context) Meta {
@@ -148,6 +736,7 @@ func NewMeta(mode uint32, context *fuse.Context) Meta {
 		Atime: time.Now(),
 		Ctime: time.Now(),
 		Mtime: time.Now(),
+		Btime: time.Now(),
 	}
 	return meta
 }
@@ -0,0 +1,210 @@
+package bucketsync
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func TestSaveReadsOnlyDirtyExtents(t *testing.T) {
+	fs, fake := newTestFS(t, nil, nil)
+	data := bytes.Repeat([]byte("0123456789abcdef"), 4)
+	writeFile(t, fs, "f", data)
+
+	gets := fake.totalGets(fs.Sess.dataPrefix())
+	f, st := fs.Open("f", uint32(os.O_RDWR), testContext)
+	if st != fuse.OK {
+		t.Fatal(st)
+	}
+	if _, st := f.Write([]byte("X"), 20); st != fuse.OK {
+		t.Fatal(st)
+	}
+	if st := f.Flush(); st != fuse.OK {
+		t.Fatal(st)
+	}
+	f.Release()
+	if n := fake.totalGets(fs.Sess.dataPrefix()) - gets; n != 1 {
+		t.Fatalf("save downloaded %d extents, want only the one written", n)
+	}
+
+	data[20] = 'X'
+	sum := sha256.Sum256(data)
+	checksum, st := fs.GetXAttr("f", ChecksumXAttr, testContext)
+	if st != fuse.OK || string(checksum) != hex.EncodeToString(sum[:]) {
+		t.Fatalf("checksum = %s %v", checksum, st)
+	}
+}
+
+func TestChecksumOfSparseFile(t *testing.T) {
+	fs, _ := newTestFS(t, nil, nil)
+	f, st := fs.Create("f", 0, 0644, testContext)
+	if st != fuse.OK {
+		t.Fatal(st)
+	}
+	f.Write([]byte("tail"), 40)
+	f.Flush()
+	f.Release()
+
+	file, st := fs.getFile(context.Background(), "f")
+	if st != fuse.OK {
+		t.Fatal(st)
+	}
+	checksum, err := file.ContentChecksum(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(append(make([]byte, 40), "tail"...))
+	if checksum != hex.EncodeToString(sum[:]) {
+		t.Fatal(checksum)
+	}
+	for i, e := range file.Extent {
+		if e.body != nil {
+			t.Fatalf("extent %d is kept after checksum", i)
+		}
+	}
+}
+
+func TestPartialCloneDoesNotReadDestination(t *testing.T) {
+	fs, fake := newTestFS(t, nil, nil)
+	writeFile(t, fs, "src", bytes.Repeat([]byte("s"), 64))
+	writeFile(t, fs, "dst", bytes.Repeat([]byte("d"), 64))
+
+	gets := fake.totalGets(fs.Sess.dataPrefix())
+	err := fs.Sess.Clone(context.Background(), fs.mustKey(t, "src"), 0, 16, fs.mustKey(t, "dst"), 16, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := fake.totalGets(fs.Sess.dataPrefix()) - gets; n != 0 {
+		t.Fatalf("clone downloaded %d extents", n)
+	}
+	want := append(bytes.Repeat([]byte("d"), 16), bytes.Repeat([]byte("s"), 16)...)
+	want = append(want, bytes.Repeat([]byte("d"), 32)...)
+	if got := readFile(t, fs, "dst"); !bytes.Equal(got, want) {
+		t.Fatalf("dst = %q", got)
+	}
+}
+
+func TestBlocksOfSparseFile(t *testing.T) {
+	fs, _ := newTestFS(t, nil, nil)
+	f, st := fs.Create("sparse", 0, 0644, testContext)
+	if st != fuse.OK {
+		t.Fatal(st)
+	}
+	if _, st := f.Write([]byte("x"), 1<<20); st != fuse.OK {
+		t.Fatal(st)
+	}
+	f.Flush()
+	f.Release()
+	writeFile(t, fs, "full", bytes.Repeat([]byte("0123456789abcdef"), 256))
+
+	for name, want := range map[string]uint64{"sparse": 1, "full": 4096 / 512} {
+		attr, st := fs.GetAttr(name, testContext)
+		if st != fuse.OK {
+			t.Fatal(st)
+		}
+		if attr.Blocks != want {
+			t.Fatalf("%s: %d blocks of size %d, want %d", name, attr.Blocks, attr.Size, want)
+		}
+	}
+
+	// A short extent counts by its bytes, not the extent size
+	large, _ := newTestFS(t, nil, func(c *Config) { c.ExtentSize = 64 * 1024 })
+	writeFile(t, large, "short", bytes.Repeat([]byte("x"), 1000))
+	attr, st := large.GetAttr("short", testContext)
+	if st != fuse.OK {
+		t.Fatal(st)
+	}
+	if attr.Blocks != 2 {
+		t.Fatalf("short: %d blocks of size %d, want 2", attr.Blocks, attr.Size)
+	}
+}
+
+func TestMetaTimesRoundTrip(t *testing.T) {
+	at := time.Unix(1500000000, 123456789)
+	meta := Meta{Mode: fuse.S_IFREG | 0644, Atime: at, Ctime: at.Add(1), Mtime: at.Add(2)}
+	data, err := json.Marshal(meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(data, []byte(`"atime":1500000000123456789`)) {
+		t.Fatalf("times are not nanoseconds: %s", data)
+	}
+	var got Meta
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !got.Atime.Equal(meta.Atime) || !got.Ctime.Equal(meta.Ctime) || !got.Mtime.Equal(meta.Mtime) || !got.Btime.IsZero() {
+		t.Fatalf("round trip %+v, want %+v", got, meta)
+	}
+
+	legacy := []byte(`{"size":3,"mode":33188,"uid":1,"gid":2,"atime":"2017-07-14T02:40:00.5+09:00",` +
+		`"ctime":"2017-07-14T02:40:00Z","mtime":"2017-07-14T02:40:00.123456789Z"}`)
+	if err := json.Unmarshal(legacy, &got); err != nil {
+		t.Fatal(err)
+	}
+	want := time.Date(2017, 7, 14, 2, 40, 0, 123456789, time.UTC)
+	if !got.Mtime.Equal(want) || got.Atime.Unix() != want.Unix()-9*3600 || got.Size != 3 {
+		t.Fatalf("legacy decoded %+v", got)
+	}
+}
+
+// TestBirthTimeIsStable changes a file in every way. Btime stays at the
+// creation, while mtime and ctime of the file and its directory move on.
+func TestBirthTimeIsStable(t *testing.T) {
+	fs, fake := newTestFS(t, nil, nil)
+	if st := fs.Mkdir("d", 0755, testContext); st != fuse.OK {
+		t.Fatal(st)
+	}
+	writeFile(t, fs, "d/f", []byte("created"))
+	file, _ := fs.getFile(context.Background(), "d/f")
+	born := file.Meta.Btime
+	dir, _ := fs.Sess.NewDirectory(context.Background(), fs.mustKey(t, "d"))
+	dirChanged := dir.Meta.Mtime
+
+	time.Sleep(10 * time.Millisecond)
+	f, st := fs.Open("d/f", syscall.O_RDWR, testContext)
+	if st != fuse.OK {
+		t.Fatal(st)
+	}
+	if _, st := f.Write([]byte("written"), 0); st != fuse.OK {
+		t.Fatal(st)
+	}
+	if st := f.Flush(); st != fuse.OK {
+		t.Fatal(st)
+	}
+	f.Release()
+	if st := fs.Chmod("d/f", 0600, testContext); st != fuse.OK {
+		t.Fatal(st)
+	}
+	atime := time.Unix(100, 0)
+	if st := fs.Utimens("d/f", &atime, nil, testContext); st != fuse.OK {
+		t.Fatal(st)
+	}
+	if st := fs.Rename("d/f", "d/g", testContext); st != fuse.OK {
+		t.Fatal(st)
+	}
+
+	reader, _ := newTestFS(t, fake, nil)
+	file, _ = reader.getFile(context.Background(), "d/g")
+	if !file.Meta.Btime.Equal(born) {
+		t.Fatalf("btime %v, created %v", file.Meta.Btime, born)
+	}
+	if !file.Meta.Mtime.After(born) || !file.Meta.Ctime.After(born) {
+		t.Fatalf("mtime %v ctime %v, created %v", file.Meta.Mtime, file.Meta.Ctime, born)
+	}
+	if !file.Meta.Atime.Equal(atime) {
+		t.Fatalf("atime %v", file.Meta.Atime)
+	}
+	dir, _ = reader.Sess.NewDirectory(context.Background(), reader.mustKey(t, "d"))
+	if !dir.Meta.Mtime.After(dirChanged) || !dir.Meta.Ctime.After(dirChanged) {
+		t.Fatalf("directory mtime %v ctime %v, before %v", dir.Meta.Mtime, dir.Meta.Ctime, dirChanged)
+	}
+}
@@ -0,0 +1,324 @@
+package bucketsync
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// Kinds of FsckIssue
+const (
+	// FsckDangling is entry of a directory whose object doesn't exist
+	FsckDangling = "dangling"
+	// FsckCorrupt is object which isn't a valid node of its key
+	FsckCorrupt = "corrupt"
+	// FsckCycle is entry referring a directory of its own ancestors
+	FsckCycle = "cycle"
+	// FsckShared is node referred by more than one entry, without hard links.
+	// Identical symlinks and empty directories share one object by design.
+	FsckShared = "shared"
+	// FsckMissingExtent is extent of a file whose object doesn't exist
+	FsckMissingExtent = "missing_extent"
+	// FsckBeyondSize is extent of a file entirely beyond its size
+	FsckBeyondSize = "beyond_size"
+	// FsckSizeMismatch is extent whose objects don't sum to its size, or a
+	// file whose extents can't hold its size
+	FsckSizeMismatch = "size_mismatch"
+	// FsckOrphan is node not reachable from the root
+	FsckOrphan = "orphan"
+)
+
+// FsckIssue is an inconsistency found by Fsck.
+type FsckIssue struct {
+	Kind     string    `json:"kind"`
+	Path     string    `json:"path,omitempty"`
+	Key      ObjectKey `json:"key"`
+	Detail   string    `json:"detail,omitempty"`
+	Repaired bool      `json:"repaired"`
+}
+
+// FsckReport is result of Fsck.
+type FsckReport struct {
+	Nodes   int         `json:"nodes"`   // reachable nodes checked
+	Objects int         `json:"objects"` // unique data objects checked
+	Issues  []FsckIssue `json:"issues"`
+}
+
+// fsck is state of a check, nodes are visited one by one.
+type fsck struct {
+	sess    *Session
+	repair  bool
+	report  *FsckReport
+	seen    map[ObjectKey]string // node -> first path
+	objects map[ObjectKey]int64  // data object -> size, -1 if missing
+}
+
+// Fsck checks structural consistency of the tree: entries resolve to valid
+// nodes, no cycles and no node shared by entries, extents exist and are
+// within the size, and every node is reachable from the root. With repair,
+// dangling and cyclic entries are pruned, missing extents are quarantined
+// and read by MissingExtent policy, and extents beyond the size are dropped.
+// Orphans are only reported, they may be of other roots sharing the bucket.
+// Repair holds the mount lock, so that it fails while a mount with MountLock
+// is there.
+func (s *Session) Fsck(ctx context.Context, repair bool) (*FsckReport, error) {
+	c := &fsck{
+		sess:    s,
+		repair:  repair,
+		report:  &FsckReport{},
+		seen:    map[ObjectKey]string{},
+		objects: map[ObjectKey]int64{},
+	}
+	if repair {
+		lock := s.NewBucketLock("mount")
+		err := lock.Acquire(ctx)
+		if err != nil {
+			return nil, errors.Wrap(err, "mount lock acquire failed")
+		}
+		lock.Hold(s.lockLost)
+		defer func() {
+			if err := lock.Release(context.Background()); err != nil {
+				s.logger.Error("mount lock release failed", zap.Error(err))
+			}
+		}()
+	}
+	root, err := s.NewDirectory(ctx, s.RootKey())
+	if err != nil {
+		return nil, errors.Wrap(err, "root load failed")
+	}
+	c.seen[root.Key] = ""
+	c.report.Nodes++
+	err = c.directory(ctx, "", root, map[ObjectKey]bool{root.Key: true})
+	if err == nil {
+		err = c.orphans(ctx)
+	}
+	if ferr := s.Flush(ctx); err == nil {
+		err = ferr
+	}
+	return c.report, err
+}
+
+func (c *fsck) add(issue FsckIssue) {
+	level := c.sess.logger.Warn
+	if issue.Repaired {
+		level = c.sess.logger.Info
+	}
+	level("Fsck: "+issue.Kind, zap.String("path", issue.Path), zap.String("key", issue.Key),
+		zap.String("detail", issue.Detail), zap.Bool("repaired", issue.Repaired))
+	c.report.Issues = append(c.report.Issues, issue)
+}
+
+// directory checks entries of dir, ancestors are keys of directories from
+// the root to dir.
+func (c *fsck) directory(ctx context.Context, path string, dir *Directory, ancestors map[ObjectKey]bool) error {
+	names := make([]string, 0, len(dir.FileMeta))
+	for name := range dir.FileMeta {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pruned := map[string]ObjectKey{}
+	for _, name := range names {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		key := dir.FileMeta[name]
+		child := filepath.Join(path, name)
+		if ancestors[key] {
+			c.add(FsckIssue{Kind: FsckCycle, Path: child, Key: key, Repaired: c.repair})
+			pruned[name] = key
+			continue
+		}
+		if first, ok := c.seen[key]; ok {
+			if !isSharedKey(key) {
+				c.add(FsckIssue{Kind: FsckShared, Path: child, Key: key, Detail: "also " + first})
+			}
+			continue
+		}
+
+		node, err := c.node(ctx, key)
+		if errors.Cause(err) == ErrNotFound {
+			c.add(FsckIssue{Kind: FsckDangling, Path: child, Key: key, Repaired: c.repair})
+			pruned[name] = key
+			continue
+		}
+		if errors.Cause(err) == errCorrupt {
+			c.add(FsckIssue{Kind: FsckCorrupt, Path: child, Key: key, Detail: err.Error()})
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		c.seen[key] = child
+		c.report.Nodes++
+
+		switch typed := node.(type) {
+		case *Directory:
+			ancestors[key] = true
+			err = c.directory(ctx, child, typed, ancestors)
+			delete(ancestors, key)
+		case *File:
+			err = c.file(ctx, child, typed)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if !c.repair || len(pruned) == 0 {
+		return nil
+	}
+	// Reload to keep entries changed meanwhile, root is committed with ETag
+	latest, err := c.sess.NewDirectory(ctx, dir.Key)
+	if err != nil {
+		return err
+	}
+	for name, key := range pruned {
+		if latest.FileMeta[name] == key {
+			latest.removeChild(name)
+		}
+	}
+	return latest.Save(ctx)
+}
+
+// errCorrupt is returned by node if the object isn't a node of the key.
+var errCorrupt = errors.New("not a valid node")
+
+// node loads node of key, errCorrupt if it's not a node of the key.
+func (c *fsck) node(ctx context.Context, key ObjectKey) (interface{}, error) {
+	obj, err := c.sess.s3.DownloadWithCache(ctx, MetaObject, key)
+	if err != nil {
+		return nil, err
+	}
+	node := &Node{}
+	if err := json.Unmarshal(obj, node); err != nil {
+		return nil, errors.Wrap(errCorrupt, err.Error())
+	}
+	if node.Key != key {
+		return nil, errors.Wrapf(errCorrupt, "key is %s", node.Key)
+	}
+	switch node.Meta.Mode & syscall.S_IFMT {
+	case syscall.S_IFDIR, syscall.S_IFREG, syscall.S_IFLNK:
+	default:
+		return nil, errors.Wrapf(errCorrupt, "mode is %o", node.Meta.Mode)
+	}
+	return c.sess.NewTypedNode(ctx, key)
+}
+
+// file checks extents of file.
+func (c *fsck) file(ctx context.Context, path string, file *File) error {
+	if file.Meta.Size > 0 && file.ExtentSize <= 0 {
+		c.add(FsckIssue{Kind: FsckSizeMismatch, Path: path, Key: file.Key,
+			Detail: fmt.Sprintf("size is %d, extent size is %d", file.Meta.Size, file.ExtentSize)})
+		return nil
+	}
+	indexes := make([]int64, 0, len(file.Extent))
+	for i := range file.Extent {
+		indexes = append(indexes, i)
+	}
+	sort.Slice(indexes, func(i, j int) bool { return indexes[i] < indexes[j] })
+
+	var beyond []int64
+	for _, i := range indexes {
+		e := file.Extent[i]
+		if file.ExtentSize > 0 && i*file.ExtentSize >= file.Meta.Size {
+			c.add(FsckIssue{Kind: FsckBeyondSize, Path: path, Key: file.Key,
+				Detail: e.Key, Repaired: c.repair})
+			beyond = append(beyond, i)
+			continue
+		}
+		if e.Damaged {
+			continue
+		}
+		var stored int64
+		missing := false
+		for _, name := range e.Objects() {
+			size, ok := c.objects[name]
+			if !ok {
+				var err error
+				size, err = c.sess.s3.Size(ctx, DataObject, name)
+				if errors.Cause(err) == ErrNotFound {
+					size = -1
+				} else if err != nil {
+					return err
+				}
+				c.objects[name] = size
+				c.report.Objects++
+			}
+			if size >= 0 {
+				stored += size
+				continue
+			}
+			missing = true
+			c.add(FsckIssue{Kind: FsckMissingExtent, Path: path, Key: file.Key,
+				Detail: name, Repaired: c.repair})
+			if c.repair {
+				err := c.sess.quarantine(ctx, extentRef{path: path, file: file.Key, index: i})
+				if err != nil {
+					return err
+				}
+			}
+			break
+		}
+		// Sizes of compressed objects don't tell the extent size
+		if !missing && e.Compression == "" && stored != file.ExtentSize {
+			c.add(FsckIssue{Kind: FsckSizeMismatch, Path: path, Key: file.Key,
+				Detail: fmt.Sprintf("extent %d stores %d bytes, extent size is %d", i, stored, file.ExtentSize)})
+		}
+	}
+	if c.repair && len(beyond) > 0 {
+		return c.sess.dropExtents(ctx, file.Key, beyond)
+	}
+	return nil
+}
+
+// orphans reports nodes not reachable from the root. Shared nodes are not,
+// a new identical one refers the object again.
+func (c *fsck) orphans(ctx context.Context) error {
+	keys, err := c.sess.s3.List(ctx, MetaObject)
+	if err != nil {
+		return err
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if _, ok := c.seen[key]; ok || isSharedKey(key) {
+			continue
+		}
+		// Other objects can share the prefix, only nodes are reported
+		if _, err := c.node(ctx, key); err != nil {
+			continue
+		}
+		c.add(FsckIssue{Kind: FsckOrphan, Key: key})
+	}
+	return nil
+}
+
+// dropExtents removes extents of indexes from file, the open file is saved
+// later.
+func (s *Session) dropExtents(ctx context.Context, key ObjectKey, indexes []int64) error {
+	if file := s.openedFile(key); file != nil {
+		file.lock.Lock()
+		defer file.lock.Unlock()
+		for _, i := range indexes {
+			if e, ok := file.Extent[i]; ok && i*file.ExtentSize >= file.Meta.Size {
+				e.release()
+				delete(file.Extent, i)
+			}
+		}
+		file.markMeta()
+		return nil
+	}
+	file, err := s.NewFile(ctx, key)
+	if err != nil {
+		return err
+	}
+	for _, i := range indexes {
+		delete(file.Extent, i)
+	}
+	return file.Save(ctx)
+}
@@ -0,0 +1,148 @@
+package bucketsync
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/pkg/errors"
+)
+
+// fsckTree has a directory d with files a and b, and file c in root.
+func fsckTree(t *testing.T) (*FileSystem, *fakeS3) {
+	fs, fake := newTestFS(t, nil, nil)
+	if st := fs.Mkdir("d", 0755, testContext); st != fuse.OK {
+		t.Fatal(st)
+	}
+	writeFile(t, fs, "d/a", []byte("0123456789abcdefA"))
+	writeFile(t, fs, "d/b", []byte("b"))
+	writeFile(t, fs, "c", []byte("c"))
+	return fs, fake
+}
+
+// editDir changes entries of directory at path.
+func editDir(t *testing.T, fs *FileSystem, path string, fn func(dir *Directory)) {
+	t.Helper()
+	ctx := context.Background()
+	key := fs.Sess.RootKey()
+	if path != "" {
+		key = fs.mustKey(t, path)
+	}
+	dir, err := fs.Sess.NewDirectory(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fn(dir)
+	if err := dir.Save(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func issuesOf(report *FsckReport, kind string) []FsckIssue {
+	var issues []FsckIssue
+	for _, issue := range report.Issues {
+		if issue.Kind == kind {
+			issues = append(issues, issue)
+		}
+	}
+	return issues
+}
+
+func runFsck(t *testing.T, fake *fakeS3, repair bool) *FsckReport {
+	t.Helper()
+	// A fresh session doesn't see caches of the one injecting
+	sess, _ := newTestSession(t, fake, nil)
+	report, err := sess.Fsck(context.Background(), repair)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return report
+}
+
+func TestFsckClean(t *testing.T) {
+	_, fake := fsckTree(t)
+	report := runFsck(t, fake, false)
+	if len(report.Issues) != 0 || report.Nodes != 5 {
+		t.Fatalf("%d nodes, issues %v", report.Nodes, report.Issues)
+	}
+}
+
+func TestFsckInjected(t *testing.T) {
+	for _, tc := range []struct {
+		kind     string
+		inject   func(t *testing.T, fs *FileSystem, fake *fakeS3)
+		repaired bool
+	}{
+		{FsckDangling, func(t *testing.T, fs *FileSystem, fake *fakeS3) {
+			fake.remove(fs.Sess.metaName(fs.mustKey(t, "d/b")))
+		}, true},
+		{FsckCorrupt, func(t *testing.T, fs *FileSystem, fake *fakeS3) {
+			fake.set(fs.Sess.metaName(fs.mustKey(t, "d/b")), []byte("{"))
+		}, false},
+		{FsckCycle, func(t *testing.T, fs *FileSystem, fake *fakeS3) {
+			editDir(t, fs, "d", func(dir *Directory) { dir.setChild("up", fs.Sess.RootKey()) })
+		}, true},
+		{FsckShared, func(t *testing.T, fs *FileSystem, fake *fakeS3) {
+			key := fs.mustKey(t, "c")
+			editDir(t, fs, "d", func(dir *Directory) { dir.setChild("c2", key) })
+		}, false},
+		{FsckMissingExtent, func(t *testing.T, fs *FileSystem, fake *fakeS3) {
+			file, _ := fs.getFile(context.Background(), "d/a")
+			bucket, name := fs.Sess.s3.location(DataObject, file.Extent[1].Objects()[0])
+			fake.remove(bucket + "/" + name)
+		}, true},
+		{FsckBeyondSize, func(t *testing.T, fs *FileSystem, fake *fakeS3) {
+			file, _ := fs.getFile(context.Background(), "d/a")
+			file.Extent[5] = &Extent{Key: file.Extent[0].Key, sess: fs.Sess}
+			file.markMeta()
+			if err := file.Save(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+		}, true},
+		{FsckSizeMismatch, func(t *testing.T, fs *FileSystem, fake *fakeS3) {
+			file, _ := fs.getFile(context.Background(), "d/a")
+			bucket, name := fs.Sess.s3.location(DataObject, file.Extent[0].Objects()[0])
+			fake.set(bucket+"/"+name, []byte("short"))
+		}, false},
+		{FsckOrphan, func(t *testing.T, fs *FileSystem, fake *fakeS3) {
+			editDir(t, fs, "d", func(dir *Directory) { dir.removeChild("b") })
+		}, false},
+	} {
+		t.Run(tc.kind, func(t *testing.T) {
+			fs, fake := fsckTree(t)
+			tc.inject(t, fs, fake)
+
+			report := runFsck(t, fake, false)
+			if issues := issuesOf(report, tc.kind); len(issues) != 1 || issues[0].Repaired {
+				t.Fatalf("issues %v", report.Issues)
+			}
+			report = runFsck(t, fake, true)
+			if issues := issuesOf(report, tc.kind); len(issues) != 1 || issues[0].Repaired != tc.repaired {
+				t.Fatalf("repair issues %v", report.Issues)
+			}
+			if !tc.repaired {
+				return
+			}
+			report = runFsck(t, fake, false)
+			if issues := issuesOf(report, tc.kind); len(issues) != 0 {
+				t.Fatalf("after repair %v", report.Issues)
+			}
+		})
+	}
+}
+
+func TestFsckRepairRefusedWhileMounted(t *testing.T) {
+	fake := newFakeS3()
+	mod := func(c *Config) { c.MountLock = true; c.LockTTL = time.Minute }
+	fs := newTestMount(t, fake, mod)
+	writeFile(t, fs, "f", []byte("f"))
+
+	sess, _ := newTestSession(t, fake, mod)
+	if _, err := sess.Fsck(context.Background(), false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sess.Fsck(context.Background(), true); errors.Cause(err) != ErrLocked {
+		t.Fatalf("repair while mounted: %v", err)
+	}
+}
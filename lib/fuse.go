@@ -1,14 +1,19 @@
 package bucketsync
 
 import (
+	"context"
+	"fmt"
 	"hash/fnv"
+	"net/http"
 	"path/filepath"
+	"sort"
 	"syscall"
 	"time"
 
 	"github.com/hanwen/go-fuse/fuse"
 	"github.com/hanwen/go-fuse/fuse/nodefs"
 	"github.com/hanwen/go-fuse/fuse/pathfs"
+	"github.com/pkg/errors"
 	uuid "github.com/satori/go.uuid"
 	"go.uber.org/zap"
 )
@@ -17,9 +22,35 @@ type FileSystem struct {
 	pathfs.FileSystem
 	Sess   *Session
 	logger *Logger
+
+	mountLock *BucketLock
+	stopSweep chan struct{}
+	health    *http.Server
 }
 
-func NewFileSystem(config *Config) *pathfs.PathNodeFs {
+func NewFileSystem(config *Config) (*pathfs.PathNodeFs, error) {
+	fs := newFileSystem(config)
+	lower, err := withLower(fs.Sess, fs)
+	if err == nil {
+		err = fs.Sess.openAudit()
+	}
+	if err != nil {
+		fs.OnUnmount()
+		return nil, err
+	}
+	return pathfs.NewPathNodeFs(wrapFileSystem(fs.Sess, lower), nil), nil
+}
+
+// NodeOptions returns options of the connector to mount with config.
+func NodeOptions(config *Config) *nodefs.Options {
+	opts := nodefs.NewOptions()
+	opts.AttrTimeout = config.attrTimeout()
+	opts.EntryTimeout = config.entryTimeout()
+	opts.NegativeTimeout = config.NegativeTimeout
+	return opts
+}
+
+func newFileSystem(config *Config) *FileSystem {
 	sess, err := NewSession(config)
 	if err != nil {
 		panic(err)
@@ -30,7 +61,48 @@ func NewFileSystem(config *Config) *pathfs.PathNodeFs {
 		Sess:       sess,
 		logger:     sess.logger,
 	}
-	return pathfs.NewPathNodeFs(fs, nil)
+	if config.MountLock && !config.readOnly() && !config.DryRun {
+		fs.mountLock = sess.NewBucketLock("mount")
+		err = fs.mountLock.Acquire(context.Background())
+		if err != nil {
+			panic(err)
+		}
+		fs.mountLock.Hold(sess.lockLost)
+	}
+	if !config.readOnly() {
+		fs.stopSweep = make(chan struct{})
+		sess.flushStop = fs.stopSweep
+	}
+	if config.StorageLimit > 0 && !config.readOnly() {
+		sess.invalidateUsage()
+	}
+	if config.ExpirySweep > 0 && !config.readOnly() {
+		go sess.sweeper(config.ExpirySweep, fs.stopSweep)
+	}
+	if config.CompactSweep > 0 && !config.readOnly() {
+		go sess.compactor(config.CompactSweep, fs.stopSweep)
+	}
+	if config.HealthAddr != "" {
+		fs.health = sess.serveHealth(config.HealthAddr)
+	}
+	return fs
+}
+
+// errStatus returns EIO instead of status if the operation ran out of budget
+func errStatus(ctx context.Context, status fuse.Status) fuse.Status {
+	if ctx.Err() == context.DeadlineExceeded {
+		return fuse.EIO
+	}
+	return status
+}
+
+// lookupStatus returns ENOENT for failed lookup of a node, or decryptStatus
+// if its metadata can't be decrypted.
+func (f *FileSystem) lookupStatus(ctx context.Context, err error) fuse.Status {
+	if errors.Cause(err) == ErrDecrypt {
+		return f.Sess.decryptStatus(err)
+	}
+	return errStatus(ctx, fuse.ENOENT)
 }
 
 func InodeHash(o ObjectKey) uint64 {
@@ -45,16 +117,27 @@ func NewObjectKey() ObjectKey {
 
 func (f *FileSystem) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
 	f.logger.Debug("GetAttr", zap.String("name", name))
+	if attr, ok := f.controlAttr(name); ok {
+		return attr, fuse.OK
+	}
+	if target, ok := extentsTarget(name); ok {
+		return f.extentsAttr(target)
+	}
+	ctx, cancel := f.Sess.opContext()
+	defer cancel()
 
-	key, err := f.Sess.PathWalk(name)
+	key, err := f.Sess.PathWalk(ctx, name)
 	if err != nil {
 		f.logger.Debug("fuse error", zap.Error(err))
-		return nil, fuse.ENOENT
+		return nil, f.lookupStatus(ctx, err)
 	}
 
-	node, err := f.Sess.NewNode(key)
+	node, err := f.Sess.NewNode(ctx, key)
 	if err != nil {
 		f.logger.Debug("fuse error", zap.Error(err))
+		return nil, f.lookupStatus(ctx, err)
+	}
+	if f.hideExpired(key, &node.Meta) {
 		return nil, fuse.ENOENT
 	}
 
@@ -63,10 +146,21 @@ func (f *FileSystem) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fu
 		Size:  uint64(node.Meta.Size),
 		Mode:  node.Meta.Mode,
 		Nlink: 1,
-		Owner: fuse.Owner{
-			Uid: node.Meta.UID,
-			Gid: node.Meta.GID,
-		},
+		Owner: f.Sess.hostOwner(&node.Meta),
+	}
+	if file := f.Sess.openedFile(key); file != nil {
+		// Not saved yet
+		file.lock.Lock()
+		attr.Size = uint64(file.Meta.Size)
+		attr.Blocks = file.Blocks()
+		file.lock.Unlock()
+	} else if node.Meta.Mode&syscall.S_IFMT == syscall.S_IFREG {
+		file, err := f.Sess.NewFile(ctx, key)
+		if err != nil {
+			f.logger.Debug("fuse error", zap.Error(err))
+			return nil, f.lookupStatus(ctx, err)
+		}
+		attr.Blocks = file.Blocks()
 	}
 	attr.SetTimes(&node.Meta.Atime, &node.Meta.Mtime, &node.Meta.Ctime)
 	return attr, fuse.OK
@@ -74,115 +168,287 @@ func (f *FileSystem) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fu
 
 func (f *FileSystem) Open(name string, flags uint32, context *fuse.Context) (file nodefs.File, code fuse.Status) {
 	f.logger.Debug("Open", zap.String("name", name))
-	key, err := f.Sess.PathWalk(name)
+	if file, ok := f.openControl(name); ok {
+		return file, fuse.OK
+	}
+	if target, ok := extentsTarget(name); ok {
+		return f.openExtents(target)
+	}
+	ctx, cancel := f.Sess.opContext()
+	defer cancel()
+	key, err := f.Sess.PathWalk(ctx, name)
 	if err != nil {
 		f.logger.Debug("fuse error", zap.Error(err))
-		return nil, fuse.ENOENT
+		return nil, f.lookupStatus(ctx, err)
+	}
+	if f.Sess.openedFile(key) == nil {
+		node, err := f.Sess.NewNode(ctx, key)
+		if err != nil {
+			f.logger.Debug("fuse error", zap.Error(err))
+			return nil, f.lookupStatus(ctx, err)
+		}
+		if f.hideExpired(key, &node.Meta) {
+			return nil, fuse.ENOENT
+		}
 	}
 
-	node, err := f.Sess.NewFile(key)
+	node, err := f.Sess.acquireFile(ctx, key)
 	if err != nil {
 		f.logger.Debug("fuse error", zap.Error(err))
-		return nil, fuse.ENOENT
+		return nil, f.lookupStatus(ctx, err)
+	}
+	opened := NewOpenedFile(node)
+	opened.appends = flags&syscall.O_APPEND != 0
+	f.Sess.openLevel(opened, f.Sess.durability(name, node))
+
+	if flags&syscall.O_TRUNC != 0 {
+		// Save immediately, readers see either old or empty file.
+		node.lock.Lock()
+		err = node.Truncate(ctx, 0)
+		if err == nil {
+			err = node.Save(ctx)
+		}
+		node.lock.Unlock()
+		if err != nil {
+			f.logger.Debug("fuse error", zap.Error(err))
+			opened.Release()
+			return nil, fuse.EIO
+		}
 	}
 
-	return NewOpenedFile(node), fuse.OK
+	if flags&syscall.O_ACCMODE == syscall.O_RDONLY {
+		f.Sess.notePrefetch(name)
+	}
+	return withOpenFlags(opened, f.Sess.config, flags), fuse.OK
 }
 
-func (f *FileSystem) getParent(name string) (*Directory, fuse.Status) {
+func (f *FileSystem) getParent(ctx context.Context, name string) (*Directory, fuse.Status) {
 	parent := filepath.Dir(name)
-	key, err := f.Sess.PathWalk(parent)
+	key, err := f.Sess.PathWalk(ctx, parent)
 	if err != nil {
 		f.logger.Debug("fuse error", zap.Error(err))
-		return nil, fuse.ENOENT
+		return nil, f.lookupStatus(ctx, err)
 	}
-	dir, err := f.Sess.NewDirectory(key)
+	dir, err := f.Sess.NewDirectory(ctx, key)
 	if err != nil {
-		return nil, fuse.EACCES
+		return nil, errStatus(ctx, fuse.EACCES)
 	}
 	return dir, fuse.OK
 }
 
+// getFile returns regular file at name
+func (f *FileSystem) getFile(ctx context.Context, name string) (*File, fuse.Status) {
+	key, err := f.Sess.PathWalk(ctx, name)
+	if err != nil {
+		f.logger.Debug("fuse error", zap.Error(err))
+		return nil, f.lookupStatus(ctx, err)
+	}
+	node, err := f.Sess.NewTypedNode(ctx, key)
+	if err != nil {
+		f.logger.Debug("fuse error", zap.Error(err))
+		return nil, f.lookupStatus(ctx, err)
+	}
+	file, ok := node.(*File)
+	if !ok {
+		return nil, fuse.ENOATTR
+	}
+	return file, fuse.OK
+}
+
+// Rename moves ObjectKey reference between directory entries. Only the
+// directory objects are rewritten, file and extents are never touched.
+// If the source is still open and modified, it's saved before the entry
+// is swapped, so the destination is never seen half-written.
 func (f *FileSystem) Rename(oldName string, newName string, context *fuse.Context) (code fuse.Status) {
-	f.logger.Debug("Rename", zap.String("oldName", oldName), zap.String("newName", newName))
+	flags := renameFlags(context)
+	f.logger.Debug("Rename", zap.String("oldName", oldName), zap.String("newName", newName),
+		zap.Uint32("flags", flags))
+	ctx, cancel := f.Sess.opContext()
+	defer cancel()
+
+	switch flags {
+	case 0, renameNoReplace, renameExchange:
+	default:
+		return fuse.EINVAL
+	}
+
+	if oldName == newName {
+		return fuse.OK
+	}
 
 	oldParentPath := filepath.Dir(oldName)
 	newParentPath := filepath.Dir(newName)
 
 	if oldParentPath == newParentPath {
 		// Get parent dir
-		dir, status := f.getParent(oldName) // got the same as newName
+		dir, status := f.getParent(ctx, oldName) // got the same as newName
 		if status != fuse.OK {
 			return status
 		}
 
-		// Rename
-		dir.FileMeta[filepath.Base(newName)] = dir.FileMeta[filepath.Base(oldName)]
-		delete(dir.FileMeta, filepath.Base(oldName))
+		key, ok := dir.FileMeta[filepath.Base(oldName)]
+		if !ok {
+			return fuse.ENOENT
+		}
+		target, exists := dir.FileMeta[filepath.Base(newName)]
+		if status := checkRenameTarget(flags, exists); status != fuse.OK {
+			return status
+		}
+		err := f.Sess.flushOpened(ctx, key)
+		if err != nil {
+			f.logger.Debug("fuse error", zap.Error(err))
+			return errStatus(ctx, fuse.EIO)
+		}
+
+		// Rename, or swap in one update
+		if flags == renameExchange {
+			dir.setChild(filepath.Base(oldName), target)
+		} else {
+			if exists {
+				f.Sess.invalidateUsage()
+			}
+			dir.removeChild(filepath.Base(oldName))
+		}
+		dir.setChild(filepath.Base(newName), key)
 
 		// Save
-		err := dir.Save()
+		err = dir.Save(ctx)
 		if err != nil {
 			f.logger.Debug("fuse error", zap.Error(err))
 			return fuse.EIO
 		}
+		if exists && flags != renameExchange {
+			f.dropReplaced(target)
+		}
 	} else {
 		// Get old dir
-		dirOld, status := f.getParent(oldName)
+		dirOld, status := f.getParent(ctx, oldName)
 		if status != fuse.OK {
 			return status
 		}
 
+		key, ok := dirOld.FileMeta[filepath.Base(oldName)]
+		if !ok {
+			return fuse.ENOENT
+		}
+		err := f.Sess.flushOpened(ctx, key)
+		if err != nil {
+			f.logger.Debug("fuse error", zap.Error(err))
+			return errStatus(ctx, fuse.EIO)
+		}
+
 		// Get new dir
-		dirNew, status := f.getParent(newName)
+		dirNew, status := f.ownParent(ctx, newName)
 		if status != fuse.OK {
 			return status
 		}
+		target, exists := dirNew.FileMeta[filepath.Base(newName)]
+		if status := checkRenameTarget(flags, exists); status != fuse.OK {
+			return status
+		}
 
-		// Rename
-		dirNew.FileMeta[filepath.Base(newName)] = dirOld.FileMeta[filepath.Base(oldName)]
-		delete(dirOld.FileMeta, filepath.Base(oldName))
+		// Rename, or swap
+		if flags == renameExchange {
+			dirOld.setChild(filepath.Base(oldName), target)
+		} else {
+			if exists {
+				f.Sess.invalidateUsage()
+			}
+			dirOld.removeChild(filepath.Base(oldName))
+		}
+		dirNew.setChild(filepath.Base(newName), key)
 
-		// Save
-		err := dirNew.Save()
+		// Save new first, the file is never lost on failure
+		err = dirNew.Save(ctx)
+		if err == nil {
+			err = f.Sess.s3.WaitBatched(ctx, dirNew.Key)
+		}
 		if err != nil {
 			f.logger.Debug("fuse error", zap.Error(err))
 			return fuse.EIO
 		}
-		err = dirOld.Save()
+		if exists && flags != renameExchange {
+			f.dropReplaced(target)
+		}
+		err = dirOld.Save(ctx)
+		if err == nil {
+			err = f.Sess.s3.WaitBatched(ctx, dirOld.Key)
+		}
 		if err != nil {
 			f.logger.Debug("fuse error", zap.Error(err))
+			if flags == renameExchange && exists {
+				// Target is only in new dir, put it back
+				dirNew.setChild(filepath.Base(newName), target)
+				if err := dirNew.Save(ctx); err != nil {
+					f.logger.Error("exchange revert failed", zap.String("name", newName), zap.Error(err))
+				}
+			}
 			return fuse.EIO
 		}
 	}
 	return fuse.OK
 }
 
+// dropReplaced releases target replaced by rename the same as Unlink, open
+// file stays usable by its handles until the last close.
+func (f *FileSystem) dropReplaced(key ObjectKey) {
+	if !f.Sess.unlinkOpened(key) {
+		f.Sess.orphan(key)
+	}
+}
+
+// checkRenameTarget checks existence of rename target by flags.
+func checkRenameTarget(flags uint32, exists bool) fuse.Status {
+	switch {
+	case flags == renameNoReplace && exists:
+		return fuse.Status(syscall.EEXIST)
+	case flags == renameExchange && !exists:
+		return fuse.ENOENT
+	}
+	return fuse.OK
+}
+
 func (f *FileSystem) Mkdir(name string, mode uint32, context *fuse.Context) fuse.Status {
 	f.logger.Debug("Mkdir", zap.String("name", name))
+	ctx, cancel := f.Sess.opContext()
+	defer cancel()
 
-	dir, status := f.getParent(name)
+	dir, status := f.ownParent(ctx, name)
 	if status != fuse.OK {
 		return status
 	}
 
-	// Set
-	newKey := NewObjectKey()
-	dir.FileMeta[filepath.Base(name)] = newKey
-
-	newDir := f.Sess.CreateDirectory(newKey, dir.Key, mode, context)
+	// Already exists, nothing to upload
+	expired, status := f.freeName(ctx, dir, filepath.Base(name))
+	if status != fuse.OK {
+		return status
+	}
 
-	// Save
-	err := newDir.Save()
+	// Set
+	newDir := f.Sess.CreateDirectory("", dir.Key, mode, context)
+	dir.inherit(&newDir.Meta)
+	newDir.Defaults = dir.Defaults
+	newDir.Key = f.Sess.emptyDirKey(newDir)
+	dir.setChild(filepath.Base(name), newDir.Key)
+
+	// Save, unless an identical one exists
+	_, err := f.Sess.NewDirectory(ctx, newDir.Key)
+	if errors.Cause(err) == ErrNotFound {
+		err = newDir.Save(ctx)
+	}
 	if err != nil {
 		f.logger.Debug("fuse error", zap.Error(err))
 		return fuse.EIO
 	}
-	err = dir.Save()
+	err = dir.Save(ctx)
 	if err != nil {
 		f.logger.Debug("fuse error", zap.Error(err))
 		return fuse.EIO
 	}
+	if expired != "" {
+		f.Sess.invalidateUsage()
+		f.dropReplaced(expired)
+	}
 	return fuse.OK
 }
 
@@ -190,28 +456,43 @@ func (f *FileSystem) Symlink(value string, linkName string, context *fuse.Contex
 	f.logger.Debug("Symlink",
 		zap.String("value", value),
 		zap.String("linkName", linkName))
+	ctx, cancel := f.Sess.opContext()
+	defer cancel()
 
-	dir, status := f.getParent(linkName)
+	dir, status := f.ownParent(ctx, linkName)
 	if status != fuse.OK {
 		return status
 	}
 
-	// Set
-	newKey := NewObjectKey()
-	dir.FileMeta[filepath.Base(linkName)] = newKey
-	symlink := f.Sess.CreateSymLink(newKey, dir.Key, value, context)
+	expired, status := f.freeName(ctx, dir, filepath.Base(linkName))
+	if status != fuse.OK {
+		return status
+	}
 
-	// Save
-	err := symlink.Save()
+	// Set
+	symlink := f.Sess.CreateSymLink("", dir.Key, value, context)
+	dir.inherit(&symlink.Meta)
+	symlink.Key = f.Sess.symLinkKey(symlink)
+	dir.setChild(filepath.Base(linkName), symlink.Key)
+
+	// Save, unless an identical one exists
+	_, err := f.Sess.NewSymLink(ctx, symlink.Key)
+	if errors.Cause(err) == ErrNotFound {
+		err = symlink.Save(ctx)
+	}
 	if err != nil {
 		f.logger.Debug("fuse error", zap.Error(err))
-		return fuse.EIO
+		return errStatus(ctx, fuse.EIO)
 	}
-	err = dir.Save()
+	err = dir.Save(ctx)
 	if err != nil {
 		f.logger.Debug("fuse error", zap.Error(err))
 		return fuse.EIO
 	}
+	if expired != "" {
+		f.Sess.invalidateUsage()
+		f.dropReplaced(expired)
+	}
 	return fuse.OK
 }
 
@@ -222,53 +503,77 @@ func (f *FileSystem) Create(name string, flags uint32, mode uint32, context *fus
 		zap.Uint32("flags", flags),
 		zap.Uint32("mode", mode),
 	)
+	ctx, cancel := f.Sess.opContext()
+	defer cancel()
 
-	dir, status := f.getParent(name)
+	dir, status := f.ownParent(ctx, name)
 	if status != fuse.OK {
 		return nil, status
 	}
 
 	// Set
 	newKey := NewObjectKey()
-	dir.FileMeta[filepath.Base(name)] = newKey
+	dir.setChild(filepath.Base(name), newKey)
 
 	file := f.Sess.CreateFile(newKey, dir.Key, mode, context)
+	dir.inherit(&file.Meta)
 
-	err := file.Save()
+	err := file.Save(ctx)
 	if err != nil {
 		f.logger.Debug("fuse error", zap.Error(err))
 		return nil, fuse.EIO
 	}
-	err = dir.Save()
+	err = dir.Save(ctx)
 	if err != nil {
 		f.logger.Debug("fuse error", zap.Error(err))
 		return nil, fuse.EIO
 	}
-	return NewOpenedFile(file), fuse.OK
+	opened := NewOpenedFile(f.Sess.registerFile(file))
+	opened.appends = flags&syscall.O_APPEND != 0
+	f.Sess.openLevel(opened, f.Sess.durability(name, opened.file))
+	return withOpenFlags(opened, f.Sess.config, flags), fuse.OK
 }
 
 func (f *FileSystem) OpenDir(name string, context *fuse.Context) (stream []fuse.DirEntry, code fuse.Status) {
 	f.logger.Debug("OpenDir", zap.String("name", name))
-	key, err := f.Sess.PathWalk(name)
+	if name == controlDir {
+		return []fuse.DirEntry{
+			{Name: filepath.Base(statsPath), Mode: fuse.S_IFREG},
+			{Name: filepath.Base(barrierPath), Mode: fuse.S_IFREG},
+			{Name: filepath.Base(extentsPath), Mode: fuse.S_IFDIR},
+		}, fuse.OK
+	}
+	if target, ok := extentsTarget(name); ok {
+		return f.openExtentsDir(target)
+	}
+	ctx, cancel := f.Sess.opContext()
+	defer cancel()
+	key, err := f.Sess.PathWalk(ctx, name)
 	if err != nil {
 		f.logger.Debug("fuse error", zap.Error(err))
-		return nil, fuse.ENOENT
+		return nil, f.lookupStatus(ctx, err)
 	}
 
-	dir, err := f.Sess.NewDirectory(key)
+	dir, err := f.Sess.NewDirectory(ctx, key)
 	if err != nil {
 		f.logger.Debug("fuse error", zap.Error(err))
-		return nil, fuse.ENOENT
+		return nil, f.lookupStatus(ctx, err)
 	}
 
-	stream = make([]fuse.DirEntry, 0)
+	// Sorted, so that offsets of the listing are stable across opens
+	hidden := f.expiredEntries(ctx, dir)
+	stream = make([]fuse.DirEntry, 0, len(dir.FileMeta))
 	for name, objkey := range dir.FileMeta {
+		if hidden[name] {
+			continue
+		}
 		dentry := fuse.DirEntry{
 			Name: name,
 			Ino:  InodeHash(objkey),
 		}
 		stream = append(stream, dentry)
 	}
+	sort.Slice(stream, func(i, j int) bool { return stream[i].Name < stream[j].Name })
 	return stream, fuse.OK
 }
 
@@ -277,35 +582,57 @@ func (f *FileSystem) OnMount(nodeFs *pathfs.PathNodeFs) {
 
 func (f *FileSystem) OnUnmount() {
 	f.logger.Debug("Unmount")
+	f.Sess.waitEvictions()
+	f.Sess.flushFiles(context.Background(), true)
+	err := f.Sess.s3.WaitBatched(context.Background())
+	if err != nil {
+		f.logger.Error("batched uploads failed", zap.Error(err))
+	}
+	if f.stopSweep != nil {
+		close(f.stopSweep)
+	}
+	if f.health != nil {
+		f.health.Close()
+	}
+	if f.mountLock != nil {
+		err := f.mountLock.Release(context.Background())
+		if err != nil {
+			f.logger.Error("mount lock release failed", zap.Error(err))
+		}
+	}
 }
 
 func (f *FileSystem) Chmod(name string, mode uint32, context *fuse.Context) (code fuse.Status) {
 	f.logger.Debug("Chmod", zap.String("name", name))
-	key, err := f.Sess.PathWalk(name)
+	ctx, cancel := f.Sess.opContext()
+	defer cancel()
+	key, err := f.Sess.PathWalk(ctx, name)
 	if err != nil {
 		f.logger.Debug("fuse error", zap.Error(err))
-		return fuse.ENOENT
+		return f.lookupStatus(ctx, err)
 	}
 
-	node, err := f.Sess.NewTypedNode(key)
+	node, err := f.Sess.NewTypedNode(ctx, key)
 	if err != nil {
 		f.logger.Debug("fuse error", zap.Error(err))
-		return fuse.ENOENT
+		return f.lookupStatus(ctx, err)
 	}
 
 	switch typed := node.(type) {
 	case *Directory:
 		typed.Meta.Mode = (typed.Meta.Mode & syscall.S_IFMT) | mode
-		typed.Meta.Ctime = time.Now()
-		err = typed.Save()
+		chmodACL(&typed.Meta)
+		typed.Meta.Ctime = f.Sess.now()
+		err = f.saveDir(ctx, name, typed, false)
 	case *File:
 		typed.Meta.Mode = (typed.Meta.Mode & syscall.S_IFMT) | mode
-		typed.Meta.Ctime = time.Now()
-		err = typed.Save()
+		chmodACL(&typed.Meta)
+		typed.Meta.Ctime = f.Sess.now()
+		err = typed.Save(ctx)
 	case *SymLink:
 		typed.Meta.Mode = (typed.Meta.Mode & syscall.S_IFMT) | mode
-		typed.Meta.Ctime = time.Now()
-		err = typed.Save()
+		typed.Meta.Ctime = f.Sess.now()
+		err = f.saveSymLink(ctx, name, typed, false)
 	}
 	if err != nil {
 		return fuse.EIO
@@ -315,34 +642,37 @@ func (f *FileSystem) Chmod(name string, mode uint32, context *fuse.Context) (cod
 
 func (f *FileSystem) Chown(name string, uid uint32, gid uint32, context *fuse.Context) (code fuse.Status) {
 	f.logger.Debug("Chown", zap.String("name", name))
-	key, err := f.Sess.PathWalk(name)
+	ctx, cancel := f.Sess.opContext()
+	defer cancel()
+	key, err := f.Sess.PathWalk(ctx, name)
 	if err != nil {
 		f.logger.Debug("fuse error", zap.Error(err))
-		return fuse.ENOENT
+		return f.lookupStatus(ctx, err)
 	}
 
-	node, err := f.Sess.NewTypedNode(key)
+	node, err := f.Sess.NewTypedNode(ctx, key)
 	if err != nil {
 		f.logger.Debug("fuse error", zap.Error(err))
-		return fuse.ENOENT
+		return f.lookupStatus(ctx, err)
 	}
 
+	uid, gid = f.Sess.storedOwner(uid, gid)
 	switch typed := node.(type) {
 	case *Directory:
 		typed.Meta.UID = uid
 		typed.Meta.GID = gid
-		typed.Meta.Ctime = time.Now()
-		err = typed.Save()
+		typed.Meta.Ctime = f.Sess.now()
+		err = f.saveDir(ctx, name, typed, false)
 	case *File:
 		typed.Meta.UID = uid
 		typed.Meta.GID = gid
-		typed.Meta.Ctime = time.Now()
-		err = typed.Save()
+		typed.Meta.Ctime = f.Sess.now()
+		err = typed.Save(ctx)
 	case *SymLink:
 		typed.Meta.UID = uid
 		typed.Meta.GID = gid
-		typed.Meta.Ctime = time.Now()
-		err = typed.Save()
+		typed.Meta.Ctime = f.Sess.now()
+		err = f.saveSymLink(ctx, name, typed, false)
 	}
 	if err != nil {
 		f.logger.Debug("fuse error", zap.Error(err))
@@ -351,36 +681,186 @@ func (f *FileSystem) Chown(name string, uid uint32, gid uint32, context *fuse.Co
 	return fuse.OK
 }
 
+// saveSymLink saves changed symlink at name. A shared one is never changed
+// in place: it's moved to the content address of the change, or to a key of
+// its own if own is true, as times are not part of the address.
+func (f *FileSystem) saveSymLink(ctx context.Context, name string, link *SymLink, own bool) error {
+	if !isSymLinkKey(link.Key) {
+		return link.Save(ctx)
+	}
+	key := NewObjectKey()
+	if !own {
+		key = f.Sess.symLinkKey(link)
+	}
+	if key == link.Key {
+		return link.Save(ctx)
+	}
+	_, err := f.relink(ctx, name, link.Key, key, func() error {
+		link.Key = key
+		return link.Save(ctx)
+	})
+	return err
+}
+
+// saveDir saves changed directory at name. A shared empty one is moved as
+// saveSymLink does.
+func (f *FileSystem) saveDir(ctx context.Context, name string, dir *Directory, own bool) error {
+	if !isEmptyDirKey(dir.Key) {
+		return dir.Save(ctx)
+	}
+	key := NewObjectKey()
+	if !own && len(dir.FileMeta) == 0 {
+		key = f.Sess.emptyDirKey(dir)
+	}
+	if key == dir.Key {
+		return dir.Save(ctx)
+	}
+	_, err := f.relink(ctx, name, dir.Key, key, func() error {
+		dir.Key = key
+		return dir.Save(ctx)
+	})
+	return err
+}
+
+// ownParent returns parent directory of name to add an entry to. A shared
+// empty one is copied to a key of its own first, and the copy is stored
+// before it returns, so that the entry is never added out of reach.
+func (f *FileSystem) ownParent(ctx context.Context, name string) (*Directory, fuse.Status) {
+	dir, status := f.getParent(ctx, name)
+	if status != fuse.OK || !isEmptyDirKey(dir.Key) {
+		return dir, status
+	}
+	key := NewObjectKey()
+	parent, err := f.relink(ctx, filepath.Dir(name), dir.Key, key, func() error {
+		dir.Key = key
+		return dir.Save(ctx)
+	})
+	if err == nil {
+		err = f.Sess.s3.WaitBatched(ctx, parent)
+	}
+	if err != nil {
+		f.logger.Debug("fuse error", zap.Error(err))
+		return nil, errStatus(ctx, fuse.EIO)
+	}
+	return dir, fuse.OK
+}
+
+// relink stores node at name under key by save, and points the entry of its
+// parent from old to it. It returns key of the parent.
+func (f *FileSystem) relink(ctx context.Context, name string, old, key ObjectKey, save func() error) (ObjectKey, error) {
+	dir, status := f.getParent(ctx, name)
+	if status != fuse.OK {
+		return "", errors.Errorf("parent can't be loaded: %v", status)
+	}
+	err := save()
+	if err != nil {
+		return "", err
+	}
+	dir.setChild(filepath.Base(name), key)
+	err = dir.Save(ctx)
+	if err != nil {
+		return "", err
+	}
+	f.Sess.orphan(old)
+	return dir.Key, nil
+}
+
+// updateNode changes the node at name by set, and saves it with ctime if set
+// returns OK. Meta of an open file is changed in memory, saved with its
+// modification. Shared nodes are moved as saveSymLink does.
+func (f *FileSystem) updateNode(name string, set func(node interface{}, meta *Meta) fuse.Status) fuse.Status {
+	ctx, cancel := f.Sess.opContext()
+	defer cancel()
+	key, err := f.Sess.PathWalk(ctx, name)
+	if err != nil {
+		f.logger.Debug("fuse error", zap.Error(err))
+		return f.lookupStatus(ctx, err)
+	}
+	if file := f.Sess.openedFile(key); file != nil {
+		file.lock.Lock()
+		defer file.lock.Unlock()
+		status := set(file, &file.Meta)
+		if status == fuse.OK {
+			file.Meta.Ctime = f.Sess.now()
+			file.markMeta()
+		}
+		return status
+	}
+
+	var node interface{}
+	if key == f.Sess.RootKey() {
+		// Root is loaded with its ETag to commit
+		node, err = f.Sess.NewDirectory(ctx, key)
+	} else {
+		node, err = f.Sess.NewTypedNode(ctx, key)
+	}
+	if err != nil {
+		f.logger.Debug("fuse error", zap.Error(err))
+		return f.lookupStatus(ctx, err)
+	}
+	status := fuse.OK
+	switch typed := node.(type) {
+	case *Directory:
+		if status = set(typed, &typed.Meta); status == fuse.OK {
+			typed.Meta.Ctime = f.Sess.now()
+			err = f.saveDir(ctx, name, typed, false)
+		}
+	case *File:
+		if status = set(typed, &typed.Meta); status == fuse.OK {
+			typed.Meta.Ctime = f.Sess.now()
+			err = typed.Save(ctx)
+		}
+	case *SymLink:
+		if status = set(typed, &typed.Meta); status == fuse.OK {
+			typed.Meta.Ctime = f.Sess.now()
+			err = f.saveSymLink(ctx, name, typed, false)
+		}
+	}
+	if err != nil {
+		f.logger.Debug("fuse error", zap.Error(err))
+		return fuse.EIO
+	}
+	return status
+}
+
+// setTimes sets times of meta, nil is omitted (UTIME_OMIT).
+func setTimes(meta *Meta, atime *time.Time, mtime *time.Time, now time.Time) {
+	if atime != nil {
+		meta.Atime = *atime
+	}
+	if mtime != nil {
+		meta.Mtime = *mtime
+	}
+	meta.Ctime = now
+}
+
 func (f *FileSystem) Utimens(name string, Atime *time.Time, Mtime *time.Time, context *fuse.Context) (code fuse.Status) {
 	f.logger.Debug("Utimens", zap.String("name", name))
-	key, err := f.Sess.PathWalk(name)
+	ctx, cancel := f.Sess.opContext()
+	defer cancel()
+	key, err := f.Sess.PathWalk(ctx, name)
 	if err != nil {
 		f.logger.Debug("fuse error", zap.Error(err))
-		return fuse.ENOENT
+		return f.lookupStatus(ctx, err)
 	}
 
-	node, err := f.Sess.NewTypedNode(key)
+	node, err := f.Sess.NewTypedNode(ctx, key)
 	if err != nil {
 		f.logger.Debug("fuse error", zap.Error(err))
-		return fuse.ENOENT
+		return f.lookupStatus(ctx, err)
 	}
 
 	switch typed := node.(type) {
 	case *Directory:
-		typed.Meta.Atime = *Atime
-		typed.Meta.Mtime = *Mtime
-		typed.Meta.Ctime = time.Now()
-		err = typed.Save()
+		setTimes(&typed.Meta, Atime, Mtime, f.Sess.now())
+		err = f.saveDir(ctx, name, typed, true)
 	case *File:
-		typed.Meta.Atime = *Atime
-		typed.Meta.Mtime = *Mtime
-		typed.Meta.Ctime = time.Now()
-		err = typed.Save()
+		setTimes(&typed.Meta, Atime, Mtime, f.Sess.now())
+		err = typed.Save(ctx)
 	case *SymLink:
-		typed.Meta.Atime = *Atime
-		typed.Meta.Mtime = *Mtime
-		typed.Meta.Ctime = time.Now()
-		err = typed.Save()
+		// Times are shared by the others, it's copied to a key of its own
+		setTimes(&typed.Meta, Atime, Mtime, f.Sess.now())
+		err = f.saveSymLink(ctx, name, typed, true)
 	}
 	if err != nil {
 		return fuse.EIO
@@ -394,36 +874,52 @@ func (f *FileSystem) Access(name string, mode uint32, context *fuse.Context) (co
 		zap.String("name", name),
 		zap.Uint32("mode", mode),
 	)
+	ctx, cancel := f.Sess.opContext()
+	defer cancel()
 
-	key, err := f.Sess.PathWalk(name)
+	key, err := f.Sess.PathWalk(ctx, name)
 	if err != nil {
 		f.logger.Debug("fuse error", zap.Error(err))
-		return fuse.ENOENT
+		return f.lookupStatus(ctx, err)
 	}
 
-	if f.Sess.s3.IsExist(key) {
+	meta, err := f.Sess.currentMeta(ctx, key)
+	if err != nil {
+		f.logger.Debug("fuse error", zap.Error(err))
+		return f.lookupStatus(ctx, err)
+	}
+	// Owner of squashed entries isn't the creator, so only existence is told
+	if f.Sess.config.SquashOwner || f.Sess.permitted(meta, mode, context) {
 		return fuse.OK
 	}
-	f.logger.Debug("fuse error", zap.Error(err))
-	return fuse.ENOENT
+	return fuse.EACCES
 }
 
 func (f *FileSystem) Truncate(name string, size uint64, context *fuse.Context) (code fuse.Status) {
 	f.logger.Debug("Truncate", zap.String("name", name))
-	key, err := f.Sess.PathWalk(name)
+	ctx, cancel := f.Sess.opContext()
+	defer cancel()
+	key, err := f.Sess.PathWalk(ctx, name)
 	if err != nil {
 		f.logger.Debug("fuse error", zap.Error(err))
-		return fuse.ENOENT
+		return f.lookupStatus(ctx, err)
 	}
 
-	node, err := f.Sess.NewFile(key)
+	node, err := f.Sess.NewFile(ctx, key)
 	if err != nil {
 		f.logger.Debug("fuse error", zap.Error(err))
-		return fuse.ENOENT
+		return f.lookupStatus(ctx, err)
 	}
 
-	node.Meta.Size = int64(size)
-	err = node.Save()
+	if int64(size) > f.Sess.config.maxFileSize(node.ExtentSize) {
+		return fuse.Status(syscall.EFBIG)
+	}
+	err = node.Truncate(ctx, int64(size))
+	if err != nil {
+		f.logger.Debug("fuse error", zap.Error(err))
+		return spaceStatus(ctx, err)
+	}
+	err = node.Save(ctx)
 	if err != nil {
 		f.logger.Debug("fuse error", zap.Error(err))
 		return fuse.EIO
@@ -433,39 +929,93 @@ func (f *FileSystem) Truncate(name string, size uint64, context *fuse.Context) (
 
 func (f *FileSystem) Readlink(name string, context *fuse.Context) (string, fuse.Status) {
 	f.logger.Debug("Readlink", zap.String("name", name))
-	key, err := f.Sess.PathWalk(name)
+	ctx, cancel := f.Sess.opContext()
+	defer cancel()
+	key, err := f.Sess.PathWalk(ctx, name)
 	if err != nil {
 		f.logger.Debug("fuse error", zap.Error(err))
-		return "", fuse.ENOENT
+		return "", f.lookupStatus(ctx, err)
 	}
 
-	node, err := f.Sess.NewSymLink(key)
+	target, err := f.Sess.LinkTarget(ctx, key)
 	if err != nil {
 		f.logger.Debug("fuse error", zap.Error(err))
-		return "", fuse.ENOENT
+		return "", f.lookupStatus(ctx, err)
 	}
 
-	return node.LinkTo, fuse.OK
+	return target, fuse.OK
 }
 
 func (f *FileSystem) Rmdir(name string, context *fuse.Context) (code fuse.Status) {
-	return f.Unlink(name, context)
+	f.logger.Debug("Rmdir", zap.String("name", name))
+	ctx, cancel := f.Sess.opContext()
+	defer cancel()
+	parent, status := f.getParent(ctx, name)
+	if status != fuse.OK {
+		return status
+	}
+	key, ok := parent.FileMeta[filepath.Base(name)]
+	if !ok {
+		return fuse.ENOENT
+	}
+	node, err := f.Sess.NewTypedNode(ctx, key)
+	if err != nil {
+		f.logger.Debug("fuse error", zap.Error(err))
+		return errStatus(ctx, fuse.EIO)
+	}
+	dir, ok := node.(*Directory)
+	if !ok {
+		return fuse.ENOTDIR
+	}
+	if len(dir.FileMeta) > 0 && !f.Sess.config.RecursiveRmdir {
+		return fuse.Status(syscall.ENOTEMPTY)
+	}
+
+	err = f.Sess.RemoveAll(ctx, dir, parent, filepath.Base(name))
+	if err != nil {
+		f.logger.Debug("fuse error", zap.Error(err))
+		return errStatus(ctx, fuse.EIO)
+	}
+	return fuse.OK
 }
 
 func (f *FileSystem) Unlink(name string, context *fuse.Context) (code fuse.Status) {
 	f.logger.Debug("Unlink", zap.String("name", name))
-	dir, status := f.getParent(name)
+	ctx, cancel := f.Sess.opContext()
+	defer cancel()
+	dir, status := f.getParent(ctx, name)
 	if status != fuse.OK {
 		return status
 	}
 
-	delete(dir.FileMeta, filepath.Base(name))
+	key, ok := dir.FileMeta[filepath.Base(name)]
+	if !ok {
+		return fuse.ENOENT
+	}
+	// Size is needed only to account storage usage
+	var size int64
+	if f.Sess.config.StorageLimit > 0 {
+		if node, err := f.Sess.NewTypedNode(ctx, key); err == nil {
+			if file, ok := node.(*File); ok {
+				size = file.Meta.Size
+			}
+		}
+	}
+
+	dir.removeChild(filepath.Base(name))
 
-	err := dir.Save()
+	err := dir.Save(ctx)
 	if err != nil {
 		f.logger.Debug("fuse error", zap.Error(err))
 		return fuse.EIO
 	}
+	// Open file stays usable by its handles until the last one is closed,
+	// and it's accounted until then.
+	if f.Sess.unlinkOpened(key) {
+		return fuse.OK
+	}
+	f.Sess.reserveSpace(ctx, -size)
+	f.Sess.orphan(key)
 
 	return fuse.OK
 }
@@ -474,19 +1024,162 @@ func (f *FileSystem) String() string {
 	return "bucketsync"
 }
 
+// dontNeed drops cached extents in range of open file. Closed file has no
+// extent bodies, so it's nothing to do.
+func (f *FileSystem) dontNeed(name string, data []byte) fuse.Status {
+	var off, length int64
+	if len(data) != 0 {
+		_, err := fmt.Sscan(string(data), &off, &length)
+		if err != nil || off < 0 || length < 0 {
+			return fuse.EINVAL
+		}
+	}
+	ctx, cancel := f.Sess.opContext()
+	defer cancel()
+	key, err := f.Sess.PathWalk(ctx, name)
+	if err != nil {
+		f.logger.Debug("fuse error", zap.Error(err))
+		return f.lookupStatus(ctx, err)
+	}
+	file := f.Sess.openedFile(key)
+	if file == nil {
+		return fuse.OK
+	}
+	file.lock.Lock()
+	dropped := file.DropCache(off, length)
+	file.lock.Unlock()
+	f.logger.Debug("DontNeed", zap.String("name", name), zap.Int("dropped", dropped))
+	return fuse.OK
+}
+
+func (f *FileSystem) GetXAttr(name string, attribute string, context *fuse.Context) (data []byte, code fuse.Status) {
+	f.logger.Debug("GetXAttr", zap.String("name", name), zap.String("attribute", attribute))
+	ctx, cancel := f.Sess.opContext()
+	defer cancel()
+	if attribute == ChecksumXAttr {
+		file, status := f.getFile(ctx, name)
+		if status != fuse.OK {
+			return nil, status
+		}
+		checksum, err := file.ContentChecksum(ctx)
+		if err != nil {
+			f.logger.Debug("fuse error", zap.Error(err))
+			return nil, errStatus(ctx, fuse.EIO)
+		}
+		return []byte(checksum), fuse.OK
+	}
+	if attribute == TTLXAttr {
+		key, err := f.Sess.PathWalk(ctx, name)
+		if err != nil {
+			return nil, f.lookupStatus(ctx, err)
+		}
+		node, err := f.Sess.NewNode(ctx, key)
+		if err != nil {
+			return nil, f.lookupStatus(ctx, err)
+		}
+		if file := f.Sess.openedFile(key); file != nil {
+			file.lock.Lock()
+			node.Meta.TTL = file.Meta.TTL
+			file.lock.Unlock()
+		}
+		if node.Meta.TTL == 0 {
+			return nil, fuse.ENOATTR
+		}
+		return []byte(node.Meta.TTL.String()), fuse.OK
+	}
+	if attribute == DefaultModeXAttr || attribute == DefaultOwnerXAttr {
+		return f.getDefaults(name, attribute)
+	}
+	if attribute == ACLAccessXAttr || attribute == ACLDefaultXAttr {
+		return f.getACL(name, attribute)
+	}
+	if attribute == DurabilityXAttr {
+		return f.getDurability(name)
+	}
+	if f.Sess.config.lenient(OpXAttr) {
+		return nil, fuse.ENOATTR
+	}
+	return nil, fuse.Status(syscall.ENOTSUP)
+}
+
+func (f *FileSystem) ListXAttr(name string, context *fuse.Context) (attributes []string, code fuse.Status) {
+	f.logger.Debug("ListXAttr", zap.String("name", name))
+	ctx, cancel := f.Sess.opContext()
+	defer cancel()
+	key, err := f.Sess.PathWalk(ctx, name)
+	if err != nil {
+		f.logger.Debug("fuse error", zap.Error(err))
+		return nil, f.lookupStatus(ctx, err)
+	}
+	// Other attributes aren't stored, so the list isn't complete
+	if !f.Sess.config.lenient(OpXAttr) {
+		return nil, fuse.Status(syscall.ENOTSUP)
+	}
+	attributes = []string{}
+	if _, status := f.getFile(ctx, name); status == fuse.OK {
+		attributes = append(attributes, ChecksumXAttr)
+	}
+	if meta, err := f.Sess.currentMeta(ctx, key); err == nil {
+		if meta.ACL != nil {
+			attributes = append(attributes, ACLAccessXAttr)
+		}
+		if meta.DefaultACL != nil {
+			attributes = append(attributes, ACLDefaultXAttr)
+		}
+	}
+	return attributes, fuse.OK
+}
+
+func (f *FileSystem) RemoveXAttr(name string, attr string, context *fuse.Context) fuse.Status {
+	f.logger.Debug("RemoveXAttr", zap.String("name", name), zap.String("attr", attr))
+	if attr == TTLXAttr {
+		return f.setTTL(name, []byte("0"))
+	}
+	if attr == DefaultModeXAttr || attr == DefaultOwnerXAttr {
+		return f.setDefaults(name, attr, nil)
+	}
+	if attr == ACLAccessXAttr || attr == ACLDefaultXAttr {
+		return f.setACL(name, attr, nil)
+	}
+	if attr == DurabilityXAttr {
+		return f.setDurability(name, nil)
+	}
+	if f.Sess.config.lenient(OpXAttr) {
+		return fuse.OK
+	}
+	return fuse.Status(syscall.ENOTSUP)
+}
+
+func (f *FileSystem) SetXAttr(name string, attr string, data []byte, flags int, context *fuse.Context) fuse.Status {
+	f.logger.Debug("SetXAttr", zap.String("name", name), zap.String("attr", attr))
+	if attr == DontNeedXAttr {
+		return f.dontNeed(name, data)
+	}
+	if attr == TTLXAttr {
+		return f.setTTL(name, data)
+	}
+	if attr == CloneXAttr || attr == CloneRangeXAttr {
+		return f.setClone(name, attr, data)
+	}
+	if attr == DefaultModeXAttr || attr == DefaultOwnerXAttr {
+		return f.setDefaults(name, attr, data)
+	}
+	if attr == ACLAccessXAttr || attr == ACLDefaultXAttr {
+		if data == nil {
+			data = []byte{}
+		}
+		return f.setACL(name, attr, data)
+	}
+	if attr == DurabilityXAttr {
+		return f.setDurability(name, data)
+	}
+	if f.Sess.config.lenient(OpXAttr) {
+		return fuse.OK
+	}
+	return fuse.Status(syscall.ENOTSUP)
+}
+
 // // TODO
-// func (f *FileSystem) GetXAttr(name string, attribute string, context *fuse.Context) (data []byte, code fuse.Status) {
-// 	return nil, fuse.OK
-// }
-// func (f *FileSystem) ListXAttr(name string, context *fuse.Context) (attributes []string, code fuse.Status) {
-// 	return nil, fuse.OK
-// }
-// func (f *FileSystem) RemoveXAttr(name string, attr string, context *fuse.Context) fuse.Status {
-// 	return fuse.OK
-// }
-// func (f *FileSystem) SetXAttr(name string, attr string, data []byte, flags int, context *fuse.Context) fuse.Status {
-// 	return fuse.OK
-// }
 // func (f *FileSystem) Link(oldName string, newName string, context *fuse.Context) (code fuse.Status) {
 // 	return fuse.OK
 // }
@@ -1,121 +1,352 @@
 package bucketsync
 
 import (
-	"bytes"
+	"context"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/hanwen/go-fuse/fuse"
 	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/pkg/errors"
 	"go.uber.org/zap"
 )
 
+// withOpenFlags returns file with FOPEN_DIRECT_IO, if the page cache is
+// bypassed by DirectIO or O_DIRECT.
+func withOpenFlags(file *OpenedFile, config *Config, flags uint32) nodefs.File {
+	if !config.DirectIO && flags&syscall.O_DIRECT == 0 {
+		return file
+	}
+	return &nodefs.WithFlags{
+		File:        file,
+		Description: "direct_io",
+		FuseFlags:   fuse.FOPEN_DIRECT_IO,
+	}
+}
+
 // nodefs.File interface
 type OpenedFile struct {
 	nodefs.File
-	file  *File
-	dirty bool
-	open  bool
+	file *File
+	open bool
+	// appends writes at the end regardless of offset, opened with O_APPEND
+	appends bool
+	// durability decides when writes are saved, flush-on-close if empty
+	durability string
 }
 
 func NewOpenedFile(file *File) *OpenedFile {
+	atomic.AddInt64(&file.sess.counters.openHandles, 1)
+	file.sess.touchFile(file)
 	return &OpenedFile{
-		File:  nodefs.NewDefaultFile(),
-		file:  file,
-		dirty: false,
-		open:  true,
+		File: nodefs.NewDefaultFile(),
+		file: file,
+		open: true,
 	}
 }
 
 func (f *OpenedFile) Flush() fuse.Status {
 	f.file.sess.logger.Debug("Flush")
-	if f.dirty {
-		f.file.Save()
-		f.dirty = false
+	if f.durability == DurabilityAsync {
+		return fuse.OK
+	}
+	return f.save()
+}
+
+// save uploads the file if modified, within operation budget.
+func (f *OpenedFile) save() fuse.Status {
+	f.file.lock.Lock()
+	defer f.file.lock.Unlock()
+	if !f.file.dirty {
+		return fuse.OK
+	}
+	ctx, cancel := f.file.sess.opContext()
+	defer cancel()
+	return f.saveLocked(ctx)
+}
+
+// saveLocked uploads the file and waits for its metadata, with lock held.
+func (f *OpenedFile) saveLocked(ctx context.Context) fuse.Status {
+	if f.file.sess.isUnlinked(f.file) {
+		// Unreachable, writes are kept in memory until the last close
+		return fuse.OK
+	}
+	err := f.file.Save(ctx)
+	if err == nil {
+		err = f.file.sess.s3.WaitBatched(ctx, f.file.Key)
+	}
+	if err != nil {
+		f.file.sess.logger.Error("Save failed", zap.String("key", f.file.Key), zap.Error(err))
+		if errors.Cause(err) == ErrReadOnly {
+			return fuse.EROFS
+		}
+		return writeStatus(ctx)
 	}
 	return fuse.OK
 }
 
+// writeStatus returns EAGAIN if the write ran out of budget, EIO otherwise
+func writeStatus(ctx context.Context) fuse.Status {
+	if ctx.Err() == context.DeadlineExceeded {
+		return fuse.EAGAIN
+	}
+	return fuse.EIO
+}
+
+// spaceStatus returns ENOSPC if storage limit is exceeded, writeStatus otherwise
+func spaceStatus(ctx context.Context, err error) fuse.Status {
+	if err == ErrNoSpace {
+		return fuse.Status(syscall.ENOSPC)
+	}
+	return writeStatus(ctx)
+}
+
 func (f *OpenedFile) Read(dest []byte, off int64) (fuse.ReadResult, fuse.Status) {
 	f.file.sess.logger.Debug("Read")
+	ctx, cancel := f.file.sess.opContext()
+	defer cancel()
+	f.file.sess.touchFile(f.file)
+	f.file.lock.Lock()
+	defer f.file.lock.Unlock()
+
+	// Extents are downloaded without the lock, so that writes and saves of
+	// the file don't wait for them. They are planned again after, until
+	// all extents in range are filled.
+	policy := f.file.sess.config.MissingExtent
+	missing := make(map[*Extent]bool)
+	var first, last, startOffset int64
+	for {
+		// Nothing to read at or beyond EOF
+		if off >= f.file.Meta.Size {
+			return &ReadResult{content: dest[:0], size: 0}, fuse.OK
+		}
+		if remain := f.file.Meta.Size - off; int64(len(dest)) > remain {
+			dest = dest[:remain]
+		}
 
-	if off > f.file.Meta.Size {
-		return nil, fuse.ENODATA
+		// Calculate Extent index, offset
+		// example: ExtentSize = 3, off = 8, len(dest) = 8
+		//        ---|---|--=|===|===|=--|---
+		// offset:012 345 678 901 234 567 890
+		// index:  0   1   2   3   4   5   6
+		//        012 012 012 012 012 012 012
+		// firstIndex = 2, lastIndex = 5
+		// startOffset = 2 endOffset = 0
+		// Requests are not aligned with direct_io, last is the extent of the
+		// last byte so that the next extent is not loaded at the boundary.
+		first = off / f.file.ExtentSize
+		last = (int64(len(dest)) + off - 1) / f.file.ExtentSize
+
+		startOffset = off - (first)*f.file.ExtentSize
+		endOffset := (int64(len(dest)) + off) - last*f.file.ExtentSize - 1
+
+		f.file.sess.logger.Debug("Read params", zap.Int64("first", first),
+			zap.Int64("last", last),
+			zap.Int64("startOffset", startOffset),
+			zap.Int64("endOffset", endOffset))
+
+		fetches := f.unfilled(first, last, missing)
+		if len(fetches) == 0 {
+			break
+		}
+		f.file.lock.Unlock()
+		f.download(ctx, fetches)
+		f.file.lock.Lock()
+		if err := f.install(fetches, missing); err != nil {
+			return nil, f.readError(ctx, err)
+		}
 	}
 
-	// Calculate Extent index, offset
-	// example: ExtentSize = 3, off = 8, len(dest) = 8
-	//        ---|---|--=|===|===|=--|---
-	// offset:012 345 678 901 234 567 890
-	// index:  0   1   2   3   4   5   6
-	//        012 012 012 012 012 012 012
-	// firstIndex = 2, lastIndex = 5
-	// startOffset = 2 endOffset = 0
-	first := off / f.file.ExtentSize
-	last := (int64(len(dest)) + off) / f.file.ExtentSize
+	// No extent means sparce area, nil is filled with zero.
+	extentBytes := make([][]byte, last-first+1)
+	missingAt := make([]bool, last-first+1)
+	for i := first; i <= last; i++ {
+		if extent, ok := f.file.Extent[i]; ok {
+			missingAt[i-first] = missing[extent]
+			if !missing[extent] {
+				extentBytes[i-first] = extent.body
+			}
+		}
+	}
 
-	startOffset := off - (first)*f.file.ExtentSize
-	endOffset := (int64(len(dest)) + off) - last*f.file.ExtentSize - 1
+	// Copy from startOffset, without joining bodies
+	pos := 0
+	for i, body := range extentBytes {
+		if body == nil {
+			n := f.file.ExtentSize
+			if i == 0 {
+				n -= startOffset
+			}
+			end := pos + int(n)
+			if end > len(dest) {
+				end = len(dest)
+			}
+			for j := pos; j < end; j++ {
+				dest[j] = 0
+			}
+			pos = end
+			continue
+		}
+		if i == 0 {
+			body = body[startOffset:]
+		}
+		pos += copy(dest[pos:], body)
+	}
 
-	f.file.sess.logger.Debug("Read params", zap.Int64("first", first),
-		zap.Int64("last", last),
-		zap.Int64("startOffset", startOffset),
-		zap.Int64("endOffset", endOffset))
+	f.file.sess.logger.Debug("wait done", zap.Int("content len", pos),
+		zap.Int("dest len", len(dest)))
+
+	size := len(dest)
+	if policy == MissingExtentSkip {
+		for i, m := range missingAt {
+			if m {
+				size = int(int64(i)*f.file.ExtentSize - startOffset)
+				if size < 0 {
+					size = 0
+				}
+				if size > len(dest) {
+					size = len(dest)
+				}
+				break
+			}
+		}
+	}
+	return &ReadResult{content: dest[:size], size: size}, fuse.OK
+}
 
-	// Get extents concurrently
-	extentBytes := make([][]byte, last-first+1)
+// readFetch is an extent downloaded by Read without the file lock.
+type readFetch struct {
+	index  int64
+	extent *Extent // in the file when planned
+	from   Extent  // objects when planned
+	body   []byte
+	err    error
+}
 
-	var wg sync.WaitGroup
-	errc := make(chan error)
-	done := make(chan struct{})
+// unfilled returns fetches of extents from first to last which aren't
+// filled nor known missing. Lock must be held.
+func (f *OpenedFile) unfilled(first, last int64, missing map[*Extent]bool) []*readFetch {
+	var fetches []*readFetch
 	for i := first; i <= last; i++ {
-		f.file.sess.logger.Debug("Download thread started", zap.Int64("num", i))
+		extent, ok := f.file.Extent[i]
+		if !ok || extent.dirty || len(extent.body) != 0 || missing[extent] {
+			continue
+		}
+		fetches = append(fetches, &readFetch{index: i, extent: extent, from: *extent})
+	}
+	return fetches
+}
+
+// download downloads fetches concurrently. Lock must not be held.
+func (f *OpenedFile) download(ctx context.Context, fetches []*readFetch) {
+	var wg sync.WaitGroup
+	for _, fetch := range fetches {
+		f.file.sess.logger.Debug("Download thread started", zap.Int64("num", fetch.index))
 		wg.Add(1)
-		go func(i int64) {
-			bytesIndex := i - first
-
-			extent, ok := f.file.Extent[i]
-			if !ok {
-				// No extent means sparce area, fill zero.
-				extentBytes[bytesIndex] = make([]byte, f.file.ExtentSize)
-				wg.Done()
-				return
-			}
-			err := extent.Fill()
-			if err != nil {
-				f.file.sess.logger.Error("Fill failed")
-				errc <- err
+		go func(fetch *readFetch) {
+			defer wg.Done()
+			fetch.body, fetch.err = fetch.from.download(ctx)
+		}(fetch)
+	}
+	wg.Wait()
+	f.file.sess.logger.Debug("All download threads done")
+}
+
+// install fills extents by fetches, unless they changed while downloaded.
+// Missing extents are recorded if MissingExtent policy reads them. Lock
+// must be held.
+func (f *OpenedFile) install(fetches []*readFetch, missing map[*Extent]bool) error {
+	policy := f.file.sess.config.MissingExtent
+	var failed error
+	for _, fetch := range fetches {
+		err := fetch.err
+		if errors.Cause(err) == ErrNotFound && (policy == MissingExtentZero || policy == MissingExtentSkip) {
+			f.file.sess.logger.Warn("Extent is missing", zap.String("file", f.file.Key),
+				zap.Int64("index", fetch.index), zap.String("policy", policy))
+			missing[fetch.extent] = true
+			continue
+		}
+		if err != nil {
+			f.file.sess.logger.Error("Fill failed")
+			if failed == nil {
+				failed = err
 			}
-			extentBytes[bytesIndex] = extent.body
-			wg.Done()
-		}(i)
-	}
-	go func() {
-		wg.Wait()
-		f.file.sess.logger.Debug("All download threads done")
-		close(done)
-	}()
-
-	select {
-	case <-errc:
-		return nil, fuse.EIO
-	case <-done:
-		// Trim
-		extentBytes[0] = extentBytes[0][startOffset:len(extentBytes[0])]
-		content := bytes.Join(extentBytes, []byte{})
-		copy(dest, content)
-
-		f.file.sess.logger.Debug("wait done", zap.Int("content len", len(content)),
-			zap.Int("dest len", len(dest)))
-		return &ReadResult{content: dest, size: len(dest)}, fuse.OK
+			continue
+		}
+		extent := fetch.extent
+		if failed != nil || f.file.Extent[fetch.index] != extent || extent.dirty || len(extent.body) != 0 ||
+			!extent.sameObjects(&fetch.from) {
+			f.file.sess.bodies.put(fetch.body)
+			continue
+		}
+		extent.hold(fetch.body)
 	}
+	return failed
+}
+
+func (f *OpenedFile) readError(ctx context.Context, err error) fuse.Status {
+	if errors.Cause(err) == ErrArchived {
+		f.file.sess.logger.Warn("Extent is archived, restore it to read",
+			zap.String("file", f.file.Key), zap.Error(err))
+		return fuse.EAGAIN
+	}
+	return errStatus(ctx, fuse.EIO)
 }
 
 func (f *OpenedFile) Write(data []byte, off int64) (written uint32, code fuse.Status) {
 	f.file.sess.logger.Debug("Write", zap.Int("datalen", len(data)),
 		zap.Int64("offset", off))
-	f.dirty = true
+	ctx, cancel := f.file.sess.opContext()
+	defer cancel()
+	if f.file.sess.s3.isReadOnly() {
+		return 0, fuse.EROFS
+	}
+	f.file.sess.touchFile(f.file)
+	f.file.lock.Lock()
+	defer f.file.lock.Unlock()
+
+	// Each append lands contiguously at the end under the lock, so that
+	// concurrent appenders don't interleave.
+	limit := f.file.sess.config.maxFileSize(f.file.ExtentSize)
+	if f.appends {
+		off = f.file.Meta.Size
+		if off+int64(len(data)) > limit {
+			return 0, fuse.Status(syscall.EFBIG)
+		}
+	}
+
+	// Write up to the limit, then fail
+	if off >= limit {
+		return 0, fuse.Status(syscall.EFBIG)
+	}
+	if off+int64(len(data)) > limit {
+		data = data[:limit-off]
+	}
+	if grow := off + int64(len(data)) - f.file.Meta.Size; grow > 0 {
+		err := f.file.sess.reserveSpace(ctx, grow)
+		if err != nil {
+			f.file.sess.logger.Debug("fuse error", zap.Error(err))
+			return 0, spaceStatus(ctx, err)
+		}
+		// Size is set at the end, space isn't used if it fails before
+		size := f.file.Meta.Size
+		defer func() {
+			if f.file.Meta.Size == size {
+				f.file.sess.reserveSpace(ctx, -grow)
+			}
+		}()
+	}
+	if off > f.file.Meta.Size {
+		// The gap before off is hole
+		err := f.file.zeroRange(ctx, f.file.Meta.Size, off)
+		if err != nil {
+			f.file.sess.logger.Error("Fill failed", zap.Error(err))
+			return 0, writeStatus(ctx)
+		}
+	}
+	f.file.markDirty(int64(len(data)))
 
 	first := off / f.file.ExtentSize
 	startOffset := off - (first)*f.file.ExtentSize
@@ -128,9 +359,13 @@ func (f *OpenedFile) Write(data []byte, off int64) (written uint32, code fuse.St
 		if _, ok := f.file.Extent[i]; !ok {
 			f.file.Extent[i] = f.file.sess.CreateExtent(f.file.ExtentSize)
 		} else {
-			f.file.Extent[i].Fill()
+			err := f.file.Extent[i].Fill(ctx)
+			if err != nil {
+				f.file.sess.logger.Error("Fill failed", zap.Error(err))
+				return 0, writeStatus(ctx)
+			}
 		}
-		f.file.Extent[i].dirty = true
+		f.file.markExtent(i)
 
 		if int64(len(f.file.Extent[i].body)) != f.file.ExtentSize {
 			f.file.sess.logger.Error("Filled extent size is invalid",
@@ -151,26 +386,33 @@ func (f *OpenedFile) Write(data []byte, off int64) (written uint32, code fuse.St
 	if f.file.Meta.Size < off+int64(len(data)) {
 		f.file.Meta.Size = off + int64(len(data))
 	}
+	f.file.Meta.Mtime = f.file.sess.now()
+	f.file.Meta.Ctime = f.file.Meta.Mtime
 
+	if f.durability == DurabilitySyncEveryWrite {
+		if status := f.saveLocked(ctx); status != fuse.OK {
+			return 0, status
+		}
+	}
 	return uint32(len(data)), fuse.OK
 }
 
 func (f *OpenedFile) Release() {
 	f.file.sess.logger.Debug("Release")
-	if f.dirty {
-		f.file.Save()
-		f.dirty = false
+	if f.durability != DurabilityAsync || !f.file.sess.lingerFile(f.file) {
+		f.save()
+	}
+	if f.durability == DurabilityAsync {
+		f.file.sess.closeAsync(f.file)
 	}
 	f.open = false
+	atomic.AddInt64(&f.file.sess.counters.openHandles, -1)
+	f.file.sess.closeFile(f.file)
 }
 
 func (f *OpenedFile) Fsync(flags int) (code fuse.Status) {
 	f.file.sess.logger.Debug("Fsync")
-	if f.dirty {
-		f.file.Save()
-		f.dirty = false
-	}
-	return fuse.OK
+	return f.save()
 }
 
 func (f *OpenedFile) String() string {
@@ -182,7 +424,18 @@ func (f *OpenedFile) Truncate(size uint64) fuse.Status {
 	if !f.open {
 		return fuse.EBADF
 	}
-	f.file.Meta.Size = int64(size)
+	f.file.lock.Lock()
+	defer f.file.lock.Unlock()
+	if int64(size) > f.file.sess.config.maxFileSize(f.file.ExtentSize) {
+		return fuse.Status(syscall.EFBIG)
+	}
+	ctx, cancel := f.file.sess.opContext()
+	defer cancel()
+	err := f.file.Truncate(ctx, int64(size))
+	if err != nil {
+		f.file.sess.logger.Debug("fuse error", zap.Error(err))
+		return spaceStatus(ctx, err)
+	}
 	return fuse.OK
 }
 
@@ -191,15 +444,18 @@ func (f *OpenedFile) GetAttr(out *fuse.Attr) fuse.Status {
 	if !f.open {
 		return fuse.EBADF
 	}
+	f.file.lock.Lock()
+	defer f.file.lock.Unlock()
 
 	out.Ino = InodeHash(f.file.Key)
 	out.Size = uint64(f.file.Meta.Size)
+	out.Blocks = f.file.Blocks()
 	out.Mode = f.file.Meta.Mode
 	out.Nlink = 1
-	out.Owner = fuse.Owner{
-		Uid: f.file.Meta.UID,
-		Gid: f.file.Meta.GID,
+	if f.file.sess.isUnlinked(f.file) {
+		out.Nlink = 0
 	}
+	out.Owner = f.file.sess.hostOwner(&f.file.Meta)
 	out.SetTimes(&f.file.Meta.Atime, &f.file.Meta.Mtime, &f.file.Meta.Ctime)
 	return fuse.OK
 }
@@ -209,9 +465,11 @@ func (f *OpenedFile) Chown(uid uint32, gid uint32) fuse.Status {
 	if !f.open {
 		return fuse.EBADF
 	}
-	f.file.Meta.UID = uid
-	f.file.Meta.GID = gid
-	f.file.Meta.Ctime = time.Now()
+	f.file.lock.Lock()
+	defer f.file.lock.Unlock()
+	f.file.Meta.UID, f.file.Meta.GID = f.file.sess.storedOwner(uid, gid)
+	f.file.Meta.Ctime = f.file.sess.now()
+	f.file.markMeta()
 	return fuse.OK
 }
 
@@ -220,8 +478,11 @@ func (f *OpenedFile) Chmod(perms uint32) fuse.Status {
 	if !f.open {
 		return fuse.EBADF
 	}
+	f.file.lock.Lock()
+	defer f.file.lock.Unlock()
 	f.file.Meta.Mode = (f.file.Meta.Mode & syscall.S_IFMT) | perms
-	f.file.Meta.Ctime = time.Now()
+	f.file.Meta.Ctime = f.file.sess.now()
+	f.file.markMeta()
 	return fuse.OK
 }
 
@@ -230,9 +491,10 @@ func (f *OpenedFile) Utimens(atime *time.Time, mtime *time.Time) fuse.Status {
 	if !f.open {
 		return fuse.EBADF
 	}
-	f.file.Meta.Atime = *atime
-	f.file.Meta.Mtime = *mtime
-	f.file.Meta.Ctime = time.Now()
+	f.file.lock.Lock()
+	defer f.file.lock.Unlock()
+	setTimes(&f.file.Meta, atime, mtime, f.file.sess.now())
+	f.file.markMeta()
 	return fuse.OK
 }
 
@@ -241,7 +503,36 @@ func (f *OpenedFile) Allocate(off uint64, size uint64, mode uint32) (code fuse.S
 	if !f.open {
 		return fuse.EBADF
 	}
-	return fuse.OK
+	if f.file.sess.config.lenient(OpAllocate) {
+		return fuse.OK
+	}
+	return fuse.Status(syscall.EOPNOTSUPP)
+}
+
+func (f *OpenedFile) GetLk(owner uint64, lk *fuse.FileLock, flags uint32, out *fuse.FileLock) (code fuse.Status) {
+	f.file.sess.logger.Debug("GetLk")
+	if f.file.sess.config.lenient(OpLock) {
+		*out = *lk
+		out.Typ = syscall.F_UNLCK
+		return fuse.OK
+	}
+	return fuse.ENOSYS
+}
+
+func (f *OpenedFile) SetLk(owner uint64, lk *fuse.FileLock, flags uint32) (code fuse.Status) {
+	f.file.sess.logger.Debug("SetLk")
+	if f.file.sess.config.lenient(OpLock) {
+		return fuse.OK
+	}
+	return fuse.ENOSYS
+}
+
+func (f *OpenedFile) SetLkw(owner uint64, lk *fuse.FileLock, flags uint32) (code fuse.Status) {
+	f.file.sess.logger.Debug("SetLkw")
+	if f.file.sess.config.lenient(OpLock) {
+		return fuse.OK
+	}
+	return fuse.ENOSYS
 }
 
 type ReadResult struct {
@@ -0,0 +1,882 @@
+package bucketsync
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+func TestReadWaitsFillsOnFailure(t *testing.T) {
+	fs, fake := newTestFS(t, nil, nil)
+	writeFile(t, fs, "f", bytes.Repeat([]byte("a"), 48))
+	file, st := fs.getFile(context.Background(), "f")
+	if st != fuse.OK {
+		t.Fatal(st)
+	}
+	broken, slow := file.Extent[0].Objects()[0], file.Extent[2].Objects()[0]
+	fake.fail = func(op, name string) error {
+		if op == "GetObject" && strings.HasSuffix(name, broken) {
+			return errors.New("broken")
+		}
+		return nil
+	}
+	fake.delayOf = func(op, name string) time.Duration {
+		if op == "GetObject" && strings.HasSuffix(name, slow) {
+			return 100 * time.Millisecond
+		}
+		return 0
+	}
+	fs.Sess.s3.cache = NewShardedCache(100, 1)
+
+	f, st := fs.Open("f", 0, testContext)
+	if st != fuse.OK {
+		t.Fatal(st)
+	}
+	defer f.Release()
+	if _, st := f.Read(make([]byte, 48), 0); st == fuse.OK {
+		t.Fatal("read of broken extent succeeded")
+	}
+	if n := atomic.LoadInt64(&fs.Sess.s3.inflightDownloads); n != 0 {
+		t.Fatalf("read returned with %d downloads running", n)
+	}
+}
+
+// TestReadDownloadsWithoutLock reads an extent of slow download. A write
+// isn't blocked by it, and one to the extent being read wins over the
+// downloaded body.
+func TestReadDownloadsWithoutLock(t *testing.T) {
+	fs, fake := newTestFS(t, nil, nil)
+	writeFile(t, fs, "f", bytes.Repeat([]byte("a"), 32))
+	file, st := fs.getFile(context.Background(), "f")
+	if st != fuse.OK {
+		t.Fatal(st)
+	}
+	slow := file.Extent[0].Objects()[0]
+	var slowGets int32
+	fake.delayOf = func(op, name string) time.Duration {
+		if op == "GetObject" && strings.HasSuffix(name, slow) && atomic.AddInt32(&slowGets, 1) == 1 {
+			return 200 * time.Millisecond
+		}
+		return 0
+	}
+	fs.Sess.s3.cache = NewShardedCache(100, 1)
+
+	f, st := fs.Open("f", syscall.O_RDWR, testContext)
+	if st != fuse.OK {
+		t.Fatal(st)
+	}
+	defer f.Release()
+	read := make(chan string)
+	go func() {
+		buf := make([]byte, 16)
+		res, st := f.Read(buf, 0)
+		if st != fuse.OK {
+			read <- st.String()
+			return
+		}
+		data, _ := res.Bytes(buf)
+		read <- string(data)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	start := time.Now()
+	if _, st := f.Write([]byte("tail"), 32); st != fuse.OK {
+		t.Fatal(st)
+	}
+	if _, st := f.Write([]byte("bbbb"), 0); st != fuse.OK {
+		t.Fatal(st)
+	}
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Fatalf("writes waited %v for the read", d)
+	}
+	if got := <-read; got != "bbbb"+strings.Repeat("a", 12) {
+		t.Fatalf("read %q", got)
+	}
+}
+
+// TestTempFileRenameOverTarget emulates editors writing a temp file and
+// renaming it over the target, while uploads fail randomly. A reader never
+// sees the target missing or partial.
+func TestTempFileRenameOverTarget(t *testing.T) {
+	fs, fake := newTestFS(t, nil, nil)
+	current := bytes.Repeat([]byte("version 0\n"), 4)
+	writeFile(t, fs, "target", current)
+
+	r := rand.New(rand.NewSource(1))
+	failing := false
+	fake.fail = func(op, name string) error {
+		if failing && op == "PutObject" && r.Intn(3) == 0 {
+			return errors.New("injected")
+		}
+		return nil
+	}
+	renamed, failed := 0, 0
+	for i := 1; i <= 20; i++ {
+		next := bytes.Repeat([]byte(fmt.Sprintf("version %d\n", i)), 4)
+		tmp := fmt.Sprintf(".target.%d.tmp", i)
+
+		fake.mu.Lock()
+		failing = true
+		fake.mu.Unlock()
+		f, st := fs.Create(tmp, 0, 0644, testContext)
+		if st == fuse.OK {
+			_, st = f.Write(next, 0)
+			if st == fuse.OK {
+				st = fs.Rename(tmp, "target", testContext)
+			}
+			f.Release()
+		}
+		fake.mu.Lock()
+		failing = false
+		fake.mu.Unlock()
+
+		reader, _ := newTestFS(t, fake, nil)
+		got := readFile(t, reader, "target")
+		switch {
+		case bytes.Equal(got, next):
+			if st != fuse.OK {
+				t.Logf("%d: renamed though %v", i, st)
+			}
+			current = next
+			renamed++
+		case bytes.Equal(got, current):
+			if st == fuse.OK {
+				t.Fatalf("%d: rename succeeded, but target is old", i)
+			}
+			failed++
+		default:
+			t.Fatalf("%d: target is %q", i, got)
+		}
+	}
+	if renamed == 0 || failed == 0 {
+		t.Fatalf("renamed %d, failed %d, want both", renamed, failed)
+	}
+}
+
+// TestLargeWriteStored writes MAX_KERNEL_WRITE bytes at an unaligned offset
+// by one request, and sets mtime on the handle as the kernel does.
+func TestLargeWriteStored(t *testing.T) {
+	fs, fake := newTestFS(t, nil, func(c *Config) { c.ExtentSize = 4096 })
+	data := make([]byte, fuse.MAX_KERNEL_WRITE)
+	rand.New(rand.NewSource(1)).Read(data)
+	f, st := fs.Create("f", 0, 0644, testContext)
+	if st != fuse.OK {
+		t.Fatal(st)
+	}
+	defer f.Release()
+	if n, st := f.Write(data, 100); st != fuse.OK || int(n) != len(data) {
+		t.Fatalf("wrote %d: %v", n, st)
+	}
+	mtime := time.Unix(1000, 0)
+	if st := f.Utimens(nil, &mtime); st != fuse.OK {
+		t.Fatal(st)
+	}
+	prefix, meta := fs.Sess.dataPrefix(), fs.Sess.metaName(fs.mustKey(t, "f"))
+	puts := fake.totalPuts(prefix) - fake.totalPuts(meta)
+	if st := f.Flush(); st != fuse.OK {
+		t.Fatal(st)
+	}
+	// Each extent is uploaded once
+	if n := fake.totalPuts(prefix) - fake.totalPuts(meta) - puts; n != len(data)/4096+1 {
+		t.Fatalf("%d uploads", n)
+	}
+
+	reader, _ := newTestFS(t, fake, func(c *Config) { c.ExtentSize = 4096 })
+	got := readFile(t, reader, "f")
+	if !bytes.Equal(got[100:], data) || !bytes.Equal(got[:100], make([]byte, 100)) {
+		t.Fatal("content differs")
+	}
+	attr, _ := reader.GetAttr("f", testContext)
+	if attr.Mtime != 1000 {
+		t.Fatalf("mtime %d", attr.Mtime)
+	}
+}
+
+// BenchmarkSequentialWrite writes 1 MiB by requests of the default and the
+// largest kernel write size. Extents are uploaded once at flush anyway.
+func BenchmarkSequentialWrite(b *testing.B) {
+	const size = 1 << 20
+	data := make([]byte, size)
+	rng := rand.New(rand.NewSource(1))
+	for _, request := range []int{4096, fuse.MAX_KERNEL_WRITE} {
+		b.Run(fmt.Sprintf("%dKiB", request/1024), func(b *testing.B) {
+			fs, fake := newTestFS(b, nil, func(c *Config) { c.ExtentSize = 64 * 1024 })
+			b.SetBytes(size)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				rng.Read(data) // not deduplicated
+				b.StartTimer()
+				f, st := fs.Create(fmt.Sprintf("f%d", i), 0, 0644, testContext)
+				if st != fuse.OK {
+					b.Fatal(st)
+				}
+				for off := 0; off < size; off += request {
+					if _, st := f.Write(data[off:off+request], int64(off)); st != fuse.OK {
+						b.Fatal(st)
+					}
+				}
+				if st := f.Flush(); st != fuse.OK {
+					b.Fatal(st)
+				}
+				f.Release()
+			}
+			b.ReportMetric(float64(fake.totalPuts(fs.Sess.dataPrefix()))/float64(b.N), "uploads/op")
+		})
+	}
+}
+
+func TestUnsupportedPolicies(t *testing.T) {
+	for _, tc := range []struct {
+		policy                        string
+		getxattr, setxattr, listxattr fuse.Status
+		getlk, setlk, allocate        fuse.Status
+	}{
+		{PolicyStrict, fuse.Status(syscall.ENOTSUP), fuse.Status(syscall.ENOTSUP), fuse.Status(syscall.ENOTSUP), fuse.ENOSYS, fuse.ENOSYS, fuse.Status(syscall.EOPNOTSUPP)},
+		{PolicyLenient, fuse.ENOATTR, fuse.OK, fuse.OK, fuse.OK, fuse.OK, fuse.OK},
+	} {
+		fs, _ := newTestFS(t, nil, func(c *Config) {
+			c.Unsupported = map[string]string{OpXAttr: tc.policy, OpLock: tc.policy, OpAllocate: tc.policy}
+		})
+		writeFile(t, fs, "f", []byte("f"))
+		f, st := fs.Open("f", syscall.O_RDWR, testContext)
+		if st != fuse.OK {
+			t.Fatal(st)
+		}
+		lk := &fuse.FileLock{Typ: syscall.F_WRLCK, End: 10}
+		var out fuse.FileLock
+		_, getxattr := fs.GetXAttr("f", "user.other", testContext)
+		_, listxattr := fs.ListXAttr("f", testContext)
+		got := []fuse.Status{
+			getxattr,
+			fs.SetXAttr("f", "user.other", []byte("v"), 0, testContext),
+			listxattr,
+			f.GetLk(1, lk, 0, &out),
+			f.SetLk(1, lk, 0),
+			f.Allocate(0, 100, 0),
+		}
+		want := []fuse.Status{tc.getxattr, tc.setxattr, tc.listxattr, tc.getlk, tc.setlk, tc.allocate}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Fatalf("%s: probe %d = %v, want %v", tc.policy, i, got[i], want[i])
+			}
+		}
+		if tc.policy == PolicyLenient && out.Typ != syscall.F_UNLCK {
+			t.Fatalf("lenient getlk = %v", out)
+		}
+		f.Release()
+	}
+}
+
+// TestMissingExtentPolicies reads a file whose middle extent is missing.
+func TestMissingExtentPolicies(t *testing.T) {
+	a, b, c := bytes.Repeat([]byte("a"), 16), bytes.Repeat([]byte("b"), 16), bytes.Repeat([]byte("c"), 16)
+	zero := make([]byte, 16)
+	for _, tc := range []struct {
+		policy string
+		off    int64
+		want   []byte
+		status fuse.Status
+	}{
+		{"", 0, nil, fuse.EIO},
+		{MissingExtentFail, 0, nil, fuse.EIO},
+		{MissingExtentZero, 0, bytes.Join([][]byte{a, zero, c}, nil), fuse.OK},
+		{MissingExtentZero, 20, bytes.Join([][]byte{zero[4:], c}, nil), fuse.OK},
+		{MissingExtentSkip, 0, a, fuse.OK},
+		{MissingExtentSkip, 8, a[8:], fuse.OK},
+		{MissingExtentSkip, 20, []byte{}, fuse.OK},
+	} {
+		t.Run(fmt.Sprintf("%s@%d", tc.policy, tc.off), func(t *testing.T) {
+			writer, fake := newTestFS(t, nil, nil)
+			writeFile(t, writer, "f", bytes.Join([][]byte{a, b, c}, nil))
+			file, _ := writer.getFile(context.Background(), "f")
+			bucket, name := writer.Sess.s3.location(DataObject, file.Extent[1].Objects()[0])
+			fake.remove(bucket + "/" + name)
+
+			fs, _ := newTestFS(t, fake, func(c *Config) { c.MissingExtent = tc.policy })
+			f, st := fs.Open("f", 0, testContext)
+			if st != fuse.OK {
+				t.Fatal(st)
+			}
+			defer f.Release()
+			buf := make([]byte, 48-tc.off)
+			res, st := f.Read(buf, tc.off)
+			if st != tc.status {
+				t.Fatalf("read = %v, want %v", st, tc.status)
+			}
+			if st != fuse.OK {
+				return
+			}
+			if got, _ := res.Bytes(buf); !bytes.Equal(got, tc.want) {
+				t.Fatalf("read %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+// TestFileSizeLimit writes across and beyond the limit of max_file_size
+// or max_extents, whichever is smaller.
+func TestFileSizeLimit(t *testing.T) {
+	for name, mod := range map[string]func(c *Config){
+		"size":    func(c *Config) { c.MaxFileSize = 64 },
+		"extents": func(c *Config) { c.MaxFileSize = 1000; c.MaxExtents = 4 },
+	} {
+		t.Run(name, func(t *testing.T) {
+			fs, _ := newTestFS(t, nil, mod)
+			f, st := fs.Create("f", 0, 0644, testContext)
+			if st != fuse.OK {
+				t.Fatal(st)
+			}
+			defer f.Release()
+			if n, st := f.Write(bytes.Repeat([]byte("x"), 40), 50); st != fuse.OK || n != 14 {
+				t.Fatalf("write across limit = %d %v", n, st)
+			}
+			if _, st := f.Write([]byte("x"), 64); st != fuse.Status(syscall.EFBIG) {
+				t.Fatalf("write at limit = %v", st)
+			}
+			if st := f.Truncate(65); st != fuse.Status(syscall.EFBIG) {
+				t.Fatalf("truncate handle = %v", st)
+			}
+			if st := f.Flush(); st != fuse.OK {
+				t.Fatal(st)
+			}
+			if st := fs.Truncate("f", 65, testContext); st != fuse.Status(syscall.EFBIG) {
+				t.Fatalf("truncate path = %v", st)
+			}
+			if attr, st := fs.GetAttr("f", testContext); st != fuse.OK || attr.Size != 64 {
+				t.Fatalf("size = %d %v", attr.Size, st)
+			}
+		})
+	}
+}
+
+// TestChunkedExtentReuploadsChunk changes one byte of a chunked extent.
+// Only the chunk holding it is uploaded again.
+func TestChunkedExtentReuploadsChunk(t *testing.T) {
+	mod := func(c *Config) {
+		c.ExtentSize = 64
+		c.ChunkSize = 16
+		c.DataPrefix = "data/"
+	}
+	fs, fake := newTestFS(t, nil, mod)
+	data := make([]byte, 64)
+	rand.Read(data)
+	writeFile(t, fs, "f", data)
+	puts := fake.totalPuts(testBucket + "/data/")
+	if puts != 4 {
+		t.Fatalf("%d chunks uploaded", puts)
+	}
+
+	f, st := fs.Open("f", syscall.O_RDWR, testContext)
+	if st != fuse.OK {
+		t.Fatal(st)
+	}
+	data[20] ^= 1
+	if _, st := f.Write(data[20:21], 20); st != fuse.OK {
+		t.Fatal(st)
+	}
+	if st := f.Flush(); st != fuse.OK {
+		t.Fatal(st)
+	}
+	if saved := fs.Sess.openedFile(fs.mustKey(t, "f")).LastSave(); saved.Uploaded != 1 || saved.Deduped != 0 {
+		t.Fatalf("save %+v, unchanged chunks aren't deduped", saved)
+	}
+	f.Release()
+	if n := fake.totalPuts(testBucket+"/data/") - puts; n != 1 {
+		t.Fatalf("%d chunks uploaded for one byte", n)
+	}
+
+	reader, _ := newTestFS(t, fake, mod)
+	if got := readFile(t, reader, "f"); !bytes.Equal(got, data) {
+		t.Fatalf("read %x, want %x", got, data)
+	}
+	file, _ := reader.getFile(context.Background(), "f")
+	if len(file.Extent[0].Chunks) != 4 {
+		t.Fatalf("chunks %v", file.Extent[0].Chunks)
+	}
+}
+
+// TestDontNeedXAttr drops extents of an open file by the xattr. Dirty
+// extents are kept, and dropped ones are read again.
+func TestDontNeedXAttr(t *testing.T) {
+	fs, _ := newTestFS(t, nil, nil)
+	data := testContent()[:48]
+	writeFile(t, fs, "f", data)
+	f, st := fs.Open("f", syscall.O_RDWR, testContext)
+	if st != fuse.OK {
+		t.Fatal(st)
+	}
+	defer f.Release()
+	if _, st := f.Read(make([]byte, 48), 0); st != fuse.OK {
+		t.Fatal(st)
+	}
+	if _, st := f.Write(data[40:41], 40); st != fuse.OK {
+		t.Fatal(st)
+	}
+	file := fs.Sess.openedFile(fs.mustKey(t, "f"))
+	resident := func() (held []bool) {
+		file.lock.Lock()
+		defer file.lock.Unlock()
+		for i := int64(0); i < 3; i++ {
+			held = append(held, file.Extent[i].body != nil)
+		}
+		return held
+	}
+
+	for _, tc := range []struct {
+		value string
+		held  string
+	}{
+		{"16 16", "[true false true]"},
+		{"0 0", "[false false true]"},
+	} {
+		if st := fs.SetXAttr("f", DontNeedXAttr, []byte(tc.value), 0, testContext); st != fuse.OK {
+			t.Fatal(st)
+		}
+		if got := fmt.Sprint(resident()); got != tc.held {
+			t.Fatalf("%q: resident %s, want %s", tc.value, got, tc.held)
+		}
+	}
+	for _, value := range []string{"x", "-1 0"} {
+		if st := fs.SetXAttr("f", DontNeedXAttr, []byte(value), 0, testContext); st != fuse.EINVAL {
+			t.Fatalf("%q: %v", value, st)
+		}
+	}
+
+	buf := make([]byte, 48)
+	res, st := f.Read(buf, 0)
+	if st != fuse.OK {
+		t.Fatal(st)
+	}
+	if got, _ := res.Bytes(buf); !bytes.Equal(got, data) {
+		t.Fatalf("read after drop %q", got)
+	}
+}
+
+// TestWriteBeyondEOFZeroesGap shrinks a file, then writes far beyond its
+// end. The gap reads as zeros, not as the stale bytes of the extents.
+func TestWriteBeyondEOFZeroesGap(t *testing.T) {
+	fs, fake := newTestFS(t, nil, nil)
+	writeFile(t, fs, "f", bytes.Repeat([]byte("x"), 48))
+	f, st := fs.Open("f", syscall.O_RDWR, testContext)
+	if st != fuse.OK {
+		t.Fatal(st)
+	}
+	if st := f.Truncate(5); st != fuse.OK {
+		t.Fatal(st)
+	}
+	if _, st := f.Write([]byte("end"), 10000); st != fuse.OK {
+		t.Fatal(st)
+	}
+	if st := f.Flush(); st != fuse.OK {
+		t.Fatal(st)
+	}
+	want := make([]byte, 10003)
+	copy(want, "xxxxx")
+	copy(want[10000:], "end")
+
+	buf := make([]byte, 20000)
+	res, st := f.Read(buf, 0)
+	if st != fuse.OK {
+		t.Fatal(st)
+	}
+	if got, _ := res.Bytes(buf); !bytes.Equal(got, want) {
+		t.Fatalf("read %d bytes, differs from written", len(got))
+	}
+	for _, off := range []int64{10003, 20000} {
+		res, st := f.Read(buf, off)
+		if st != fuse.OK {
+			t.Fatalf("read at %d: %v", off, st)
+		}
+		if got, _ := res.Bytes(buf); len(got) != 0 {
+			t.Fatalf("read %d bytes at %d", len(got), off)
+		}
+	}
+	f.Release()
+
+	reader, _ := newTestFS(t, fake, nil)
+	if got := readFile(t, reader, "f"); !bytes.Equal(got, want) {
+		t.Fatalf("stored %q...", got[:48])
+	}
+}
+
+// TestSaveWaitsAllUploads fails one extent upload while another is slow.
+// The save returns only after the slow one, and a read racing with it
+// sees the written content.
+func TestSaveWaitsAllUploads(t *testing.T) {
+	fs, fake := newTestFS(t, nil, nil)
+	a, b, c := bytes.Repeat([]byte("a"), 16), bytes.Repeat([]byte("b"), 16), bytes.Repeat([]byte("c"), 16)
+	dataName := func(body []byte) string {
+		bucket, name := fs.Sess.s3.location(DataObject, fs.Sess.KeyGen(body))
+		return bucket + "/" + name
+	}
+	slow, failing := dataName(b), dataName(c)
+	writeFile(t, fs, "f", make([]byte, 48))
+
+	w, st := fs.Open("f", syscall.O_RDWR, testContext)
+	if st != fuse.OK {
+		t.Fatal(st)
+	}
+	defer w.Release()
+	r, st := fs.Open("f", 0, testContext)
+	if st != fuse.OK {
+		t.Fatal(st)
+	}
+	defer r.Release()
+	data := bytes.Join([][]byte{a, b, c}, nil)
+	if _, st := w.Write(data, 0); st != fuse.OK {
+		t.Fatal(st)
+	}
+
+	fake.mu.Lock()
+	fake.delayOf = func(op, name string) time.Duration {
+		if op == "PutObject" && name == slow {
+			return 200 * time.Millisecond
+		}
+		return 0
+	}
+	fake.fail = func(op, name string) error {
+		if op == "PutObject" && name == failing {
+			return errors.New("injected")
+		}
+		return nil
+	}
+	fake.mu.Unlock()
+
+	read := make(chan []byte)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		buf := make([]byte, 48)
+		res, _ := r.Read(buf, 0)
+		got, _ := res.Bytes(buf)
+		read <- got
+	}()
+	if st := w.Flush(); st == fuse.OK {
+		t.Fatal("save succeeded")
+	}
+	if _, ok := fake.get(slow); !ok {
+		t.Fatal("save returned before the slow upload")
+	}
+	if got := <-read; !bytes.Equal(got, data) {
+		t.Fatalf("read during save %q", got)
+	}
+	fake.mu.Lock()
+	fake.delayOf, fake.fail = nil, nil
+	fake.mu.Unlock()
+}
+
+// TestDirectIOUnaligned reads and writes at every offset and length, as
+// direct_io passes requests unaligned. A read ending at an extent boundary
+// doesn't load the next extent.
+func TestDirectIOUnaligned(t *testing.T) {
+	direct := func(c *Config) { c.DirectIO = true }
+	fs, fake := newTestFS(t, nil, direct)
+	data := testContent()[:48]
+	writeFile(t, fs, "f", data)
+
+	for _, tc := range []struct {
+		mod   func(c *Config)
+		flags uint32
+		want  bool
+	}{
+		{nil, 0, false},
+		{nil, syscall.O_DIRECT, true},
+		{direct, 0, true},
+	} {
+		other, _ := newTestFS(t, fake, tc.mod)
+		f, st := other.Open("f", tc.flags, testContext)
+		if st != fuse.OK {
+			t.Fatal(st)
+		}
+		flagged, ok := f.(*nodefs.WithFlags)
+		if got := ok && flagged.FuseFlags&fuse.FOPEN_DIRECT_IO != 0; got != tc.want {
+			t.Fatalf("flags %o: direct io %v", tc.flags, got)
+		}
+		f.Release()
+	}
+
+	reader, _ := newTestFS(t, fake, direct)
+	file, _ := reader.getFile(context.Background(), "f")
+	bucket, name := reader.Sess.s3.location(DataObject, file.Extent[1].Objects()[0])
+	f, st := reader.Open("f", syscall.O_RDWR, testContext)
+	if st != fuse.OK {
+		t.Fatal(st)
+	}
+	defer f.Release()
+	buf := make([]byte, 16)
+	if _, st := f.Read(buf, 0); st != fuse.OK {
+		t.Fatal(st)
+	}
+	if n := fake.totalGets(bucket + "/" + name); n != 0 {
+		t.Fatalf("next extent loaded %d times", n)
+	}
+
+	for off := 0; off < len(data); off++ {
+		for size := 1; off+size <= len(data); size++ {
+			buf := make([]byte, size)
+			res, st := f.Read(buf, int64(off))
+			if st != fuse.OK {
+				t.Fatal(st)
+			}
+			if got, _ := res.Bytes(buf); !bytes.Equal(got, data[off:off+size]) {
+				t.Fatalf("read %d at %d = %q, want %q", size, off, got, data[off:off+size])
+			}
+		}
+	}
+	for _, w := range []struct{ off, size int }{{3, 5}, {15, 2}, {17, 30}, {40, 8}} {
+		for i := w.off; i < w.off+w.size; i++ {
+			data[i] = byte('A' + i%26)
+		}
+		if _, st := f.Write(data[w.off:w.off+w.size], int64(w.off)); st != fuse.OK {
+			t.Fatal(st)
+		}
+	}
+	if st := f.Flush(); st != fuse.OK {
+		t.Fatal(st)
+	}
+	if got := readFile(t, reader, "f"); !bytes.Equal(got, data) {
+		t.Fatalf("read %q, want %q", got, data)
+	}
+}
+
+// TestConcurrentAppends appends records from handles of several goroutines,
+// at a stale offset. Every record lands whole at the end.
+func TestConcurrentAppends(t *testing.T) {
+	fs, fake := newTestFS(t, nil, nil)
+	writeFile(t, fs, "log", nil)
+	const writers, records = 8, 50
+	done := make(chan string, writers)
+	for w := 0; w < writers; w++ {
+		go func(w int) {
+			f, st := fs.Open("log", syscall.O_WRONLY|syscall.O_APPEND, testContext)
+			if st != fuse.OK {
+				done <- "open " + st.String()
+				return
+			}
+			defer f.Release()
+			for i := 0; i < records; i++ {
+				record := fmt.Sprintf("writer %d record %02d\n", w, i)
+				if n, st := f.Write([]byte(record), 0); st != fuse.OK || int(n) != len(record) {
+					done <- fmt.Sprintf("write %d %v", n, st)
+					return
+				}
+			}
+			if st := f.Flush(); st != fuse.OK {
+				done <- "flush " + st.String()
+				return
+			}
+			done <- ""
+		}(w)
+	}
+	for w := 0; w < writers; w++ {
+		if failed := <-done; failed != "" {
+			t.Fatal(failed)
+		}
+	}
+
+	reader, _ := newTestFS(t, fake, nil)
+	lines := strings.Split(strings.TrimSuffix(string(readFile(t, reader, "log")), "\n"), "\n")
+	if len(lines) != writers*records {
+		t.Fatalf("%d records", len(lines))
+	}
+	next := make([]int, writers)
+	for _, line := range lines {
+		var w, i int
+		if _, err := fmt.Sscanf(line, "writer %d record %d", &w, &i); err != nil || w >= writers || i != next[w] {
+			t.Fatalf("record %q, expected %d of writer", line, next[w%writers])
+		}
+		next[w]++
+	}
+}
+
+// tinyRandomWrites writes 8 random bytes at random offsets of file name,
+// flushing each, and applies them to data.
+func tinyRandomWrites(tb testing.TB, fs *FileSystem, name string, rng *rand.Rand, data []byte, writes int) {
+	tb.Helper()
+	f, st := fs.Open(name, syscall.O_RDWR, testContext)
+	if st != fuse.OK {
+		tb.Fatal(st)
+	}
+	defer f.Release()
+	for i := 0; i < writes; i++ {
+		off := rng.Intn(len(data) - 8)
+		rng.Read(data[off : off+8])
+		if _, st := f.Write(data[off:off+8], int64(off)); st != fuse.OK {
+			tb.Fatal(st)
+		}
+		if st := f.Flush(); st != fuse.OK {
+			tb.Fatal(st)
+		}
+	}
+}
+
+func amplificationGuard(c *Config) {
+	c.ExtentSize = 4096
+	c.WriteAmplification = 8
+	c.GuardChunkSize = 256
+}
+
+// TestWriteAmplificationGuard writes tiny random writes to files with and
+// without the guard. The guarded one switches to smaller chunks, uploads
+// less, and has the same content.
+func TestWriteAmplificationGuard(t *testing.T) {
+	if (&Config{WriteAmplification: -1}).validate() {
+		t.Fatal("negative write amplification is valid")
+	}
+	data := make([]byte, 16*1024)
+	rand.Read(data)
+	contents := map[string][]byte{}
+	uploaded := map[string]int64{}
+	for name, mod := range map[string]func(*Config){
+		"naive":   func(c *Config) { c.ExtentSize = 4096 },
+		"guarded": amplificationGuard,
+	} {
+		fs, fake := newTestFS(t, nil, mod)
+		content := append([]byte(nil), data...)
+		writeFile(t, fs, "f", content)
+		before := fs.Sess.Stats().UploadedBytes
+		tinyRandomWrites(t, fs, "f", rand.New(rand.NewSource(1)), content, 20)
+		uploaded[name] = fs.Sess.Stats().UploadedBytes - before
+
+		reader, _ := newTestFS(t, fake, mod)
+		contents[name] = readFile(t, reader, "f")
+		if !bytes.Equal(contents[name], content) {
+			t.Fatalf("%s content differs", name)
+		}
+		file, _ := reader.getFile(context.Background(), "f")
+		if want := map[string]int64{"naive": 0, "guarded": 256}[name]; file.ChunkSize != want {
+			t.Fatalf("%s chunk size %d", name, file.ChunkSize)
+		}
+	}
+	if !bytes.Equal(contents["naive"], contents["guarded"]) {
+		t.Fatal("guarded content differs from naive")
+	}
+	if uploaded["guarded"]*2 > uploaded["naive"] {
+		t.Fatalf("guarded uploaded %d bytes, naive %d", uploaded["guarded"], uploaded["naive"])
+	}
+}
+
+func BenchmarkTinyRandomWrites(b *testing.B) {
+	data := make([]byte, 64*1024)
+	for name, mod := range map[string]func(*Config){
+		"naive":   func(c *Config) { c.ExtentSize = 4096 },
+		"guarded": amplificationGuard,
+	} {
+		b.Run(name, func(b *testing.B) {
+			rng := rand.New(rand.NewSource(1))
+			rng.Read(data)
+			fs, _ := newTestFS(b, nil, mod)
+			writeFile(b, fs, "f", data)
+			before := fs.Sess.Stats().UploadedBytes
+			b.ResetTimer()
+			tinyRandomWrites(b, fs, "f", rng, data, b.N)
+			b.ReportMetric(float64(fs.Sess.Stats().UploadedBytes-before)/float64(b.N), "uploaded-bytes/op")
+		})
+	}
+}
+
+// TestMetadataAfterExtents checks that every uploaded metadata of a file
+// refers only objects present in the backend, and that a dedup-heavy save
+// confirms chunks concurrently.
+func TestMetadataAfterExtents(t *testing.T) {
+	mod := func(c *Config) {
+		c.ExtentSize = 64
+		c.ChunkSize = 16
+		c.DataPrefix = "data/"
+	}
+	fs, fake := newTestFS(t, nil, mod)
+	var missing []string
+	metas := 0
+	fake.onPut = func(name string, body []byte) error {
+		file := &File{}
+		if json.Unmarshal(body, file) != nil || len(file.Extent) == 0 {
+			return nil
+		}
+		metas++
+		for _, e := range file.Extent {
+			for _, obj := range e.Objects() {
+				bucket, object := fs.Sess.s3.location(DataObject, obj)
+				if _, ok := fake.objects[bucket+"/"+object]; !ok {
+					missing = append(missing, bucket+"/"+object)
+				}
+			}
+		}
+		return nil
+	}
+	data := make([]byte, 256)
+	rand.Read(data)
+	writeFile(t, fs, "a", data)
+
+	const head = 50 * time.Millisecond
+	prefix := fs.Sess.dataPrefix()
+	fake.mu.Lock()
+	fake.delayOf = func(op, name string) time.Duration {
+		if op == "HeadObject" && strings.HasPrefix(name, prefix) {
+			return head
+		}
+		return 0
+	}
+	fake.mu.Unlock()
+	// HEAD of 16 chunks one by one takes 16 times
+	start := time.Now()
+	writeFile(t, fs, "b", data)
+	if d := time.Since(start); d > 8*head {
+		t.Fatalf("dedup save took %v", d)
+	}
+
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if metas < 2 || len(missing) != 0 {
+		t.Fatalf("%d metadata, referring missing %v", metas, missing)
+	}
+}
+
+// TestSaveOnlyDirtyExtents writes a byte into a file of 1000 extents. The
+// save processes the one extent, and uploads one object.
+func TestSaveOnlyDirtyExtents(t *testing.T) {
+	mod := func(c *Config) { c.DataPrefix = "data/" }
+	fs, fake := newTestFS(t, nil, mod)
+	data := make([]byte, 16*1000)
+	rand.Read(data)
+	writeFile(t, fs, "huge", data)
+	prefix := fs.Sess.dataPrefix()
+	puts := fake.totalPuts(prefix)
+
+	f, st := fs.Open("huge", syscall.O_RDWR, testContext)
+	if st != fuse.OK {
+		t.Fatal(st)
+	}
+	defer f.Release()
+	data[8000] ^= 1
+	if _, st := f.Write(data[8000:8001], 8000); st != fuse.OK {
+		t.Fatal(st)
+	}
+	file := fs.Sess.openedFile(fs.mustKey(t, "huge"))
+	if _, ok := file.dirtyExtents[500]; !ok || len(file.dirtyExtents) != 1 {
+		t.Fatalf("dirty extents %v", file.dirtyExtents)
+	}
+	if st := f.Flush(); st != fuse.OK {
+		t.Fatal(st)
+	}
+	if file.dirtyExtents != nil {
+		t.Fatalf("dirty extents after save %v", file.dirtyExtents)
+	}
+	if n, saved := fake.totalPuts(prefix)-puts, file.LastSave(); n != 1 || saved.Uploaded != 1 {
+		t.Fatalf("%d puts, save %+v", n, saved)
+	}
+
+	reader, _ := newTestFS(t, fake, mod)
+	if got := readFile(t, reader, "huge"); !bytes.Equal(got, data) {
+		t.Fatal("content differs")
+	}
+}
@@ -0,0 +1,499 @@
+package bucketsync
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+)
+
+// mkdirAll is mkdir -p of path.
+func mkdirAll(fs *FileSystem, path string) fuse.Status {
+	dir := ""
+	for _, name := range strings.Split(path, "/") {
+		dir = strings.TrimPrefix(dir+"/"+name, "/")
+		if st := fs.Mkdir(dir, 0755, testContext); st != fuse.OK && st != fuse.Status(syscall.EEXIST) {
+			return st
+		}
+	}
+	return fuse.OK
+}
+
+func TestMkdirAllTwiceUploadsNothing(t *testing.T) {
+	fs, fake := newTestFS(t, nil, nil)
+	if st := mkdirAll(fs, "a/b/c"); st != fuse.OK {
+		t.Fatal(st)
+	}
+	puts := fake.totalPuts("")
+	if st := mkdirAll(fs, "a/b/c"); st != fuse.OK {
+		t.Fatal(st)
+	}
+	if n := fake.totalPuts("") - puts; n != 0 {
+		t.Fatalf("second mkdir -p uploaded %d objects", n)
+	}
+	if st := fs.Rename("a/b", "a/b", testContext); st != fuse.OK || fake.totalPuts("") != puts {
+		t.Fatalf("rename to itself uploaded: %v", st)
+	}
+}
+
+func TestIdenticalSymlinksShareObject(t *testing.T) {
+	fs, fake := newTestFS(t, nil, nil)
+	if st := fs.Mkdir("d", 0755, testContext); st != fuse.OK {
+		t.Fatal(st)
+	}
+	for i := 0; i < 20; i++ {
+		if st := fs.Symlink("target", fmt.Sprintf("d/l%d", i), testContext); st != fuse.OK {
+			t.Fatal(st)
+		}
+	}
+	key := fs.mustKey(t, "d/l0")
+	for i := 1; i < 20; i++ {
+		if k := fs.mustKey(t, fmt.Sprintf("d/l%d", i)); k != key {
+			t.Fatalf("l%d has key %s, l0 %s", i, k, key)
+		}
+	}
+	if n := fake.totalPuts(fs.Sess.metaName(key)); n != 1 {
+		t.Fatalf("%d uploads of the symlink", n)
+	}
+
+	// Changed one moves to its own object
+	orphans := orphaned(fs)
+	if st := fs.Chown("d/l1", 7, 7, testContext); st != fuse.OK {
+		t.Fatal(st)
+	}
+	if fs.mustKey(t, "d/l1") == key || fs.mustKey(t, "d/l2") != key {
+		t.Fatal("chown doesn't move the symlink")
+	}
+	if attr, st := fs.GetAttr("d/l2", testContext); st != fuse.OK || attr.Uid == 7 {
+		t.Fatalf("chown changed the others: %v %v", attr, st)
+	}
+	if attr, st := fs.GetAttr("d/l1", testContext); st != fuse.OK || attr.Uid != 7 {
+		t.Fatalf("chown = %v %v", attr, st)
+	}
+	if st := fs.Unlink("d/l3", testContext); st != fuse.OK {
+		t.Fatal(st)
+	}
+	if orphaned(fs) != orphans {
+		t.Fatal("shared symlink is orphaned")
+	}
+
+	reader, _ := newTestFS(t, fake, nil)
+	for _, name := range []string{"d/l0", "d/l1", "d/l19"} {
+		if to, st := reader.Readlink(name, testContext); st != fuse.OK || to != "target" {
+			t.Fatalf("%s -> %q %v", name, to, st)
+		}
+	}
+	var paths int64
+	err := reader.Sess.Walk(context.Background(), "", reader.Sess.RootKey(), WalkOptions{}, func(path string, key ObjectKey, node interface{}) error {
+		if _, ok := node.(*SymLink); ok {
+			atomic.AddInt64(&paths, 1)
+		}
+		return nil
+	})
+	if err != nil || paths != 19 {
+		t.Fatalf("walk visited %d symlinks: %v", paths, err)
+	}
+	if report := runFsck(t, fake, false); len(report.Issues) != 0 {
+		t.Fatalf("fsck %v", report.Issues)
+	}
+}
+
+func TestSymlinkTimesAreNotShared(t *testing.T) {
+	fs, _ := newTestFS(t, nil, nil)
+	for _, name := range []string{"a", "b"} {
+		if st := fs.Symlink("target", name, testContext); st != fuse.OK {
+			t.Fatal(st)
+		}
+	}
+	key := fs.mustKey(t, "a")
+	before, _ := fs.GetAttr("b", testContext)
+	mtime := time.Unix(1000, 0)
+	if st := fs.Utimens("a", nil, &mtime, testContext); st != fuse.OK {
+		t.Fatal(st)
+	}
+	if fs.mustKey(t, "a") == key || fs.mustKey(t, "b") != key {
+		t.Fatal("utimens doesn't copy the symlink")
+	}
+	if attr, _ := fs.GetAttr("a", testContext); attr.Mtime != 1000 {
+		t.Fatalf("mtime = %d", attr.Mtime)
+	}
+	if attr, _ := fs.GetAttr("b", testContext); attr.Mtime != before.Mtime || attr.Ctime != before.Ctime {
+		t.Fatalf("utimens changed times of the other: %v", attr)
+	}
+}
+
+func TestEmptyDirectoriesShareObject(t *testing.T) {
+	fs, fake := newTestFS(t, nil, nil)
+	for i := 0; i < 20; i++ {
+		if st := fs.Mkdir(fmt.Sprintf("d%d", i), 0755, testContext); st != fuse.OK {
+			t.Fatal(st)
+		}
+	}
+	key := fs.mustKey(t, "d0")
+	for i := 1; i < 20; i++ {
+		if k := fs.mustKey(t, fmt.Sprintf("d%d", i)); k != key {
+			t.Fatalf("d%d has key %s, d0 %s", i, k, key)
+		}
+	}
+	if n := fake.totalPuts(fs.Sess.metaName(key)); n != 1 {
+		t.Fatalf("%d uploads of the empty directory", n)
+	}
+
+	// The first entry copies the directory, the shared object is unchanged
+	shared, _ := fake.get(fs.Sess.metaName(key))
+	writeFile(t, fs, "d1/f", []byte("f"))
+	if st := fs.Mkdir("d2/sub", 0755, testContext); st != fuse.OK {
+		t.Fatal(st)
+	}
+	if st := fs.Chmod("d3", 0700, testContext); st != fuse.OK {
+		t.Fatal(st)
+	}
+	for _, name := range []string{"d1", "d2", "d3"} {
+		if fs.mustKey(t, name) == key {
+			t.Fatalf("%s is still shared", name)
+		}
+	}
+	if fs.mustKey(t, "d2/sub") != key {
+		t.Fatal("new empty directory isn't shared")
+	}
+	if got, _ := fake.get(fs.Sess.metaName(key)); !bytes.Equal(got, shared) {
+		t.Fatal("shared directory is changed in place")
+	}
+	if n := fake.totalPuts(fs.Sess.metaName(key)); n != 1 {
+		t.Fatalf("%d uploads of the empty directory", n)
+	}
+
+	reader, _ := newTestFS(t, fake, nil)
+	if got := readFile(t, reader, "d1/f"); string(got) != "f" {
+		t.Fatalf("d1/f = %q", got)
+	}
+	if attr, st := reader.GetAttr("d3", testContext); st != fuse.OK || attr.Mode&0777 != 0700 {
+		t.Fatalf("d3 = %v %v", attr, st)
+	}
+	if attr, st := reader.GetAttr("d4", testContext); st != fuse.OK || attr.Mode&0777 != 0755 {
+		t.Fatalf("d4 = %v %v", attr, st)
+	}
+	if entries, st := reader.OpenDir("d0", testContext); st != fuse.OK || len(entries) != 0 {
+		t.Fatalf("d0 = %v %v", entries, st)
+	}
+	if report := runFsck(t, fake, false); len(report.Issues) != 0 {
+		t.Fatalf("fsck %v", report.Issues)
+	}
+}
+
+func TestOpenTruncates(t *testing.T) {
+	fs, fake := newTestFS(t, nil, nil)
+	writeFile(t, fs, "f", []byte("0123456789abcdef0123"))
+	f, st := fs.Open("f", syscall.O_RDWR|syscall.O_TRUNC, testContext)
+	if st != fuse.OK {
+		t.Fatal(st)
+	}
+	defer f.Release()
+	res, st := f.Read(make([]byte, 20), 0)
+	if st != fuse.OK || res.Size() != 0 {
+		t.Fatalf("read %d bytes: %v", res.Size(), st)
+	}
+
+	reader, _ := newTestFS(t, fake, nil)
+	file, st := reader.getFile(context.Background(), "f")
+	if st != fuse.OK {
+		t.Fatal(st)
+	}
+	if file.Meta.Size != 0 || len(file.Extent) != 0 {
+		t.Fatalf("size %d, %d extents after O_TRUNC", file.Meta.Size, len(file.Extent))
+	}
+}
+
+// TestTruncateDropsExtents shrinks a file of four extents into the second.
+// The reloaded file has two extents with the prefix of the content, and the
+// dropped extents are neither uploaded again nor referred by the file.
+func TestTruncateDropsExtents(t *testing.T) {
+	fs, fake := newTestFS(t, nil, func(c *Config) { c.DataPrefix = "data/" })
+	data := testContent()[:64]
+	writeFile(t, fs, "f", data)
+	file, st := fs.getFile(context.Background(), "f")
+	if st != fuse.OK || len(file.Extent) != 4 {
+		t.Fatalf("%d extents: %v", len(file.Extent), st)
+	}
+	dataName := func(key ObjectKey) string {
+		bucket, name := fs.Sess.s3.location(DataObject, key)
+		return bucket + "/" + name
+	}
+	dropped := map[ObjectKey]int{}
+	fake.mu.Lock()
+	for _, i := range []int64{2, 3} {
+		for _, key := range file.Extent[i].Objects() {
+			dropped[key] = fake.puts[dataName(key)]
+		}
+	}
+	fake.mu.Unlock()
+
+	f, st := fs.Open("f", syscall.O_RDWR, testContext)
+	if st != fuse.OK {
+		t.Fatal(st)
+	}
+	puts := fake.totalPuts(fs.Sess.dataPrefix())
+	if st := f.Truncate(20); st != fuse.OK {
+		t.Fatal(st)
+	}
+	if st := f.Flush(); st != fuse.OK {
+		t.Fatal(st)
+	}
+	f.Release()
+	if n := fake.totalPuts(fs.Sess.dataPrefix()) - puts; n > 1 {
+		t.Fatalf("%d data uploads saving the truncated file", n)
+	}
+
+	reader, _ := newTestFS(t, fake, func(c *Config) { c.DataPrefix = "data/" })
+	if got := readFile(t, reader, "f"); !bytes.Equal(got, data[:20]) {
+		t.Fatalf("read %q", got)
+	}
+	file, _ = reader.getFile(context.Background(), "f")
+	m := readExtentMap(t, reader, "f")
+	if m.Size != 20 || len(m.Extents) != 2 || m.Extents[0].Size != 16 || m.Extents[1].Size != 4 || len(file.Extent) != 2 {
+		t.Fatalf("extent map %+v", m)
+	}
+	body, _ := fake.get(reader.Sess.metaName(file.Key))
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	for key, n := range dropped {
+		if bytes.Contains(body, []byte(key)) {
+			t.Fatalf("dropped object %s is referred", key)
+		}
+		if fake.puts[dataName(key)] != n {
+			t.Fatalf("dropped object %s is uploaded again", key)
+		}
+	}
+}
+
+// TestCreatedOwners creates objects from two callers. Each owns its own,
+// unless squash_owner maps them all to one owner.
+func TestCreatedOwners(t *testing.T) {
+	other := &fuse.Context{Owner: fuse.Owner{Uid: 7, Gid: 8}}
+	create := func(t *testing.T, fs *FileSystem, ctx *fuse.Context, prefix string) {
+		t.Helper()
+		if st := fs.Mkdir(prefix+"d", 0755, ctx); st != fuse.OK {
+			t.Fatal(st)
+		}
+		f, st := fs.Create(prefix+"f", 0, 0644, ctx)
+		if st != fuse.OK {
+			t.Fatal(st)
+		}
+		f.Release()
+		if st := fs.Symlink(prefix+"f", prefix+"l", ctx); st != fuse.OK {
+			t.Fatal(st)
+		}
+	}
+	check := func(t *testing.T, fs *FileSystem, prefix string, owner fuse.Owner) {
+		t.Helper()
+		for _, name := range []string{"d", "f", "l"} {
+			attr, st := fs.GetAttr(prefix+name, testContext)
+			if st != fuse.OK {
+				t.Fatal(st)
+			}
+			if attr.Uid != owner.Uid || attr.Gid != owner.Gid {
+				t.Fatalf("%s%s owned by %d:%d, want %v", prefix, name, attr.Uid, attr.Gid, owner)
+			}
+		}
+	}
+
+	t.Run("caller", func(t *testing.T) {
+		fs, _ := newTestFS(t, nil, nil)
+		create(t, fs, testContext, "1")
+		create(t, fs, other, "7")
+		check(t, fs, "1", testContext.Owner)
+		check(t, fs, "7", other.Owner)
+	})
+	t.Run("squash", func(t *testing.T) {
+		squashed := fuse.Owner{Uid: 100, Gid: 200}
+		fs, fake := newTestFS(t, nil, func(c *Config) {
+			c.SquashOwner = true
+			c.SquashUID = squashed.Uid
+			c.SquashGID = squashed.Gid
+		})
+		create(t, fs, testContext, "1")
+		create(t, fs, other, "7")
+		reader, _ := newTestFS(t, fake, nil)
+		check(t, reader, "1", squashed)
+		check(t, reader, "7", squashed)
+	})
+}
+
+// TestSymlinkTargets reads symlink targets through the cache, and resolves
+// relative, absolute and chained links internally.
+func TestSymlinkTargets(t *testing.T) {
+	internal := func(c *Config) { c.SymlinkMode = SymlinkInternal }
+	fs, fake := newTestFS(t, nil, internal)
+	if st := fs.Mkdir("d", 0755, testContext); st != fuse.OK {
+		t.Fatal(st)
+	}
+	writeFile(t, fs, "d/f", []byte("F"))
+	for link, target := range map[string]string{
+		"d/rel":  "f",
+		"abs":    "/d/f",
+		"d/up":   "../abs",
+		"loop":   "loop",
+		"d/file": "f/x",
+	} {
+		if st := fs.Symlink(target, link, testContext); st != fuse.OK {
+			t.Fatal(st)
+		}
+	}
+
+	if target, st := fs.Readlink("d/rel", testContext); st != fuse.OK || target != "f" {
+		t.Fatalf("readlink = %q %v", target, st)
+	}
+	if target, err := fs.Sess.links.Get(fs.mustKey(t, "d/rel")); err != nil || string(target) != "f" {
+		t.Fatalf("cached %q %v", target, err)
+	}
+	// Replaced link is read anew
+	if st := fs.Unlink("d/rel", testContext); st != fuse.OK {
+		t.Fatal(st)
+	}
+	if st := fs.Symlink("../abs", "d/rel", testContext); st != fuse.OK {
+		t.Fatal(st)
+	}
+	if target, st := fs.Readlink("d/rel", testContext); st != fuse.OK || target != "../abs" {
+		t.Fatalf("replaced readlink = %q %v", target, st)
+	}
+
+	ctx := context.Background()
+	want := fs.mustKey(t, "d/f")
+	for _, path := range []string{"d/rel", "abs", "d/up", "d/../d/rel"} {
+		if key, err := fs.Sess.Resolve(ctx, path); err != nil || key != want {
+			t.Fatalf("resolve %s = %s %v, want %s", path, key, err, want)
+		}
+	}
+	for _, path := range []string{"loop", "d/file", "missing"} {
+		if _, err := fs.Sess.Resolve(ctx, path); err == nil {
+			t.Fatalf("resolve %s succeeded", path)
+		}
+	}
+
+	kernel, _ := newTestFS(t, fake, nil)
+	if key, err := kernel.Sess.Resolve(ctx, "abs"); err != nil || key != kernel.mustKey(t, "abs") {
+		t.Fatalf("kernel mode resolve = %s %v", key, err)
+	}
+}
+
+// TestKernelCacheTimeouts looks up a file through the connector. Replies
+// carry the configured attribute and entry timeouts, or the defaults.
+func TestKernelCacheTimeouts(t *testing.T) {
+	for _, tc := range []struct {
+		attr, entry time.Duration
+		wantAttr    time.Duration
+		wantEntry   time.Duration
+	}{
+		{0, 0, time.Second, time.Second},
+		{time.Minute, 2 * time.Second, time.Minute, 2 * time.Second},
+	} {
+		mod := func(c *Config) { c.AttrTimeout = tc.attr; c.EntryTimeout = tc.entry }
+		fs, _ := newTestFS(t, nil, mod)
+		writeFile(t, fs, "f", []byte("f"))
+		config := testConfig(t, mod)
+		conn := nodefs.NewFileSystemConnector(pathfs.NewPathNodeFs(fs, nil).Root(), NodeOptions(config))
+		var out fuse.EntryOut
+		if st := conn.RawFS().Lookup(&fuse.InHeader{NodeId: fuse.FUSE_ROOT_ID}, "f", &out); st != fuse.OK {
+			t.Fatal(st)
+		}
+		attr := time.Duration(out.AttrValid)*time.Second + time.Duration(out.AttrValidNsec)
+		entry := time.Duration(out.EntryValid)*time.Second + time.Duration(out.EntryValidNsec)
+		if attr != tc.wantAttr || entry != tc.wantEntry {
+			t.Fatalf("attr %v entry %v, want %v %v", attr, entry, tc.wantAttr, tc.wantEntry)
+		}
+	}
+	if (&Config{AttrTimeout: -time.Second}).validate() {
+		t.Fatal("negative timeout is valid")
+	}
+}
+
+// TestNegativeLookups looks up missing names with the directory dropped
+// from the cache. The directory isn't loaded again until the entry
+// expires, and names created by the mount are seen at once.
+func TestNegativeLookups(t *testing.T) {
+	const timeout = 100 * time.Millisecond
+	fs, fake := newTestFS(t, nil, func(c *Config) { c.NegativeTimeout = timeout })
+	if st := fs.Mkdir("d", 0755, testContext); st != fuse.OK {
+		t.Fatal(st)
+	}
+	dir := fs.mustKey(t, "d")
+	loads := func(name string) int {
+		t.Helper()
+		fs.Sess.s3.cache.Remove(dir)
+		gets := fake.totalGets(fs.Sess.metaName(dir))
+		if _, st := fs.GetAttr(name, testContext); st != fuse.ENOENT {
+			t.Fatalf("%s: %v", name, st)
+		}
+		return fake.totalGets(fs.Sess.metaName(dir)) - gets
+	}
+	if n := loads("d/missing"); n != 1 {
+		t.Fatalf("first lookup loaded %d times", n)
+	}
+	if n := loads("d/missing"); n != 0 {
+		t.Fatalf("cached lookup loaded %d times", n)
+	}
+	writeFile(t, fs, "d/missing", []byte("created"))
+	if _, st := fs.GetAttr("d/missing", testContext); st != fuse.OK {
+		t.Fatalf("created: %v", st)
+	}
+	// The first entry moves d from the shared empty directory
+	dir = fs.mustKey(t, "d")
+
+	if n := loads("d/other"); n != 1 {
+		t.Fatalf("other lookup loaded %d times", n)
+	}
+	time.Sleep(2 * timeout)
+	if n := loads("d/other"); n != 1 {
+		t.Fatalf("expired lookup loaded %d times", n)
+	}
+}
+
+// TestReaddirPagination lists a large directory by pages, each from a new
+// listing as a reopened directory continues from its offset, alternating
+// sessions. Every entry is returned once, in order of names.
+func TestReaddirPagination(t *testing.T) {
+	fs, fake := newTestFS(t, nil, nil)
+	if st := fs.Mkdir("big", 0755, testContext); st != fuse.OK {
+		t.Fatal(st)
+	}
+	const entries, page = 200, 32
+	for i := 0; i < entries; i++ {
+		writeFile(t, fs, fmt.Sprintf("big/%03x", i*7919%entries), nil)
+	}
+	reader, _ := newTestFS(t, fake, nil)
+
+	var names []string
+	for off := 0; off < entries; off += page {
+		lister := fs
+		if off/page%2 == 1 {
+			lister = reader
+		}
+		listing, st := lister.OpenDir("big", testContext)
+		if st != fuse.OK || len(listing) != entries {
+			t.Fatalf("%d entries %v", len(listing), st)
+		}
+		end := off + page
+		if end > entries {
+			end = entries
+		}
+		for _, e := range listing[off:end] {
+			names = append(names, e.Name)
+		}
+	}
+	if len(names) != entries {
+		t.Fatalf("%d entries", len(names))
+	}
+	for i, name := range names {
+		if want := fmt.Sprintf("%03x", i); name != want {
+			t.Fatalf("entry %d is %s, want %s", i, name, want)
+		}
+	}
+}
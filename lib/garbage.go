@@ -0,0 +1,44 @@
+package bucketsync
+
+import (
+	"context"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+)
+
+// orphan records nodes no longer referenced. Nothing collects them yet, so
+// their objects and ones reachable from them stay in the bucket. They are
+// counted as OrphanedNodes, and logged for collection by hand. Symlinks and
+// empty directories addressed by content may be referred by other entries,
+// they're skipped.
+func (s *Session) orphan(keys ...ObjectKey) {
+	var orphans []ObjectKey
+	for _, key := range keys {
+		if !isSharedKey(key) {
+			orphans = append(orphans, key)
+		}
+	}
+	keys = orphans
+	atomic.AddInt64(&s.counters.orphanedNodes, int64(len(keys)))
+	s.logger.Debug("orphaned", zap.Strings("keys", keys))
+}
+
+// RemoveAll detaches a directory subtree from its parent by one update.
+// Only the directory itself is loaded; it and its children are orphaned.
+func (s *Session) RemoveAll(ctx context.Context, dir, parent *Directory, name string) error {
+	keys := make([]ObjectKey, 0, len(dir.FileMeta)+1)
+	for _, key := range dir.FileMeta {
+		keys = append(keys, key)
+	}
+	keys = append(keys, dir.Key)
+
+	parent.removeChild(name)
+	err := parent.Save(ctx)
+	if err != nil {
+		return err
+	}
+	s.orphan(keys...)
+	s.invalidateUsage()
+	return nil
+}
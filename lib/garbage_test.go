@@ -0,0 +1,34 @@
+package bucketsync
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func TestRecursiveRmdirLoadsOnlyDirectory(t *testing.T) {
+	fs, fake := newTestFS(t, nil, nil)
+	if st := fs.Mkdir("big", 0755, testContext); st != fuse.OK {
+		t.Fatal(st)
+	}
+	const files = 50
+	for i := 0; i < files; i++ {
+		writeFile(t, fs, fmt.Sprintf("big/%d", i), []byte("x"))
+	}
+
+	remover, _ := newTestFS(t, fake, func(c *Config) { c.RecursiveRmdir = true })
+	gets := fake.totalGets("")
+	if st := remover.Rmdir("big", testContext); st != fuse.OK {
+		t.Fatal(st)
+	}
+	if n := fake.totalGets("") - gets; n > 5 {
+		t.Fatalf("rmdir of %d files made %d gets", files, n)
+	}
+	if n := orphaned(remover); n != files+1 {
+		t.Fatalf("%d orphaned, want %d", n, files+1)
+	}
+	if _, st := remover.GetAttr("big", testContext); st != fuse.ENOENT {
+		t.Fatalf("big is %v", st)
+	}
+}
@@ -0,0 +1,110 @@
+package bucketsync
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// Defaults of health checks
+const (
+	defaultHealthTimeout = 5 * time.Second
+	defaultStuckTimeout  = 5 * time.Minute
+)
+
+// operations tracks start time of in-flight operations bounded by opContext.
+type operations struct {
+	lock    sync.Mutex
+	next    uint64
+	started map[uint64]time.Time
+}
+
+func (o *operations) begin() uint64 {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if o.started == nil {
+		o.started = make(map[uint64]time.Time)
+	}
+	o.next++
+	o.started[o.next] = time.Now()
+	return o.next
+}
+
+func (o *operations) end(id uint64) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	delete(o.started, id)
+}
+
+// oldest returns start time of the oldest in-flight operation.
+func (o *operations) oldest() (time.Time, bool) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	var oldest time.Time
+	for _, t := range o.started {
+		if oldest.IsZero() || t.Before(oldest) {
+			oldest = t
+		}
+	}
+	return oldest, !oldest.IsZero()
+}
+
+// Ready probes the backend by HEAD of the root object within HealthTimeout.
+func (s *Session) Ready(ctx context.Context) error {
+	timeout := s.config.HealthTimeout
+	if timeout <= 0 {
+		timeout = defaultHealthTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return errors.Wrap(s.s3.Head(ctx, MetaObject, s.RootKey()), "root is not reachable")
+}
+
+// Live returns error if an operation, including saves of dirty files, has
+// been running longer than StuckTimeout.
+func (s *Session) Live() error {
+	timeout := s.config.StuckTimeout
+	if timeout <= 0 {
+		timeout = defaultStuckTimeout
+	}
+	oldest, ok := s.ops.oldest()
+	if ok && time.Since(oldest) > timeout {
+		return errors.Errorf("operation stuck for %s", time.Since(oldest).Round(time.Second))
+	}
+	return nil
+}
+
+// HealthHandler serves /livez and /readyz, 200 if healthy, 503 otherwise.
+func (s *Session) HealthHandler() http.Handler {
+	mux := http.NewServeMux()
+	check := func(probe func(r *http.Request) error) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			err := probe(r)
+			if err != nil {
+				s.logger.Warn("health check failed", zap.String("path", r.URL.Path), zap.Error(err))
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+			w.Write([]byte("ok\n"))
+		}
+	}
+	mux.HandleFunc("/livez", check(func(r *http.Request) error { return s.Live() }))
+	mux.HandleFunc("/readyz", check(func(r *http.Request) error { return s.Ready(r.Context()) }))
+	return mux
+}
+
+// serveHealth starts HTTP server of HealthHandler on addr.
+func (s *Session) serveHealth(addr string) *http.Server {
+	server := &http.Server{Addr: addr, Handler: s.HealthHandler()}
+	go func() {
+		err := server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			s.logger.Error("health server failed", zap.String("addr", addr), zap.Error(err))
+		}
+	}()
+	return server
+}
@@ -0,0 +1,80 @@
+package bucketsync
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func probe(sess *Session, path string) int {
+	w := httptest.NewRecorder()
+	sess.HealthHandler().ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+	return w.Code
+}
+
+// TestReadiness probes a healthy, failing and hanging backend.
+func TestReadiness(t *testing.T) {
+	fs, fake := newTestFS(t, nil, func(c *Config) { c.HealthTimeout = 100 * time.Millisecond })
+	if code := probe(fs.Sess, "/readyz"); code != http.StatusOK {
+		t.Fatalf("healthy: %d", code)
+	}
+
+	fake.mu.Lock()
+	fake.fail = func(op, name string) error {
+		if op == "HeadObject" {
+			return errors.New("injected")
+		}
+		return nil
+	}
+	fake.mu.Unlock()
+	if code := probe(fs.Sess, "/readyz"); code != http.StatusServiceUnavailable {
+		t.Fatalf("failing: %d", code)
+	}
+
+	fake.mu.Lock()
+	fake.fail = nil
+	fake.headDelay = time.Minute
+	fake.mu.Unlock()
+	start := time.Now()
+	if code := probe(fs.Sess, "/readyz"); code != http.StatusServiceUnavailable {
+		t.Fatalf("hanging: %d", code)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("probe took %v", d)
+	}
+}
+
+// TestLiveness saves a file slower than the stuck timeout. The mount isn't
+// live while the save runs.
+func TestLiveness(t *testing.T) {
+	fs, fake := newTestFS(t, nil, func(c *Config) { c.StuckTimeout = 50 * time.Millisecond })
+	if code := probe(fs.Sess, "/livez"); code != http.StatusOK {
+		t.Fatalf("idle: %d", code)
+	}
+	fake.mu.Lock()
+	fake.putDelay = 300 * time.Millisecond
+	fake.mu.Unlock()
+	saved := make(chan fuse.Status)
+	go func() {
+		f, st := fs.Create("f", 0, 0644, testContext)
+		if st == fuse.OK {
+			f.Release()
+		}
+		saved <- st
+	}()
+
+	time.Sleep(150 * time.Millisecond)
+	if code := probe(fs.Sess, "/livez"); code != http.StatusServiceUnavailable {
+		t.Fatalf("stuck: %d", code)
+	}
+	if st := <-saved; st != fuse.OK {
+		t.Fatal(st)
+	}
+	if code := probe(fs.Sess, "/livez"); code != http.StatusOK {
+		t.Fatalf("after save: %d", code)
+	}
+}
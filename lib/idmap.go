@@ -0,0 +1,72 @@
+package bucketsync
+
+import (
+	"sort"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// IDRange maps Count ids from Stored of the bucket to Host of the mount,
+// like idmapped mounts. Ids out of ranges are not mapped.
+type IDRange struct {
+	Stored uint32 `yaml:"stored"`
+	Host   uint32 `yaml:"host"`
+	Count  uint32 `yaml:"count"`
+}
+
+type idMap []IDRange
+
+func (m idMap) toHost(id uint32) uint32 {
+	for _, r := range m {
+		if id >= r.Stored && id-r.Stored < r.Count {
+			return r.Host + (id - r.Stored)
+		}
+	}
+	return id
+}
+
+func (m idMap) toStored(id uint32) uint32 {
+	for _, r := range m {
+		if id >= r.Host && id-r.Host < r.Count {
+			return r.Stored + (id - r.Host)
+		}
+	}
+	return id
+}
+
+// valid returns true if ranges are non-empty and don't overlap on either
+// side, so that mapping is the same both ways.
+func (m idMap) valid() bool {
+	for _, r := range m {
+		if r.Count == 0 || uint64(r.Stored)+uint64(r.Count) > 1<<32 ||
+			uint64(r.Host)+uint64(r.Count) > 1<<32 {
+			return false
+		}
+	}
+	overlaps := func(start func(r IDRange) uint32) bool {
+		sorted := append(idMap{}, m...)
+		sort.Slice(sorted, func(i, j int) bool { return start(sorted[i]) < start(sorted[j]) })
+		for i := 1; i < len(sorted); i++ {
+			prev := sorted[i-1]
+			if uint64(start(prev))+uint64(prev.Count) > uint64(start(sorted[i])) {
+				return true
+			}
+		}
+		return false
+	}
+	return !overlaps(func(r IDRange) uint32 { return r.Stored }) &&
+		!overlaps(func(r IDRange) uint32 { return r.Host })
+}
+
+// hostOwner returns owner of meta seen by the mount.
+func (s *Session) hostOwner(meta *Meta) fuse.Owner {
+	return fuse.Owner{
+		Uid: idMap(s.config.UIDMap).toHost(meta.UID),
+		Gid: idMap(s.config.GIDMap).toHost(meta.GID),
+	}
+}
+
+// storedOwner returns ids of host uid and gid to store.
+func (s *Session) storedOwner(uid, gid uint32) (uint32, uint32) {
+	return idMap(s.config.UIDMap).toStored(uid), idMap(s.config.GIDMap).toStored(gid)
+}
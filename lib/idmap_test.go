@@ -0,0 +1,59 @@
+package bucketsync
+
+import (
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func TestIDMap(t *testing.T) {
+	mapped := func(c *Config) {
+		c.UIDMap = []IDRange{{Stored: 1000, Host: 100000, Count: 10}}
+		c.GIDMap = []IDRange{{Stored: 2000, Host: 200000, Count: 10}}
+	}
+	for _, ranges := range [][]IDRange{
+		{{Stored: 1000, Host: 100000, Count: 0}},
+		{{Stored: 1000, Host: 100000, Count: 10}, {Stored: 1005, Host: 300000, Count: 10}},
+		{{Stored: 1000, Host: 100000, Count: 10}, {Stored: 5000, Host: 100009, Count: 1}},
+		{{Stored: 1000, Host: 1<<32 - 1, Count: 2}},
+	} {
+		if (&Config{UIDMap: ranges}).validate() {
+			t.Fatalf("ranges %v are valid", ranges)
+		}
+	}
+
+	plain, fake := newTestFS(t, nil, nil)
+	stored := &fuse.Context{Owner: fuse.Owner{Uid: 1000, Gid: 2001}}
+	writeFile(t, plain, "stored", []byte("s"))
+	if st := plain.Chown("stored", 1000, 2001, stored); st != fuse.OK {
+		t.Fatal(st)
+	}
+
+	fs, _ := newTestFS(t, fake, mapped)
+	if attr, st := fs.GetAttr("stored", testContext); st != fuse.OK || attr.Owner != (fuse.Owner{Uid: 100000, Gid: 200001}) {
+		t.Fatalf("stored file is owned by %v %v", attr.Owner, st)
+	}
+	host := &fuse.Context{Owner: fuse.Owner{Uid: 100003, Gid: 200004}}
+	f, st := fs.Create("created", 0, 0644, host)
+	if st != fuse.OK {
+		t.Fatal(st)
+	}
+	var attr fuse.Attr
+	if st := f.GetAttr(&attr); st != fuse.OK || attr.Owner != host.Owner {
+		t.Fatalf("created file is owned by %v %v", attr.Owner, st)
+	}
+	f.Release()
+	if st := fs.Chown("stored", 100005, 7, testContext); st != fuse.OK {
+		t.Fatal(st)
+	}
+
+	reader, _ := newTestFS(t, fake, nil)
+	for name, want := range map[string]fuse.Owner{
+		"created": {Uid: 1003, Gid: 2004},
+		"stored":  {Uid: 1005, Gid: 7},
+	} {
+		if attr, st := reader.GetAttr(name, testContext); st != fuse.OK || attr.Owner != want {
+			t.Fatalf("%s is stored as %v %v, want %v", name, attr.Owner, st, want)
+		}
+	}
+}
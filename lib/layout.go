@@ -0,0 +1,84 @@
+package bucketsync
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// Limits of key layout
+const (
+	keyLayoutVersion = 1
+	maxShardLevels   = 4
+	shardWidth       = 2 // hex chars of a level
+)
+
+// keyLayout is placement of data objects. It's stored along with the root,
+// so that a bucket is read by the layout it was written with.
+type keyLayout struct {
+	Version     int `json:"version"`
+	ShardLevels int `json:"shard_levels"`
+}
+
+func (s *Session) layoutKey() ObjectKey {
+	return s.RootKey() + ".layout"
+}
+
+// loadLayout applies the stored layout. If it's not stored, a new root is
+// written by the configured layout and it's stored, an existing root has been
+// written flat.
+func (s *Session) loadLayout(ctx context.Context, create bool) error {
+	data, err := s.s3.Download(ctx, MetaObject, s.layoutKey())
+	if err == nil {
+		layout := keyLayout{}
+		err = json.Unmarshal(data, &layout)
+		if err != nil {
+			return errors.Wrap(err, "layout is corrupt")
+		}
+		if layout.Version > keyLayoutVersion || layout.ShardLevels < 0 || layout.ShardLevels > maxShardLevels {
+			return errors.Errorf("layout is not supported. version = %d, shard levels = %d",
+				layout.Version, layout.ShardLevels)
+		}
+		if layout.ShardLevels != s.config.KeyShardLevels {
+			s.logger.Warn("key_shard_levels differs from the bucket, using the bucket's",
+				zap.Int("config", s.config.KeyShardLevels), zap.Int("bucket", layout.ShardLevels))
+		}
+		s.s3.shardLevels = layout.ShardLevels
+		return nil
+	}
+	if errors.Cause(err) != ErrNotFound {
+		return err
+	}
+	if !create {
+		s.s3.shardLevels = 0
+		return nil
+	}
+
+	layout := keyLayout{Version: keyLayoutVersion, ShardLevels: s.config.KeyShardLevels}
+	data, err = json.Marshal(&layout)
+	if err != nil {
+		return err
+	}
+	s.s3.shardLevels = layout.ShardLevels
+	return s.s3.Upload(ctx, MetaObject, s.layoutKey(), bytes.NewReader(data))
+}
+
+// shardPath returns prefix of key by leading hex chars, e.g. "ab/cd/" of
+// "abcdef" in 2 levels. Short keys have fewer levels.
+func shardPath(key ObjectKey, levels int) string {
+	var path strings.Builder
+	for i := 0; i < levels && (i+1)*shardWidth <= len(key); i++ {
+		path.WriteString(key[i*shardWidth : (i+1)*shardWidth])
+		path.WriteByte('/')
+	}
+	return path.String()
+}
+
+// unshard returns key of object name relative to the prefix of its class.
+func unshard(name string) ObjectKey {
+	return name[strings.LastIndexByte(name, '/')+1:]
+}
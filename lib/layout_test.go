@@ -0,0 +1,78 @@
+package bucketsync
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// TestShardedKeyLayout writes data objects by 2 shard levels. They are under
+// prefixes of their keys, and the bucket is read and listed by the stored
+// layout regardless of config.
+func TestShardedKeyLayout(t *testing.T) {
+	if (&Config{KeyShardLevels: maxShardLevels + 1}).validate() {
+		t.Fatal("too many shard levels are valid")
+	}
+	if got := shardPath("abcde", 3); got != "ab/cd/" {
+		t.Fatalf("short key is sharded %q", got)
+	}
+	sharded := func(levels int) func(c *Config) {
+		return func(c *Config) {
+			c.DataPrefix = "data/"
+			c.KeyShardLevels = levels
+		}
+	}
+	data := testContent()
+	fs, fake := newTestFS(t, nil, sharded(2))
+	writeFile(t, fs, "f", data)
+	file, _ := fs.getFile(context.Background(), "f")
+	var keys []ObjectKey
+	for _, e := range file.Extent {
+		for _, obj := range e.Objects() {
+			keys = append(keys, obj)
+			want := testBucket + "/data/" + obj[0:2] + "/" + obj[2:4] + "/" + obj
+			if _, ok := fake.get(want); !ok {
+				t.Fatalf("%s is not stored at %s: %v", obj, want, fake.names(testBucket+"/data/"))
+			}
+		}
+	}
+	for _, name := range fake.names(testBucket + "/data/") {
+		if strings.Count(strings.TrimPrefix(name, testBucket+"/data/"), "/") != 2 {
+			t.Fatalf("%s is not sharded", name)
+		}
+	}
+
+	reader, _ := newTestFS(t, fake, sharded(0))
+	if got := readFile(t, reader, "f"); !bytes.Equal(got, data) {
+		t.Fatalf("read %q", got)
+	}
+	listed, err := reader.Sess.s3.List(context.Background(), DataObject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(keys)
+	sort.Strings(listed)
+	if strings.Join(listed, ",") != strings.Join(keys, ",") {
+		t.Fatalf("listed %v, want %v", listed, keys)
+	}
+
+	// A bucket written flat stays flat
+	flat, fake := newTestFS(t, nil, sharded(0))
+	writeFile(t, flat, "f", data)
+	before := len(fake.names(""))
+	reader, _ = newTestFS(t, fake, sharded(2))
+	if got := readFile(t, reader, "f"); !bytes.Equal(got, data) {
+		t.Fatalf("flat read %q", got)
+	}
+	writeFile(t, reader, "g", []byte("0123456789abcdefg"))
+	for _, name := range fake.names(testBucket + "/data/") {
+		if strings.Contains(strings.TrimPrefix(name, testBucket+"/data/"), "/") {
+			t.Fatalf("%s is sharded in a flat bucket", name)
+		}
+	}
+	if len(fake.names("")) <= before {
+		t.Fatal("nothing is written")
+	}
+}
@@ -0,0 +1,185 @@
+package bucketsync
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// ErrLocked is returned by Acquire when other owner holds unexpired lock.
+var ErrLocked = errors.New("locked by other owner")
+
+// ErrLockLost is returned by Renew when the lock is taken by other owner.
+var ErrLockLost = errors.New("lock lost")
+
+const defaultLockTTL = time.Minute
+
+type lockObject struct {
+	Owner   string `json:"owner"`
+	Expires int64  `json:"expires"` // Unix nanoseconds
+}
+
+// BucketLock is best-effort lock shared by mounts through a lock object.
+// It's written by conditional PUT, and can be stolen after its TTL.
+type BucketLock struct {
+	sess  *Session
+	key   ObjectKey
+	owner string
+	ttl   time.Duration
+
+	lock sync.Mutex
+	etag string
+	stop chan struct{}
+	lost bool // taken by other owner while held
+}
+
+func (s *Session) NewBucketLock(name string) *BucketLock {
+	ttl := s.config.LockTTL
+	if ttl <= 0 {
+		ttl = defaultLockTTL
+	}
+	return &BucketLock{
+		sess:  s,
+		key:   s.RootKey() + ".lock." + name,
+		owner: NewObjectKey(),
+		ttl:   ttl,
+	}
+}
+
+func (l *BucketLock) write(ctx context.Context, etag string, expires time.Time) (string, error) {
+	value, err := json.Marshal(&lockObject{Owner: l.owner, Expires: expires.UnixNano()})
+	if err != nil {
+		return "", err
+	}
+	return l.sess.s3.CompareAndSwap(ctx, MetaObject, l.key, etag, bytes.NewReader(value))
+}
+
+// Acquire takes the lock if it's free, expired or already ours.
+func (l *BucketLock) Acquire(ctx context.Context) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	obj, etag, err := l.sess.s3.DownloadWithETag(ctx, MetaObject, l.key)
+	switch {
+	case errors.Cause(err) == ErrNotFound:
+		etag = ""
+	case err != nil:
+		return err
+	default:
+		current := &lockObject{}
+		err = json.Unmarshal(obj, current)
+		if err != nil {
+			return err
+		}
+		if current.Owner != l.owner && l.sess.now().UnixNano() < current.Expires {
+			return ErrLocked
+		}
+		if current.Owner != l.owner {
+			l.sess.logger.Info("stealing expired lock",
+				zap.String("key", l.key), zap.String("owner", current.Owner))
+		}
+	}
+
+	etag, err = l.write(ctx, etag, l.sess.now().Add(l.ttl))
+	if err == ErrConflict {
+		return ErrLocked
+	}
+	if err != nil {
+		return err
+	}
+	l.etag = etag
+	l.lost = false
+	return nil
+}
+
+// Renew extends TTL of the held lock.
+func (l *BucketLock) Renew(ctx context.Context) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.lost {
+		return ErrLockLost
+	}
+	etag, err := l.write(ctx, l.etag, l.sess.now().Add(l.ttl))
+	if err == ErrConflict {
+		l.lost = true
+		return ErrLockLost
+	}
+	if err != nil {
+		return err
+	}
+	l.etag = etag
+	return nil
+}
+
+// Lost returns true if the lock is taken by other owner while held.
+func (l *BucketLock) Lost() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.lost
+}
+
+// Hold renews the lock periodically until Release. If it's lost, renewal
+// stops and lost is called.
+func (l *BucketLock) Hold(lost func()) {
+	l.lock.Lock()
+	l.stop = make(chan struct{})
+	stop := l.stop
+	l.lock.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(l.ttl / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			ctx, cancel := l.sess.opContext()
+			err := l.Renew(ctx)
+			cancel()
+			if err != nil {
+				l.sess.logger.Error("lock renewal failed", zap.String("key", l.key), zap.Error(err))
+			}
+			if err == ErrLockLost {
+				if lost != nil {
+					lost()
+				}
+				return
+			}
+		}
+	}()
+}
+
+// lockLost makes the session read-only, since other mount may write the
+// bucket now. Modifications not saved yet are lost.
+func (s *Session) lockLost() {
+	s.logger.Error("mount lock is lost, the mount is read-only now")
+	s.s3.setReadOnly()
+}
+
+// Release stops renewal and expires the lock, unless it's already lost.
+func (l *BucketLock) Release(ctx context.Context) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.stop != nil {
+		close(l.stop)
+		l.stop = nil
+	}
+	if l.lost {
+		return ErrLockLost
+	}
+	_, err := l.write(ctx, l.etag, time.Unix(0, 0))
+	if err == ErrConflict {
+		return ErrLockLost
+	}
+	l.etag = ""
+	return err
+}
@@ -0,0 +1,112 @@
+package bucketsync
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func TestBucketLockTakeOver(t *testing.T) {
+	sess, fake := newTestSession(t, nil, func(c *Config) { c.LockTTL = 200 * time.Millisecond })
+	other, _ := newTestSession(t, fake, func(c *Config) { c.LockTTL = 200 * time.Millisecond })
+	a, b := sess.NewBucketLock("mount"), other.NewBucketLock("mount")
+	ctx := context.Background()
+
+	if err := a.Acquire(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Acquire(ctx); err != ErrLocked {
+		t.Fatal(err)
+	}
+	if err := a.Renew(ctx); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(250 * time.Millisecond)
+	if err := b.Acquire(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Renew(ctx); err != ErrLockLost || !a.Lost() {
+		t.Fatal(err)
+	}
+	if err := a.Release(ctx); err != ErrLockLost {
+		t.Fatal(err)
+	}
+	if err := b.Release(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Acquire(ctx); err != nil || a.Lost() {
+		t.Fatal(err)
+	}
+}
+
+// TestMountLockLostMakesReadOnly stalls renewal of a mount, so that another
+// session takes the lock over. The first mount must not write after that.
+func TestMountLockLostMakesReadOnly(t *testing.T) {
+	fake := newFakeS3()
+	mod := func(c *Config) { c.MountLock = true; c.LockTTL = 150 * time.Millisecond }
+	// unmounted by the test itself, not by newTestMount cleanup
+	var fs *FileSystem
+	onFake(fake, func() { fs = newFileSystem(testConfig(t, mod)) })
+	writeFile(t, fs, "f", []byte("before"))
+	f, st := fs.Open("f", syscall.O_RDWR, testContext)
+	if st != fuse.OK {
+		t.Fatal(st)
+	}
+	defer f.Release()
+
+	lockName, owner := fs.Sess.metaName(fs.mountLock.key), []byte(fs.mountLock.owner)
+	fake.mu.Lock()
+	fake.onPut = func(name string, body []byte) error {
+		if name == lockName && bytes.Contains(body, owner) {
+			return errors.New("stalled")
+		}
+		return nil
+	}
+	fake.mu.Unlock()
+	time.Sleep(200 * time.Millisecond)
+
+	other, _ := newTestSession(t, fake, mod)
+	if err := other.NewBucketLock("mount").Acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	fake.mu.Lock()
+	fake.onPut = nil
+	fake.mu.Unlock()
+	deadline := time.Now().Add(time.Second)
+	for !fs.Sess.s3.isReadOnly() {
+		if time.Now().After(deadline) {
+			t.Fatal("mount is writable after the lock is lost")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	puts := fake.totalPuts("")
+	mounted := wrapFileSystem(fs.Sess, fs)
+	if st := mounted.Mkdir("d", 0755, testContext); st != fuse.EROFS {
+		t.Fatalf("Mkdir = %v", st)
+	}
+	if _, st := mounted.Create("g", 0, 0644, testContext); st != fuse.EROFS {
+		t.Fatalf("Create = %v", st)
+	}
+	if _, st := f.Write([]byte("after"), 0); st != fuse.EROFS {
+		t.Fatalf("Write = %v", st)
+	}
+	if st := mounted.Truncate("f", 0, testContext); st != fuse.EROFS {
+		t.Fatalf("Truncate = %v", st)
+	}
+	if st := f.Flush(); st != fuse.OK {
+		t.Fatalf("Flush = %v", st)
+	}
+	if got := readFile(t, fs, "f"); string(got) != "before" {
+		t.Fatalf("f = %q", got)
+	}
+	fs.OnUnmount()
+	if n := fake.totalPuts(""); n != puts {
+		t.Fatalf("%d puts after the lock is lost", n-puts)
+	}
+}
@@ -0,0 +1,561 @@
+package bucketsync
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// lowerFileSystem overlays the bucket on a local lower directory, which is
+// never modified except populated by writes if configured.
+//
+//   - A name in the bucket takes precedence. Its content is read from the
+//     lower file if it's fresh, a regular file of the same size with mtime not
+//     older than the bucket's.
+//   - A name only in the lower directory is read from it. Before it's
+//     modified, it's copied up to the bucket with its parent directories.
+//   - Removing or renaming a name of the lower directory records a whiteout
+//     in the bucket, which hides the name and below in the lower directory.
+//     Directories in it aren't renamed, EXDEV lets tools copy them.
+type lowerFileSystem struct {
+	pathfs.FileSystem // of the bucket
+	lower             pathfs.FileSystem
+	root              string
+	sess              *Session
+	populate          bool
+
+	lock      sync.Mutex
+	whiteouts map[string]bool
+}
+
+// withLower returns fs overlaid on LowerDir, fs itself if it's not set.
+func withLower(sess *Session, fs pathfs.FileSystem) (pathfs.FileSystem, error) {
+	config := sess.config
+	if config.LowerDir == "" {
+		return fs, nil
+	}
+	info, err := os.Stat(config.LowerDir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "lower dir is not accessible. path = %s", config.LowerDir)
+	}
+	if !info.IsDir() {
+		return nil, errors.Errorf("lower dir is not a directory. path = %s", config.LowerDir)
+	}
+	l := &lowerFileSystem{
+		FileSystem: fs,
+		lower:      pathfs.NewLoopbackFileSystem(config.LowerDir),
+		root:       config.LowerDir,
+		sess:       sess,
+		populate:   config.LowerPopulate,
+		whiteouts:  map[string]bool{},
+	}
+	err = l.loadWhiteouts(context.Background())
+	if err != nil {
+		return nil, errors.Wrap(err, "whiteouts load failed")
+	}
+	return l, nil
+}
+
+func (l *lowerFileSystem) whiteoutKey() ObjectKey {
+	return l.sess.RootKey() + ".whiteouts"
+}
+
+func (l *lowerFileSystem) loadWhiteouts(ctx context.Context) error {
+	data, err := l.sess.s3.DownloadWithCache(ctx, MetaObject, l.whiteoutKey())
+	if errors.Cause(err) == ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var names []string
+	err = json.Unmarshal(data, &names)
+	if err != nil {
+		return errors.Wrap(err, "whiteouts are corrupt")
+	}
+	for _, name := range names {
+		l.whiteouts[name] = true
+	}
+	return nil
+}
+
+// setWhiteout adds or removes whiteout of name, and stores them.
+func (l *lowerFileSystem) setWhiteout(name string, hide bool) fuse.Status {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.whiteouts[name] == hide {
+		return fuse.OK
+	}
+	if hide {
+		l.whiteouts[name] = true
+	} else {
+		delete(l.whiteouts, name)
+	}
+	names := make([]string, 0, len(l.whiteouts))
+	for name := range l.whiteouts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	data, err := json.Marshal(names)
+	if err == nil {
+		ctx, cancel := l.sess.opContext()
+		err = l.sess.s3.UploadWithCache(ctx, MetaObject, l.whiteoutKey(), bytes.NewReader(data))
+		cancel()
+	}
+	if err != nil {
+		l.sess.logger.Error("whiteout save failed", zap.String("name", name), zap.Error(err))
+		return fuse.EIO
+	}
+	return fuse.OK
+}
+
+// hidden returns true if name or its parent is whited out.
+func (l *lowerFileSystem) hidden(name string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for p := name; p != "." && p != ""; p = filepath.Dir(p) {
+		if l.whiteouts[p] {
+			return true
+		}
+	}
+	return false
+}
+
+// lowerAttr returns attr of name in the lower directory if it's visible.
+func (l *lowerFileSystem) lowerAttr(name string) (*fuse.Attr, bool) {
+	if name == controlDir || strings.HasPrefix(name, controlDir+"/") || l.hidden(name) {
+		return nil, false
+	}
+	attr, status := l.lower.GetAttr(name, nil)
+	return attr, status == fuse.OK
+}
+
+// fresh returns true if lower has the same content as upper by size and mtime.
+func fresh(upper, lower *fuse.Attr) bool {
+	return upper.Mode&syscall.S_IFMT == syscall.S_IFREG && lower.Mode&syscall.S_IFMT == syscall.S_IFREG &&
+		upper.Size == lower.Size && !lower.ModTime().Before(upper.ModTime())
+}
+
+func (l *lowerFileSystem) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
+	attr, status := l.FileSystem.GetAttr(name, context)
+	if status != fuse.ENOENT {
+		return attr, status
+	}
+	if lower, ok := l.lowerAttr(name); ok {
+		return lower, fuse.OK
+	}
+	return attr, status
+}
+
+// lowerOnly returns true if name is only in the lower directory.
+func (l *lowerFileSystem) lowerOnly(name string, context *fuse.Context) bool {
+	if _, status := l.FileSystem.GetAttr(name, context); status != fuse.ENOENT {
+		return false
+	}
+	_, ok := l.lowerAttr(name)
+	return ok
+}
+
+func (l *lowerFileSystem) Access(name string, mode uint32, context *fuse.Context) fuse.Status {
+	status := l.FileSystem.Access(name, mode, context)
+	if status == fuse.ENOENT && l.lowerOnly(name, context) {
+		return l.lower.Access(name, mode, context)
+	}
+	return status
+}
+
+func (l *lowerFileSystem) GetXAttr(name string, attr string, context *fuse.Context) ([]byte, fuse.Status) {
+	if l.lowerOnly(name, context) {
+		return l.lower.GetXAttr(name, attr, context)
+	}
+	return l.FileSystem.GetXAttr(name, attr, context)
+}
+
+func (l *lowerFileSystem) ListXAttr(name string, context *fuse.Context) ([]string, fuse.Status) {
+	if l.lowerOnly(name, context) {
+		return l.lower.ListXAttr(name, context)
+	}
+	return l.FileSystem.ListXAttr(name, context)
+}
+
+func (l *lowerFileSystem) OpenDir(name string, context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	entries, status := l.FileSystem.OpenDir(name, context)
+	if status != fuse.OK && status != fuse.ENOENT {
+		return entries, status
+	}
+	if attr, ok := l.lowerAttr(name); !ok || !attr.IsDir() {
+		return entries, status
+	}
+	lower, lowerStatus := l.lower.OpenDir(name, context)
+	if lowerStatus != fuse.OK {
+		return entries, status
+	}
+	seen := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		seen[e.Name] = true
+	}
+	for _, e := range lower {
+		child := filepath.Join(name, e.Name)
+		if seen[e.Name] || child == controlDir || l.hidden(child) {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	return entries, fuse.OK
+}
+
+func (l *lowerFileSystem) Readlink(name string, context *fuse.Context) (string, fuse.Status) {
+	target, status := l.FileSystem.Readlink(name, context)
+	if status != fuse.ENOENT {
+		return target, status
+	}
+	if _, ok := l.lowerAttr(name); ok {
+		return l.lower.Readlink(name, context)
+	}
+	return target, status
+}
+
+func (l *lowerFileSystem) Open(name string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	if flags&fuse.O_ANYWRITE != 0 || flags&syscall.O_TRUNC != 0 {
+		if status := l.copyUp(name, context); status != fuse.OK {
+			return nil, status
+		}
+		file, status := l.FileSystem.Open(name, flags, context)
+		if status != fuse.OK {
+			return file, status
+		}
+		return l.populated(file, name), status
+	}
+
+	upper, status := l.FileSystem.GetAttr(name, context)
+	lower, ok := l.lowerAttr(name)
+	switch {
+	case status == fuse.OK && ok && fresh(upper, lower):
+		return l.lower.Open(name, syscall.O_RDONLY, context)
+	case status == fuse.ENOENT && ok:
+		return l.lower.Open(name, syscall.O_RDONLY, context)
+	}
+	return l.FileSystem.Open(name, flags, context)
+}
+
+func (l *lowerFileSystem) Create(name string, flags uint32, mode uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	if status := l.copyUpParents(name, context); status != fuse.OK {
+		return nil, status
+	}
+	file, status := l.FileSystem.Create(name, flags, mode, context)
+	if status != fuse.OK {
+		return file, status
+	}
+	return l.populated(file, name), status
+}
+
+func (l *lowerFileSystem) Mkdir(name string, mode uint32, context *fuse.Context) fuse.Status {
+	if _, ok := l.lowerAttr(name); ok {
+		return fuse.Status(syscall.EEXIST)
+	}
+	if status := l.copyUpParents(name, context); status != fuse.OK {
+		return status
+	}
+	return l.FileSystem.Mkdir(name, mode, context)
+}
+
+func (l *lowerFileSystem) Symlink(value string, linkName string, context *fuse.Context) fuse.Status {
+	if _, ok := l.lowerAttr(linkName); ok {
+		return fuse.Status(syscall.EEXIST)
+	}
+	if status := l.copyUpParents(linkName, context); status != fuse.OK {
+		return status
+	}
+	return l.FileSystem.Symlink(value, linkName, context)
+}
+
+func (l *lowerFileSystem) Unlink(name string, context *fuse.Context) fuse.Status {
+	_, upper := l.FileSystem.GetAttr(name, context)
+	_, lower := l.lowerAttr(name)
+	if upper == fuse.OK {
+		if status := l.FileSystem.Unlink(name, context); status != fuse.OK {
+			return status
+		}
+	}
+	if lower {
+		return l.setWhiteout(name, true)
+	}
+	if upper != fuse.OK {
+		return fuse.ENOENT
+	}
+	return fuse.OK
+}
+
+func (l *lowerFileSystem) Rmdir(name string, context *fuse.Context) fuse.Status {
+	entries, status := l.OpenDir(name, context)
+	if status != fuse.OK {
+		return status
+	}
+	if len(entries) != 0 {
+		return fuse.Status(syscall.ENOTEMPTY)
+	}
+	_, upper := l.FileSystem.GetAttr(name, context)
+	if upper == fuse.OK {
+		if status := l.FileSystem.Rmdir(name, context); status != fuse.OK {
+			return status
+		}
+	}
+	if _, ok := l.lowerAttr(name); ok {
+		return l.setWhiteout(name, true)
+	}
+	return fuse.OK
+}
+
+func (l *lowerFileSystem) Rename(oldName string, newName string, context *fuse.Context) fuse.Status {
+	lower, ok := l.lowerAttr(oldName)
+	if ok && lower.IsDir() {
+		// Entries below it would be hidden
+		return fuse.Status(syscall.EXDEV)
+	}
+	if status := l.copyUp(oldName, context); status != fuse.OK {
+		return status
+	}
+	if status := l.copyUpParents(newName, context); status != fuse.OK {
+		return status
+	}
+	status := l.FileSystem.Rename(oldName, newName, context)
+	if status != fuse.OK {
+		return status
+	}
+	if ok {
+		return l.setWhiteout(oldName, true)
+	}
+	return fuse.OK
+}
+
+func (l *lowerFileSystem) Chmod(name string, mode uint32, context *fuse.Context) fuse.Status {
+	if status := l.copyUp(name, context); status != fuse.OK {
+		return status
+	}
+	return l.FileSystem.Chmod(name, mode, context)
+}
+
+func (l *lowerFileSystem) Chown(name string, uid uint32, gid uint32, context *fuse.Context) fuse.Status {
+	if status := l.copyUp(name, context); status != fuse.OK {
+		return status
+	}
+	return l.FileSystem.Chown(name, uid, gid, context)
+}
+
+func (l *lowerFileSystem) Truncate(name string, size uint64, context *fuse.Context) fuse.Status {
+	if status := l.copyUp(name, context); status != fuse.OK {
+		return status
+	}
+	return l.FileSystem.Truncate(name, size, context)
+}
+
+func (l *lowerFileSystem) Utimens(name string, atime *time.Time, mtime *time.Time, context *fuse.Context) fuse.Status {
+	if status := l.copyUp(name, context); status != fuse.OK {
+		return status
+	}
+	return l.FileSystem.Utimens(name, atime, mtime, context)
+}
+
+func (l *lowerFileSystem) SetXAttr(name string, attr string, data []byte, flags int, context *fuse.Context) fuse.Status {
+	if status := l.copyUp(name, context); status != fuse.OK {
+		return status
+	}
+	return l.FileSystem.SetXAttr(name, attr, data, flags, context)
+}
+
+func (l *lowerFileSystem) String() string {
+	return fmt.Sprintf("lowerFileSystem(%v, %s)", l.FileSystem, l.root)
+}
+
+// copyUpParents makes parent directories of name exist in the bucket.
+func (l *lowerFileSystem) copyUpParents(name string, context *fuse.Context) fuse.Status {
+	parent := filepath.Dir(name)
+	if parent == "." {
+		return fuse.OK
+	}
+	return l.copyUp(parent, context)
+}
+
+// copyUp copies name from the lower directory to the bucket, if it's only
+// in the lower directory. Not found is OK, the operation reports it.
+func (l *lowerFileSystem) copyUp(name string, context *fuse.Context) fuse.Status {
+	if _, status := l.FileSystem.GetAttr(name, context); status != fuse.ENOENT {
+		return fuse.OK
+	}
+	attr, ok := l.lowerAttr(name)
+	if !ok {
+		return fuse.OK
+	}
+	if status := l.copyUpParents(name, context); status != fuse.OK {
+		return status
+	}
+	mode := attr.Mode &^ syscall.S_IFMT
+	switch attr.Mode & syscall.S_IFMT {
+	case syscall.S_IFDIR:
+		return l.FileSystem.Mkdir(name, mode, context)
+	case syscall.S_IFLNK:
+		target, status := l.lower.Readlink(name, context)
+		if status != fuse.OK {
+			return status
+		}
+		return l.FileSystem.Symlink(target, name, context)
+	case syscall.S_IFREG:
+	default:
+		return fuse.ENOSYS
+	}
+
+	src, err := os.Open(filepath.Join(l.root, name))
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	defer src.Close()
+	dst, status := l.FileSystem.Create(name, syscall.O_WRONLY, mode, context)
+	if status != fuse.OK {
+		return status
+	}
+	buf := make([]byte, l.sess.config.ExtentSize)
+	var off int64
+	for status == fuse.OK {
+		n, err := src.Read(buf)
+		if n > 0 {
+			_, status = dst.Write(buf[:n], off)
+			off += int64(n)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			status = fuse.ToStatus(err)
+		}
+	}
+	if status == fuse.OK {
+		status = dst.Flush()
+	}
+	dst.Release()
+	if status != fuse.OK {
+		return status
+	}
+	mtime := attr.ModTime()
+	l.sess.logger.Debug("Copied up", zap.String("name", name), zap.Int64("size", off))
+	return l.FileSystem.Utimens(name, nil, &mtime, context)
+}
+
+// populated wraps file written to the bucket to populate the lower directory
+// when it's closed, if configured.
+func (l *lowerFileSystem) populated(file nodefs.File, name string) nodefs.File {
+	if !l.populate {
+		return file
+	}
+	if flags, ok := file.(*nodefs.WithFlags); ok {
+		flags.File = &lowerFile{File: flags.File, fs: l, name: name}
+		return flags
+	}
+	return &lowerFile{File: file, fs: l, name: name}
+}
+
+// populateLower writes content of name in the bucket to the lower directory,
+// with the same mtime so that it's fresh.
+func (l *lowerFileSystem) populateLower(name string) error {
+	attr, status := l.FileSystem.GetAttr(name, nil)
+	if status != fuse.OK {
+		return errors.New(status.String())
+	}
+	file, status := l.FileSystem.Open(name, syscall.O_RDONLY, nil)
+	if status != fuse.OK {
+		return errors.New(status.String())
+	}
+	defer file.Release()
+
+	path := filepath.Join(l.root, name)
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".bucketsync-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	buf := make([]byte, l.sess.config.ExtentSize)
+	for off := int64(0); off < int64(attr.Size); {
+		result, status := file.Read(buf, off)
+		if status != fuse.OK {
+			tmp.Close()
+			return errors.New(status.String())
+		}
+		data, _ := result.Bytes(buf)
+		if len(data) == 0 {
+			break
+		}
+		_, err = tmp.Write(data)
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+		off += int64(len(data))
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Chmod(tmp.Name(), os.FileMode(attr.Mode&^syscall.S_IFMT))
+	if err != nil {
+		return err
+	}
+	err = os.Chtimes(tmp.Name(), attr.AccessTime(), attr.ModTime())
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return err
+	}
+	if status := l.setWhiteout(name, false); status != fuse.OK {
+		return errors.New(status.String())
+	}
+	return nil
+}
+
+// lowerFile populates the lower directory by content of the bucket after
+// the handle wrote is released.
+type lowerFile struct {
+	nodefs.File
+	fs      *lowerFileSystem
+	name    string
+	written int32
+}
+
+func (f *lowerFile) Write(data []byte, off int64) (uint32, fuse.Status) {
+	n, status := f.File.Write(data, off)
+	if n > 0 {
+		f.written = 1
+	}
+	return n, status
+}
+
+func (f *lowerFile) Release() {
+	f.File.Release()
+	if f.written == 0 {
+		return
+	}
+	err := f.fs.populateLower(f.name)
+	if err != nil {
+		f.fs.sess.logger.Warn("lower populate failed", zap.String("name", f.name), zap.Error(err))
+	}
+}
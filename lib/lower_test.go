@@ -0,0 +1,139 @@
+package bucketsync
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+)
+
+func readFS(t *testing.T, fs pathfs.FileSystem, name string) string {
+	t.Helper()
+	attr, st := fs.GetAttr(name, testContext)
+	if st != fuse.OK {
+		t.Fatalf("getattr %s: %v", name, st)
+	}
+	f, st := fs.Open(name, syscall.O_RDONLY, testContext)
+	if st != fuse.OK {
+		t.Fatalf("open %s: %v", name, st)
+	}
+	defer f.Release()
+	buf := make([]byte, attr.Size)
+	res, st := f.Read(buf, 0)
+	if st != fuse.OK {
+		t.Fatalf("read %s: %v", name, st)
+	}
+	data, _ := res.Bytes(buf)
+	return string(data)
+}
+
+// TestLowerDir overlays a bucket on a local directory. Local files are read
+// from disk, bucket-only ones and ones changed in the bucket from S3, and
+// removal and writes leave the directory as it was.
+func TestLowerDir(t *testing.T) {
+	lower := t.TempDir()
+	for name, content := range map[string]string{
+		"local":    "from disk",
+		"fresh":    "disk",
+		"stale":    "disk",
+		"sub/deep": "deep on disk",
+	} {
+		path := filepath.Join(lower, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writer, fake := newTestFS(t, nil, func(c *Config) { c.DataPrefix = "data/" })
+	for name, content := range map[string]string{"remote": "from bucket", "fresh": "buck", "stale": "buck"} {
+		writeFile(t, writer, name, []byte(content))
+	}
+	now := time.Now()
+	os.Chtimes(filepath.Join(lower, "fresh"), now.Add(time.Hour), now.Add(time.Hour))
+	os.Chtimes(filepath.Join(lower, "stale"), now.Add(-time.Hour), now.Add(-time.Hour))
+
+	overlay := func() pathfs.FileSystem {
+		fs, _ := newTestFS(t, fake, func(c *Config) {
+			c.DataPrefix = "data/"
+			c.LowerDir = lower
+		})
+		l, err := withLower(fs.Sess, fs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return l
+	}
+	fs := overlay()
+	prefix := writer.Sess.dataPrefix()
+	gets := fake.totalGets(prefix)
+	if got := readFS(t, fs, "local"); got != "from disk" {
+		t.Fatalf("local = %q", got)
+	}
+	if n := fake.totalGets(prefix) - gets; n != 0 {
+		t.Fatalf("%d data gets reading a local file", n)
+	}
+	for name, want := range map[string]string{"remote": "from bucket", "fresh": "disk", "stale": "buck"} {
+		if got := readFS(t, fs, name); got != want {
+			t.Fatalf("%s = %q, want %q", name, got, want)
+		}
+	}
+
+	if st := fs.Access("local", 4, testContext); st != fuse.OK {
+		t.Fatalf("access of local file: %v", st)
+	}
+	if st := fs.Access("missing", 4, testContext); st != fuse.ENOENT {
+		t.Fatalf("access of missing file: %v", st)
+	}
+	if err := syscall.Setxattr(filepath.Join(lower, "local"), "user.test", []byte("x"), 0); err == nil {
+		if got, st := fs.GetXAttr("local", "user.test", testContext); st != fuse.OK || string(got) != "x" {
+			t.Fatalf("xattr of local file %q %v", got, st)
+		}
+		if got, st := fs.ListXAttr("local", testContext); st != fuse.OK || len(got) != 1 || got[0] != "user.test" {
+			t.Fatalf("xattrs of local file %q %v", got, st)
+		}
+	}
+
+	if st := fs.Unlink("local", testContext); st != fuse.OK {
+		t.Fatal(st)
+	}
+	f, st := fs.Open("sub/deep", syscall.O_WRONLY, testContext)
+	if st != fuse.OK {
+		t.Fatal(st)
+	}
+	if _, st := f.Write([]byte("DEEP"), 0); st != fuse.OK {
+		t.Fatal(st)
+	}
+	f.Flush()
+	f.Release()
+
+	fs = overlay()
+	if _, st := fs.GetAttr("local", testContext); st != fuse.ENOENT {
+		t.Fatalf("removed local file: %v", st)
+	}
+	if got := readFS(t, fs, "sub/deep"); got != "DEEP on disk" {
+		t.Fatalf("written local file = %q", got)
+	}
+	for name, want := range map[string]string{"local": "from disk", "sub/deep": "deep on disk"} {
+		if got, _ := ioutil.ReadFile(filepath.Join(lower, name)); string(got) != want {
+			t.Fatalf("lower %s = %q", name, got)
+		}
+	}
+}
+
+func TestLowerDirInvalid(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "file")
+	if err := ioutil.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{file, filepath.Join(file, "missing")} {
+		fs, _ := newTestFS(t, nil, func(c *Config) { c.LowerDir = dir })
+		if _, err := withLower(fs.Sess, fs); err == nil {
+			t.Fatalf("%s is accepted", dir)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package bucketsync
+
+import (
+	"sync"
+	"time"
+)
+
+// maxNegativeEntries bounds memory of negative entries
+const maxNegativeEntries = 4096
+
+type negativeKey struct {
+	dir  ObjectKey
+	name string
+}
+
+// negative remembers names not found in directories for NegativeTimeout,
+// so that lookups of them don't load the directory again. Entries are
+// removed when the name is set in the directory by this mount.
+type negative struct {
+	lock    sync.Mutex
+	expires map[negativeKey]time.Time
+}
+
+func (s *Session) negativeHit(dir ObjectKey, name string) bool {
+	if s.config.NegativeTimeout <= 0 {
+		return false
+	}
+	s.negative.lock.Lock()
+	defer s.negative.lock.Unlock()
+	key := negativeKey{dir, name}
+	expires, ok := s.negative.expires[key]
+	if !ok {
+		return false
+	}
+	if time.Now().After(expires) {
+		delete(s.negative.expires, key)
+		return false
+	}
+	return true
+}
+
+func (s *Session) addNegative(dir ObjectKey, name string) {
+	if s.config.NegativeTimeout <= 0 {
+		return
+	}
+	s.negative.lock.Lock()
+	defer s.negative.lock.Unlock()
+	now := time.Now()
+	if s.negative.expires == nil {
+		s.negative.expires = make(map[negativeKey]time.Time)
+	}
+	if len(s.negative.expires) >= maxNegativeEntries {
+		for key, expires := range s.negative.expires {
+			if now.After(expires) {
+				delete(s.negative.expires, key)
+			}
+		}
+		if len(s.negative.expires) >= maxNegativeEntries {
+			s.negative.expires = make(map[negativeKey]time.Time)
+		}
+	}
+	s.negative.expires[negativeKey{dir, name}] = now.Add(s.config.NegativeTimeout)
+}
+
+func (s *Session) removeNegative(dir ObjectKey, name string) {
+	if s.config.NegativeTimeout <= 0 {
+		return
+	}
+	s.negative.lock.Lock()
+	defer s.negative.lock.Unlock()
+	delete(s.negative.expires, negativeKey{dir, name})
+}
@@ -2,3 +2,12 @@ package bucketsync
 
 // ObjectKey is v4 UUID assgned to newly created object
 type ObjectKey = string
+
+// ObjectClass distinguishes metadata objects (Directory, File and SymLink)
+// from extent data, so that they can be stored in different locations.
+type ObjectClass int
+
+const (
+	MetaObject ObjectClass = iota
+	DataObject
+)
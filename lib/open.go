@@ -0,0 +1,253 @@
+package bucketsync
+
+import (
+	"container/list"
+	"context"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+)
+
+// openFile is File shared by all handles opened on the same key
+type openFile struct {
+	file    *File
+	handles int
+
+	elem      *list.Element // in openLRU, most recent at front
+	resident  bool          // extent bodies may be in memory
+	unlinked  bool          // directory entry is removed, released at last close
+	lingering bool          // holds a handle of closed async one until saved
+	async     int           // handles of async level, saved by the flusher
+}
+
+// acquireFile returns File for key shared with other open handles.
+// releaseFile must be called when the handle is closed.
+func (s *Session) acquireFile(ctx context.Context, key ObjectKey) (*File, error) {
+	s.openLock.Lock()
+	if o, ok := s.openFiles[key]; ok {
+		o.handles++
+		s.openLock.Unlock()
+		return o.file, nil
+	}
+	s.openLock.Unlock()
+
+	file, err := s.NewFile(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return s.registerFile(file), nil
+}
+
+// registerFile adds a handle to file, or to the one already opened on the key.
+func (s *Session) registerFile(file *File) *File {
+	s.openLock.Lock()
+	defer s.openLock.Unlock()
+	if o, ok := s.openFiles[file.Key]; ok {
+		o.handles++
+		return o.file
+	}
+	o := &openFile{file: file, handles: 1, resident: true}
+	o.elem = s.openLRU.PushFront(o)
+	s.openFiles[file.Key] = o
+	s.residentFiles++
+	return file
+}
+
+// releaseFile removes a handle, it returns true if it was the last one, and
+// unlinked true if the file was unlinked while open.
+func (s *Session) releaseFile(file *File) (last, unlinked bool) {
+	s.openLock.Lock()
+	defer s.openLock.Unlock()
+	o, ok := s.openFiles[file.Key]
+	if !ok {
+		return true, false
+	}
+	o.handles--
+	if o.handles > 0 {
+		return false, false
+	}
+	delete(s.openFiles, file.Key)
+	s.openLRU.Remove(o.elem)
+	if o.resident {
+		s.residentFiles--
+	}
+	return true, o.unlinked
+}
+
+// closeFile releases a handle of file, and drops it at the last one.
+func (s *Session) closeFile(file *File) {
+	last, unlinked := s.releaseFile(file)
+	if !last {
+		return
+	}
+	// Nobody can save it any more
+	file.lock.Lock()
+	file.clean()
+	for _, e := range file.Extent {
+		e.release()
+	}
+	file.lock.Unlock()
+	if unlinked {
+		s.removeUnlinked(file.Key)
+	}
+}
+
+// unlinkOpened marks file of key unlinked if it's open, so that handles keep
+// reading and writing it, and it's removed at the last close. It returns
+// false if no handle is open.
+func (s *Session) unlinkOpened(key ObjectKey) bool {
+	s.openLock.Lock()
+	defer s.openLock.Unlock()
+	o, ok := s.openFiles[key]
+	if ok {
+		o.unlinked = true
+	}
+	return ok
+}
+
+// removeUnlinked orphans file unlinked while open, after its last handle is
+// closed.
+func (s *Session) removeUnlinked(key ObjectKey) {
+	s.orphan(key)
+	s.invalidateUsage()
+	s.logger.Debug("Unlinked file released", zap.String("key", key))
+}
+
+// isUnlinked returns true if open file is unlinked.
+func (s *Session) isUnlinked(file *File) bool {
+	s.openLock.Lock()
+	defer s.openLock.Unlock()
+	o, ok := s.openFiles[file.Key]
+	return ok && o.file == file && o.unlinked
+}
+
+// liveHandles returns number of handles opened, apart from the one held by
+// lingering.
+func (o *openFile) liveHandles() int {
+	if o.lingering {
+		return o.handles - 1
+	}
+	return o.handles
+}
+
+// touchFile marks file recently used. If more than MaxOpenFiles are
+// resident, least recently used ones without live handles, lingering after
+// their async handles are closed, are saved if modified and closed in
+// background, so that the operation doesn't wait for uploads of other files.
+// Files with live handles are never evicted. Unlinked files are never saved.
+// It must be called without lock of any file.
+func (s *Session) touchFile(file *File) {
+	max := s.config.MaxOpenFiles
+	if max <= 0 {
+		return
+	}
+	s.openLock.Lock()
+	o, ok := s.openFiles[file.Key]
+	if !ok || o.file != file {
+		s.openLock.Unlock()
+		return
+	}
+	s.openLRU.MoveToFront(o.elem)
+	if !o.resident {
+		o.resident = true
+		s.residentFiles++
+	}
+	var victims []*File
+	for e := s.openLRU.Back(); e != nil && s.residentFiles > max; e = e.Prev() {
+		victim := e.Value.(*openFile)
+		if victim == o || !victim.resident || victim.liveHandles() > 0 {
+			continue
+		}
+		victim.resident = false
+		s.residentFiles--
+		victims = append(victims, victim.file)
+	}
+	if len(victims) > 0 {
+		s.evictions++
+	}
+	s.openLock.Unlock()
+
+	if len(victims) == 0 {
+		return
+	}
+	go func() {
+		for _, victim := range victims {
+			s.evictFile(victim)
+		}
+		s.openLock.Lock()
+		if s.evictions--; s.evictions == 0 {
+			s.evicted.Broadcast()
+		}
+		s.openLock.Unlock()
+	}()
+}
+
+// waitEvictions waits for evictions running in background.
+func (s *Session) waitEvictions() {
+	s.openLock.Lock()
+	defer s.openLock.Unlock()
+	for s.evictions > 0 {
+		s.evicted.Wait()
+	}
+}
+
+// evictFile saves lingering file if modified, and closes it. If save fails,
+// it stays for the flusher to retry.
+func (s *Session) evictFile(file *File) {
+	var err error
+	file.lock.Lock()
+	if file.dirty && !s.isUnlinked(file) {
+		ctx, cancel := s.opContext()
+		err = file.Save(ctx)
+		if err == nil {
+			err = s.s3.WaitBatched(ctx, file.Key)
+		}
+		cancel()
+	}
+	file.lock.Unlock()
+
+	s.openLock.Lock()
+	o, ok := s.openFiles[file.Key]
+	ok = ok && o.file == file
+	lingering := ok && o.lingering && err == nil
+	if lingering {
+		o.lingering = false
+	} else if ok && !o.resident {
+		o.resident = true
+		s.residentFiles++
+	}
+	s.openLock.Unlock()
+	if err != nil {
+		s.logger.Error("Save of evicted file failed", zap.String("key", file.Key), zap.Error(err))
+		return
+	}
+	if lingering {
+		s.closeFile(file)
+	}
+	atomic.AddInt64(&s.counters.evictedFiles, 1)
+	s.logger.Debug("Evicted", zap.String("key", file.Key))
+}
+
+// openedFile returns File if any handle is open on key, otherwise nil.
+func (s *Session) openedFile(key ObjectKey) *File {
+	s.openLock.Lock()
+	defer s.openLock.Unlock()
+	if o, ok := s.openFiles[key]; ok {
+		return o.file
+	}
+	return nil
+}
+
+// flushOpened saves file of key if it is opened and modified.
+func (s *Session) flushOpened(ctx context.Context, key ObjectKey) error {
+	file := s.openedFile(key)
+	if file == nil {
+		return nil
+	}
+	file.lock.Lock()
+	defer file.lock.Unlock()
+	if !file.dirty {
+		return nil
+	}
+	return file.Save(ctx)
+}
@@ -0,0 +1,240 @@
+package bucketsync
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func orphaned(fs *FileSystem) int64 {
+	return fs.Sess.Stats().OrphanedNodes
+}
+
+// TestUnlinkedFileIsNotSaved writes an unlinked open file, and opens another
+// beyond MaxOpenFiles and barriers. Nothing is uploaded, and the handle
+// still reads the writes.
+func TestUnlinkedFileIsNotSaved(t *testing.T) {
+	fs, fake := newTestFS(t, nil, func(c *Config) {
+		c.MaxOpenFiles = 1
+		c.Durability = DurabilitySyncEveryWrite
+	})
+	writeFile(t, fs, "f", []byte("0123456789"))
+	writeFile(t, fs, "g", []byte("other"))
+	orphans := orphaned(fs)
+	f, st := fs.Open("f", syscall.O_RDWR, testContext)
+	if st != fuse.OK {
+		t.Fatal(st)
+	}
+	if st := fs.Unlink("f", testContext); st != fuse.OK {
+		t.Fatal(st)
+	}
+
+	puts := fake.totalPuts("")
+	if _, st := f.Write([]byte("written"), 0); st != fuse.OK {
+		t.Fatal(st)
+	}
+	g, st := fs.Open("g", 0, testContext)
+	if st != fuse.OK {
+		t.Fatal(st)
+	}
+	g.Release()
+	if err := fs.Sess.Barrier(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if st := f.Flush(); st != fuse.OK {
+		t.Fatal(st)
+	}
+	if n := fake.totalPuts("") - puts; n != 0 {
+		t.Fatalf("%d puts of unlinked file", n)
+	}
+
+	buf := make([]byte, 10)
+	res, st := f.Read(buf, 0)
+	if st != fuse.OK {
+		t.Fatal(st)
+	}
+	if got, _ := res.Bytes(buf); string(got) != "written789" {
+		t.Fatalf("read %q", got)
+	}
+	f.Release()
+	if orphaned(fs) != orphans+1 {
+		t.Fatal("unlinked file is not orphaned after close")
+	}
+}
+
+func TestRenameOverOpenTarget(t *testing.T) {
+	fs, _ := newTestFS(t, nil, nil)
+	old := bytes.Repeat([]byte("o"), 20)
+	writeFile(t, fs, "target", old)
+	writeFile(t, fs, "src", []byte("new"))
+	orphans := orphaned(fs)
+	f, st := fs.Open("target", 0, testContext)
+	if st != fuse.OK {
+		t.Fatal(st)
+	}
+	if st := fs.Rename("src", "target", testContext); st != fuse.OK {
+		t.Fatal(st)
+	}
+	if orphaned(fs) != orphans {
+		t.Fatal("open target is orphaned")
+	}
+	var attr fuse.Attr
+	if st := f.GetAttr(&attr); st != fuse.OK || attr.Nlink != 0 {
+		t.Fatalf("nlink = %d %v", attr.Nlink, st)
+	}
+	buf := make([]byte, 20)
+	res, st := f.Read(buf, 0)
+	if st != fuse.OK {
+		t.Fatal(st)
+	}
+	if got, _ := res.Bytes(buf); !bytes.Equal(got, old) {
+		t.Fatalf("read %q", got)
+	}
+	f.Release()
+	if orphaned(fs) != orphans+1 {
+		t.Fatal("replaced target is not orphaned after close")
+	}
+	if got := readFile(t, fs, "target"); string(got) != "new" {
+		t.Fatalf("target = %q", got)
+	}
+}
+
+func TestRenameAcrossDirsReplacesTarget(t *testing.T) {
+	fs, _ := newTestFS(t, nil, nil)
+	if st := fs.Mkdir("d", 0755, testContext); st != fuse.OK {
+		t.Fatal(st)
+	}
+	writeFile(t, fs, "target", []byte("old"))
+	writeFile(t, fs, "d/src", []byte("new"))
+	orphans := orphaned(fs)
+	if st := fs.Rename("d/src", "target", testContext); st != fuse.OK {
+		t.Fatal(st)
+	}
+	if orphaned(fs) != orphans+1 {
+		t.Fatal("replaced target is not orphaned")
+	}
+	if got := readFile(t, fs, "target"); string(got) != "new" {
+		t.Fatalf("target = %q", got)
+	}
+}
+
+// TestEvictionInBackground closes an async file, and opens others beyond
+// MaxOpenFiles while saving the lingering one is slow. The open doesn't wait
+// for it, and an open handle beyond the limit is never evicted.
+func TestEvictionInBackground(t *testing.T) {
+	fs, fake := newTestFS(t, nil, func(c *Config) {
+		c.MaxOpenFiles = 1
+		c.Durability = DurabilityAsync
+		c.FlushInterval = time.Hour
+	})
+	writeFile(t, fs, "g", []byte("other"))
+	for _, name := range []string{"b", "a"} {
+		f, st := fs.Create(name, 0, 0644, testContext)
+		if st != fuse.OK {
+			t.Fatal(st)
+		}
+		if _, st := f.Write([]byte("dirty "+name), 0); st != fuse.OK {
+			t.Fatal(st)
+		}
+		if name == "b" {
+			defer f.Release()
+			continue
+		}
+		f.Release()
+	}
+	a, b := fs.mustKey(t, "a"), fs.mustKey(t, "b")
+	if fs.Sess.openedFile(a) == nil {
+		t.Fatal("async file isn't lingering")
+	}
+	// g lingering is evicted by them
+	if err := fs.Sess.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	evicted := fs.Sess.Stats().EvictedFiles
+	prefix := fs.Sess.dataPrefix()
+	fake.delayOf = func(op, name string) time.Duration {
+		if op == "PutObject" && strings.HasPrefix(name, prefix) {
+			return 300 * time.Millisecond
+		}
+		return 0
+	}
+
+	start := time.Now()
+	g, st := fs.Open("g", 0, testContext)
+	if st != fuse.OK {
+		t.Fatal(st)
+	}
+	defer g.Release()
+	if d := time.Since(start); d > 150*time.Millisecond {
+		t.Fatalf("open waited %v for eviction", d)
+	}
+	if err := fs.Sess.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	fake.delayOf = nil
+	if n := fs.Sess.Stats().EvictedFiles - evicted; fs.Sess.openedFile(a) != nil || n != 1 {
+		t.Fatalf("lingering file isn't evicted, %d evicted", n)
+	}
+	if file := fs.Sess.openedFile(b); file == nil || !file.dirty {
+		t.Fatal("open handle is evicted")
+	}
+	reader, _ := newTestFS(t, fake, nil)
+	if got := readFile(t, reader, "a"); string(got) != "dirty a" {
+		t.Fatalf("evicted file = %q", got)
+	}
+}
+
+// TestRenameMovesNoExtents moves a file between directories. None of its
+// extents is uploaded or downloaded.
+func TestRenameMovesNoExtents(t *testing.T) {
+	fs, fake := newTestFS(t, nil, nil)
+	for _, dir := range []string{"a", "b"} {
+		if st := fs.Mkdir(dir, 0755, testContext); st != fuse.OK {
+			t.Fatal(st)
+		}
+	}
+	data := testContent()
+	writeFile(t, fs, "a/f", data)
+	file, _ := fs.getFile(context.Background(), "a/f")
+	extents := map[string]bool{}
+	for _, e := range file.Extent {
+		for _, obj := range e.Objects() {
+			bucket, name := fs.Sess.s3.location(DataObject, obj)
+			extents[bucket+"/"+name] = true
+		}
+	}
+
+	var touched []string
+	fake.fail = func(op, name string) error {
+		if extents[name] {
+			touched = append(touched, op+" "+name)
+		}
+		return nil
+	}
+	if st := fs.Rename("a/f", "b/f", testContext); st != fuse.OK {
+		t.Fatal(st)
+	}
+	if st := fs.Rename("a/missing", "b/missing", testContext); st != fuse.ENOENT {
+		t.Fatalf("missing source: %v", st)
+	}
+	fake.fail = nil
+	if len(touched) != 0 {
+		t.Fatalf("rename touched extents: %v", touched)
+	}
+
+	reader, _ := newTestFS(t, fake, nil)
+	if got := readFile(t, reader, "b/f"); !bytes.Equal(got, data) {
+		t.Fatalf("moved content %q", got)
+	}
+	if _, st := reader.GetAttr("a/f", testContext); st != fuse.ENOENT {
+		t.Fatalf("source after move: %v", st)
+	}
+	if _, st := reader.GetAttr("b/missing", testContext); st != fuse.ENOENT {
+		t.Fatalf("missing source moved: %v", st)
+	}
+}
@@ -0,0 +1,70 @@
+package bucketsync
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// bodyPool reuses extent bodies of ExtentSize, if BodyPool is set. Bodies
+// are put back only under lock of the file after being detached from the
+// extent, and uploads of a save and fills of a read finish within the lock,
+// so none is reused while it's still referenced.
+type bodyPool struct {
+	size int64
+	pool *sync.Pool
+}
+
+func newBodyPool(config *Config) bodyPool {
+	if !config.BodyPool {
+		return bodyPool{}
+	}
+	size := config.ExtentSize
+	return bodyPool{size: size, pool: &sync.Pool{
+		New: func() interface{} { return make([]byte, size) },
+	}}
+}
+
+// get returns zero-filled body of size.
+func (p bodyPool) get(size int64) []byte {
+	if p.pool == nil || size != p.size {
+		return make([]byte, size)
+	}
+	body := p.pool.Get().([]byte)[:size]
+	for i := range body {
+		body[i] = 0
+	}
+	return body
+}
+
+// getEmpty returns empty body to append to, nil without the pool.
+func (p bodyPool) getEmpty() []byte {
+	if p.pool == nil {
+		return nil
+	}
+	return p.pool.Get().([]byte)[:0]
+}
+
+// put returns body to the pool, it must not be used any more.
+func (p bodyPool) put(body []byte) {
+	if p.pool == nil || int64(cap(body)) != p.size {
+		return
+	}
+	p.pool.Put(body[:0])
+}
+
+// hold sets body of the extent, counted by Stats until release.
+func (e *Extent) hold(body []byte) {
+	e.body = body
+	atomic.AddInt64(&e.sess.counters.heldExtents, 1)
+	atomic.AddInt64(&e.sess.counters.heldBytes, int64(len(body)))
+}
+
+// release detaches body of the extent and returns it to the pool.
+func (e *Extent) release() {
+	if e.body != nil {
+		atomic.AddInt64(&e.sess.counters.heldExtents, -1)
+		atomic.AddInt64(&e.sess.counters.heldBytes, -int64(len(e.body)))
+		e.sess.bodies.put(e.body)
+		e.body = nil
+	}
+}
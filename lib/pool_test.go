@@ -0,0 +1,83 @@
+package bucketsync
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// TestBodyPoolNoStaleData writes and drops files full of bytes, so that their
+// bodies are reused by sparse writes of other files.
+func TestBodyPoolNoStaleData(t *testing.T) {
+	fs, _ := newTestFS(t, nil, func(c *Config) { c.BodyPool = true; c.ExtentSize = 64 })
+	for round := 0; round < 20; round++ {
+		writeFile(t, fs, "full", bytes.Repeat([]byte{'A'}, 64*4))
+		f, st := fs.Create("sparse", uint32(os.O_RDWR), 0644, testContext)
+		if st != fuse.OK {
+			t.Fatal(st)
+		}
+		f.Write([]byte("xy"), 64*2+10)
+		f.Truncate(64*5 + 3)
+		f.Flush()
+		f.Release()
+
+		want := make([]byte, 64*5+3)
+		copy(want[64*2+10:], "xy")
+		if got := readFile(t, fs, "sparse"); !bytes.Equal(got, want) {
+			t.Fatalf("round %d: %q", round, got)
+		}
+		if got := readFile(t, fs, "full"); !bytes.Equal(got, bytes.Repeat([]byte{'A'}, 64*4)) {
+			t.Fatalf("round %d: %q", round, got)
+		}
+		fs.Unlink("sparse", testContext)
+	}
+}
+
+func TestBodyPoolConcurrentFiles(t *testing.T) {
+	fs, _ := newTestFS(t, nil, func(c *Config) { c.BodyPool = true; c.ExtentSize = 64 })
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := fmt.Sprintf("f%d", i)
+			data := bytes.Repeat([]byte{byte('a' + i)}, 64*8)
+			for round := 0; round < 5; round++ {
+				writeFile(t, fs, name, data)
+				if got := readFile(t, fs, name); !bytes.Equal(got, data) {
+					t.Errorf("%s: %q", name, got)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func benchmarkSequential(b *testing.B, pool bool) {
+	fs, _ := newTestFS(b, nil, func(c *Config) { c.BodyPool = pool; c.ExtentSize = 64 * 1024 })
+	data := bytes.Repeat([]byte("0123456789abcdef"), 8*64*1024/16)
+	buf := make([]byte, 32*1024)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		f, _ := fs.Create("f", uint32(os.O_RDWR), 0644, testContext)
+		for off := 0; off < len(data); off += len(buf) {
+			f.Write(data[off:off+len(buf)], int64(off))
+		}
+		f.Release()
+		g, _ := fs.Open("f", 0, testContext)
+		for off := 0; off < len(data); off += len(buf) {
+			g.Read(buf, int64(off))
+		}
+		g.Release()
+	}
+}
+
+func BenchmarkSequentialNoPool(b *testing.B) { benchmarkSequential(b, false) }
+func BenchmarkSequentialPool(b *testing.B)   { benchmarkSequential(b, true) }
@@ -0,0 +1,205 @@
+package bucketsync
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"go.uber.org/zap"
+)
+
+// Defaults of prefetch
+const (
+	defaultPrefetchBuffer = 64
+	// prefetchRun is number of opens in order of names which starts prefetch
+	prefetchRun = 2
+	// prefetchDirs is number of directories tracked at most
+	prefetchDirs = 64
+)
+
+// prefetcher detects files of a directory opened in order of their names.
+type prefetcher struct {
+	files int64 // files ahead, atomic
+
+	lock sync.Mutex
+	dirs map[string]*openRun
+}
+
+// openRun is sequence of opens in a directory.
+type openRun struct {
+	last  string // name opened last
+	run   int    // opens in order ending at last
+	ahead string // name prefetched last
+	busy  bool   // prefetch is running
+}
+
+// PrefetchFiles returns how many files following the one opened are
+// prefetched, when files of a directory are opened in order. 0 disables it.
+func (s *Session) PrefetchFiles() int {
+	return int(atomic.LoadInt64(&s.prefetch.files))
+}
+
+// SetPrefetchFiles changes PrefetchFiles of the running session.
+func (s *Session) SetPrefetchFiles(n int) {
+	if n < 0 {
+		n = 0
+	}
+	atomic.StoreInt64(&s.prefetch.files, int64(n))
+}
+
+// notePrefetch records open of name, and prefetches files following it if
+// files of the directory are opened in order of their names.
+func (s *Session) notePrefetch(name string) {
+	n := s.PrefetchFiles()
+	if n <= 0 {
+		return
+	}
+	dir, base := filepath.Dir(name), filepath.Base(name)
+
+	p := &s.prefetch
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	r, ok := p.dirs[dir]
+	if !ok {
+		if p.dirs == nil || len(p.dirs) >= prefetchDirs {
+			p.dirs = make(map[string]*openRun)
+		}
+		r = &openRun{}
+		p.dirs[dir] = r
+	}
+	switch {
+	case base == r.last:
+		return
+	case r.last != "" && base > r.last:
+		r.run++
+	default:
+		r.run = 1
+		r.ahead = ""
+	}
+	r.last = base
+	if r.run < prefetchRun || r.busy {
+		return
+	}
+	r.busy = true
+	from := base
+	if r.ahead > from {
+		from = r.ahead
+	}
+	go s.prefetchAfter(r, dir, base, from, n)
+}
+
+// prefetchAfter downloads metadata and the first extent of up to n files
+// following base, skipping ones up to from which are prefetched already.
+func (s *Session) prefetchAfter(r *openRun, dir, base, from string, n int) {
+	ctx, cancel := s.opContext()
+	defer cancel()
+
+	ahead := from
+	defer func() {
+		s.prefetch.lock.Lock()
+		r.ahead = ahead
+		r.busy = false
+		s.prefetch.lock.Unlock()
+	}()
+
+	dirKey, err := s.PathWalk(ctx, dir)
+	if err != nil {
+		return
+	}
+	parent, err := s.NewDirectory(ctx, dirKey)
+	if err != nil {
+		s.logger.Debug("prefetch failed", zap.String("dir", dir), zap.Error(err))
+		return
+	}
+	names := make([]string, 0, len(parent.FileMeta))
+	for name := range parent.FileMeta {
+		if name > base {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	if len(names) > n {
+		names = names[:n]
+	}
+	for _, name := range names {
+		if name <= from {
+			continue
+		}
+		ahead = name
+		key := parent.FileMeta[name]
+		if s.openedFile(key) != nil {
+			continue
+		}
+		err := s.prefetchFile(ctx, key)
+		if err != nil {
+			s.logger.Debug("prefetch failed", zap.String("name", filepath.Join(dir, name)), zap.Error(err))
+			return
+		}
+	}
+}
+
+// prefetchFile downloads metadata of key, and objects of its first extent if
+// it's a regular file.
+func (s *Session) prefetchFile(ctx context.Context, key ObjectKey) error {
+	data, err := s.s3.prefetchObject(ctx, MetaObject, key)
+	if err != nil {
+		return err
+	}
+	file := &File{}
+	err = json.Unmarshal(data, file)
+	if err != nil {
+		return err
+	}
+	if file.Meta.Mode&syscall.S_IFMT != syscall.S_IFREG {
+		return nil
+	}
+	e, ok := file.Extent[0]
+	if !ok || e.Damaged {
+		return nil
+	}
+	for _, object := range e.Objects() {
+		_, err := s.s3.prefetchObject(ctx, DataObject, object)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// prefetchObject downloads key into prefetch buffer unless it's cached. The
+// buffer is apart from the object cache, so that prefetches never evict hot
+// objects.
+func (s *S3Session) prefetchObject(ctx context.Context, class ObjectClass, key ObjectKey) ([]byte, error) {
+	if data, err := s.cache.Get(key); err == nil {
+		return data, nil
+	}
+	if data, ok := s.lookupBatched(key); ok && class == MetaObject {
+		return data, nil
+	}
+	if data, err := s.prefetched.Get(key); err == nil {
+		return data, nil
+	}
+	data, err := s.download(ctx, class, key)
+	if err != nil {
+		return nil, err
+	}
+	s.prefetched.Add(key, data)
+	atomic.AddInt64(&s.prefetchedObjects, 1)
+	return data, nil
+}
+
+// takePrefetched returns object in prefetch buffer, and removes it. Metadata
+// moves to the object cache by DownloadWithCache then.
+func (s *S3Session) takePrefetched(key ObjectKey) ([]byte, bool) {
+	data, err := s.prefetched.Get(key)
+	if err != nil {
+		return nil, false
+	}
+	s.prefetched.Remove(key)
+	atomic.AddInt64(&s.prefetchHits, 1)
+	return data, true
+}
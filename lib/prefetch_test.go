@@ -0,0 +1,61 @@
+package bucketsync
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// TestPrefetchFollowingFiles reads files of a directory in order. Metadata
+// and first extents of the following files are prefetched, and their reads
+// download nothing.
+func TestPrefetchFollowingFiles(t *testing.T) {
+	writer, fake := newTestFS(t, nil, nil)
+	if st := writer.Mkdir("d", 0755, testContext); st != fuse.OK {
+		t.Fatal(st)
+	}
+	objects := map[string][]string{}
+	for i := 0; i < 5; i++ {
+		name := fmt.Sprintf("d/f%d", i)
+		writeFile(t, writer, name, []byte(fmt.Sprintf("file %d content", i)))
+		file, _ := writer.getFile(context.Background(), name)
+		objects[name] = []string{writer.Sess.metaName(file.Key)}
+		bucket, object := writer.Sess.s3.location(DataObject, file.Extent[0].Objects()[0])
+		objects[name] = append(objects[name], bucket+"/"+object)
+	}
+	gets := func(name string) int {
+		n := 0
+		for _, object := range objects[name] {
+			n += fake.totalGets(object)
+		}
+		return n
+	}
+
+	fs, _ := newTestFS(t, fake, func(c *Config) { c.PrefetchFiles = 2 })
+	readFile(t, fs, "d/f0")
+	readFile(t, fs, "d/f1")
+	deadline := time.Now().Add(time.Second)
+	for fs.Sess.Stats().PrefetchedObjects < 4 {
+		if time.Now().After(deadline) {
+			t.Fatalf("prefetched %d objects", fs.Sess.Stats().PrefetchedObjects)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := gets("d/f4"); n != 0 {
+		t.Fatalf("%d gets of a file beyond prefetch", n)
+	}
+
+	before := gets("d/f2")
+	if got := readFile(t, fs, "d/f2"); string(got) != "file 2 content" {
+		t.Fatalf("read %q", got)
+	}
+	if n := gets("d/f2") - before; n != 0 {
+		t.Fatalf("%d gets of a prefetched file", n)
+	}
+	if hits := fs.Sess.Stats().PrefetchHits; hits < 2 {
+		t.Fatalf("%d prefetch hits", hits)
+	}
+}
@@ -0,0 +1,101 @@
+package bucketsync
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// With PrivateLayout, metadata objects are sealed, so that the bucket doesn't
+// tell sizes of files, their extents and the objects they share:
+//
+//	offset  size  field
+//	0       4     magic "BSSM"
+//	4             AES-GCM of Cipher, nonce prepended, sealing
+//	              original size (4, big endian), original, zero padding
+//
+// Padding makes sealed objects one of fixed sizes. Extents are stored as full
+// ExtentSize already, and compressed ones are padded the same way, by a zstd
+// skippable frame which decoders ignore.
+const sealMagic = "BSSM"
+
+// Minimum sizes padded to, sizes grow by power of two from them
+const (
+	sealPadMin   = 1024
+	extentPadMin = 4096
+)
+
+// zstdSkippable is magic of zstd skippable frame, followed by size of its
+// content in 4 bytes, little endian.
+const zstdSkippable = 0x184D2A50
+
+// padSize returns the smallest power of two times min, not less than n.
+func padSize(n, min int) int {
+	size := min
+	for size < n {
+		size *= 2
+	}
+	return size
+}
+
+// sealMeta returns data of key sealed and padded.
+func (s *S3Session) sealMeta(data []byte, key ObjectKey) ([]byte, error) {
+	plain := make([]byte, padSize(4+len(data), sealPadMin))
+	binary.BigEndian.PutUint32(plain, uint32(len(data)))
+	copy(plain[4:], data)
+	sealed, err := s.cipher.Seal(plain, key)
+	if err != nil {
+		return nil, errors.Wrapf(err, "seal failed. key = %s", key)
+	}
+	return append([]byte(sealMagic), sealed...), nil
+}
+
+// openMeta returns original of sealed metadata. With PrivateLayout, objects
+// not sealed are refused, anyone with access to the bucket could put them.
+func (s *S3Session) openMeta(data []byte, key ObjectKey) ([]byte, error) {
+	if !bytes.HasPrefix(data, []byte(sealMagic)) {
+		if s.privateLayout {
+			return nil, errors.Wrapf(ErrDecrypt, "object is not sealed, private layout requires it. key = %s", key)
+		}
+		return data, nil
+	}
+	if s.cipher == nil {
+		return nil, errors.Errorf("object is sealed, encryption is required. key = %s", key)
+	}
+	plain, err := s.cipher.Open(data[len(sealMagic):], key)
+	if err != nil {
+		return nil, errors.Wrapf(ErrDecrypt, "sealed object can't be opened: %v. key = %s", err, key)
+	}
+	if len(plain) < 4 || int(binary.BigEndian.Uint32(plain)) > len(plain)-4 {
+		return nil, errors.Errorf("sealed object is corrupt. key = %s", key)
+	}
+	return plain[4 : 4+binary.BigEndian.Uint32(plain)], nil
+}
+
+// sealed returns true if metadata objects of class are sealed.
+func (s *S3Session) sealed(class ObjectClass) bool {
+	return s.privateLayout && class == MetaObject
+}
+
+// padZstd appends a skippable frame to compressed data, so that its size is
+// one of fixed ones.
+func padZstd(data []byte) []byte {
+	size := padSize(len(data)+8, extentPadMin)
+	frame := make([]byte, size-len(data))
+	binary.LittleEndian.PutUint32(frame, zstdSkippable)
+	binary.LittleEndian.PutUint32(frame[4:], uint32(len(frame)-8))
+	return append(data, frame...)
+}
+
+// decryptStatus logs metadata failed decryption, and returns status by
+// DecryptFailure.
+func (s *Session) decryptStatus(err error) fuse.Status {
+	s.logger.Error("metadata can't be decrypted, key mismatch or tampered object", zap.Error(err))
+	if s.config.DecryptFailure == DecryptFailureNoData {
+		return fuse.ENODATA
+	}
+	return fuse.EIO
+}
@@ -0,0 +1,109 @@
+package bucketsync
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/pkg/errors"
+)
+
+func privateLayout(c *Config) {
+	c.Encryption = true
+	c.PrivateLayout = true
+}
+
+func TestPrivateLayoutHidesSizes(t *testing.T) {
+	fs, fake := newTestFS(t, nil, privateLayout)
+	writeFile(t, fs, "small", []byte("s"))
+	writeFile(t, fs, "large", bytes.Repeat([]byte("l"), 100))
+
+	small, _ := fake.get(fs.Sess.metaName(fs.mustKey(t, "small")))
+	large, _ := fake.get(fs.Sess.metaName(fs.mustKey(t, "large")))
+	if len(small) != len(large) {
+		t.Fatalf("metadata sizes %d and %d", len(small), len(large))
+	}
+	if !bytes.HasPrefix(large, []byte(sealMagic)) || bytes.Contains(large, []byte(`"size"`)) {
+		t.Fatalf("metadata is not sealed: %q", large)
+	}
+
+	reader, _ := newTestFS(t, fake, privateLayout)
+	if got := readFile(t, reader, "large"); !bytes.Equal(got, bytes.Repeat([]byte("l"), 100)) {
+		t.Fatalf("large = %q", got)
+	}
+}
+
+func TestPrivateLayoutRefusesUnsealed(t *testing.T) {
+	fs, fake := newTestFS(t, nil, privateLayout)
+	writeFile(t, fs, "f", []byte("content"))
+	name := fs.Sess.metaName(fs.mustKey(t, "f"))
+	sealed, _ := fake.get(name)
+
+	plain, err := fs.Sess.s3.openMeta(sealed, fs.mustKey(t, "f"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := append([]byte(nil), sealed...)
+	tampered[len(tampered)-1] ^= 1
+	for _, body := range [][]byte{plain, tampered} {
+		fake.set(name, body)
+		reader, _ := newTestFS(t, fake, privateLayout)
+		if _, st := reader.GetAttr("f", testContext); st == fuse.OK {
+			t.Fatalf("metadata %q is accepted", body)
+		}
+	}
+}
+
+// tamper flips the last byte of object.
+func tamper(fake *fakeS3, name string) {
+	body, _ := fake.get(name)
+	body = append([]byte(nil), body...)
+	body[len(body)-1] ^= 1
+	fake.set(name, body)
+}
+
+func TestMountRefusesKeyMismatch(t *testing.T) {
+	fs, fake := newTestFS(t, nil, privateLayout)
+	writeFile(t, fs, "f", []byte("content"))
+
+	var err error
+	onFake(fake, func() {
+		_, err = NewSession(testConfig(t, func(c *Config) {
+			privateLayout(c)
+			c.Password = "wrong"
+			c.RequireRoot = true
+		}))
+	})
+	if errors.Cause(err) != ErrKeyMismatch {
+		t.Fatalf("wrong password: %v", err)
+	}
+
+	tamper(fake, fs.Sess.metaName(fs.Sess.RootKey()))
+	onFake(fake, func() { _, err = NewSession(testConfig(t, privateLayout)) })
+	if errors.Cause(err) != ErrDecrypt {
+		t.Fatalf("tampered root: %v", err)
+	}
+}
+
+func TestDecryptFailurePolicy(t *testing.T) {
+	for policy, want := range map[string]fuse.Status{
+		"":                   fuse.EIO,
+		DecryptFailureFail:   fuse.EIO,
+		DecryptFailureNoData: fuse.ENODATA,
+	} {
+		fs, fake := newTestFS(t, nil, privateLayout)
+		writeFile(t, fs, "f", []byte("content"))
+		tamper(fake, fs.Sess.metaName(fs.mustKey(t, "f")))
+
+		reader, _ := newTestFS(t, fake, func(c *Config) {
+			privateLayout(c)
+			c.DecryptFailure = policy
+		})
+		if _, st := reader.GetAttr("f", testContext); st != want {
+			t.Fatalf("%q: GetAttr = %v, want %v", policy, st, want)
+		}
+		if _, st := reader.Open("f", 0, testContext); st != want {
+			t.Fatalf("%q: Open = %v, want %v", policy, st, want)
+		}
+	}
+}
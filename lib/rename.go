@@ -0,0 +1,64 @@
+package bucketsync
+
+import (
+	"sync"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// renameat2 flags
+const (
+	renameNoReplace = 1 // RENAME_NOREPLACE
+	renameExchange  = 2 // RENAME_EXCHANGE
+)
+
+// pending flags of rename requests, keyed by the request context. nodefs
+// rejects rename with flags, so they're passed beside it to Rename, which
+// receives the same context.
+var pendingRenameFlags sync.Map
+
+func renameFlags(context *fuse.Context) uint32 {
+	if flags, ok := pendingRenameFlags.Load(context); ok {
+		return flags.(uint32)
+	}
+	return 0
+}
+
+type renameFlagsFileSystem struct {
+	fuse.RawFileSystem
+	server *fuse.Server
+}
+
+// WithRenameFlags wraps raw filesystem of nodefs to pass renameat2 flags
+// to FileSystem.Rename.
+func WithRenameFlags(raw fuse.RawFileSystem) fuse.RawFileSystem {
+	return &renameFlagsFileSystem{RawFileSystem: raw}
+}
+
+func (r *renameFlagsFileSystem) Init(server *fuse.Server) {
+	r.server = server
+	r.RawFileSystem.Init(server)
+}
+
+func (r *renameFlagsFileSystem) Rename(input *fuse.RenameIn, oldName string, newName string) fuse.Status {
+	if input.Flags == 0 {
+		return r.RawFileSystem.Rename(input, oldName, newName)
+	}
+	pendingRenameFlags.Store(&input.Context, input.Flags)
+	defer pendingRenameFlags.Delete(&input.Context)
+	flags := input.Flags
+	input.Flags = 0
+	defer func() { input.Flags = flags }()
+	status := r.RawFileSystem.Rename(input, oldName, newName)
+
+	// nodefs took exchange as rename overwriting the target, so entries
+	// are looked up again.
+	if status == fuse.OK && flags == renameExchange && r.server != nil {
+		parent, newParent := input.NodeId, input.Newdir
+		go func() {
+			r.server.EntryNotify(parent, oldName)
+			r.server.EntryNotify(newParent, newName)
+		}()
+	}
+	return status
+}
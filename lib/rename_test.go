@@ -0,0 +1,82 @@
+package bucketsync
+
+import (
+	"errors"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// renameWith renames as a request with renameat2 flags.
+func renameWith(fs *FileSystem, oldName, newName string, flags uint32) fuse.Status {
+	ctx := &fuse.Context{Owner: testContext.Owner}
+	pendingRenameFlags.Store(ctx, flags)
+	defer pendingRenameFlags.Delete(ctx)
+	return fs.Rename(oldName, newName, ctx)
+}
+
+func TestRenameFlags(t *testing.T) {
+	for _, tc := range []struct {
+		name, oldName, newName string
+		flags                  uint32
+		status                 fuse.Status
+		want                   map[string]string
+	}{
+		{"noreplace", "a", "b", renameNoReplace, fuse.Status(syscall.EEXIST), map[string]string{"a": "A", "b": "B"}},
+		{"noreplace new", "a", "n", renameNoReplace, fuse.OK, map[string]string{"n": "A", "b": "B"}},
+		{"noreplace across", "a", "d/c", renameNoReplace, fuse.Status(syscall.EEXIST), map[string]string{"a": "A", "d/c": "C"}},
+		{"exchange", "a", "b", renameExchange, fuse.OK, map[string]string{"a": "B", "b": "A"}},
+		{"exchange across", "a", "d/c", renameExchange, fuse.OK, map[string]string{"a": "C", "d/c": "A"}},
+		{"exchange missing", "a", "d/n", renameExchange, fuse.ENOENT, map[string]string{"a": "A"}},
+		{"unknown", "a", "n", 4, fuse.EINVAL, map[string]string{"a": "A"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fs, fake := newTestFS(t, nil, nil)
+			if st := fs.Mkdir("d", 0755, testContext); st != fuse.OK {
+				t.Fatal(st)
+			}
+			writeFile(t, fs, "a", []byte("A"))
+			writeFile(t, fs, "b", []byte("B"))
+			writeFile(t, fs, "d/c", []byte("C"))
+			if st := renameWith(fs, tc.oldName, tc.newName, tc.flags); st != tc.status {
+				t.Fatalf("rename = %v, want %v", st, tc.status)
+			}
+			reader, _ := newTestFS(t, fake, nil)
+			for name, content := range tc.want {
+				if got := readFile(t, reader, name); string(got) != content {
+					t.Fatalf("%s = %q, want %q", name, got, content)
+				}
+			}
+		})
+	}
+}
+
+// TestExchangeReverted fails the second directory save of an exchange.
+// Both files stay at their places.
+func TestExchangeReverted(t *testing.T) {
+	fs, fake := newTestFS(t, nil, nil)
+	if st := fs.Mkdir("d", 0755, testContext); st != fuse.OK {
+		t.Fatal(st)
+	}
+	writeFile(t, fs, "a", []byte("A"))
+	writeFile(t, fs, "d/c", []byte("C"))
+	root := fs.Sess.metaName(fs.Sess.RootKey())
+	fake.fail = func(op, name string) error {
+		if op == "PutObject" && name == root {
+			return errors.New("injected")
+		}
+		return nil
+	}
+	if st := renameWith(fs, "a", "d/c", renameExchange); st != fuse.EIO {
+		t.Fatalf("rename = %v", st)
+	}
+	fake.fail = nil
+
+	reader, _ := newTestFS(t, fake, nil)
+	for name, content := range map[string]string{"a": "A", "d/c": "C"} {
+		if got := readFile(t, reader, name); string(got) != content {
+			t.Fatalf("%s = %q, want %q", name, got, content)
+		}
+	}
+}
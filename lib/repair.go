@@ -0,0 +1,196 @@
+package bucketsync
+
+import (
+	"bytes"
+	"context"
+	"sync"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// RepairReport is summary of Repair.
+type RepairReport struct {
+	Checked     int `json:"checked"`     // unique data objects verified
+	Damaged     int `json:"damaged"`     // missing or content doesn't match key
+	Repaired    int `json:"repaired"`    // uploaded again from good content
+	Quarantined int `json:"quarantined"` // extents marked damaged
+}
+
+// extentRef is a data object referred by an extent of a file.
+type extentRef struct {
+	path  string
+	file  ObjectKey
+	index int64
+	key   ObjectKey // content address of the object
+	name  ObjectKey
+	comp  string
+	dict  string
+}
+
+// Repair verifies all data objects against their content address. Damaged
+// object is uploaded again if the same content is found in other object or
+// an open file, otherwise extents referring it are quarantined and read by
+// MissingExtent policy.
+func (s *Session) Repair(ctx context.Context) (*RepairReport, error) {
+	report, err := s.repair(ctx)
+	if ferr := s.Flush(ctx); err == nil {
+		err = ferr
+	}
+	return report, err
+}
+
+func (s *Session) repair(ctx context.Context) (*RepairReport, error) {
+	var lock sync.Mutex
+	refs := map[ObjectKey][]extentRef{} // by object name
+	err := s.Walk(ctx, "", s.RootKey(), WalkOptions{}, func(path string, key ObjectKey, node interface{}) error {
+		file, ok := node.(*File)
+		if !ok {
+			return nil
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		for i, e := range file.Extent {
+			if e.Damaged {
+				continue
+			}
+			keys := e.Chunks
+			if len(keys) == 0 {
+				keys = []ObjectKey{e.Key}
+			}
+			for _, k := range keys {
+				name := objectName(k, e.Compression, e.Dict)
+				refs[name] = append(refs[name], extentRef{
+					path: path, file: key, index: i, key: k, name: name,
+					comp: e.Compression, dict: e.Dict,
+				})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	report := &RepairReport{}
+	good := map[ObjectKey][]extentRef{} // content address -> verified objects
+	var damaged []ObjectKey
+	for name, rs := range refs {
+		report.Checked++
+		_, err := s.verifyObject(ctx, rs[0])
+		if err == nil {
+			good[rs[0].key] = append(good[rs[0].key], rs[0])
+			continue
+		}
+		if errors.Cause(err) != ErrNotFound && errors.Cause(err) != errMismatch {
+			return report, err
+		}
+		s.logger.Warn("Repair: damaged object", zap.String("object", name),
+			zap.String("path", rs[0].path), zap.Error(err))
+		report.Damaged++
+		damaged = append(damaged, name)
+	}
+
+	for _, name := range damaged {
+		ref := refs[name][0]
+		body := s.goodContent(ctx, ref.key, good[ref.key])
+		if body != nil {
+			data, err := s.compress(ctx, body, ref.comp, ref.dict)
+			if err != nil {
+				return report, err
+			}
+			err = s.s3.Upload(ctx, DataObject, name, bytes.NewReader(data))
+			if err != nil {
+				return report, err
+			}
+			s.logger.Info("Repair: uploaded again", zap.String("object", name))
+			report.Repaired++
+			continue
+		}
+		for _, r := range refs[name] {
+			err := s.quarantine(ctx, r)
+			if err != nil {
+				return report, err
+			}
+			s.logger.Warn("Repair: quarantined extent", zap.String("path", r.path),
+				zap.Int64("index", r.index), zap.String("object", name))
+			report.Quarantined++
+		}
+	}
+	return report, nil
+}
+
+// errMismatch is returned by verifyObject if the content doesn't match key.
+var errMismatch = errors.New("content doesn't match key")
+
+// verifyObject downloads object of ref, and returns its content. It's
+// always read from the bucket, a cached copy may be good when the object
+// isn't.
+func (s *Session) verifyObject(ctx context.Context, ref extentRef) ([]byte, error) {
+	data, err := s.s3.download(ctx, DataObject, ref.name)
+	if err != nil {
+		return nil, err
+	}
+	body, err := s.decompress(ctx, data, ref.comp, ref.dict)
+	if err != nil {
+		return nil, errors.Wrap(errMismatch, err.Error())
+	}
+	if s.KeyGen(body) != ref.key {
+		return nil, errMismatch
+	}
+	return body, nil
+}
+
+// goodContent returns content of key from verified objects or extents of
+// open files, nil if not found.
+func (s *Session) goodContent(ctx context.Context, key ObjectKey, verified []extentRef) []byte {
+	for _, ref := range verified {
+		body, err := s.verifyObject(ctx, ref)
+		if err == nil {
+			return body
+		}
+	}
+
+	s.openLock.Lock()
+	files := make([]*File, 0, len(s.openFiles))
+	for _, o := range s.openFiles {
+		files = append(files, o.file)
+	}
+	s.openLock.Unlock()
+	for _, file := range files {
+		file.lock.Lock()
+		for _, e := range file.Extent {
+			if !e.dirty && len(e.Chunks) == 0 && len(e.body) != 0 && e.CurrentKey() == key {
+				body := append([]byte{}, e.body...)
+				file.lock.Unlock()
+				return body
+			}
+		}
+		file.lock.Unlock()
+	}
+	return nil
+}
+
+// quarantine marks extent of ref damaged, the open file is saved later.
+func (s *Session) quarantine(ctx context.Context, ref extentRef) error {
+	if file := s.openedFile(ref.file); file != nil {
+		file.lock.Lock()
+		defer file.lock.Unlock()
+		if e, ok := file.Extent[ref.index]; ok && !e.dirty {
+			e.Damaged = true
+			e.release()
+			file.markMeta()
+		}
+		return nil
+	}
+	file, err := s.NewFile(ctx, ref.file)
+	if err != nil {
+		return err
+	}
+	e, ok := file.Extent[ref.index]
+	if !ok {
+		return nil
+	}
+	e.Damaged = true
+	return file.Save(ctx)
+}
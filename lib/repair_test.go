@@ -0,0 +1,92 @@
+package bucketsync
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// TestRepairIgnoresPrefetched tampers an object after it's prefetched. The
+// good copy in the buffer doesn't hide the damage from Repair.
+func TestRepairIgnoresPrefetched(t *testing.T) {
+	fs, fake := newTestFS(t, nil, nil)
+	writeFile(t, fs, "f", []byte("prefetched"))
+	file, _ := fs.getFile(context.Background(), "f")
+	object := file.Extent[0].Objects()[0]
+	if _, err := fs.Sess.s3.prefetchObject(context.Background(), DataObject, object); err != nil {
+		t.Fatal(err)
+	}
+	bucket, name := fs.Sess.s3.location(DataObject, object)
+	tamper(fake, bucket+"/"+name)
+
+	report, err := fs.Sess.Repair(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Checked != 1 || report.Damaged != 1 {
+		t.Fatalf("report %+v", report)
+	}
+}
+
+// TestRepairSources damages an object, whose content is also stored by
+// another file, or open, or nowhere else.
+func TestRepairSources(t *testing.T) {
+	compressed := func(c *Config) { c.Compression = true }
+	content := bytes.Repeat([]byte("r"), 16)
+	for _, tc := range []struct {
+		name        string
+		setup       func(t *testing.T, fs *FileSystem, fake *fakeS3) func()
+		repaired    int
+		quarantined int
+	}{
+		{"other object", func(t *testing.T, fs *FileSystem, fake *fakeS3) func() {
+			// Compressed, the same content is stored as other object
+			other, _ := newTestFS(t, fake, compressed)
+			writeFile(t, other, "g", content)
+			return func() {}
+		}, 1, 0},
+		{"open file", func(t *testing.T, fs *FileSystem, fake *fakeS3) func() {
+			f, st := fs.Open("f", 0, testContext)
+			if st != fuse.OK {
+				t.Fatal(st)
+			}
+			if _, st := f.Read(make([]byte, 16), 0); st != fuse.OK {
+				t.Fatal(st)
+			}
+			return f.Release
+		}, 1, 0},
+		{"nowhere", func(t *testing.T, fs *FileSystem, fake *fakeS3) func() {
+			return func() {}
+		}, 0, 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			plain, fake := newTestFS(t, nil, nil)
+			writeFile(t, plain, "f", content)
+			fs, _ := newTestFS(t, fake, compressed)
+			release := tc.setup(t, fs, fake)
+			defer release()
+			file, _ := plain.getFile(context.Background(), "f")
+			bucket, name := fs.Sess.s3.location(DataObject, file.Extent[0].Objects()[0])
+			tamper(fake, bucket+"/"+name)
+
+			report, err := fs.Sess.Repair(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.Damaged != 1 || report.Repaired != tc.repaired || report.Quarantined != tc.quarantined {
+				t.Fatalf("report %+v", report)
+			}
+
+			want := content
+			if tc.quarantined != 0 {
+				want = make([]byte, 16)
+			}
+			reader, _ := newTestFS(t, fake, func(c *Config) { c.MissingExtent = MissingExtentZero })
+			if got := readFile(t, reader, "f"); !bytes.Equal(got, want) {
+				t.Fatalf("read %q, want %q", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,65 @@
+package bucketsync
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// RestoreExtent requests restore of archived extent with tier
+// (Expedited, Standard or Bulk). It returns true if extent is still
+// archived and restore is in progress.
+func (s *Session) RestoreExtent(ctx context.Context, key ObjectKey, tier string) (pending bool, err error) {
+	archived, ongoing, err := s.s3.RestoreStatus(ctx, DataObject, key)
+	if err != nil {
+		return false, err
+	}
+	if !archived {
+		return false, nil
+	}
+	if ongoing {
+		return true, nil
+	}
+
+	days := s.config.RestoreDays
+	if days == 0 {
+		days = 1
+	}
+	err = s.s3.Restore(ctx, DataObject, key, tier, days)
+	if err != nil {
+		return false, err
+	}
+	s.logger.Info("Restore requested", zap.String("key", key), zap.String("tier", tier))
+	return true, nil
+}
+
+// RestoreFile requests restore of all archived extents of the file at path.
+// It returns the number of extents which are not readable yet.
+func (s *Session) RestoreFile(ctx context.Context, path string, tier string) (pending int, err error) {
+	key, err := s.PathWalk(ctx, path)
+	if err != nil {
+		return 0, err
+	}
+	file, err := s.NewFile(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+
+	restoring := make(map[ObjectKey]bool)
+	for _, e := range file.Extent {
+		for _, key := range e.Objects() {
+			if _, ok := restoring[key]; ok {
+				continue
+			}
+			restoring[key], err = s.RestoreExtent(ctx, key, tier)
+			if err != nil {
+				return 0, errors.Wrapf(err, "restore failed. path = %s", path)
+			}
+			if restoring[key] {
+				pending++
+			}
+		}
+	}
+	return pending, nil
+}
@@ -0,0 +1,76 @@
+package bucketsync
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// TestRestoreArchived archives extents of a file, and restores them. Reads
+// fail with EAGAIN until the restore completes.
+func TestRestoreArchived(t *testing.T) {
+	writer, fake := newTestFS(t, nil, nil)
+	data := []byte("0123456789abcdef0123")
+	writeFile(t, writer, "f", data)
+	file, _ := writer.getFile(context.Background(), "f")
+	var names []string
+	for _, e := range file.Extent {
+		bucket, name := writer.Sess.s3.location(DataObject, e.Objects()[0])
+		names = append(names, bucket+"/"+name)
+	}
+	fake.mu.Lock()
+	for _, name := range names {
+		fake.classes[name] = "GLACIER"
+	}
+	fake.mu.Unlock()
+
+	read := func() fuse.Status {
+		fs, _ := newTestFS(t, fake, nil)
+		f, st := fs.Open("f", 0, testContext)
+		if st != fuse.OK {
+			return st
+		}
+		defer f.Release()
+		res, st := f.Read(make([]byte, len(data)), 0)
+		if st == fuse.OK {
+			if got, _ := res.Bytes(nil); string(got) != string(data) {
+				t.Fatalf("read %q", got)
+			}
+		}
+		return st
+	}
+	restore := func() int {
+		sess, _ := newTestSession(t, fake, nil)
+		pending, err := sess.RestoreFile(context.Background(), "f", "Standard")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pending
+	}
+
+	if st := read(); st != fuse.EAGAIN {
+		t.Fatalf("read of archived = %v", st)
+	}
+	if n := restore(); n != len(names) {
+		t.Fatalf("%d pending", n)
+	}
+	if n := restore(); n != len(names) {
+		t.Fatalf("%d pending while restoring", n)
+	}
+	if st := read(); st != fuse.EAGAIN {
+		t.Fatalf("read while restoring = %v", st)
+	}
+
+	fake.mu.Lock()
+	for _, name := range names {
+		fake.restores[name] = `ongoing-request="false", expiry-date="Fri, 21 Dec 2040 00:00:00 GMT"`
+	}
+	fake.mu.Unlock()
+	if n := restore(); n != 0 {
+		t.Fatalf("%d pending after restore", n)
+	}
+	if st := read(); st != fuse.OK {
+		t.Fatalf("read after restore = %v", st)
+	}
+}
@@ -1,49 +1,137 @@
 package bucketsync
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"io"
 	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 	"github.com/pkg/errors"
 	"go.uber.org/zap"
 )
 
+// ErrConflict is returned by CompareAndSwap when the object was modified
+// since the given ETag was observed.
+var ErrConflict = errors.New("object was modified concurrently")
+
+// ErrNotFound is returned by Download when the object doesn't exist.
+var ErrNotFound = errors.New("object not found")
+
+// ErrReadOnly is returned by uploads after the session is made read-only,
+// when its mount lock is lost.
+var ErrReadOnly = errors.New("session is read-only")
+
+// ErrArchived is returned by Download when the object is in archival
+// storage class and not restored.
+var ErrArchived = errors.New("object is archived, restore is required")
+
+// newS3API returns the client of the backend. Tests replace it with a fake.
+var newS3API = func(sess *session.Session, awsConfig *aws.Config) s3iface.S3API {
+	return s3.New(sess, awsConfig)
+}
+
 type S3Session struct {
-	svc         *s3.S3
-	cache       *cache
+	svc         s3iface.S3API
+	cache       *shardedCache
 	logger      *Logger
 	cipher      *Cipher
 	compression bool
 	bucket      string
+	metaBucket  string
+	metaPrefix  string
+	dataPrefix  string
+	shardLevels int // of data objects, by stored layout
+
+	confirmTimeout time.Duration
+	pinned         *pinned
+	checksum       string
+	dryRun         bool
+	privateLayout  bool            // metadata objects are sealed
+	batch          *metaBatch      // nil unless metadata uploads are batched
+	fault          *faultTransport // nil unless faults are injected
+
+	inflightLock sync.Mutex
+	inflight     map[ObjectKey]*download
+
+	inflightUploads   int64
+	inflightDownloads int64
+	readOnly          int32 // set by setReadOnly, uploads fail then
+
+	prefetched        *cache // objects downloaded ahead of use
+	prefetchedObjects int64
+	prefetchHits      int64
+}
+
+// download is in-flight Download shared by concurrent callers
+// download is shared by callers of the same key. It runs detached from
+// their contexts, and is canceled when all of them give up.
+type download struct {
+	done    chan struct{}
+	body    []byte
+	err     error
+	waiters int // under inflightLock
+	cancel  context.CancelFunc
 }
 
 func NewS3Session(config *Config, logger *Logger) (*S3Session, error) {
 	sess := session.Must(session.NewSession())
 
-	svc := s3.New(sess, &aws.Config{
-		Region: aws.String(config.Region),
-		Credentials: credentials.NewStaticCredentials(
-			config.AccessKey,
-			config.SecretKey,
-			"",
-		),
-		Logger: aws.Logger(logger),
-		//LogLevel: aws.LogLevel(aws.LogDebugWithHTTPBody),
-	})
+	awsConfig, err := newAWSConfig(config, logger)
+	if err != nil {
+		return nil, err
+	}
+	fault, err := injectFaults(config, awsConfig, logger)
+	if err != nil {
+		return nil, err
+	}
+	svc := newS3API(sess, awsConfig)
+
+	cacheSize := config.CacheSize
+	if cacheSize == 0 {
+		cacheSize = 10
+	}
 
 	s3Session := &S3Session{svc: svc,
-		cache:       NewCache(10),
+		cache:       NewShardedCache(cacheSize, config.CacheShards),
 		logger:      logger,
 		bucket:      config.Bucket,
 		compression: config.Compression,
+		metaBucket:  config.MetaBucket,
+		metaPrefix:  config.MetaPrefix,
+		dataPrefix:  config.DataPrefix,
+		inflight:    make(map[ObjectKey]*download),
+
+		confirmTimeout: config.ConfirmTimeout,
+		checksum:       config.Checksum,
+		dryRun:         config.DryRun,
+		privateLayout:  config.PrivateLayout,
+		batch:          newMetaBatch(config),
+		fault:          fault,
+	}
+	prefetchBuffer := config.PrefetchBuffer
+	if prefetchBuffer <= 0 {
+		prefetchBuffer = defaultPrefetchBuffer
+	}
+	s3Session.prefetched = NewCache(prefetchBuffer)
+	if s3Session.metaBucket == "" {
+		s3Session.metaBucket = config.Bucket
 	}
 
 	if config.Encryption {
-		var err error
 		s3Session.cipher, err = NewCipher(config.Password)
 		if err != nil {
 			return nil, err
@@ -53,32 +141,155 @@ func NewS3Session(config *Config, logger *Logger) (*S3Session, error) {
 	return s3Session, nil
 }
 
-func (s *S3Session) DownloadWithCache(key ObjectKey) ([]byte, error) {
+func newAWSConfig(config *Config, logger *Logger) (*aws.Config, error) {
+	awsConfig := &aws.Config{
+		Region: aws.String(config.Region),
+		Credentials: credentials.NewStaticCredentials(
+			config.AccessKey,
+			config.SecretKey,
+			"",
+		),
+		Logger: aws.Logger(logger),
+		//LogLevel: aws.LogLevel(aws.LogDebugWithHTTPBody),
+	}
+	if config.Endpoint != "" {
+		awsConfig.Endpoint = aws.String(config.Endpoint)
+	}
+	awsConfig.S3ForcePathStyle = aws.Bool(config.pathStyle())
+
+	if config.CACertFile != "" || config.InsecureSkipVerify {
+		tlsConfig := &tls.Config{InsecureSkipVerify: config.InsecureSkipVerify}
+		if config.CACertFile != "" {
+			pem, err := ioutil.ReadFile(config.CACertFile)
+			if err != nil {
+				return nil, errors.Wrap(err, "CA certificate load failed")
+			}
+			tlsConfig.RootCAs = x509.NewCertPool()
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, errors.Errorf("no CA certificate in %s", config.CACertFile)
+			}
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = tlsConfig
+		awsConfig.HTTPClient = &http.Client{Transport: transport}
+	}
+	if config.RequestTimeout > 0 {
+		if awsConfig.HTTPClient == nil {
+			awsConfig.HTTPClient = &http.Client{Transport: http.DefaultTransport.(*http.Transport).Clone()}
+		}
+		// Bounds waiting for the backend, not the transfer of a large body
+		transport := awsConfig.HTTPClient.Transport.(*http.Transport)
+		transport.DialContext = (&net.Dialer{Timeout: config.RequestTimeout, KeepAlive: 30 * time.Second}).DialContext
+		transport.TLSHandshakeTimeout = config.RequestTimeout
+		transport.ResponseHeaderTimeout = config.RequestTimeout
+	}
+	if config.MaxRetries != nil {
+		awsConfig.MaxRetries = aws.Int(*config.MaxRetries)
+	}
+	return awsConfig, nil
+}
+
+// setReadOnly makes all uploads fail with ErrReadOnly from now on.
+func (s *S3Session) setReadOnly() {
+	atomic.StoreInt32(&s.readOnly, 1)
+}
+
+func (s *S3Session) isReadOnly() bool {
+	return atomic.LoadInt32(&s.readOnly) != 0
+}
+
+// location returns bucket and object name where the key of class is stored.
+func (s *S3Session) location(class ObjectClass, key ObjectKey) (bucket, name string) {
+	if class == MetaObject {
+		return s.metaBucket, s.metaPrefix + key
+	}
+	return s.bucket, s.dataPrefix + shardPath(key, s.shardLevels) + key
+}
+
+func (s *S3Session) DownloadWithCache(ctx context.Context, class ObjectClass, key ObjectKey) ([]byte, error) {
 	cached, err := s.cache.Get(key)
 	if err == nil {
 		return cached, nil
 	}
-	new, err := s.Download(key)
-	if err != nil {
-		return nil, err
+
+	// Join the same key being downloaded by someone else
+	s.inflightLock.Lock()
+	d, ok := s.inflight[key]
+	if !ok {
+		dctx, cancel := context.WithCancel(context.Background())
+		d = &download{done: make(chan struct{}), cancel: cancel}
+		s.inflight[key] = d
+		go func() {
+			defer close(d.done)
+			defer cancel()
+			body, err := s.Download(dctx, class, key)
+			if err == nil {
+				s.cache.Add(key, body)
+			}
+			s.inflightLock.Lock()
+			d.body, d.err = body, err
+			if s.inflight[key] == d {
+				delete(s.inflight, key)
+			}
+			s.inflightLock.Unlock()
+		}()
+	}
+	d.waiters++
+	s.inflightLock.Unlock()
+
+	select {
+	case <-d.done:
+		return d.body, d.err
+	case <-ctx.Done():
+		s.inflightLock.Lock()
+		d.waiters--
+		if d.waiters == 0 && s.inflight[key] == d {
+			delete(s.inflight, key)
+			d.cancel()
+		}
+		s.inflightLock.Unlock()
+		return nil, errors.Wrapf(ctx.Err(), "download canceled. key = %s", key)
 	}
-	s.cache.Add(key, new)
-	return new, nil
 }
 
-func (s *S3Session) Download(key ObjectKey) ([]byte, error) {
+func (s *S3Session) Download(ctx context.Context, class ObjectClass, key ObjectKey) ([]byte, error) {
+	if data, ok := s.lookupBatched(key); ok && class == MetaObject {
+		return data, nil
+	}
+	if data, ok := s.takePrefetched(key); ok {
+		return data, nil
+	}
+	return s.download(ctx, class, key)
+}
+
+func (s *S3Session) download(ctx context.Context, class ObjectClass, key ObjectKey) ([]byte, error) {
 	s.logger.Debug("Download", zap.String("key", key))
 
 	if key == "" {
 		return nil, errors.New("Key shouldn't be empty")
 	}
 
+	atomic.AddInt64(&s.inflightDownloads, 1)
+	defer atomic.AddInt64(&s.inflightDownloads, -1)
+
+	version, err := s.versionID(ctx, class, key)
+	if err != nil {
+		return nil, err
+	}
+	bucket, name := s.location(class, key)
 	paramsGet := &s3.GetObjectInput{
-		Bucket: aws.String(s.bucket),
-		Key:    aws.String(key),
+		Bucket:    aws.String(bucket),
+		Key:       aws.String(name),
+		VersionId: version,
 	}
-	obj, cause := s.svc.GetObject(paramsGet)
+	obj, cause := s.svc.GetObjectWithContext(ctx, paramsGet)
 	if cause != nil {
+		if aerr, ok := cause.(awserr.Error); ok && aerr.Code() == s3.ErrCodeInvalidObjectState {
+			return nil, errors.Wrapf(ErrArchived, "GetObject failed. key = %s", key)
+		}
+		if aerr, ok := cause.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+			return nil, errors.Wrapf(ErrNotFound, "GetObject failed. key = %s", key)
+		}
 		return nil, errors.Wrapf(cause, "GetObject failed. key = %s", key)
 	}
 	defer obj.Body.Close()
@@ -87,12 +298,125 @@ func (s *S3Session) Download(key ObjectKey) ([]byte, error) {
 	if cause != nil {
 		return nil, errors.Wrapf(cause, "GetObject failed. key = %s", key)
 	}
+	if class == MetaObject {
+		body, err = s.openMeta(body, key)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	s.logger.Debug("Download", zap.Int("size", len(body)))
 	return body, nil
 }
 
-func (s *S3Session) UploadWithCache(key ObjectKey, value io.ReadSeeker) error {
+// DownloadWithETag fetches the latest object bypassing the cache, and returns
+// its ETag to be used with CompareAndSwap.
+func (s *S3Session) DownloadWithETag(ctx context.Context, class ObjectClass, key ObjectKey) ([]byte, string, error) {
+	s.logger.Debug("DownloadWithETag", zap.String("key", key))
+
+	version, err := s.versionID(ctx, class, key)
+	if err != nil {
+		return nil, "", err
+	}
+	bucket, name := s.location(class, key)
+	paramsGet := &s3.GetObjectInput{
+		Bucket:    aws.String(bucket),
+		Key:       aws.String(name),
+		VersionId: version,
+	}
+	obj, cause := s.svc.GetObjectWithContext(ctx, paramsGet)
+	if cause != nil {
+		if aerr, ok := cause.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+			return nil, "", errors.Wrapf(ErrNotFound, "GetObject failed. key = %s", key)
+		}
+		return nil, "", errors.Wrapf(cause, "GetObject failed. key = %s", key)
+	}
+	defer obj.Body.Close()
+
+	body, cause := ioutil.ReadAll(obj.Body)
+	if cause != nil {
+		return nil, "", errors.Wrapf(cause, "GetObject failed. key = %s", key)
+	}
+	if class == MetaObject {
+		body, err = s.openMeta(body, key)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	s.cache.Add(key, body)
+	return body, aws.StringValue(obj.ETag), nil
+}
+
+// CompareAndSwap uploads value only if the object's ETag still equals etag.
+// Empty etag means the object must not exist yet.
+// It returns the new ETag, or ErrConflict if the precondition failed.
+func (s *S3Session) CompareAndSwap(ctx context.Context, class ObjectClass, key ObjectKey, etag string, value io.ReadSeeker) (string, error) {
+	s.logger.Debug("CompareAndSwap", zap.String("key", key), zap.String("etag", etag))
+	if s.isReadOnly() {
+		return "", errors.Wrapf(ErrReadOnly, "CompareAndSwap failed. key = %s", key)
+	}
+	s.prefetched.Remove(key)
+
+	data, err := ioutil.ReadAll(value)
+	if err != nil {
+		return "", err
+	}
+	value.Seek(0, 0)
+
+	if s.dryRun {
+		s.logDryRun("CompareAndSwap", class, key, int64(len(data)))
+		s.cache.Add(key, data)
+		return etag, nil
+	}
+
+	if s.sealed(class) {
+		sealed, err := s.sealMeta(data, key)
+		if err != nil {
+			return "", err
+		}
+		value = bytes.NewReader(sealed)
+	}
+	bucket, name := s.location(class, key)
+	paramsPut := &s3.PutObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(name),
+		Body:   value,
+	}
+	err = s.setChecksum(paramsPut)
+	if err != nil {
+		return "", err
+	}
+	req, out := s.svc.PutObjectRequest(paramsPut)
+	req.SetContext(ctx)
+	if etag == "" {
+		req.HTTPRequest.Header.Set("If-None-Match", "*")
+	} else {
+		req.HTTPRequest.Header.Set("If-Match", etag)
+	}
+	cause := req.Send()
+	if cause != nil {
+		if reqErr, ok := cause.(awserr.RequestFailure); ok {
+			switch reqErr.StatusCode() {
+			case http.StatusPreconditionFailed, http.StatusConflict:
+				s.cache.Remove(key)
+				return "", ErrConflict
+			}
+		}
+		return "", errors.Wrapf(cause, "PutObject failed. key = %s", key)
+	}
+	err = s.verifyChecksum(paramsPut, out, key)
+	if err != nil {
+		return "", err
+	}
+	s.cache.Add(key, data)
+	newETag := aws.StringValue(out.ETag)
+	return newETag, s.confirmWrite(ctx, class, key, newETag)
+}
+
+func (s *S3Session) UploadWithCache(ctx context.Context, class ObjectClass, key ObjectKey, value io.ReadSeeker) error {
+	if s.isReadOnly() {
+		return errors.Wrapf(ErrReadOnly, "PutObject failed. key = %s", key)
+	}
 	data, err := ioutil.ReadAll(value)
 	if err != nil {
 		return err
@@ -100,29 +424,240 @@ func (s *S3Session) UploadWithCache(key ObjectKey, value io.ReadSeeker) error {
 	s.cache.Add(key, data)
 	value.Seek(0, 0)
 
-	return s.Upload(key, value)
+	etag, err := s.put(ctx, class, key, value)
+	if err != nil {
+		return err
+	}
+	if class == MetaObject {
+		return s.confirmWrite(ctx, class, key, etag)
+	}
+	return nil
+}
+
+func (s *S3Session) Upload(ctx context.Context, class ObjectClass, key ObjectKey, value io.ReadSeeker) error {
+	_, err := s.put(ctx, class, key, value)
+	return err
 }
 
-func (s *S3Session) Upload(key ObjectKey, value io.ReadSeeker) error {
+// confirmWrite waits until the object with etag is observable, for backends
+// without read-after-write consistency. It does nothing if disabled.
+func (s *S3Session) confirmWrite(ctx context.Context, class ObjectClass, key ObjectKey, etag string) error {
+	if s.confirmTimeout <= 0 || etag == "" {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, s.confirmTimeout)
+	defer cancel()
+
+	bucket, name := s.location(class, key)
+	paramsHead := &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(name),
+	}
+	wait := 50 * time.Millisecond
+	for {
+		out, err := s.svc.HeadObjectWithContext(ctx, paramsHead)
+		if err == nil && aws.StringValue(out.ETag) == etag {
+			return nil
+		}
+		s.logger.Debug("Write is not observable yet", zap.String("key", key))
+		select {
+		case <-ctx.Done():
+			return errors.Wrapf(ctx.Err(), "write confirmation failed. key = %s", key)
+		case <-time.After(wait):
+		}
+		if wait < time.Second {
+			wait *= 2
+		}
+	}
+}
+
+// logDryRun logs the request which would be sent without dry run.
+func (s *S3Session) logDryRun(op string, class ObjectClass, key ObjectKey, size int64) {
+	bucket, name := s.location(class, key)
+	s.logger.Info("Dry run: "+op+" not executed", zap.String("bucket", bucket),
+		zap.String("name", name), zap.Int64("size", size))
+}
+
+func (s *S3Session) put(ctx context.Context, class ObjectClass, key ObjectKey, value io.ReadSeeker) (etag string, err error) {
 	s.logger.Debug("Upload", zap.String("key", key))
+	if s.isReadOnly() {
+		return "", errors.Wrapf(ErrReadOnly, "PutObject failed. key = %s", key)
+	}
+	s.prefetched.Remove(key)
+	if s.dryRun {
+		size, _ := value.Seek(0, io.SeekEnd)
+		value.Seek(0, io.SeekStart)
+		s.logDryRun("Upload", class, key, size)
+		return "", nil
+	}
+	atomic.AddInt64(&s.inflightUploads, 1)
+	defer atomic.AddInt64(&s.inflightUploads, -1)
 
+	if s.sealed(class) {
+		data, err := ioutil.ReadAll(value)
+		if err != nil {
+			return "", err
+		}
+		sealed, err := s.sealMeta(data, key)
+		if err != nil {
+			return "", err
+		}
+		value = bytes.NewReader(sealed)
+	}
+	bucket, name := s.location(class, key)
 	paramsPut := &s3.PutObjectInput{
-		Bucket: aws.String(s.bucket),
-		Key:    aws.String(key),
+		Bucket: aws.String(bucket),
+		Key:    aws.String(name),
 		Body:   value,
 	}
-	_, cause := s.svc.PutObject(paramsPut)
+	err = s.setChecksum(paramsPut)
+	if err != nil {
+		return "", err
+	}
+	out, cause := s.svc.PutObjectWithContext(ctx, paramsPut)
 	if cause != nil {
-		return errors.Wrapf(cause, "PutObject failed. key = %s", key)
+		return "", errors.Wrapf(cause, "PutObject failed. key = %s", key)
 	}
-	return nil
+	err = s.verifyChecksum(paramsPut, out, key)
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(out.ETag), nil
 }
 
-func (s *S3Session) IsExist(key ObjectKey) bool {
+func (s *S3Session) IsExist(ctx context.Context, class ObjectClass, key ObjectKey) bool {
+	bucket, name := s.location(class, key)
 	paramsHead := &s3.HeadObjectInput{
-		Bucket: aws.String(s.bucket),
-		Key:    aws.String(key),
+		Bucket: aws.String(bucket),
+		Key:    aws.String(name),
 	}
-	_, err := s.svc.HeadObject(paramsHead)
+	_, err := s.svc.HeadObjectWithContext(ctx, paramsHead)
 	return err == nil
 }
+
+// Head returns error of HEAD request of the object, ErrNotFound if it
+// doesn't exist.
+func (s *S3Session) Head(ctx context.Context, class ObjectClass, key ObjectKey) error {
+	bucket, name := s.location(class, key)
+	paramsHead := &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(name),
+	}
+	_, cause := s.svc.HeadObjectWithContext(ctx, paramsHead)
+	if aerr, ok := cause.(awserr.Error); ok && aerr.Code() == "NotFound" {
+		return errors.Wrapf(ErrNotFound, "HeadObject failed. key = %s", key)
+	}
+	return errors.Wrapf(cause, "HeadObject failed. key = %s", key)
+}
+
+// Size returns size of the object, ErrNotFound if it doesn't exist.
+func (s *S3Session) Size(ctx context.Context, class ObjectClass, key ObjectKey) (int64, error) {
+	bucket, name := s.location(class, key)
+	paramsHead := &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(name),
+	}
+	out, cause := s.svc.HeadObjectWithContext(ctx, paramsHead)
+	if aerr, ok := cause.(awserr.Error); ok && aerr.Code() == "NotFound" {
+		return 0, errors.Wrapf(ErrNotFound, "HeadObject failed. key = %s", key)
+	}
+	if cause != nil {
+		return 0, errors.Wrapf(cause, "HeadObject failed. key = %s", key)
+	}
+	return aws.Int64Value(out.ContentLength), nil
+}
+
+// List returns keys of all objects of class.
+func (s *S3Session) List(ctx context.Context, class ObjectClass) ([]ObjectKey, error) {
+	bucket, prefix := s.location(class, "")
+	params := &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix),
+	}
+	var keys []ObjectKey
+	err := s.svc.ListObjectsV2PagesWithContext(ctx, params, func(page *s3.ListObjectsV2Output, last bool) bool {
+		for _, o := range page.Contents {
+			key := strings.TrimPrefix(aws.StringValue(o.Key), prefix)
+			if class == DataObject {
+				key = unshard(key)
+			}
+			keys = append(keys, key)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "ListObjects failed")
+	}
+	return keys, nil
+}
+
+// ServerTime returns time of S3 from Date header of a response.
+func (s *S3Session) ServerTime(ctx context.Context) (time.Time, error) {
+	req, _ := s.svc.HeadBucketRequest(&s3.HeadBucketInput{
+		Bucket: aws.String(s.bucket),
+	})
+	req.SetContext(ctx)
+	// Error response also has Date
+	cause := req.Send()
+	if req.HTTPResponse == nil || req.HTTPResponse.Header.Get("Date") == "" {
+		if cause == nil {
+			cause = errors.New("no Date header")
+		}
+		return time.Time{}, errors.Wrap(cause, "HeadBucket failed")
+	}
+	return http.ParseTime(req.HTTPResponse.Header.Get("Date"))
+}
+
+// RestoreStatus reports whether the object is in archival storage class,
+// and whether restore is requested and still in progress.
+func (s *S3Session) RestoreStatus(ctx context.Context, class ObjectClass, key ObjectKey) (archived, ongoing bool, err error) {
+	bucket, name := s.location(class, key)
+	paramsHead := &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(name),
+	}
+	out, cause := s.svc.HeadObjectWithContext(ctx, paramsHead)
+	if cause != nil {
+		return false, false, errors.Wrapf(cause, "HeadObject failed. key = %s", key)
+	}
+	switch aws.StringValue(out.StorageClass) {
+	case s3.StorageClassGlacier, s3.StorageClassDeepArchive:
+	default:
+		return false, false, nil
+	}
+	restore := aws.StringValue(out.Restore)
+	if strings.Contains(restore, `ongoing-request="false"`) {
+		// Restored copy is available
+		return false, false, nil
+	}
+	return true, strings.Contains(restore, `ongoing-request="true"`), nil
+}
+
+// Restore requests temporary copy of archived object for days.
+func (s *S3Session) Restore(ctx context.Context, class ObjectClass, key ObjectKey, tier string, days int64) error {
+	s.logger.Debug("Restore", zap.String("key", key), zap.String("tier", tier))
+	if s.dryRun {
+		s.logDryRun("Restore", class, key, 0)
+		return nil
+	}
+
+	bucket, name := s.location(class, key)
+	paramsRestore := &s3.RestoreObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(name),
+		RestoreRequest: &s3.RestoreRequest{
+			Days: aws.Int64(days),
+			GlacierJobParameters: &s3.GlacierJobParameters{
+				Tier: aws.String(tier),
+			},
+		},
+	}
+	_, cause := s.svc.RestoreObjectWithContext(ctx, paramsRestore)
+	if cause != nil {
+		if aerr, ok := cause.(awserr.Error); ok && aerr.Code() == "RestoreAlreadyInProgress" {
+			return nil
+		}
+		return errors.Wrapf(cause, "RestoreObject failed. key = %s", key)
+	}
+	return nil
+}
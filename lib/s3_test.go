@@ -0,0 +1,348 @@
+package bucketsync
+
+import (
+	"context"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/pkg/errors"
+)
+
+func slowObject(t *testing.T, delay time.Duration) (*S3Session, *fakeS3, ObjectKey) {
+	sess, fake := newTestSession(t, nil, nil)
+	key := "slow"
+	bucket, name := sess.s3.location(DataObject, key)
+	fake.set(bucket+"/"+name, []byte("body"))
+	fake.delayOf = func(op, n string) time.Duration {
+		if op == "GetObject" && n == bucket+"/"+name {
+			return delay
+		}
+		return 0
+	}
+	return sess.s3, fake, key
+}
+
+// TestSharedDownloadOutlivesCanceledCaller cancels the caller which started
+// a download, while another one waits for it.
+func TestSharedDownloadOutlivesCanceledCaller(t *testing.T) {
+	s3, fake, key := slowObject(t, 200*time.Millisecond)
+	gets := fake.totalGets("")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	first := make(chan error)
+	go func() {
+		_, err := s3.DownloadWithCache(ctx, DataObject, key)
+		first <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	start := time.Now()
+	second := make(chan error)
+	go func() {
+		body, err := s3.DownloadWithCache(context.Background(), DataObject, key)
+		if err == nil && string(body) != "body" {
+			t.Errorf("body = %q", body)
+		}
+		second <- err
+	}()
+
+	if err := <-first; err == nil {
+		t.Fatal("canceled caller succeeded")
+	}
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Fatalf("canceled caller returned after %v", d)
+	}
+	if err := <-second; err != nil {
+		t.Fatalf("waiter failed by other's context: %v", err)
+	}
+	if n := fake.totalGets("") - gets; n != 1 {
+		t.Fatalf("%d gets, want one shared", n)
+	}
+}
+
+func TestSharedDownloadCanceledWithoutWaiters(t *testing.T) {
+	s3, _, key := slowObject(t, time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := s3.DownloadWithCache(ctx, DataObject, key); err == nil {
+		t.Fatal("canceled caller succeeded")
+	}
+	deadline := time.Now().Add(200 * time.Millisecond)
+	for atomic.LoadInt64(&s3.inflightDownloads) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("download runs without waiters")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// TestRequestTimeoutSparesSlowBody serves a response whose body takes longer
+// than RequestTimeout, and one whose headers do. Only the latter times out.
+func TestRequestTimeoutSparesSlowBody(t *testing.T) {
+	const timeout = 100 * time.Millisecond
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow-header" {
+			time.Sleep(3 * timeout)
+		}
+		w.Write([]byte("head"))
+		w.(http.Flusher).Flush()
+		time.Sleep(3 * timeout)
+		w.Write([]byte("tail"))
+	}))
+	defer server.Close()
+
+	awsConfig, err := newAWSConfig(&Config{Region: "test", RequestTimeout: timeout}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := awsConfig.HTTPClient
+	res, err := client.Get(server.URL + "/slow-body")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil || string(body) != "headtail" {
+		t.Fatalf("slow body %q: %v", body, err)
+	}
+	if res, err := client.Get(server.URL + "/slow-header"); err == nil {
+		res.Body.Close()
+		t.Fatal("slow header doesn't time out")
+	}
+}
+
+// TestProfileKeepsExplicitBudget applies the interactive profile to a config
+// with a budget, and one without.
+func TestProfileKeepsExplicitBudget(t *testing.T) {
+	config := &Config{Profile: ProfileInteractive, OperationBudget: time.Minute}
+	if got := config.withProfile().OperationBudget; got != time.Minute {
+		t.Fatalf("explicit budget = %v", got)
+	}
+	config.OperationBudget = 0
+	if got := config.withProfile().OperationBudget; got != interactiveBudget {
+		t.Fatalf("profile budget = %v", got)
+	}
+}
+
+func TestObjectPrefixes(t *testing.T) {
+	prefixes := func(c *Config) {
+		c.MetaBucket = "m"
+		c.MetaPrefix = "meta/"
+		c.DataPrefix = "data/"
+	}
+	fs, fake := newTestFS(t, nil, prefixes)
+	writeFile(t, fs, "f", []byte("0123456789abcdef0123"))
+
+	meta, data := 0, 0
+	for _, name := range fake.names("") {
+		switch {
+		case strings.HasPrefix(name, "m/meta/"):
+			meta++
+		case strings.HasPrefix(name, testBucket+"/data/"):
+			data++
+		default:
+			t.Fatalf("object %s outside the prefixes", name)
+		}
+	}
+	if meta < 2 || data != 2 {
+		t.Fatalf("%d metadata and %d data objects", meta, data)
+	}
+	reader, _ := newTestFS(t, fake, prefixes)
+	if got := readFile(t, reader, "f"); string(got) != "0123456789abcdef0123" {
+		t.Fatalf("read %q", got)
+	}
+}
+
+// TestConcurrentOpensLoadDirectoryOnce opens files under a/b at once by a
+// new session, while loading metadata is slow.
+func TestConcurrentOpensLoadDirectoryOnce(t *testing.T) {
+	writer, fake := newTestFS(t, nil, nil)
+	if st := mkdirAll(writer, "a/b"); st != fuse.OK {
+		t.Fatal(st)
+	}
+	for i := 0; i < 8; i++ {
+		writeFile(t, writer, fmt.Sprintf("a/b/f%d", i), []byte("f"))
+	}
+	dir := writer.Sess.metaName(writer.mustKey(t, "a/b"))
+	fs, _ := newTestFS(t, fake, nil)
+	gets := fake.totalGets(dir)
+	fake.getDelay = 20 * time.Millisecond
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			f, st := fs.Open(fmt.Sprintf("a/b/f%d", i), 0, testContext)
+			if st != fuse.OK {
+				t.Error(st)
+				return
+			}
+			f.Release()
+		}(i)
+	}
+	wg.Wait()
+	if n := fake.totalGets(dir) - gets; n != 1 {
+		t.Fatalf("a/b loaded %d times", n)
+	}
+}
+
+// TestConfirmWrite serves stale HEADs for a window after each put. With
+// confirm_timeout, metadata uploads wait for the window to pass.
+func TestConfirmWrite(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		confirm time.Duration
+		window  int
+		heads   int
+		fails   bool
+	}{
+		{"disabled", 0, 3, 0, false},
+		{"window", 5 * time.Second, 3, 4, false},
+		{"never", 200 * time.Millisecond, 1 << 30, -1, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			sess, fake := newTestSession(t, nil, func(c *Config) { c.ConfirmTimeout = tc.confirm })
+			name := sess.metaName("confirmed")
+			stale, heads := 0, 0
+			fake.fail = func(op, n string) error {
+				if n != name {
+					return nil
+				}
+				switch op {
+				case "PutObject":
+					stale = tc.window
+				case "HeadObject":
+					heads++
+					if stale > 0 {
+						stale--
+						return notFound("NotFound")
+					}
+				}
+				return nil
+			}
+
+			start := time.Now()
+			err := sess.s3.UploadWithCache(context.Background(), MetaObject, "confirmed", strings.NewReader("meta"))
+			if (err != nil) != tc.fails {
+				t.Fatalf("upload: %v", err)
+			}
+			fake.mu.Lock()
+			defer fake.mu.Unlock()
+			if tc.heads >= 0 && heads != tc.heads {
+				t.Fatalf("%d heads, want %d", heads, tc.heads)
+			}
+			if tc.fails && time.Since(start) > 2*tc.confirm {
+				t.Fatalf("gave up after %v", time.Since(start))
+			}
+		})
+	}
+}
+
+// TestCustomEndpoint sends requests to a TLS gateway with a private CA.
+// Requests are path-style, and fail without the CA.
+func TestCustomEndpoint(t *testing.T) {
+	var paths []string
+	var lock sync.Mutex
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		paths = append(paths, r.URL.Path)
+		lock.Unlock()
+	}))
+	defer server.Close()
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := ioutil.WriteFile(caFile, ca, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	headBucket := func(config *Config) error {
+		config.Region = "test"
+		config.AccessKey, config.SecretKey = "access", "secret"
+		awsConfig, err := newAWSConfig(config, nil)
+		if err != nil {
+			return err
+		}
+		awsConfig.MaxRetries = aws.Int(0)
+		svc := s3.New(session.Must(session.NewSession()), awsConfig)
+		_, err = svc.HeadBucket(&s3.HeadBucketInput{Bucket: aws.String("bucket")})
+		return err
+	}
+	if err := headBucket(&Config{Endpoint: server.URL, CACertFile: caFile}); err != nil {
+		t.Fatal(err)
+	}
+	if err := headBucket(&Config{Endpoint: server.URL}); err == nil {
+		t.Fatal("unknown CA is accepted")
+	}
+	if err := headBucket(&Config{Endpoint: server.URL, InsecureSkipVerify: true}); err != nil {
+		t.Fatal(err)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if len(paths) != 2 || paths[0] != "/bucket" {
+		t.Fatalf("paths %v", paths)
+	}
+
+	virtual := false
+	for _, tc := range []struct {
+		config Config
+		want   bool
+	}{
+		{Config{}, false},
+		{Config{Endpoint: "https://s3.eu-west-1.amazonaws.com"}, false},
+		{Config{Endpoint: "https://minio.example.com:9000"}, true},
+		{Config{Endpoint: "https://minio.example.com:9000", PathStyle: &virtual}, false},
+	} {
+		if got := tc.config.pathStyle(); got != tc.want {
+			t.Fatalf("%+v: path style %v", tc.config, got)
+		}
+	}
+}
+
+// TestUploadChecksums uploads with each algorithm to a backend which
+// verifies the checksum, rejects it, or echoes a wrong one.
+func TestUploadChecksums(t *testing.T) {
+	if (&Config{Checksum: "md5"}).validate() {
+		t.Fatal("unknown checksum is valid")
+	}
+	for _, algorithm := range []string{"", ChecksumCRC32C, ChecksumSHA256} {
+		for _, backend := range []string{"", "reject", "wrong"} {
+			t.Run(algorithm+"/"+backend, func(t *testing.T) {
+				sess, fake := newTestSession(t, nil, func(c *Config) { c.Checksum = algorithm })
+				fake.checksums = backend
+				err := sess.s3.Upload(context.Background(), DataObject, "summed", strings.NewReader("content"))
+				switch {
+				case algorithm == "" || backend == "":
+					if err != nil {
+						t.Fatal(err)
+					}
+					bucket, name := sess.s3.location(DataObject, "summed")
+					if got, _ := fake.get(bucket + "/" + name); string(got) != "content" {
+						t.Fatalf("uploaded %q", got)
+					}
+				case backend == "reject":
+					if err == nil {
+						t.Fatal("checksum is not sent")
+					}
+				case backend == "wrong":
+					if errors.Cause(err) != ErrChecksum {
+						t.Fatalf("wrong echo: %v", err)
+					}
+				}
+			})
+		}
+	}
+}
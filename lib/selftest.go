@@ -0,0 +1,172 @@
+package bucketsync
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+	"github.com/pkg/errors"
+)
+
+// SelfTestStep is result of an operation of SelfTest, Error is empty if
+// it passed.
+type SelfTestStep struct {
+	Name     string        `json:"name"`
+	Error    string        `json:"error,omitempty"`
+	Duration time.Duration `json:"duration"`
+}
+
+// SelfTest exercises filesystem operations in a temporary directory under
+// the root, and removes it. Steps after a failure are not run, except cleanup.
+func (s *Session) SelfTest(ctx context.Context) ([]SelfTestStep, error) {
+	fs := &FileSystem{
+		FileSystem: pathfs.NewDefaultFileSystem(),
+		Sess:       s,
+		logger:     s.logger,
+	}
+	fctx := &fuse.Context{}
+	dir := fmt.Sprintf(".selftest-%s", NewObjectKey())
+	file := filepath.Join(dir, "file")
+	renamed := filepath.Join(dir, "renamed")
+	link := filepath.Join(dir, "link")
+	data := bytes.Repeat([]byte("bucketsync selftest\n"), 1024)
+
+	var opened nodefs.File
+	steps := []struct {
+		name string
+		fn   func() error
+	}{
+		{"mkdir", func() error {
+			return statusError(fs.Mkdir(dir, 0700, fctx))
+		}},
+		{"create", func() error {
+			var status fuse.Status
+			opened, status = fs.Create(file, syscall.O_RDWR, 0600, fctx)
+			return statusError(status)
+		}},
+		{"write", func() error {
+			n, status := opened.Write(data, 0)
+			if status == fuse.OK && int(n) != len(data) {
+				return errors.Errorf("short write %d of %d", n, len(data))
+			}
+			return statusError(status)
+		}},
+		{"fsync", func() error {
+			return statusError(opened.Fsync(0))
+		}},
+		{"release", func() error {
+			opened.Release()
+			opened = nil
+			return nil
+		}},
+		{"stat", func() error {
+			attr, status := fs.GetAttr(file, fctx)
+			if status == fuse.OK && attr.Size != uint64(len(data)) {
+				return errors.Errorf("size %d, expected %d", attr.Size, len(data))
+			}
+			return statusError(status)
+		}},
+		{"read", func() error {
+			f, status := fs.Open(file, syscall.O_RDONLY, fctx)
+			if status != fuse.OK {
+				return statusError(status)
+			}
+			defer f.Release()
+			buf := make([]byte, len(data))
+			result, status := f.Read(buf, 0)
+			if status != fuse.OK {
+				return statusError(status)
+			}
+			got, status := result.Bytes(buf)
+			if status == fuse.OK && !bytes.Equal(got, data) {
+				return errors.New("read content differs from written")
+			}
+			return statusError(status)
+		}},
+		{"rename", func() error {
+			status := fs.Rename(file, renamed, fctx)
+			if status != fuse.OK {
+				return statusError(status)
+			}
+			if _, status := fs.GetAttr(file, fctx); status != fuse.ENOENT {
+				return errors.New("old name still exists")
+			}
+			_, status = fs.GetAttr(renamed, fctx)
+			return statusError(status)
+		}},
+		{"symlink", func() error {
+			status := fs.Symlink("renamed", link, fctx)
+			if status != fuse.OK {
+				return statusError(status)
+			}
+			target, status := fs.Readlink(link, fctx)
+			if status == fuse.OK && target != "renamed" {
+				return errors.Errorf("link to %s", target)
+			}
+			return statusError(status)
+		}},
+		{"unlink", func() error {
+			if err := statusError(fs.Unlink(link, fctx)); err != nil {
+				return err
+			}
+			return statusError(fs.Unlink(renamed, fctx))
+		}},
+		{"rmdir", func() error {
+			return statusError(fs.Rmdir(dir, fctx))
+		}},
+		{"flush", func() error {
+			return s.Flush(ctx)
+		}},
+	}
+
+	results := make([]SelfTestStep, 0, len(steps))
+	failed := false
+	for _, step := range steps {
+		if err := ctx.Err(); err != nil {
+			failed = true
+			break
+		}
+		start := time.Now()
+		err := step.fn()
+		result := SelfTestStep{Name: step.name, Duration: time.Since(start)}
+		if err != nil {
+			result.Error = err.Error()
+			failed = true
+		}
+		results = append(results, result)
+		if failed {
+			break
+		}
+	}
+
+	if failed {
+		// Best-effort cleanup
+		if opened != nil {
+			opened.Release()
+		}
+		fs.Unlink(link, fctx)
+		fs.Unlink(renamed, fctx)
+		fs.Unlink(file, fctx)
+		fs.Rmdir(dir, fctx)
+		s.Flush(ctx)
+		if err := ctx.Err(); err != nil {
+			return results, err
+		}
+		return results, errors.New("selftest failed")
+	}
+	return results, nil
+}
+
+// statusError returns error of non-OK status.
+func statusError(status fuse.Status) error {
+	if status == fuse.OK {
+		return nil
+	}
+	return errors.New(status.String())
+}
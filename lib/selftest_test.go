@@ -0,0 +1,63 @@
+package bucketsync
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func TestSelfTest(t *testing.T) {
+	sess, fake := newTestSession(t, nil, nil)
+	steps, err := sess.SelfTest(context.Background())
+	if err != nil {
+		t.Fatal(err, steps)
+	}
+	names := []string{"mkdir", "create", "write", "fsync", "release", "stat", "read", "rename", "symlink", "unlink", "rmdir", "flush"}
+	if len(steps) != len(names) {
+		t.Fatalf("steps %v", steps)
+	}
+	for i, step := range steps {
+		if step.Name != names[i] || step.Error != "" {
+			t.Fatalf("step %d: %+v", i, step)
+		}
+	}
+
+	reader, _ := newTestFS(t, fake, nil)
+	entries, st := reader.OpenDir("", testContext)
+	if st != fuse.OK || len(entries) != 0 {
+		t.Fatalf("left %v %v", entries, st)
+	}
+}
+
+// TestSelfTestFailure fails uploads of file contents. The failing step is
+// reported, and the temporary directory is removed.
+func TestSelfTestFailure(t *testing.T) {
+	fs, fake := newTestFS(t, nil, func(c *Config) { c.DataPrefix = "data/" })
+	prefix := fs.Sess.dataPrefix()
+	fake.fail = func(op, name string) error {
+		if op == "PutObject" && strings.HasPrefix(name, prefix) {
+			return errors.New("injected")
+		}
+		return nil
+	}
+	steps, err := fs.Sess.SelfTest(context.Background())
+	fake.fail = nil
+	if err == nil {
+		t.Fatal("selftest passed")
+	}
+	last := steps[len(steps)-1]
+	if last.Name != "fsync" || last.Error == "" {
+		t.Fatalf("steps %v", steps)
+	}
+	for _, step := range steps[:len(steps)-1] {
+		if step.Error != "" {
+			t.Fatalf("step %+v", step)
+		}
+	}
+	if entries, st := fs.OpenDir("", testContext); st != fuse.OK || len(entries) != 0 {
+		t.Fatalf("left %v %v", entries, st)
+	}
+}
@@ -1,36 +1,120 @@
 package bucketsync
 
 import (
+	"container/list"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
 	"fmt"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
+	"bytes"
 	"encoding/json"
 
 	"path/filepath"
 
 	"github.com/hanwen/go-fuse/fuse"
+	"github.com/klauspost/compress/zstd"
 	"github.com/pkg/errors"
 	"github.com/spaolacci/murmur3"
 	"go.uber.org/zap"
 )
 
+// rootCommitRetry is the number of attempts to commit the root on conflict.
+const rootCommitRetry = 5
+
 type Session struct {
 	s3     *S3Session
 	config *Config
 	logger *Logger
+
+	rootLock sync.Mutex
+	rootETag string
+
+	counters counters
+
+	openLock  sync.Mutex
+	openFiles map[ObjectKey]*openFile
+	openLRU   *list.List
+	// number of openFiles which may have extent bodies
+	residentFiles int
+	evictions     int        // running in background
+	evicted       *sync.Cond // of openLock, broadcast when evictions are 0
+
+	flushStop chan struct{} // stops the flusher, nil if it never runs
+	flushOnce sync.Once     // starts the flusher at the first async handle
+
+	links *cache // resolved symlink targets
+
+	usage      usage
+	compressor compressor
+	clock      clock
+	ops        operations
+	negative   negative
+	audit      *auditLog
+	bodies     bodyPool
+	prefetch   prefetcher
+	events     *events
 }
 
+// KeyGen returns content address of object. If DedupSalt is set, it's
+// keyed by the salt, so the same content of other salt has other key.
 func (s *Session) KeyGen(object []byte) ObjectKey {
-	return fmt.Sprintf("%x", murmur3.Sum64(object))
+	if s.config.DedupSalt == "" {
+		return fmt.Sprintf("%x", murmur3.Sum64(object))
+	}
+	mac := hmac.New(sha256.New, []byte(s.config.DedupSalt))
+	mac.Write(object)
+	return fmt.Sprintf("%x", mac.Sum(nil)[:8])
 }
 
+// RootKey doesn't depend on DedupSalt, so that the root is the same.
 func (s *Session) RootKey() ObjectKey {
-	return s.KeyGen([]byte(s.config.Password))
+	return fmt.Sprintf("%x", murmur3.Sum64([]byte(s.config.Password)))
+}
+
+// opContext returns context to bound backend calls of one FUSE operation
+func (s *Session) opContext() (context.Context, context.CancelFunc) {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if s.config.OperationBudget <= 0 {
+		ctx, cancel = context.WithCancel(context.Background())
+	} else {
+		ctx, cancel = context.WithTimeout(context.Background(), s.config.OperationBudget)
+	}
+	id := s.ops.begin()
+	return ctx, func() {
+		s.ops.end(id)
+		cancel()
+	}
+}
+
+// WriteAmplification returns threshold of uploaded per written bytes to
+// switch a file to smaller chunks, 0 is disabled.
+func (s *Session) WriteAmplification() float64 {
+	return s.config.WriteAmplification
+}
+
+// Profile returns preset of timeouts applied to the session.
+func (s *Session) Profile() string {
+	return s.config.Profile
+}
+
+// AttrTimeout returns how long the kernel may cache attributes.
+func (s *Session) AttrTimeout() time.Duration {
+	return s.config.attrTimeout()
+}
+
+// EntryTimeout returns how long the kernel may cache directory entries.
+func (s *Session) EntryTimeout() time.Duration {
+	return s.config.entryTimeout()
 }
 
 func NewSession(config *Config) (*Session, error) {
+	config = config.withProfile()
 	if !config.validate() {
 		return nil, errors.New("Invalid config")
 	}
@@ -49,11 +133,61 @@ func NewSession(config *Config) (*Session, error) {
 		s3:     s3Session,
 		config: config,
 		logger: logger,
+		bodies: newBodyPool(config),
+		prefetch: prefetcher{
+			files: int64(config.PrefetchFiles),
+		},
+
+		openFiles: make(map[ObjectKey]*openFile),
+		openLRU:   list.New(),
+		links:     NewCache(1024),
+		compressor: compressor{
+			encoders: make(map[string]*zstd.Encoder),
+			decoders: make(map[string]*zstd.Decoder),
+		},
+	}
+	bsess.evicted = sync.NewCond(&bsess.openLock)
+	bsess.events = newEvents(config, logger, bsess.now)
+
+	if config.TimeSource == TimeServer {
+		err = bsess.syncClock(context.Background())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if config.RootVersion != "" {
+		err = bsess.s3.pin(context.Background(), bsess.RootKey(), config.RootVersion)
+		if err != nil {
+			return nil, err
+		}
+		err = bsess.loadLayout(context.Background(), false)
+		if err != nil {
+			return nil, err
+		}
+		return bsess, nil
+	}
+
+	rootExists := bsess.s3.IsExist(context.Background(), MetaObject, bsess.RootKey())
+	err = bsess.loadLayout(context.Background(), !rootExists && !config.RequireRoot)
+	if err != nil {
+		return nil, err
 	}
 
-	if !bsess.s3.IsExist(bsess.RootKey()) {
+	if rootExists && config.PrivateLayout {
+		// Mismatch would fail every operation, refuse it at once
+		_, err := bsess.s3.Download(context.Background(), MetaObject, bsess.RootKey())
+		if err != nil {
+			return nil, errors.Wrap(err, "root can't be opened, refusing to mount")
+		}
+	}
+	if !rootExists {
 		logger.Error("root key is not found", zap.Error(err))
+		if config.RequireRoot {
+			return nil, errors.Wrap(ErrKeyMismatch, "root is not found, refusing to create it")
+		}
 
+		now := bsess.now()
 		root := &Directory{
 			Key: bsess.RootKey(),
 			Meta: Meta{
@@ -61,15 +195,16 @@ func NewSession(config *Config) (*Session, error) {
 				Size:  0,
 				UID:   0,
 				GID:   0,
-				Atime: time.Now(),
-				Ctime: time.Now(),
-				Mtime: time.Now(),
+				Atime: now,
+				Ctime: now,
+				Mtime: now,
+				Btime: now,
 			},
 			FileMeta: make(map[string]ObjectKey, 0),
 			sess:     bsess,
 		}
 
-		err := root.Save()
+		err := root.Save(context.Background())
 		if err != nil {
 			return nil, err
 		}
@@ -79,17 +214,34 @@ func NewSession(config *Config) (*Session, error) {
 	return bsess, nil
 }
 
+// newMeta returns Meta owned by the caller mapped to stored ids, or squashed
+// owner if configured.
+func (s *Session) newMeta(mode uint32, context *fuse.Context) Meta {
+	meta := NewMeta(mode, context)
+	now := s.now()
+	meta.Atime, meta.Ctime, meta.Mtime, meta.Btime = now, now, now, now
+	meta.UID, meta.GID = s.storedOwner(context.Uid, context.Gid)
+	if s.config.SquashOwner {
+		meta.UID = s.config.SquashUID
+		meta.GID = s.config.SquashGID
+	}
+	return meta
+}
+
 func (s *Session) CreateDirectory(key, parent ObjectKey, mode uint32, context *fuse.Context) *Directory {
 	return &Directory{
 		Key:      key,
-		Meta:     NewMeta(fuse.S_IFDIR|mode, context),
+		Meta:     s.newMeta(fuse.S_IFDIR|mode, context),
 		FileMeta: make(map[string]ObjectKey, 0),
 		sess:     s,
 	}
 }
 
-func (s *Session) NewDirectory(key ObjectKey) (*Directory, error) {
-	obj, err := s.s3.DownloadWithCache(key)
+func (s *Session) NewDirectory(ctx context.Context, key ObjectKey) (*Directory, error) {
+	if key == s.RootKey() {
+		return s.loadRoot(ctx, false)
+	}
+	obj, err := s.s3.DownloadWithCache(ctx, MetaObject, key)
 	if err != nil {
 		return nil, err
 	}
@@ -98,22 +250,101 @@ func (s *Session) NewDirectory(key ObjectKey) (*Directory, error) {
 	if err != nil {
 		return nil, err
 	}
+	s.clampTimes(key, &node.Meta)
 	node.sess = s
 	return node, nil
 }
 
+// loadRoot returns root directory with the ETag it is based on.
+// If latest is true, cache is bypassed.
+func (s *Session) loadRoot(ctx context.Context, latest bool) (*Directory, error) {
+	s.rootLock.Lock()
+	etag := s.rootETag
+	s.rootLock.Unlock()
+
+	var obj []byte
+	var err error
+	if latest || etag == "" {
+		obj, etag, err = s.s3.DownloadWithETag(ctx, MetaObject, s.RootKey())
+		if err != nil {
+			return nil, err
+		}
+		s.setRootETag(etag)
+	} else {
+		obj, err = s.s3.DownloadWithCache(ctx, MetaObject, s.RootKey())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	node := &Directory{}
+	err = json.Unmarshal(obj, node)
+	if err != nil {
+		return nil, err
+	}
+	s.clampTimes(s.RootKey(), &node.Meta)
+	node.sess = s
+	node.etag = etag
+	node.setBase()
+	return node, nil
+}
+
+func (s *Session) setRootETag(etag string) {
+	s.rootLock.Lock()
+	defer s.rootLock.Unlock()
+	s.rootETag = etag
+}
+
+// commitRoot saves root by compare-and-swap. On conflict, the latest root is
+// reloaded and the changes made to root are reapplied on it.
+func (s *Session) commitRoot(ctx context.Context, root *Directory) error {
+	children := make([]ObjectKey, 0, len(root.FileMeta))
+	for _, key := range root.FileMeta {
+		children = append(children, key)
+	}
+	err := s.s3.WaitBatched(ctx, children...)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < rootCommitRetry; i++ {
+		result, err := json.Marshal(root)
+		if err != nil {
+			return err
+		}
+		etag, err := s.s3.CompareAndSwap(ctx, MetaObject, root.Key, root.etag, bytes.NewReader(result))
+		if err == nil {
+			s.setRootETag(etag)
+			root.etag = etag
+			root.setBase()
+			return nil
+		}
+		if errors.Cause(err) != ErrConflict {
+			return err
+		}
+
+		s.logger.Info("root commit conflict, retrying", zap.Int("attempt", i+1))
+		latest, err := s.loadRoot(ctx, true)
+		if err != nil {
+			return err
+		}
+		root.rebase(latest)
+	}
+	return errors.New("root commit failed, too many conflicts")
+}
+
 func (s *Session) CreateFile(key, parent ObjectKey, mode uint32, context *fuse.Context) *File {
 	return &File{
 		Key:        key,
-		Meta:       NewMeta(fuse.S_IFREG|mode, context),
+		Meta:       s.newMeta(fuse.S_IFREG|mode, context),
 		ExtentSize: s.config.ExtentSize,
+		ChunkSize:  s.config.chunkSize(),
 		Extent:     make(map[int64]*Extent, 0),
 		sess:       s,
 	}
 }
 
-func (s *Session) NewFile(key ObjectKey) (*File, error) {
-	obj, err := s.s3.DownloadWithCache(key)
+func (s *Session) NewFile(ctx context.Context, key ObjectKey) (*File, error) {
+	obj, err := s.s3.DownloadWithCache(ctx, MetaObject, key)
 	if err != nil {
 		return nil, err
 	}
@@ -122,6 +353,7 @@ func (s *Session) NewFile(key ObjectKey) (*File, error) {
 	if err != nil {
 		return nil, err
 	}
+	s.clampTimes(key, &node.Meta)
 	node.sess = s
 	for _, e := range node.Extent {
 		e.sess = s
@@ -132,22 +364,76 @@ func (s *Session) NewFile(key ObjectKey) (*File, error) {
 	return node, nil
 }
 func (s *Session) CreateExtent(size int64) *Extent {
-	return &Extent{
-		body: make([]byte, size),
-		sess: s,
-	}
+	e := &Extent{sess: s}
+	e.hold(s.bodies.get(size))
+	return e
 }
 func (s *Session) CreateSymLink(key, parent ObjectKey, linkTo string, context *fuse.Context) *SymLink {
 	return &SymLink{
 		Key:    key,
-		Meta:   NewMeta(fuse.S_IFLNK, context),
+		Meta:   s.newMeta(fuse.S_IFLNK, context),
 		LinkTo: linkTo,
 		sess:   s,
 	}
 }
 
-func (s *Session) NewSymLink(key ObjectKey) (*SymLink, error) {
-	obj, err := s.s3.DownloadWithCache(key)
+// symLinkPrefix starts keys of symlinks addressed by content.
+const symLinkPrefix = "symlink-"
+
+// symLinkKey returns content address of link, so that identical symlinks
+// share one object. Times are not part of it, they're shared too.
+func (s *Session) symLinkKey(link *SymLink) ObjectKey {
+	stable := *link
+	stable.Key = ""
+	stable.Meta.Atime = time.Time{}
+	stable.Meta.Ctime = time.Time{}
+	stable.Meta.Mtime = time.Time{}
+	stable.Meta.Btime = time.Time{}
+	data, err := json.Marshal(&stable)
+	if err != nil {
+		return NewObjectKey()
+	}
+	return symLinkPrefix + s.KeyGen(data)
+}
+
+// emptyDirPrefix starts keys of empty directories addressed by content.
+const emptyDirPrefix = "emptydir-"
+
+// emptyDirKey returns content address of empty dir, so that identical empty
+// directories share one object. Times are not part of it, as symLinkKey.
+func (s *Session) emptyDirKey(dir *Directory) ObjectKey {
+	stable := *dir
+	stable.Key = ""
+	stable.FileMeta = map[string]ObjectKey{}
+	stable.Meta.Atime = time.Time{}
+	stable.Meta.Ctime = time.Time{}
+	stable.Meta.Mtime = time.Time{}
+	stable.Meta.Btime = time.Time{}
+	data, err := json.Marshal(&stable)
+	if err != nil {
+		return NewObjectKey()
+	}
+	return emptyDirPrefix + s.KeyGen(data)
+}
+
+// isSymLinkKey returns true if key is content address of a symlink.
+func isSymLinkKey(key ObjectKey) bool {
+	return strings.HasPrefix(key, symLinkPrefix)
+}
+
+// isEmptyDirKey returns true if key is content address of an empty directory.
+func isEmptyDirKey(key ObjectKey) bool {
+	return strings.HasPrefix(key, emptyDirPrefix)
+}
+
+// isSharedKey returns true if key is content address of a node, which may be
+// referred by several entries. Its object is never changed in place.
+func isSharedKey(key ObjectKey) bool {
+	return isSymLinkKey(key) || isEmptyDirKey(key)
+}
+
+func (s *Session) NewSymLink(ctx context.Context, key ObjectKey) (*SymLink, error) {
+	obj, err := s.s3.DownloadWithCache(ctx, MetaObject, key)
 	if err != nil {
 		return nil, err
 	}
@@ -156,12 +442,26 @@ func (s *Session) NewSymLink(key ObjectKey) (*SymLink, error) {
 	if err != nil {
 		return nil, err
 	}
+	s.clampTimes(key, &node.Meta)
 	node.sess = s
 	return node, nil
 }
 
-func (s *Session) NewNode(key ObjectKey) (*Node, error) {
-	obj, err := s.s3.DownloadWithCache(key)
+// LinkTarget returns target of symlink, from cache if possible.
+func (s *Session) LinkTarget(ctx context.Context, key ObjectKey) (string, error) {
+	if target, err := s.links.Get(key); err == nil {
+		return string(target), nil
+	}
+	node, err := s.NewSymLink(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	s.links.Add(key, []byte(node.LinkTo))
+	return node.LinkTo, nil
+}
+
+func (s *Session) NewNode(ctx context.Context, key ObjectKey) (*Node, error) {
+	obj, err := s.s3.DownloadWithCache(ctx, MetaObject, key)
 	if err != nil {
 		return nil, err
 	}
@@ -170,13 +470,22 @@ func (s *Session) NewNode(key ObjectKey) (*Node, error) {
 	if err != nil {
 		return nil, err
 	}
+	s.clampTimes(key, &node.Meta)
 
 	return node, nil
 }
 
 // NewNode returns Directory, File or Symlink
-func (s *Session) NewTypedNode(key ObjectKey) (interface{}, error) {
-	obj, err := s.s3.DownloadWithCache(key)
+func (s *Session) NewTypedNode(ctx context.Context, key ObjectKey) (interface{}, error) {
+	if key == s.RootKey() {
+		// With the ETag and base for commitRoot, as NewDirectory
+		root, err := s.loadRoot(ctx, false)
+		if err != nil {
+			return nil, err
+		}
+		return root, nil
+	}
+	obj, err := s.s3.DownloadWithCache(ctx, MetaObject, key)
 	if err != nil {
 		return nil, err
 	}
@@ -203,11 +512,22 @@ func (s *Session) NewTypedNode(key ObjectKey) (interface{}, error) {
 	if err != nil {
 		return nil, err
 	}
+	switch typed := node.(type) {
+	case *Directory:
+		s.clampTimes(key, &typed.Meta)
+	case *File:
+		s.clampTimes(key, &typed.Meta)
+		for _, e := range typed.Extent {
+			e.sess = s
+		}
+	case *SymLink:
+		s.clampTimes(key, &typed.Meta)
+	}
 
 	return node, nil
 }
 
-func (s *Session) PathWalk(relPath string) (key ObjectKey, err error) {
+func (s *Session) PathWalk(ctx context.Context, relPath string) (key ObjectKey, err error) {
 	s.logger.Debug("PathWalk", zap.String("relPath", relPath))
 	key = s.RootKey()
 
@@ -217,24 +537,33 @@ func (s *Session) PathWalk(relPath string) (key ObjectKey, err error) {
 		return key, nil
 	}
 
-	node, err := s.NewDirectory(key)
+	// "a/b/c" => [0:a, 1:b, 2:c] , len = 3
+	pathList := strings.Split(relPath, string(filepath.Separator))
+	last := pathList[len(pathList)-1]
+	if len(pathList) == 1 && s.negativeHit(key, last) {
+		return "", errors.New("File not found")
+	}
+
+	node, err := s.NewDirectory(ctx, key)
 	if err != nil {
 		return "", err
 	}
 
-	// "a/b/c" => [0:a, 1:b, 2:c] , len = 3
-	pathList := strings.Split(relPath, string(filepath.Separator))
 	for i, p := range pathList {
 		var ok bool
 		if key, ok = node.FileMeta[p]; !ok {
+			s.addNegative(node.Key, p)
 			return "", errors.New("File not found")
 		}
 
 		if i == len(pathList)-1 { // key points 2:c in example.
 			break
 		}
+		if i == len(pathList)-2 && s.negativeHit(key, last) {
+			return "", errors.New("File not found")
+		}
 
-		node, err = s.NewDirectory(key)
+		node, err = s.NewDirectory(ctx, key)
 		if err != nil {
 			return "", err
 		}
@@ -243,3 +572,73 @@ func (s *Session) PathWalk(relPath string) (key ObjectKey, err error) {
 	s.logger.Debug("PathWalk finished", zap.String("key", key))
 	return
 }
+
+// maxSymlinkHops is the limit of symlinks followed by Resolve, as Linux.
+const maxSymlinkHops = 40
+
+// Resolve is PathWalk following symlinks when SymlinkMode is internal.
+// Relative target is resolved from the directory of the link, absolute
+// target is resolved from the root of the filesystem.
+func (s *Session) Resolve(ctx context.Context, relPath string) (ObjectKey, error) {
+	if s.config.SymlinkMode != SymlinkInternal {
+		return s.PathWalk(ctx, relPath)
+	}
+
+	hops := 0
+	parents := []ObjectKey{s.RootKey()}
+	key := s.RootKey()
+	pending := strings.Split(relPath, string(filepath.Separator))
+	for len(pending) > 0 {
+		name := pending[0]
+		pending = pending[1:]
+		switch name {
+		case "", ".":
+			continue
+		case "..":
+			if len(parents) > 1 {
+				parents = parents[:len(parents)-1]
+			}
+			key = parents[len(parents)-1]
+			continue
+		}
+
+		dir, err := s.NewDirectory(ctx, parents[len(parents)-1])
+		if err != nil {
+			return "", err
+		}
+		child, ok := dir.FileMeta[name]
+		if !ok {
+			return "", errors.New("File not found")
+		}
+		node, err := s.NewNode(ctx, child)
+		if err != nil {
+			return "", err
+		}
+
+		switch node.Meta.Mode & syscall.S_IFMT {
+		case syscall.S_IFLNK:
+			hops++
+			if hops > maxSymlinkHops {
+				return "", errors.New("Too many levels of symbolic links")
+			}
+			target, err := s.LinkTarget(ctx, child)
+			if err != nil {
+				return "", err
+			}
+			if filepath.IsAbs(target) {
+				parents = parents[:1]
+			}
+			pending = append(strings.Split(target, string(filepath.Separator)), pending...)
+			key = parents[len(parents)-1]
+		case syscall.S_IFDIR:
+			parents = append(parents, child)
+			key = child
+		default:
+			if len(pending) != 0 {
+				return "", errors.New("Not a directory")
+			}
+			key = child
+		}
+	}
+	return key, nil
+}
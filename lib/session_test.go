@@ -0,0 +1,230 @@
+package bucketsync
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func TestCommitRootRetriesConflict(t *testing.T) {
+	a, fake := newTestFS(t, nil, nil)
+	b, _ := newTestFS(t, fake, nil)
+
+	// b caches root, then a changes it behind b's back
+	if _, st := b.OpenDir("", testContext); st != fuse.OK {
+		t.Fatal(st)
+	}
+	if st := a.Mkdir("x", 0755, testContext); st != fuse.OK {
+		t.Fatal(st)
+	}
+	conflicts := 0
+	fake.onPut = func(name string, body []byte) error {
+		if name == b.Sess.metaName(b.Sess.RootKey()) {
+			conflicts++
+		}
+		return nil
+	}
+	if st := b.Mkdir("y", 0755, testContext); st != fuse.OK {
+		t.Fatal(st)
+	}
+	if conflicts != 2 {
+		t.Fatalf("root puts = %d, want a conflict and a retry", conflicts)
+	}
+
+	root, err := a.Sess.loadRoot(context.Background(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"x", "y"} {
+		if _, ok := root.FileMeta[name]; !ok {
+			t.Fatalf("%s is lost: %v", name, root.FileMeta)
+		}
+	}
+}
+
+// TestCommitRootRebasesMeta changes root meta from two sessions, one of
+// them on root loaded by NewTypedNode. Both changes and the child survive.
+func TestCommitRootRebasesMeta(t *testing.T) {
+	a, fake := newTestFS(t, nil, nil)
+	b, _ := newTestFS(t, fake, nil)
+	ctx := context.Background()
+	node, err := b.Sess.NewTypedNode(ctx, b.Sess.RootKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := node.(*Directory)
+
+	if st := a.Mkdir("x", 0755, testContext); st != fuse.OK {
+		t.Fatal(st)
+	}
+	if st := a.SetXAttr("", DurabilityXAttr, []byte(DurabilityAsync), 0, testContext); st != fuse.OK {
+		t.Fatal(st)
+	}
+	root.Meta.Mode = fuse.S_IFDIR | 0700
+	root.Meta.TTL = time.Hour
+	if err := root.Save(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	latest, err := a.Sess.loadRoot(ctx, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := latest.FileMeta["x"]; !ok {
+		t.Fatalf("x is lost: %v", latest.FileMeta)
+	}
+	if m := latest.Meta; m.Mode != fuse.S_IFDIR|0700 || m.TTL != time.Hour || m.Durability != DurabilityAsync {
+		t.Fatalf("root meta %+v", m)
+	}
+}
+
+func TestCommitRootGivesUp(t *testing.T) {
+	fs, fake := newTestFS(t, nil, nil)
+	rootName := fs.Sess.metaName(fs.Sess.RootKey())
+	fake.fail = func(op, name string) error {
+		if op == "PutObject" && name == rootName {
+			return awserr.NewRequestFailure(awserr.New("PreconditionFailed", "etag", nil), http.StatusPreconditionFailed, "")
+		}
+		return nil
+	}
+	root, err := fs.Sess.loadRoot(context.Background(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fs.Sess.commitRoot(context.Background(), root)
+	if err == nil || !strings.Contains(err.Error(), "too many conflicts") {
+		t.Fatalf("err = %v", err)
+	}
+}
+
+// TestOperationBudget makes the backend hang, as if it retried forever.
+// Operations give up at the budget.
+func TestOperationBudget(t *testing.T) {
+	const budget = 100 * time.Millisecond
+	writer, fake := newTestFS(t, nil, nil)
+	writeFile(t, writer, "f", []byte("f"))
+	fs, _ := newTestFS(t, fake, func(c *Config) { c.OperationBudget = budget })
+	f, st := fs.Create("g", 0, 0644, testContext)
+	if st != fuse.OK {
+		t.Fatal(st)
+	}
+	defer f.Release()
+	if _, st := f.Write([]byte("g"), 0); st != fuse.OK {
+		t.Fatal(st)
+	}
+	fake.mu.Lock()
+	fake.getDelay = time.Minute
+	fake.putDelay = time.Minute
+	fake.mu.Unlock()
+
+	start := time.Now()
+	if _, st := fs.GetAttr("f", testContext); st != fuse.EIO {
+		t.Fatalf("lookup = %v", st)
+	}
+	if st := f.Flush(); st != fuse.EAGAIN {
+		t.Fatalf("flush = %v", st)
+	}
+	if d := time.Since(start); d > 4*budget {
+		t.Fatalf("gave up after %v", d)
+	}
+}
+
+// TestInteractiveProfile makes the backend hang with the interactive
+// profile. A lookup and a flush fail within the profile's budget.
+func TestInteractiveProfile(t *testing.T) {
+	writer, fake := newTestFS(t, nil, nil)
+	writeFile(t, writer, "f", []byte("f"))
+	fs, _ := newTestFS(t, fake, func(c *Config) { c.Profile = ProfileInteractive })
+	if fs.Sess.Profile() != ProfileInteractive || fs.Sess.config.OperationBudget != interactiveBudget {
+		t.Fatalf("profile %q, budget %v", fs.Sess.Profile(), fs.Sess.config.OperationBudget)
+	}
+	f, st := fs.Create("g", 0, 0644, testContext)
+	if st != fuse.OK {
+		t.Fatal(st)
+	}
+	defer f.Release()
+	if _, st := f.Write([]byte("g"), 0); st != fuse.OK {
+		t.Fatal(st)
+	}
+	fake.mu.Lock()
+	fake.getDelay = time.Minute
+	fake.putDelay = time.Minute
+	fake.mu.Unlock()
+
+	start := time.Now()
+	lookup := make(chan fuse.Status, 1)
+	go func() {
+		_, st := fs.GetAttr("f", testContext)
+		lookup <- st
+	}()
+	if st := f.Flush(); st != fuse.EAGAIN {
+		t.Fatalf("flush = %v", st)
+	}
+	if st := <-lookup; st != fuse.EIO {
+		t.Fatalf("lookup = %v", st)
+	}
+	if d := time.Since(start); d > 2*interactiveBudget {
+		t.Fatalf("gave up after %v", d)
+	}
+	fake.mu.Lock()
+	fake.getDelay, fake.putDelay = 0, 0
+	fake.mu.Unlock()
+}
+
+// TestDedupSalt writes the same content as tenants of a bucket. Extents
+// are shared only by tenants of the same salt.
+func TestDedupSalt(t *testing.T) {
+	tenant := func(password, salt string) func(c *Config) {
+		return func(c *Config) { c.Password = password; c.DedupSalt = salt }
+	}
+	data := testContent()
+	dataObjects := func(fs *FileSystem) map[string]bool {
+		file, _ := fs.getFile(context.Background(), "f")
+		names := map[string]bool{}
+		for _, e := range file.Extent {
+			for _, obj := range e.Objects() {
+				bucket, name := fs.Sess.s3.location(DataObject, obj)
+				names[bucket+"/"+name] = true
+			}
+		}
+		return names
+	}
+
+	a, fake := newTestFS(t, nil, tenant("a", "salt"))
+	writeFile(t, a, "f", data)
+	b, _ := newTestFS(t, fake, tenant("b", "salt"))
+	writeFile(t, b, "f", data)
+	c, _ := newTestFS(t, fake, tenant("c", "other"))
+	writeFile(t, c, "f", data)
+
+	shared, own := dataObjects(a), dataObjects(c)
+	for name := range dataObjects(b) {
+		if !shared[name] {
+			t.Fatalf("%s is not shared by the same salt", name)
+		}
+	}
+	for name := range own {
+		if shared[name] {
+			t.Fatalf("%s is shared by other salt", name)
+		}
+	}
+	for name := range shared {
+		if fake.puts[name] != 1 {
+			t.Fatalf("%s uploaded %d times", name, fake.puts[name])
+		}
+	}
+
+	plain, _ := newTestFS(t, fake, tenant("a", ""))
+	if plain.Sess.RootKey() != a.Sess.RootKey() {
+		t.Fatal("salt changes the root key")
+	}
+	if got := readFile(t, plain, "f"); !bytes.Equal(got, data) {
+		t.Fatalf("read without salt %q", got)
+	}
+}
@@ -0,0 +1,185 @@
+package bucketsync
+
+import (
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+	"go.uber.org/zap"
+)
+
+// SingleFileSystem exposes one file in the tree as the mount point itself,
+// for block device like use such as a disk image on loopback.
+type SingleFileSystem struct {
+	*FileSystem
+	path string
+}
+
+// NewSingleFileSystem mounts file of path, it's created if not exist.
+// The mount point must be a regular file.
+func NewSingleFileSystem(config *Config, path string) (*pathfs.PathNodeFs, error) {
+	fs := newFileSystem(config)
+	single, err := newSingleFileSystem(fs, path)
+	if err == nil {
+		err = fs.Sess.openAudit()
+	}
+	if err != nil {
+		fs.OnUnmount()
+		return nil, err
+	}
+	return pathfs.NewPathNodeFs(wrapFileSystem(fs.Sess, single), nil), nil
+}
+
+func newSingleFileSystem(fs *FileSystem, path string) (*SingleFileSystem, error) {
+	path = filepath.Clean(path)
+	ctx, cancel := fs.Sess.opContext()
+	defer cancel()
+	_, err := fs.Sess.PathWalk(ctx, path)
+	if err != nil && fs.Sess.config.readOnly() {
+		return nil, err
+	}
+	if err != nil {
+		fs.logger.Info("creating single file", zap.String("path", path))
+		file, status := fs.Create(path, 0, 0644, &fuse.Context{})
+		if status != fuse.OK {
+			return nil, syscall.Errno(status)
+		}
+		file.Release()
+	}
+	return &SingleFileSystem{FileSystem: fs, path: path}, nil
+}
+
+// resolve maps the mount point to the file, there's nothing else.
+func (f *SingleFileSystem) resolve(name string) (string, fuse.Status) {
+	if name != "" {
+		return "", fuse.ENOENT
+	}
+	return f.path, fuse.OK
+}
+
+func (f *SingleFileSystem) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
+	path, status := f.resolve(name)
+	if status != fuse.OK {
+		return nil, status
+	}
+	return f.FileSystem.GetAttr(path, context)
+}
+
+func (f *SingleFileSystem) Open(name string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	path, status := f.resolve(name)
+	if status != fuse.OK {
+		return nil, status
+	}
+	return f.FileSystem.Open(path, flags, context)
+}
+
+func (f *SingleFileSystem) Truncate(name string, size uint64, context *fuse.Context) fuse.Status {
+	path, status := f.resolve(name)
+	if status != fuse.OK {
+		return status
+	}
+	return f.FileSystem.Truncate(path, size, context)
+}
+
+func (f *SingleFileSystem) Chmod(name string, mode uint32, context *fuse.Context) fuse.Status {
+	path, status := f.resolve(name)
+	if status != fuse.OK {
+		return status
+	}
+	return f.FileSystem.Chmod(path, mode, context)
+}
+
+func (f *SingleFileSystem) Chown(name string, uid uint32, gid uint32, context *fuse.Context) fuse.Status {
+	path, status := f.resolve(name)
+	if status != fuse.OK {
+		return status
+	}
+	return f.FileSystem.Chown(path, uid, gid, context)
+}
+
+func (f *SingleFileSystem) Utimens(name string, atime *time.Time, mtime *time.Time, context *fuse.Context) fuse.Status {
+	path, status := f.resolve(name)
+	if status != fuse.OK {
+		return status
+	}
+	return f.FileSystem.Utimens(path, atime, mtime, context)
+}
+
+func (f *SingleFileSystem) Access(name string, mode uint32, context *fuse.Context) fuse.Status {
+	path, status := f.resolve(name)
+	if status != fuse.OK {
+		return status
+	}
+	return f.FileSystem.Access(path, mode, context)
+}
+
+func (f *SingleFileSystem) GetXAttr(name string, attribute string, context *fuse.Context) ([]byte, fuse.Status) {
+	path, status := f.resolve(name)
+	if status != fuse.OK {
+		return nil, status
+	}
+	return f.FileSystem.GetXAttr(path, attribute, context)
+}
+
+func (f *SingleFileSystem) ListXAttr(name string, context *fuse.Context) ([]string, fuse.Status) {
+	path, status := f.resolve(name)
+	if status != fuse.OK {
+		return nil, status
+	}
+	return f.FileSystem.ListXAttr(path, context)
+}
+
+func (f *SingleFileSystem) SetXAttr(name string, attr string, data []byte, flags int, context *fuse.Context) fuse.Status {
+	path, status := f.resolve(name)
+	if status != fuse.OK {
+		return status
+	}
+	return f.FileSystem.SetXAttr(path, attr, data, flags, context)
+}
+
+func (f *SingleFileSystem) RemoveXAttr(name string, attr string, context *fuse.Context) fuse.Status {
+	path, status := f.resolve(name)
+	if status != fuse.OK {
+		return status
+	}
+	return f.FileSystem.RemoveXAttr(path, attr, context)
+}
+
+func (f *SingleFileSystem) OpenDir(name string, context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	return nil, fuse.ENOTDIR
+}
+
+func (f *SingleFileSystem) Mkdir(name string, mode uint32, context *fuse.Context) fuse.Status {
+	return fuse.ENOTDIR
+}
+
+func (f *SingleFileSystem) Create(name string, flags uint32, mode uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	return nil, fuse.ENOTDIR
+}
+
+func (f *SingleFileSystem) Symlink(value string, linkName string, context *fuse.Context) fuse.Status {
+	return fuse.ENOTDIR
+}
+
+func (f *SingleFileSystem) Unlink(name string, context *fuse.Context) fuse.Status {
+	return fuse.ENOTDIR
+}
+
+func (f *SingleFileSystem) Rmdir(name string, context *fuse.Context) fuse.Status {
+	return fuse.ENOTDIR
+}
+
+func (f *SingleFileSystem) Rename(oldName string, newName string, context *fuse.Context) fuse.Status {
+	return fuse.ENOTDIR
+}
+
+func (f *SingleFileSystem) Readlink(name string, context *fuse.Context) (string, fuse.Status) {
+	return "", fuse.EINVAL
+}
+
+func (f *SingleFileSystem) String() string {
+	return "bucketsync:" + f.path
+}
@@ -0,0 +1,63 @@
+package bucketsync
+
+import (
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// TestSingleFileMount mounts a new file as the mount point. It's written
+// through the root, and nothing else is there.
+func TestSingleFileMount(t *testing.T) {
+	fs, fake := newTestFS(t, nil, nil)
+	if st := fs.Mkdir("images", 0755, testContext); st != fuse.OK {
+		t.Fatal(st)
+	}
+	if _, err := newSingleFileSystem(fs, "missing/disk.img"); err == nil {
+		t.Fatal("created in missing directory")
+	}
+	single, err := newSingleFileSystem(fs, "images/disk.img")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	attr, st := single.GetAttr("", testContext)
+	if st != fuse.OK || !attr.IsRegular() || attr.Size != 0 {
+		t.Fatalf("root attr %v %v", attr, st)
+	}
+	f, st := single.Open("", syscall.O_RDWR, testContext)
+	if st != fuse.OK {
+		t.Fatal(st)
+	}
+	if _, st := f.Write([]byte("block"), 4096); st != fuse.OK {
+		t.Fatal(st)
+	}
+	if st := f.Flush(); st != fuse.OK {
+		t.Fatal(st)
+	}
+	f.Release()
+
+	if _, st := single.GetAttr("other", testContext); st != fuse.ENOENT {
+		t.Fatalf("other name: %v", st)
+	}
+	if st := single.Mkdir("d", 0755, testContext); st != fuse.ENOTDIR {
+		t.Fatalf("mkdir: %v", st)
+	}
+	if _, st := single.OpenDir("", testContext); st != fuse.ENOTDIR {
+		t.Fatalf("opendir: %v", st)
+	}
+
+	// Mounted again, the file is kept
+	reader, _ := newTestFS(t, fake, nil)
+	again, err := newSingleFileSystem(reader, "images/disk.img")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attr, st := again.GetAttr("", testContext); st != fuse.OK || attr.Size != 4101 {
+		t.Fatalf("size after remount %v %v", attr, st)
+	}
+	if got := readFile(t, reader, "images/disk.img"); string(got[4096:]) != "block" {
+		t.Fatalf("read %q", got[4096:])
+	}
+}
@@ -0,0 +1,117 @@
+package bucketsync
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// ErrNoSpace is returned when a write would exceed StorageLimit.
+var ErrNoSpace = errors.New("storage limit exceeded")
+
+// usage is logical bytes of all files. It's counted by walking the tree in
+// background, from mount or when invalidated, then updated incrementally by
+// this session.
+type usage struct {
+	lock     sync.Mutex
+	loaded   bool
+	counting chan struct{} // closed when the running count is done
+	err      error         // of the last count
+	bytes    int64         // changes since the count started, until loaded
+}
+
+// reserveSpace accounts delta bytes of file size, and fails if it grows
+// beyond StorageLimit.
+func (s *Session) reserveSpace(ctx context.Context, delta int64) error {
+	if s.config.StorageLimit <= 0 {
+		return nil
+	}
+	s.usage.lock.Lock()
+	defer s.usage.lock.Unlock()
+
+	if delta <= 0 {
+		s.usage.bytes += delta
+		return nil
+	}
+	for !s.usage.loaded {
+		// Wait for the count without lock, shrinking ops go on meanwhile
+		done := s.startCountUsage()
+		s.usage.lock.Unlock()
+		select {
+		case <-done:
+		case <-ctx.Done():
+		}
+		s.usage.lock.Lock()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if !s.usage.loaded && s.usage.err != nil {
+			return s.usage.err
+		}
+	}
+	if s.usage.bytes+delta > s.config.StorageLimit {
+		return ErrNoSpace
+	}
+	s.usage.bytes += delta
+	return nil
+}
+
+// invalidateUsage counts usage again, when files of unknown size are
+// removed.
+func (s *Session) invalidateUsage() {
+	if s.config.StorageLimit <= 0 {
+		return
+	}
+	s.usage.lock.Lock()
+	defer s.usage.lock.Unlock()
+	s.usage.loaded = false
+	s.startCountUsage()
+}
+
+// startCountUsage starts counting usage in background unless it's running,
+// and returns channel closed when it's done. Lock of usage must be held.
+func (s *Session) startCountUsage() chan struct{} {
+	if s.usage.counting != nil {
+		return s.usage.counting
+	}
+	done := make(chan struct{})
+	s.usage.counting = done
+	s.usage.bytes = 0
+	go func() {
+		defer close(done)
+		used, err := s.countUsage(context.Background())
+		s.usage.lock.Lock()
+		defer s.usage.lock.Unlock()
+		s.usage.counting = nil
+		s.usage.err = err
+		if err != nil {
+			s.logger.Error("storage usage count failed", zap.Error(err))
+			return
+		}
+		s.usage.bytes += used
+		s.usage.loaded = true
+		s.logger.Info("storage usage counted", zap.Int64("bytes", s.usage.bytes))
+	}()
+	return done
+}
+
+// usedBytes returns usage if it's counted.
+func (s *Session) usedBytes() int64 {
+	s.usage.lock.Lock()
+	defer s.usage.lock.Unlock()
+	return s.usage.bytes
+}
+
+func (s *Session) countUsage(ctx context.Context) (int64, error) {
+	var used int64
+	err := s.Walk(ctx, "", s.RootKey(), WalkOptions{}, func(path string, key ObjectKey, node interface{}) error {
+		if file, ok := node.(*File); ok {
+			atomic.AddInt64(&used, file.Meta.Size)
+		}
+		return nil
+	})
+	return used, err
+}
@@ -0,0 +1,103 @@
+package bucketsync
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func TestFailedWriteReleasesSpace(t *testing.T) {
+	fs, fake := newTestFS(t, nil, func(c *Config) { c.StorageLimit = 64 })
+	writeFile(t, fs, "f", []byte("0123456789abcdef"))
+	file, st := fs.getFile(context.Background(), "f")
+	if st != fuse.OK {
+		t.Fatal(st)
+	}
+	broken := file.Extent[0].Objects()[0]
+	fs.Sess.s3.cache = NewShardedCache(100, 1)
+
+	f, st := fs.Open("f", syscall.O_RDWR, testContext)
+	if st != fuse.OK {
+		t.Fatal(st)
+	}
+	fake.fail = func(op, name string) error {
+		if op == "GetObject" && strings.HasSuffix(name, broken) {
+			return errors.New("broken")
+		}
+		return nil
+	}
+	if _, st := f.Write(make([]byte, 40), 8); st == fuse.OK {
+		t.Fatal("write over broken extent succeeded")
+	}
+	fake.fail = nil
+	f.Release()
+
+	if got := fs.Sess.usedBytes(); got != 16 {
+		t.Fatalf("used %d bytes after failed write", got)
+	}
+	writeFile(t, fs, "g", make([]byte, 48))
+}
+
+// TestUsageCountedInBackground checks that the walk counting usage doesn't
+// block operations not growing files.
+func TestUsageCountedInBackground(t *testing.T) {
+	fs, fake := newTestFS(t, nil, func(c *Config) { c.StorageLimit = 1000 })
+	writeFile(t, fs, "f", make([]byte, 10))
+	writeFile(t, fs, "g", make([]byte, 10))
+	slow := fs.Sess.metaName(fs.mustKey(t, "f"))
+	fs.Sess.s3.cache = NewShardedCache(100, 1)
+	fake.delayOf = func(op, name string) time.Duration {
+		if op == "GetObject" && name == slow {
+			return 300 * time.Millisecond
+		}
+		return 0
+	}
+	fs.Sess.invalidateUsage()
+
+	grown := make(chan error)
+	go func() { grown <- fs.Sess.reserveSpace(context.Background(), 10) }()
+	time.Sleep(50 * time.Millisecond)
+	start := time.Now()
+	fs.Sess.usedBytes()
+	if err := fs.Sess.reserveSpace(context.Background(), -5); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > 150*time.Millisecond {
+		t.Fatalf("shrink waited %v for the count", d)
+	}
+	if err := <-grown; err != nil {
+		t.Fatal(err)
+	}
+	if got := fs.Sess.usedBytes(); got != 25 {
+		t.Fatalf("used %d bytes, want 25", got)
+	}
+}
+
+func TestMountCountsUsage(t *testing.T) {
+	fake := newFakeS3()
+	fs := newTestMount(t, fake, nil)
+	writeFile(t, fs, "f", make([]byte, 10))
+
+	mounted := newTestMount(t, fake, func(c *Config) { c.StorageLimit = 1000 })
+	deadline := time.Now().Add(time.Second)
+	for {
+		mounted.Sess.usage.lock.Lock()
+		loaded := mounted.Sess.usage.loaded
+		mounted.Sess.usage.lock.Unlock()
+		if loaded {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("usage is not counted at mount")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := mounted.Sess.usedBytes(); got != 10 {
+		t.Fatalf("used %d bytes", got)
+	}
+}
@@ -0,0 +1,132 @@
+package bucketsync
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"sync/atomic"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+// Stats is snapshot of session counters
+type Stats struct {
+	OpenHandles       int64 `json:"open_handles"`
+	DirtyFiles        int64 `json:"dirty_files"`
+	DirtyBytes        int64 `json:"dirty_bytes"`
+	CachedObjects     int64 `json:"cached_objects"`
+	CachedBytes       int64 `json:"cached_bytes"`
+	InflightUploads   int64 `json:"inflight_uploads"`
+	InflightDownloads int64 `json:"inflight_downloads"`
+	UsedBytes         int64 `json:"used_bytes"`
+	SavedExtents      int64 `json:"saved_extents"`
+	UploadedObjects   int64 `json:"uploaded_objects"`
+	DedupedObjects    int64 `json:"deduped_objects"`
+	DedupedBytes      int64 `json:"deduped_bytes"`
+	EvictedFiles      int64 `json:"evicted_files"`
+	UploadedBytes     int64 `json:"uploaded_bytes"`
+	PrefetchedObjects int64 `json:"prefetched_objects"`
+	PrefetchHits      int64 `json:"prefetch_hits"`
+	CompactedFiles    int64 `json:"compacted_files"`
+	OrphanedNodes     int64 `json:"orphaned_nodes"`
+	InjectedFaults    int64 `json:"injected_faults"`
+}
+
+// counters are updated atomically
+type counters struct {
+	openHandles int64
+	dirtyFiles  int64
+	dirtyBytes  int64
+
+	// totals of SaveStats
+	savedExtents    int64
+	uploadedObjects int64
+	dedupedObjects  int64
+	dedupedBytes    int64
+	uploadedBytes   int64
+
+	evictedFiles   int64
+	compactedFiles int64
+	orphanedNodes  int64
+
+	// extent bodies in memory, apart from the object cache
+	heldExtents int64
+	heldBytes   int64
+}
+
+func (c *counters) addSave(stats *SaveStats) {
+	atomic.AddInt64(&c.savedExtents, stats.Extents)
+	atomic.AddInt64(&c.uploadedObjects, stats.Uploaded)
+	atomic.AddInt64(&c.dedupedObjects, stats.Deduped)
+	atomic.AddInt64(&c.dedupedBytes, stats.DedupedBytes)
+	atomic.AddInt64(&c.uploadedBytes, stats.UploadedBytes)
+}
+
+// Stats returns current counters of the session
+func (s *Session) Stats() Stats {
+	objects, bytes := s.s3.cache.Usage()
+	objects += atomic.LoadInt64(&s.counters.heldExtents)
+	bytes += atomic.LoadInt64(&s.counters.heldBytes)
+	return Stats{
+		OpenHandles:       atomic.LoadInt64(&s.counters.openHandles),
+		DirtyFiles:        atomic.LoadInt64(&s.counters.dirtyFiles),
+		DirtyBytes:        atomic.LoadInt64(&s.counters.dirtyBytes),
+		CachedObjects:     objects,
+		CachedBytes:       bytes,
+		InflightUploads:   atomic.LoadInt64(&s.s3.inflightUploads),
+		InflightDownloads: atomic.LoadInt64(&s.s3.inflightDownloads),
+		UsedBytes:         s.usedBytes(),
+		SavedExtents:      atomic.LoadInt64(&s.counters.savedExtents),
+		UploadedObjects:   atomic.LoadInt64(&s.counters.uploadedObjects),
+		DedupedObjects:    atomic.LoadInt64(&s.counters.dedupedObjects),
+		DedupedBytes:      atomic.LoadInt64(&s.counters.dedupedBytes),
+		EvictedFiles:      atomic.LoadInt64(&s.counters.evictedFiles),
+		UploadedBytes:     atomic.LoadInt64(&s.counters.uploadedBytes),
+		PrefetchedObjects: atomic.LoadInt64(&s.s3.prefetchedObjects),
+		PrefetchHits:      atomic.LoadInt64(&s.s3.prefetchHits),
+		CompactedFiles:    atomic.LoadInt64(&s.counters.compactedFiles),
+		OrphanedNodes:     atomic.LoadInt64(&s.counters.orphanedNodes),
+		InjectedFaults:    s.s3.InjectedFaults(),
+	}
+}
+
+// Control directory is hidden from readdir of root
+const controlDir = ".bucketsync"
+
+var statsPath = filepath.Join(controlDir, "stats")
+
+func (f *FileSystem) statsJSON() []byte {
+	data, err := json.MarshalIndent(f.Sess.Stats(), "", "  ")
+	if err != nil {
+		return nil
+	}
+	return append(data, '\n')
+}
+
+// controlAttr returns attributes of virtual files in control directory
+func (f *FileSystem) controlAttr(name string) (*fuse.Attr, bool) {
+	switch name {
+	case controlDir:
+		return &fuse.Attr{Mode: fuse.S_IFDIR | 0555, Nlink: 1}, true
+	case statsPath:
+		return &fuse.Attr{Mode: fuse.S_IFREG | 0444, Nlink: 1, Size: uint64(len(f.statsJSON()))}, true
+	case barrierPath:
+		return &fuse.Attr{Mode: fuse.S_IFREG | 0444, Nlink: 1}, true
+	}
+	return nil, false
+}
+
+// openControl opens virtual file in control directory
+func (f *FileSystem) openControl(name string) (nodefs.File, bool) {
+	if name == barrierPath {
+		return &barrierFile{File: nodefs.NewReadOnlyFile(nodefs.NewDataFile(nil)), sess: f.Sess}, true
+	}
+	if name != statsPath {
+		return nil, false
+	}
+	// Content changes, so bypass page cache.
+	return &nodefs.WithFlags{
+		File:      nodefs.NewReadOnlyFile(nodefs.NewDataFile(f.statsJSON())),
+		FuseFlags: fuse.FOPEN_DIRECT_IO,
+	}, true
+}
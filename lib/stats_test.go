@@ -0,0 +1,82 @@
+package bucketsync
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// TestStatsCountOpenExtents reads a file, and checks that extents filled for
+// the handle are counted as cached until it's closed.
+func TestStatsCountOpenExtents(t *testing.T) {
+	fs, _ := newTestFS(t, nil, func(c *Config) { c.CacheSize = 0 })
+	data := bytes.Repeat([]byte("x"), 40)
+	writeFile(t, fs, "f", data)
+	before := fs.Sess.Stats()
+
+	f, st := fs.Open("f", 0, testContext)
+	if st != fuse.OK {
+		t.Fatal(st)
+	}
+	buf := make([]byte, len(data))
+	if _, st := f.Read(buf, 0); st != fuse.OK {
+		t.Fatal(st)
+	}
+	open := fs.Sess.Stats()
+	if n := open.CachedObjects - before.CachedObjects; n != 3 {
+		t.Fatalf("%d more cached objects", n)
+	}
+	if n := open.CachedBytes - before.CachedBytes; n != 3*16 {
+		t.Fatalf("%d more cached bytes", n)
+	}
+
+	f.Release()
+	after := fs.Sess.Stats()
+	if after.CachedObjects != before.CachedObjects || after.CachedBytes != before.CachedBytes {
+		t.Fatalf("after close %+v, before %+v", after, before)
+	}
+}
+
+// TestSaveDedupStats saves extents repeated in a file and stored by another
+// file. Both are counted as deduplicated.
+func TestSaveDedupStats(t *testing.T) {
+	fs, _ := newTestFS(t, nil, nil)
+	a, b, c := bytes.Repeat([]byte("a"), 16), bytes.Repeat([]byte("b"), 16), bytes.Repeat([]byte("c"), 16)
+	for _, tc := range []struct {
+		name string
+		data []byte
+		want SaveStats
+	}{
+		{"f", bytes.Join([][]byte{a, a, b}, nil), SaveStats{Extents: 3, Uploaded: 2, Deduped: 1, DedupedBytes: 16, UploadedBytes: 32}},
+		{"g", bytes.Join([][]byte{b, c}, nil), SaveStats{Extents: 2, Uploaded: 1, Deduped: 1, DedupedBytes: 16, UploadedBytes: 16}},
+	} {
+		before := fs.Sess.Stats()
+		f, st := fs.Create(tc.name, 0, 0644, testContext)
+		if st != fuse.OK {
+			t.Fatal(st)
+		}
+		if _, st := f.Write(tc.data, 0); st != fuse.OK {
+			t.Fatal(st)
+		}
+		if st := f.Flush(); st != fuse.OK {
+			t.Fatal(st)
+		}
+		last := fs.Sess.openedFile(fs.mustKey(t, tc.name)).LastSave()
+		f.Release()
+		if last != tc.want {
+			t.Fatalf("%s: last save %+v, want %+v", tc.name, last, tc.want)
+		}
+		after := fs.Sess.Stats()
+		got := SaveStats{
+			Extents:       after.SavedExtents - before.SavedExtents,
+			Uploaded:      after.UploadedObjects - before.UploadedObjects,
+			Deduped:       after.DedupedObjects - before.DedupedObjects,
+			DedupedBytes:  after.DedupedBytes - before.DedupedBytes,
+			UploadedBytes: after.UploadedBytes - before.UploadedBytes,
+		}
+		if got != tc.want {
+			t.Fatalf("%s: stats %+v, want %+v", tc.name, got, tc.want)
+		}
+	}
+}
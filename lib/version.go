@@ -0,0 +1,135 @@
+package bucketsync
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// ObjectVersion is a version of an object in a bucket with versioning.
+type ObjectVersion struct {
+	ID           string    `json:"id"`
+	LastModified time.Time `json:"last_modified"`
+	Latest       bool      `json:"latest"`
+	DeleteMarker bool      `json:"delete_marker"`
+}
+
+// pinned resolves metadata objects to their versions last modified before a
+// time. Data objects are addressed by content, so they are never overwritten.
+type pinned struct {
+	before   time.Time // zero for the latest
+	versions sync.Map  // name -> version id, "" if the object didn't exist
+}
+
+// ListVersions returns versions of the object, newest first.
+func (s *S3Session) ListVersions(ctx context.Context, class ObjectClass, key ObjectKey) ([]ObjectVersion, error) {
+	bucket, name := s.location(class, key)
+	params := &s3.ListObjectVersionsInput{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(name),
+	}
+	var versions []ObjectVersion
+	err := s.svc.ListObjectVersionsPagesWithContext(ctx, params, func(page *s3.ListObjectVersionsOutput, last bool) bool {
+		for _, v := range page.Versions {
+			if aws.StringValue(v.Key) != name {
+				continue
+			}
+			versions = append(versions, ObjectVersion{
+				ID:           aws.StringValue(v.VersionId),
+				LastModified: aws.TimeValue(v.LastModified),
+				Latest:       aws.BoolValue(v.IsLatest),
+			})
+		}
+		for _, v := range page.DeleteMarkers {
+			if aws.StringValue(v.Key) != name {
+				continue
+			}
+			versions = append(versions, ObjectVersion{
+				ID:           aws.StringValue(v.VersionId),
+				LastModified: aws.TimeValue(v.LastModified),
+				Latest:       aws.BoolValue(v.IsLatest),
+				DeleteMarker: true,
+			})
+		}
+		return true
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "ListObjectVersions failed. key = %s", key)
+	}
+	sort.SliceStable(versions, func(i, j int) bool {
+		if versions[i].Latest != versions[j].Latest {
+			return versions[i].Latest
+		}
+		return versions[i].LastModified.After(versions[j].LastModified)
+	})
+	return versions, nil
+}
+
+// pin makes metadata downloads return versions, which were current while
+// the version of key was the latest.
+func (s *S3Session) pin(ctx context.Context, key ObjectKey, id string) error {
+	versions, err := s.ListVersions(ctx, MetaObject, key)
+	if err != nil {
+		return err
+	}
+	for i, v := range versions {
+		if v.ID != id {
+			continue
+		}
+		if v.DeleteMarker {
+			return errors.Errorf("version %s of %s is a delete marker", id, key)
+		}
+		s.pinned = &pinned{}
+		if i > 0 {
+			s.pinned.before = versions[i-1].LastModified
+		}
+		_, name := s.location(MetaObject, key)
+		s.pinned.versions.Store(name, id)
+		s.logger.Info("Pinned metadata", zap.String("key", key), zap.String("version", id),
+			zap.Time("before", s.pinned.before))
+		return nil
+	}
+	return errors.Errorf("version %s of %s is not found", id, key)
+}
+
+// versionID returns version of the object to download, nil for the latest.
+// It returns ErrNotFound if the object didn't exist at the pinned time.
+func (s *S3Session) versionID(ctx context.Context, class ObjectClass, key ObjectKey) (*string, error) {
+	if s.pinned == nil || class != MetaObject {
+		return nil, nil
+	}
+	_, name := s.location(class, key)
+	cached, ok := s.pinned.versions.Load(name)
+	if !ok {
+		versions, err := s.ListVersions(ctx, class, key)
+		if err != nil {
+			return nil, err
+		}
+		id := ""
+		for _, v := range versions {
+			if !s.pinned.before.IsZero() && !v.LastModified.Before(s.pinned.before) {
+				continue
+			}
+			if !v.DeleteMarker {
+				id = v.ID
+			}
+			break
+		}
+		cached, _ = s.pinned.versions.LoadOrStore(name, id)
+	}
+	if cached.(string) == "" {
+		return nil, errors.Wrapf(ErrNotFound, "no version before %s. key = %s", s.pinned.before, key)
+	}
+	return aws.String(cached.(string)), nil
+}
+
+// RootVersions returns versions of the root, to be mounted by RootVersion.
+func (s *Session) RootVersions(ctx context.Context) ([]ObjectVersion, error) {
+	return s.s3.ListVersions(ctx, MetaObject, s.RootKey())
+}
@@ -0,0 +1,53 @@
+package bucketsync
+
+import (
+	"context"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// TestMountRootVersion adds a file, which makes a new root version, and
+// then changes a file. Mounted at the old version, the tree is as it was.
+func TestMountRootVersion(t *testing.T) {
+	fs, fake := newTestFS(t, nil, nil)
+	writeFile(t, fs, "a", []byte("old"))
+	versions, err := fs.Sess.RootVersions(context.Background())
+	if err != nil || len(versions) == 0 || !versions[0].Latest {
+		t.Fatalf("versions %v %v", versions, err)
+	}
+	old := versions[0].ID
+	writeFile(t, fs, "b", []byte("added"))
+
+	f, st := fs.Open("a", syscall.O_RDWR, testContext)
+	if st != fuse.OK {
+		t.Fatal(st)
+	}
+	if _, st := f.Write([]byte("new"), 0); st != fuse.OK {
+		t.Fatal(st)
+	}
+	if st := f.Flush(); st != fuse.OK {
+		t.Fatal(st)
+	}
+	f.Release()
+
+	pinned, _ := newTestFS(t, fake, func(c *Config) { c.RootVersion = old })
+	if got := readFile(t, pinned, "a"); string(got) != "old" {
+		t.Fatalf("a = %q", got)
+	}
+	if _, st := pinned.GetAttr("b", testContext); st != fuse.ENOENT {
+		t.Fatalf("b at old version: %v", st)
+	}
+
+	latest, _ := newTestFS(t, fake, nil)
+	if got := readFile(t, latest, "a"); string(got) != "new" {
+		t.Fatalf("latest a = %q", got)
+	}
+	onFake(fake, func() {
+		_, err = NewSession(testConfig(t, func(c *Config) { c.RootVersion = "missing" }))
+	})
+	if err == nil {
+		t.Fatal("missing version is mounted")
+	}
+}
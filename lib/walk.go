@@ -0,0 +1,140 @@
+package bucketsync
+
+import (
+	"context"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// SkipDir is returned by WalkFunc to skip children of the directory.
+var SkipDir = errors.New("skip this directory")
+
+// WalkFunc is called with each node (*Directory, *File or *SymLink) found
+// by Walk, concurrently unless Concurrency is 1.
+type WalkFunc func(path string, key ObjectKey, node interface{}) error
+
+type WalkOptions struct {
+	// Concurrency is number of nodes loaded at once, WalkConcurrency if 0.
+	// With 1, nodes are visited in depth-first order sorted by name.
+	Concurrency int
+	// Progress is called with number of visited nodes.
+	Progress func(visited int64)
+}
+
+const defaultWalkConcurrency = 8
+
+type walker struct {
+	sess *Session
+	fn   WalkFunc
+	opts WalkOptions
+	ctx  context.Context
+	stop context.CancelFunc
+	sem  chan struct{}
+	wg   sync.WaitGroup
+
+	lock    sync.Mutex
+	visited map[ObjectKey]bool
+	err     error
+	count   int64
+}
+
+// Walk visits the tree under key, parents before children. Each object is
+// loaded and visited once, even if it's reachable by several paths, except
+// shared symlinks and empty directories, visited at each path.
+// It stops at the first error of fn or loading, or cancel of ctx.
+func (s *Session) Walk(ctx context.Context, path string, key ObjectKey, opts WalkOptions, fn WalkFunc) error {
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = s.config.WalkConcurrency
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = defaultWalkConcurrency
+	}
+	w := &walker{
+		sess:    s,
+		fn:      fn,
+		opts:    opts,
+		sem:     make(chan struct{}, opts.Concurrency-1),
+		visited: make(map[ObjectKey]bool),
+	}
+	w.ctx, w.stop = context.WithCancel(ctx)
+	defer w.stop()
+
+	w.visit(path, key)
+	w.wg.Wait()
+
+	if w.err != nil {
+		return w.err
+	}
+	return ctx.Err()
+}
+
+func (w *walker) fail(err error) {
+	w.lock.Lock()
+	if w.err == nil {
+		w.err = err
+	}
+	w.lock.Unlock()
+	w.stop()
+}
+
+// first returns true at the first visit of key.
+func (w *walker) first(key ObjectKey) bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.visited[key] {
+		return false
+	}
+	w.visited[key] = true
+	return true
+}
+
+func (w *walker) visit(path string, key ObjectKey) {
+	if w.ctx.Err() != nil || (!isSharedKey(key) && !w.first(key)) {
+		return
+	}
+	node, err := w.sess.NewTypedNode(w.ctx, key)
+	if err != nil {
+		w.fail(errors.Wrapf(err, "walk failed. path = %s", path))
+		return
+	}
+	err = w.fn(path, key, node)
+	if err == SkipDir {
+		return
+	}
+	if err != nil {
+		w.fail(err)
+		return
+	}
+	visited := atomic.AddInt64(&w.count, 1)
+	if w.opts.Progress != nil {
+		w.opts.Progress(visited)
+	}
+
+	dir, ok := node.(*Directory)
+	if !ok {
+		return
+	}
+	names := make([]string, 0, len(dir.FileMeta))
+	for name := range dir.FileMeta {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		childPath, childKey := filepath.Join(path, name), dir.FileMeta[name]
+		select {
+		case w.sem <- struct{}{}:
+			w.wg.Add(1)
+			go func() {
+				defer w.wg.Done()
+				w.visit(childPath, childKey)
+				<-w.sem
+			}()
+		default:
+			w.visit(childPath, childKey)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package bucketsync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// walkTree has directories d0..d3 of files f0..f3, and d0/f0 is also
+// linked as d3/shared.
+func walkTree(t *testing.T) (*FileSystem, *fakeS3) {
+	fs, fake := newTestFS(t, nil, nil)
+	for i := 0; i < 4; i++ {
+		dir := fmt.Sprintf("d%d", i)
+		if st := fs.Mkdir(dir, 0755, testContext); st != fuse.OK {
+			t.Fatal(st)
+		}
+		for j := 0; j < 4; j++ {
+			writeFile(t, fs, fmt.Sprintf("%s/f%d", dir, j), []byte(fmt.Sprintf("%d%d", i, j)))
+		}
+	}
+	key := fs.mustKey(t, "d0/f0")
+	editDir(t, fs, "d3", func(dir *Directory) { dir.setChild("shared", key) })
+	return fs, fake
+}
+
+func TestWalkVisitsOnce(t *testing.T) {
+	fs, fake := walkTree(t)
+	shared := fs.Sess.metaName(fs.mustKey(t, "d0/f0"))
+	for _, concurrency := range []int{1, 8} {
+		// A fresh session loads every node from the bucket
+		sess, _ := newTestSession(t, fake, nil)
+		gets := fake.totalGets(shared)
+		var lock sync.Mutex
+		var paths []string
+		err := sess.Walk(context.Background(), "", sess.RootKey(), WalkOptions{Concurrency: concurrency},
+			func(path string, key ObjectKey, node interface{}) error {
+				lock.Lock()
+				paths = append(paths, path)
+				lock.Unlock()
+				return nil
+			})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(paths) != 21 {
+			t.Fatalf("concurrency %d: visited %d: %v", concurrency, len(paths), paths)
+		}
+		if n := fake.totalGets(shared) - gets; n != 1 {
+			t.Fatalf("concurrency %d: shared file loaded %d times", concurrency, n)
+		}
+		if concurrency == 1 && !reflect.DeepEqual(paths[:7], []string{"", "d0", "d0/f0", "d0/f1", "d0/f2", "d0/f3", "d1"}) {
+			t.Fatalf("not depth-first by name: %v", paths)
+		}
+	}
+}
+
+// TestWalkConcurrency loads nodes of a slow backend. With concurrency they
+// are loaded at once.
+func TestWalkConcurrency(t *testing.T) {
+	_, fake := walkTree(t)
+	fake.getDelay = 20 * time.Millisecond
+	sess, _ := newTestSession(t, fake, nil)
+	start := time.Now()
+	err := sess.Walk(context.Background(), "", sess.RootKey(), WalkOptions{Concurrency: 16},
+		func(string, ObjectKey, interface{}) error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	// One by one, it's 21 loads of 20ms
+	if d := time.Since(start); d > 200*time.Millisecond {
+		t.Fatalf("walk took %v", d)
+	}
+}
+
+func TestWalkStops(t *testing.T) {
+	_, fake := walkTree(t)
+	injected := errors.New("injected")
+	for _, tc := range []struct {
+		name string
+		fn   func(cancel context.CancelFunc, path string) error
+		want error
+	}{
+		{"error", func(_ context.CancelFunc, path string) error {
+			if path == "d1/f2" {
+				return injected
+			}
+			return nil
+		}, injected},
+		{"cancel", func(cancel context.CancelFunc, path string) error {
+			if path == "d1/f2" {
+				cancel()
+			}
+			return nil
+		}, context.Canceled},
+		{"skip", func(_ context.CancelFunc, path string) error {
+			if path == "d1" {
+				return SkipDir
+			}
+			return nil
+		}, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			sess, _ := newTestSession(t, fake, nil)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			visited := 0
+			err := sess.Walk(ctx, "", sess.RootKey(), WalkOptions{Concurrency: 1},
+				func(path string, key ObjectKey, node interface{}) error {
+					visited++
+					return tc.fn(cancel, path)
+				})
+			if err != tc.want {
+				t.Fatalf("walk = %v, want %v", err, tc.want)
+			}
+			if tc.want != nil && visited != 10 {
+				t.Fatalf("visited %d after stop", visited)
+			}
+			if tc.want == nil && visited != 17 {
+				t.Fatalf("visited %d skipping d1", visited)
+			}
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
@@ -13,8 +14,12 @@ import (
 	"path"
 
 	"strconv"
+	"sync"
+	"time"
 
+	"github.com/hanwen/go-fuse/fuse"
 	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
 	bucketsync "github.com/juntaki/bucketsync/lib"
 	"github.com/urfave/cli"
 	yaml "gopkg.in/yaml.v2"
@@ -41,6 +46,33 @@ func main() {
 					Value: "",
 					Usage: "Specifies the mount point path",
 				},
+				cli.BoolFlag{
+					Name:  "allow-other",
+					Usage: "Allow access by other users",
+				},
+				cli.StringFlag{
+					Name:  "file",
+					Value: "",
+					Usage: "Mount only the file of the path, the mount point must be a file",
+				},
+				cli.StringFlag{
+					Name:  "root-version",
+					Value: "",
+					Usage: "Mount the version of the root read-only, listed by versions",
+				},
+				cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "Log uploads instead of executing them",
+				},
+				cli.BoolFlag{
+					Name:  "interactive",
+					Usage: "Fail operations fast instead of retrying a slow backend",
+				},
+				cli.IntFlag{
+					Name:  "max-write",
+					Value: fuse.MAX_KERNEL_WRITE,
+					Usage: "Maximum size of a write request from kernel in bytes",
+				},
 			},
 		},
 		{
@@ -66,6 +98,81 @@ func main() {
 				return nil
 			},
 		},
+		{
+			Name:   "restore",
+			Usage:  "Restore archived extents of a file",
+			Action: restore,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "path",
+					Value: "",
+					Usage: "File path relative to the mount point",
+				},
+				cli.StringFlag{
+					Name:  "tier",
+					Value: "Standard",
+					Usage: "Restore tier, Expedited, Standard or Bulk",
+				},
+			},
+		},
+		{
+			Name:   "versions",
+			Usage:  "List versions of the root in versioned bucket",
+			Action: versions,
+		},
+		{
+			Name:   "selftest",
+			Usage:  "Check filesystem operations in a temporary directory",
+			Action: selftest,
+		},
+		{
+			Name:   "repair",
+			Usage:  "Verify data objects and repair or quarantine damaged ones",
+			Action: repair,
+		},
+		{
+			Name:   "fsck",
+			Usage:  "Check consistency of the tree",
+			Action: fsck,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "repair",
+					Usage: "Prune dangling entries, quarantine missing extents and drop extents beyond size",
+				},
+			},
+		},
+		{
+			Name:   "export",
+			Usage:  "Copy the tree to a local directory, resumable by running again",
+			Action: export,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "dest",
+					Value: "",
+					Usage: "Destination directory",
+				},
+				cli.IntFlag{
+					Name:  "concurrency",
+					Value: 0,
+					Usage: "Number of nodes exported at once, walk_concurrency if 0",
+				},
+				cli.BoolFlag{
+					Name:  "verify",
+					Usage: "Compare checksums of exported files with stored ones",
+				},
+			},
+		},
+		{
+			Name:   "train-dict",
+			Usage:  "Train compression dictionary from sample files",
+			Action: trainDict,
+			Flags: []cli.Flag{
+				cli.StringSliceFlag{
+					Name:  "path",
+					Usage: "Sample file path relative to the mount point, can be repeated",
+				},
+			},
+		},
 		{
 			Name:   "config",
 			Usage:  "Unmount bucketsync filesystem",
@@ -188,10 +295,12 @@ func config(cli *cli.Context) error {
 	if config.CacheSize == 0 {
 		config.CacheSize = 1024
 	}
+	if config.CacheShards == 0 {
+		config.CacheShards = 16
+	}
 	if config.ExtentSize == 0 {
 		config.ExtentSize = 1024 * 64
 	}
-
 	// TODO: check logging mode
 	configYAML, err := yaml.Marshal(config)
 	if err != nil {
@@ -214,6 +323,20 @@ func mount(cli *cli.Context) error {
 		os.Exit(1)
 	}
 
+	if cli.String("root-version") != "" {
+		config.RootVersion = cli.String("root-version")
+	}
+	if cli.Bool("dry-run") {
+		config.DryRun = true
+	}
+	if cli.Bool("interactive") {
+		config.Profile = bucketsync.ProfileInteractive
+	}
+	// A profile presets its own budget
+	if config.OperationBudget == 0 && config.Profile == "" {
+		config.OperationBudget = 30 * time.Second
+	}
+
 	// Exec daemon
 	if !cli.Bool("daemon") {
 		args := append(os.Args[1:len(os.Args)], "--daemon")
@@ -226,10 +349,23 @@ func mount(cli *cli.Context) error {
 		os.Exit(0)
 	}
 
-	fs := bucketsync.NewFileSystem(config)
+	var fs *pathfs.PathNodeFs
+	if cli.String("file") != "" {
+		fs, err = bucketsync.NewSingleFileSystem(config, cli.String("file"))
+	} else {
+		fs, err = bucketsync.NewFileSystem(config)
+	}
+	if err != nil {
+		return err
+	}
 	fs.SetDebug(true)
 
-	s, _, err := nodefs.MountRoot(cli.String("dir"), fs.Root(), nil)
+	conn := nodefs.NewFileSystemConnector(fs.Root(), bucketsync.NodeOptions(config))
+	mountOpts := &fuse.MountOptions{
+		AllowOther: cli.Bool("allow-other"),
+		MaxWrite:   cli.Int("max-write"),
+	}
+	s, err := fuse.NewServer(bucketsync.WithRenameFlags(conn.RawFS()), cli.String("dir"), mountOpts)
 	if err != nil {
 		panic(err)
 	}
@@ -251,3 +387,179 @@ func mount(cli *cli.Context) error {
 	s.Serve()
 	return nil
 }
+
+func restore(cli *cli.Context) error {
+	config, err := readConfig()
+	if err != nil {
+		return err
+	}
+	sess, err := bucketsync.NewSession(config)
+	if err != nil {
+		return err
+	}
+	pending, err := sess.RestoreFile(context.Background(), cli.String("path"), cli.String("tier"))
+	if err != nil {
+		return err
+	}
+	if pending != 0 {
+		fmt.Printf("Restore in progress: %d extents\n", pending)
+		return nil
+	}
+	fmt.Println("Restored")
+	return nil
+}
+
+func trainDict(cli *cli.Context) error {
+	config, err := readConfig()
+	if err != nil {
+		return err
+	}
+	sess, err := bucketsync.NewSession(config)
+	if err != nil {
+		return err
+	}
+	dict, err := sess.TrainDictionary(context.Background(), cli.StringSlice("path"))
+	if err != nil {
+		return err
+	}
+	fmt.Println("Trained dictionary:", dict)
+	return nil
+}
+
+func versions(cli *cli.Context) error {
+	config, err := readConfig()
+	if err != nil {
+		return err
+	}
+	sess, err := bucketsync.NewSession(config)
+	if err != nil {
+		return err
+	}
+	versions, err := sess.RootVersions(context.Background())
+	if err != nil {
+		return err
+	}
+	for _, v := range versions {
+		note := ""
+		if v.Latest {
+			note = " (latest)"
+		}
+		if v.DeleteMarker {
+			note += " (deleted)"
+		}
+		fmt.Printf("%s %s%s\n", v.LastModified.Format(time.RFC3339), v.ID, note)
+	}
+	return nil
+}
+
+func repair(cli *cli.Context) error {
+	config, err := readConfig()
+	if err != nil {
+		return err
+	}
+	sess, err := bucketsync.NewSession(config)
+	if err != nil {
+		return err
+	}
+	report, err := sess.Repair(context.Background())
+	if err != nil {
+		return err
+	}
+	fmt.Printf("checked %d, damaged %d, repaired %d, quarantined %d extents\n",
+		report.Checked, report.Damaged, report.Repaired, report.Quarantined)
+	return nil
+}
+
+func fsck(cli *cli.Context) error {
+	config, err := readConfig()
+	if err != nil {
+		return err
+	}
+	sess, err := bucketsync.NewSession(config)
+	if err != nil {
+		return err
+	}
+	report, err := sess.Fsck(context.Background(), cli.Bool("repair"))
+	if err != nil {
+		return err
+	}
+	remaining := 0
+	for _, issue := range report.Issues {
+		note := ""
+		if issue.Repaired {
+			note = " (repaired)"
+		} else {
+			remaining++
+		}
+		fmt.Printf("%s\t%s\t%s\t%s%s\n", issue.Kind, issue.Path, issue.Key, issue.Detail, note)
+	}
+	fmt.Printf("checked %d nodes, %d objects, %d issues\n", report.Nodes, report.Objects, len(report.Issues))
+	if remaining != 0 {
+		return fmt.Errorf("%d issues remain", remaining)
+	}
+	return nil
+}
+
+func export(cli *cli.Context) error {
+	config, err := readConfig()
+	if err != nil {
+		return err
+	}
+	if cli.String("dest") == "" {
+		return fmt.Errorf("specify destination directory")
+	}
+	sess, err := bucketsync.NewSession(config)
+	if err != nil {
+		return err
+	}
+	var lock sync.Mutex
+	var lastReport time.Time
+	opts := bucketsync.ExportOptions{
+		Concurrency: cli.Int("concurrency"),
+		Verify:      cli.Bool("verify"),
+		Progress: func(p bucketsync.ExportProgress) {
+			lock.Lock()
+			defer lock.Unlock()
+			if time.Since(lastReport) >= time.Second {
+				lastReport = time.Now()
+				fmt.Printf("%d files, %d bytes, %d extents, %d skipped\n", p.Files, p.Bytes, p.Extents, p.Skipped)
+			}
+		},
+	}
+	report, err := sess.Export(context.Background(), cli.String("dest"), opts)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("exported %d files, %d bytes, %d extents, %d skipped\n",
+		report.Files, report.Bytes, report.Extents, report.Skipped)
+	if opts.Verify {
+		for _, path := range report.Mismatched {
+			fmt.Printf("mismatch\t%s\n", path)
+		}
+		fmt.Printf("verified %d files\n", report.Verified)
+		if len(report.Mismatched) != 0 {
+			return fmt.Errorf("%d files mismatch, run again to export them", len(report.Mismatched))
+		}
+	}
+	return nil
+}
+
+func selftest(cli *cli.Context) error {
+	config, err := readConfig()
+	if err != nil {
+		return err
+	}
+	sess, err := bucketsync.NewSession(config)
+	if err != nil {
+		return err
+	}
+	steps, err := sess.SelfTest(context.Background())
+	for _, step := range steps {
+		result := "ok"
+		if step.Error != "" {
+			result = "FAIL: " + step.Error
+		}
+		fmt.Printf("%-8s %10s  %s\n", step.Name, step.Duration.Round(time.Millisecond), result)
+	}
+	return err
+}